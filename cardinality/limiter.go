@@ -0,0 +1,414 @@
+// Package cardinality keeps labelled metrics from exploding.
+//
+// Every new combination of label values is a new series for Prometheus to store forever (well, for the retention).
+// Labels like endpoint or handler only have a handful of values, but a label like playerID has as many values
+// as there are players, and a single bad client can make up as many as it wants.
+//
+// The Limiter wraps prometheus.HistogramVec and prometheus.CounterVec: once a metric has reached its limit,
+// the label values never seen before in a new combination are replaced by "__overflow__", the others are kept.
+// A new playerID on /rolldice is still counted on /rolldice, just not by its own series.
+// The folded series count in the limit too: a quarter of it is kept for them, plus one for the series where
+// every label is folded, so a metric never exports more series than its limit.
+package cardinality
+
+import (
+	"container/heap"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OverflowValue replaces the new label values of a combination that didn't fit in the limit.
+const OverflowValue = "__overflow__"
+
+// maxTrackedOffenders bounds the memory used to remember who's causing the overflow.
+// Otherwise the offender list itself would have the cardinality problem we're trying to avoid.
+const maxTrackedOffenders = 1000
+
+// Limiter keeps track of the series of every metric it created.
+//
+// It's a prometheus.Collector itself, exporting how many series each metric has and how many observations were folded.
+type Limiter struct {
+	mtx    sync.Mutex
+	guards []*guard
+
+	seriesDesc   *prometheus.Desc
+	limitDesc    *prometheus.Desc
+	rejectedDesc *prometheus.Desc
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{
+		seriesDesc: prometheus.NewDesc(
+			"cardinality_limiter_series",
+			"Number of series created by the metric, the overflow series included.",
+			[]string{"metric"}, nil,
+		),
+		limitDesc: prometheus.NewDesc(
+			"cardinality_limiter_series_limit",
+			"Max number of series allowed for the metric.",
+			[]string{"metric"}, nil,
+		),
+		rejectedDesc: prometheus.NewDesc(
+			"cardinality_limiter_rejected_observations_total",
+			"Number of observations folded into the overflow series because the metric reached its series limit.",
+			[]string{"metric"}, nil,
+		),
+	}
+}
+
+// HistogramVec is a prometheus.HistogramVec with a series limit.
+type HistogramVec struct {
+	vec   *prometheus.HistogramVec
+	guard *guard
+}
+
+// NewHistogramVec creates the HistogramVec, with at most limit series (at least 1).
+// The returned vec still has to be registered, like any prometheus.HistogramVec.
+func (l *Limiter) NewHistogramVec(opts prometheus.HistogramOpts, labelNames []string, limit int) *HistogramVec {
+	return &HistogramVec{
+		vec:   prometheus.NewHistogramVec(opts, labelNames),
+		guard: l.newGuard(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), labelNames, limit),
+	}
+}
+
+// WithLabelValues is prometheus.HistogramVec.WithLabelValues, except it never creates more series than the limit.
+func (v *HistogramVec) WithLabelValues(lvs ...string) prometheus.Observer {
+	return v.vec.WithLabelValues(v.guard.admit(lvs)...)
+}
+
+// With is prometheus.HistogramVec.With, except it never creates more series than the limit.
+func (v *HistogramVec) With(labels prometheus.Labels) prometheus.Observer {
+	return v.vec.WithLabelValues(v.guard.admit(v.guard.values(labels))...)
+}
+
+func (v *HistogramVec) Describe(ch chan<- *prometheus.Desc) { v.vec.Describe(ch) }
+func (v *HistogramVec) Collect(ch chan<- prometheus.Metric) { v.vec.Collect(ch) }
+
+// Unwrap returns the wrapped prometheus.HistogramVec, for tools that need to know the metric type.
+func (v *HistogramVec) Unwrap() prometheus.Collector { return v.vec }
+
+// CounterVec is a prometheus.CounterVec with a series limit.
+type CounterVec struct {
+	vec   *prometheus.CounterVec
+	guard *guard
+}
+
+// NewCounterVec creates the CounterVec, with at most limit series (at least 1).
+// The returned vec still has to be registered, like any prometheus.CounterVec.
+func (l *Limiter) NewCounterVec(opts prometheus.CounterOpts, labelNames []string, limit int) *CounterVec {
+	return &CounterVec{
+		vec:   prometheus.NewCounterVec(opts, labelNames),
+		guard: l.newGuard(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), labelNames, limit),
+	}
+}
+
+// WithLabelValues is prometheus.CounterVec.WithLabelValues, except it never creates more series than the limit.
+func (v *CounterVec) WithLabelValues(lvs ...string) prometheus.Counter {
+	return v.vec.WithLabelValues(v.guard.admit(lvs)...)
+}
+
+// With is prometheus.CounterVec.With, except it never creates more series than the limit.
+func (v *CounterVec) With(labels prometheus.Labels) prometheus.Counter {
+	return v.vec.WithLabelValues(v.guard.admit(v.guard.values(labels))...)
+}
+
+func (v *CounterVec) Describe(ch chan<- *prometheus.Desc) { v.vec.Describe(ch) }
+func (v *CounterVec) Collect(ch chan<- prometheus.Metric) { v.vec.Collect(ch) }
+
+// Unwrap returns the wrapped prometheus.CounterVec, for tools that need to know the metric type.
+func (v *CounterVec) Unwrap() prometheus.Collector { return v.vec }
+
+// guard is the limit of one metric.
+type guard struct {
+	metric     string
+	labelNames []string
+	limit      int
+	// foldLimit is the part of limit kept for the folded series, the overflow series excluded.
+	foldLimit int
+	overflow  []string
+
+	mtx    sync.Mutex
+	series map[string]struct{}
+	// known are the values of each label in series, by label index: the ones kept in a folded combination.
+	known []map[string]struct{}
+	// folded are the series with some of their labels folded, at most foldLimit.
+	folded map[string]struct{}
+	// overflowed is set once the series where every label is folded exists, the last one of the limit.
+	overflowed bool
+	rejected   uint64
+	offenders  offenders
+}
+
+func (l *Limiter) newGuard(metric string, labelNames []string, limit int) *guard {
+	// The overflow series needs a place.
+	limit = max(limit, 1)
+	g := &guard{
+		metric:     metric,
+		labelNames: labelNames,
+		limit:      limit,
+		foldLimit:  limit / 4,
+		overflow:   make([]string, len(labelNames)),
+		series:     make(map[string]struct{}),
+		known:      make([]map[string]struct{}, len(labelNames)),
+		folded:     make(map[string]struct{}),
+		offenders:  offenders{index: make(map[Offender]*offenderCount)},
+	}
+	for i := range g.overflow {
+		g.overflow[i] = OverflowValue
+		g.known[i] = make(map[string]struct{})
+	}
+
+	l.mtx.Lock()
+	l.guards = append(l.guards, g)
+	l.mtx.Unlock()
+
+	return g
+}
+
+// values orders the labels the same way as labelNames.
+// A missing label becomes "", the wrapped vec will complain about it like it always does.
+func (g *guard) values(labels prometheus.Labels) []string {
+	lvs := make([]string, len(g.labelNames))
+	for i, name := range g.labelNames {
+		lvs[i] = labels[name]
+	}
+
+	return lvs
+}
+
+// admit returns the label values to use: lvs itself if the series exists or still fits in the limit,
+// lvs with its new values folded otherwise, or every label folded when even that doesn't fit.
+func (g *guard) admit(lvs []string) []string {
+	if len(lvs) != len(g.labelNames) {
+		// Wrong number of labels, let the wrapped vec panic with its usual message.
+		return lvs
+	}
+
+	key := strings.Join(lvs, "\xff")
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if _, ok := g.series[key]; ok {
+		return lvs
+	}
+	if _, ok := g.folded[key]; ok {
+		return lvs
+	}
+	if slices.Equal(lvs, g.overflow) {
+		g.overflowed = true
+		return lvs
+	}
+	if len(g.series) < g.limit-g.foldLimit-1 {
+		g.series[key] = struct{}{}
+		for i, v := range lvs {
+			g.known[i][v] = struct{}{}
+		}
+		return lvs
+	}
+
+	if g.rejected == 0 {
+		log.Printf("cardinality: %s reached its limit of %d series, new label values are folded into %q\n", g.metric, g.limit, OverflowValue)
+	}
+	g.rejected++
+
+	// Only the new values are to blame. A new combination of known values has none, it's folded entirely.
+	folded := make([]string, len(lvs))
+	newValues := false
+	for i, v := range lvs {
+		if _, ok := g.known[i][v]; ok {
+			folded[i] = v
+			continue
+		}
+		folded[i] = OverflowValue
+		newValues = true
+		g.offenders.add(Offender{Label: g.labelNames[i], Value: v})
+	}
+	if !newValues || slices.Equal(folded, g.overflow) {
+		g.overflowed = true
+		return g.overflow
+	}
+
+	key = strings.Join(folded, "\xff")
+	if _, ok := g.folded[key]; !ok {
+		if len(g.folded) >= g.foldLimit {
+			g.overflowed = true
+			return g.overflow
+		}
+		g.folded[key] = struct{}{}
+	}
+
+	return folded
+}
+
+// count is the number of series of the metric, the overflow series included. g.mtx must be held.
+func (g *guard) count() int {
+	n := len(g.series) + len(g.folded)
+	if g.overflowed {
+		n++
+	}
+
+	return n
+}
+
+// offenders counts the label values folded with the space-saving algorithm: when the list is full,
+// the least seen value makes room and the newcomer inherits its count, so a value seen over and over
+// still makes it to the top (it's an estimation, not an exact count). The least seen value is the root
+// of a heap, so a flood of new values doesn't scan the list under the lock.
+type offenders struct {
+	index map[Offender]*offenderCount
+	heap  offenderHeap
+}
+
+type offenderCount struct {
+	Offender
+	count uint64
+	// i is the position in the heap.
+	i int
+}
+
+func (o *offenders) add(offender Offender) {
+	if c, ok := o.index[offender]; ok {
+		c.count++
+		heap.Fix(&o.heap, c.i)
+		return
+	}
+	if len(o.heap) < maxTrackedOffenders {
+		c := &offenderCount{Offender: offender, count: 1}
+		o.index[offender] = c
+		heap.Push(&o.heap, c)
+		return
+	}
+
+	least := o.heap[0]
+	delete(o.index, least.Offender)
+	least.Offender = offender
+	least.count++
+	o.index[offender] = least
+	heap.Fix(&o.heap, 0)
+}
+
+// offenderHeap implements heap.Interface, the least seen value first.
+type offenderHeap []*offenderCount
+
+func (h offenderHeap) Len() int           { return len(h) }
+func (h offenderHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h offenderHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].i, h[j].i = i, j
+}
+func (h *offenderHeap) Push(x any) {
+	c := x.(*offenderCount)
+	c.i = len(*h)
+	*h = append(*h, c)
+}
+func (h *offenderHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// Offender is a label value seen in folded observations.
+type Offender struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// OffenderCount is an Offender with the number of observations it caused to be folded.
+type OffenderCount struct {
+	Offender
+	Rejected uint64 `json:"rejected"`
+}
+
+// MetricReport is the state of one metric.
+type MetricReport struct {
+	Metric       string          `json:"metric"`
+	Limit        int             `json:"limit"`
+	Series       int             `json:"series"`
+	Rejected     uint64          `json:"rejected"`
+	TopOffenders []OffenderCount `json:"topOffenders"`
+}
+
+// Report returns the state of every metric, with its top label values causing the overflow.
+func (l *Limiter) Report(top int) []MetricReport {
+	l.mtx.Lock()
+	guards := append([]*guard(nil), l.guards...)
+	l.mtx.Unlock()
+
+	reports := make([]MetricReport, 0, len(guards))
+	for _, g := range guards {
+		g.mtx.Lock()
+		report := MetricReport{
+			Metric:       g.metric,
+			Limit:        g.limit,
+			Series:       g.count(),
+			Rejected:     g.rejected,
+			TopOffenders: make([]OffenderCount, 0, len(g.offenders.heap)),
+		}
+		for _, c := range g.offenders.heap {
+			report.TopOffenders = append(report.TopOffenders, OffenderCount{Offender: c.Offender, Rejected: c.count})
+		}
+		g.mtx.Unlock()
+
+		sort.Slice(report.TopOffenders, func(i, j int) bool {
+			a, b := report.TopOffenders[i], report.TopOffenders[j]
+			if a.Rejected != b.Rejected {
+				return a.Rejected > b.Rejected
+			}
+			if a.Label != b.Label {
+				return a.Label < b.Label
+			}
+			return a.Value < b.Value
+		})
+		if len(report.TopOffenders) > top {
+			report.TopOffenders = report.TopOffenders[:top]
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports
+}
+
+// Handler serves the Report as JSON, ?top=N sets the number of offenders per metric (10 by default).
+func (l *Limiter) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		top := 10
+		if s := r.URL.Query().Get("top"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				http.Error(w, "top must be a positive number", http.StatusBadRequest)
+				return
+			}
+			top = n
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(l.Report(top)); err != nil {
+			log.Printf("cardinality: failed to write report: %v\n", err)
+		}
+	})
+}
+
+func (l *Limiter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- l.seriesDesc
+	ch <- l.limitDesc
+	ch <- l.rejectedDesc
+}
+
+func (l *Limiter) Collect(ch chan<- prometheus.Metric) {
+	for _, report := range l.Report(0) {
+		ch <- prometheus.MustNewConstMetric(l.seriesDesc, prometheus.GaugeValue, float64(report.Series), report.Metric)
+		ch <- prometheus.MustNewConstMetric(l.limitDesc, prometheus.GaugeValue, float64(report.Limit), report.Metric)
+		ch <- prometheus.MustNewConstMetric(l.rejectedDesc, prometheus.CounterValue, float64(report.Rejected), report.Metric)
+	}
+}
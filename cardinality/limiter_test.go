@@ -0,0 +1,197 @@
+package cardinality
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter()
+	rolls := limiter.NewCounterVec(
+		prometheus.CounterOpts{Name: "dice_rolls_total", Help: "Number of rolls"},
+		[]string{"endpoint", "playerID"},
+		5,
+	)
+
+	for _, player := range []string{"alice", "bob", "carol", "mallory-1", "mallory-2", "mallory-1"} {
+		rolls.WithLabelValues("/rolldice", player).Inc()
+	}
+	// An existing series keeps working after the limit is reached.
+	rolls.With(prometheus.Labels{"endpoint": "/rolldice", "playerID": "alice"}).Inc()
+
+	if got := testutil.CollectAndCount(rolls); got != 4 {
+		t.Fatalf("got %d series, want 3 + the overflow series of /rolldice", got)
+	}
+	// The endpoint is known, only the playerID is folded.
+	if got := testutil.ToFloat64(rolls.WithLabelValues("/rolldice", OverflowValue)); got != 3 {
+		t.Fatalf("overflow series is %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(rolls.WithLabelValues("/rolldice", "alice")); got != 2 {
+		t.Fatalf("alice is %v, want 2", got)
+	}
+
+	reports := limiter.Report(2)
+	if len(reports) != 1 {
+		t.Fatalf("got %d reports, want 1", len(reports))
+	}
+	report := reports[0]
+	if report.Series != 4 || report.Rejected != 3 {
+		t.Fatalf("got %+v, want 4 series and 3 rejected", report)
+	}
+	want := []OffenderCount{
+		{Offender: Offender{Label: "playerID", Value: "mallory-1"}, Rejected: 2},
+		{Offender: Offender{Label: "playerID", Value: "mallory-2"}, Rejected: 1},
+	}
+	if len(report.TopOffenders) != len(want) {
+		t.Fatalf("got offenders %+v, want %+v", report.TopOffenders, want)
+	}
+	for i := range want {
+		if report.TopOffenders[i] != want[i] {
+			t.Fatalf("got offenders %+v, want %+v", report.TopOffenders, want)
+		}
+	}
+}
+
+// TestLimiterFold checks only the new label values are folded, the bounded labels keep their breakdown.
+func TestLimiterFold(t *testing.T) {
+	limiter := NewLimiter()
+	// 3 series, 1 folded series and the overflow series.
+	rolls := limiter.NewCounterVec(
+		prometheus.CounterOpts{Name: "dice_rolls_total", Help: "Number of rolls"},
+		[]string{"endpoint", "playerID"},
+		5,
+	)
+
+	rolls.WithLabelValues("/rolldice", "alice").Inc()
+	rolls.WithLabelValues("/reroll", "bob").Inc()
+	rolls.WithLabelValues("/rolldice", "carol").Inc()
+	// Past the limit: a new player on a known endpoint.
+	rolls.WithLabelValues("/rolldice", "mallory").Inc()
+	// No folded series left: a new player on another endpoint, a new endpoint, a new combination of known values.
+	rolls.WithLabelValues("/reroll", "mallory").Inc()
+	rolls.WithLabelValues("/admin", "alice").Inc()
+	rolls.WithLabelValues("/reroll", "alice").Inc()
+	// The folded series of /rolldice is there already.
+	rolls.WithLabelValues("/rolldice", "eve").Inc()
+
+	for _, tt := range []struct {
+		lvs  []string
+		want float64
+	}{
+		{lvs: []string{"/rolldice", OverflowValue}, want: 2},
+		{lvs: []string{OverflowValue, OverflowValue}, want: 3},
+	} {
+		if got := testutil.ToFloat64(rolls.WithLabelValues(tt.lvs...)); got != tt.want {
+			t.Errorf("%v is %v, want %v", tt.lvs, got, tt.want)
+		}
+	}
+	if got := testutil.CollectAndCount(rolls); got != 5 {
+		t.Errorf("got %d series, want 3 + 2 folded", got)
+	}
+}
+
+// TestLimiterMaxSeries floods metrics with new label values and checks they never export more series than their limit.
+func TestLimiterMaxSeries(t *testing.T) {
+	for limit := range 20 {
+		limiter := NewLimiter()
+		rolls := limiter.NewCounterVec(
+			prometheus.CounterOpts{Name: "dice_rolls_total", Help: "Number of rolls"},
+			[]string{"endpoint", "playerID"},
+			limit,
+		)
+
+		for i := range 100 {
+			// Some new endpoints, lots of new players, and the combinations of the known ones.
+			rolls.WithLabelValues("/endpoint-"+strconv.Itoa(i%7), "player-"+strconv.Itoa(i%40)).Inc()
+		}
+
+		got := testutil.CollectAndCount(rolls)
+		if got > max(limit, 1) {
+			t.Errorf("limit %d: got %d series", limit, got)
+		}
+		if report := limiter.Report(0)[0]; report.Series != got {
+			t.Errorf("limit %d: the report has %d series, %d exported", limit, report.Series, got)
+		}
+	}
+}
+
+// TestOffenders checks a value seen over and over makes it to the top when the list is full.
+func TestOffenders(t *testing.T) {
+	o := offenders{index: make(map[Offender]*offenderCount)}
+	for i := range maxTrackedOffenders * 3 {
+		o.add(Offender{Label: "playerID", Value: strconv.Itoa(i)})
+		if i%10 == 0 {
+			o.add(Offender{Label: "playerID", Value: "mallory"})
+		}
+	}
+
+	if len(o.heap) != maxTrackedOffenders || len(o.index) != maxTrackedOffenders {
+		t.Fatalf("tracking %d/%d offenders, want %d", len(o.heap), len(o.index), maxTrackedOffenders)
+	}
+	top := o.heap[0]
+	for _, c := range o.heap {
+		if c.count > top.count {
+			top = c
+		}
+		if o.index[c.Offender] != c {
+			t.Fatalf("%+v isn't indexed", c.Offender)
+		}
+	}
+	if top.Value != "mallory" || top.count < maxTrackedOffenders*3/10 {
+		t.Errorf("top offender is %+v, want mallory seen at least %d times", top, maxTrackedOffenders*3/10)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	limiter := NewLimiter()
+	rolls := limiter.NewCounterVec(
+		prometheus.CounterOpts{Name: "dice_rolls_total", Help: "Number of rolls"},
+		[]string{"endpoint", "playerID"},
+		2,
+	)
+	for _, player := range []string{"alice", "mallory", "mallory", "eve"} {
+		rolls.WithLabelValues("/rolldice", player).Inc()
+	}
+
+	srv := httptest.NewServer(limiter.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/admin/cardinality?top=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("got %s, %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	var reports []MetricReport
+	if err := json.NewDecoder(resp.Body).Decode(&reports); err != nil {
+		t.Fatal(err)
+	}
+	want := MetricReport{
+		Metric:       "dice_rolls_total",
+		Limit:        2,
+		Series:       2,
+		Rejected:     3,
+		TopOffenders: []OffenderCount{{Offender: Offender{Label: "playerID", Value: "mallory"}, Rejected: 2}},
+	}
+	if len(reports) != 1 || !reflect.DeepEqual(reports[0], want) {
+		t.Errorf("got %+v, want %+v", reports, want)
+	}
+
+	resp, err = http.Get(srv.URL + "/admin/cardinality?top=-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("top=-1: got %s, want 400", resp.Status)
+	}
+}
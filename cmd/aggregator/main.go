@@ -0,0 +1,266 @@
+// aggregator collects the metrics of every step service in one place.
+//
+// Every Prometheus (or OTEL collector with the prometheusremotewrite exporter) can point its
+// remote_write at this binary:
+//
+//	remote_write:
+//	  - url: "http://localhost:9201/api/v1/write"
+//
+// Then the stored data can be looked up with:
+//
+//	curl 'localhost:9201/api/v1/series?match=ping_process_bucket{endpoint="/ping"}&start=1739000000&end=1739003600'
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"learn-prometheus/metricstore"
+	"learn-prometheus/remotewrite"
+	"learn-prometheus/webconfig"
+)
+
+func main() {
+	var (
+		listenAddr = flag.String("listen", ":9201", "address to serve remote_write and the query API on")
+		storageDir = flag.String("storage.path", "data/", "directory for the WAL and the blocks")
+		retention  = flag.Duration("retention.time", 15*24*time.Hour, "how long to keep the raw data, 0 keeps it forever")
+		retention5 = flag.Duration("retention.5m", 90*24*time.Hour, "how long to keep the 5m downsampled data, 0 keeps it forever")
+		retention1 = flag.Duration("retention.1h", 365*24*time.Hour, "how long to keep the 1h downsampled data, 0 keeps it forever")
+		maxSize    = flag.Int64("retention.size", 0, "max bytes for the blocks and the WAL, oldest blocks are deleted first, 0 means no limit")
+		blockSize  = flag.Duration("block.duration", 2*time.Hour, "time range of a block compacted from the head")
+		webConfig  = flag.String("web.config.file", "", "web.yml with the TLS and auth config of remote_write and the query API, see web.example.yml, reloaded on SIGHUP")
+	)
+	flag.Parse()
+
+	// Anyone reaching remote_write can write anything in the store, only the Prometheus servers should.
+	web, err := webconfig.New(*webConfig)
+	if err != nil {
+		panic(err)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := web.Reload(); err != nil {
+				log.Printf("failed to reload the web config: %v\n", err)
+			}
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	store, err := metricstore.Open(*storageDir, metricstore.Options{
+		BlockDuration:     *blockSize,
+		RetentionDuration: *retention,
+		Retention5m:       *retention5,
+		Retention1h:       *retention1,
+		RetentionSize:     *maxSize,
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			log.Printf("failed to close the store: %v\n", err)
+		}
+	}()
+
+	go store.Run(ctx)
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/write", remotewrite.NewHandler(store))
+	mux.HandleFunc("/api/v1/series", seriesHandler(store))
+	mux.HandleFunc("/api/v1/query_range", queryRangeHandler(store))
+	mux.HandleFunc("/api/v1/histogram_quantile", histogramQuantileHandler(store))
+	mux.HandleFunc("/api/v1/status", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, store.Stats())
+	})
+
+	srv := &http.Server{
+		Addr:        *listenAddr,
+		BaseContext: func(_ net.Listener) context.Context { return ctx },
+		Handler:     mux,
+	}
+
+	srvErr := make(chan error, 1)
+	go func() {
+		log.Printf("aggregator listening on %s\n", *listenAddr)
+		srvErr <- web.ListenAndServe(srv)
+	}()
+
+	select {
+	case err := <-srvErr:
+		// Error when the server starts.
+		log.Printf("failed to serve: %v\n", err)
+	case <-ctx.Done():
+		stop()
+		fmt.Println("Gracefully shutdown...")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("failed to shutdown: %v\n", err)
+		}
+	}
+}
+
+// seriesHandler returns the raw samples of the series matching the "match" selector.
+// "start" and "end" are unix timestamps in seconds, default to the last hour.
+func seriesHandler(store *metricstore.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		matchers, err := metricstore.ParseSelector(r.URL.Query().Get("match"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		now := time.Now()
+		start, err := parseTime(r.URL.Query().Get("start"), now.Add(-time.Hour))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "start: " + err.Error()})
+			return
+		}
+		end, err := parseTime(r.URL.Query().Get("end"), now)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "end: " + err.Error()})
+			return
+		}
+
+		series, err := store.Select(start.UnixMilli(), end.UnixMilli(), matchers...)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, series)
+	}
+}
+
+// queryRangeHandler evaluates func(match[step]) from start to end,
+// e.g. func=rate&match=ping_request_count&step=5m is rate(ping_request_count[5m]).
+// The resolution (raw, 5m or 1h) is picked from the step.
+func queryRangeHandler(store *metricstore.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fn, err := metricstore.ParseFunction(r.URL.Query().Get("func"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		q, err := parseRangeQuery(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		result, err := store.QueryRange(fn, q.start.UnixMilli(), q.end.UnixMilli(), q.step, q.matchers...)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// histogramQuantileHandler is histogram_quantile(q, increase(match[step])) from start to end,
+// e.g. q=0.99&match=ping_process_bucket{endpoint="/ping"}&step=1h for a week long p99 graph.
+func histogramQuantileHandler(store *metricstore.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		phi, err := strconv.ParseFloat(r.URL.Query().Get("q"), 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "q: invalid quantile"})
+			return
+		}
+
+		q, err := parseRangeQuery(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		result, err := store.HistogramQuantile(phi, q.start.UnixMilli(), q.end.UnixMilli(), q.step, q.matchers...)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+type rangeQuery struct {
+	matchers   []*metricstore.Matcher
+	start, end time.Time
+	step       time.Duration
+}
+
+// parseRangeQuery reads match, start, end and step (a duration like 5m, or seconds), step defaults to 1m.
+func parseRangeQuery(r *http.Request) (rangeQuery, error) {
+	var (
+		q   rangeQuery
+		err error
+	)
+
+	if q.matchers, err = metricstore.ParseSelector(r.URL.Query().Get("match")); err != nil {
+		return q, err
+	}
+
+	now := time.Now()
+	if q.start, err = parseTime(r.URL.Query().Get("start"), now.Add(-time.Hour)); err != nil {
+		return q, fmt.Errorf("start: %w", err)
+	}
+	if q.end, err = parseTime(r.URL.Query().Get("end"), now); err != nil {
+		return q, fmt.Errorf("end: %w", err)
+	}
+
+	q.step = time.Minute
+	if s := r.URL.Query().Get("step"); s != "" {
+		if q.step, err = time.ParseDuration(s); err != nil {
+			seconds, convErr := strconv.ParseFloat(s, 64)
+			if convErr != nil {
+				return q, fmt.Errorf("step: invalid duration %q", s)
+			}
+			q.step = time.Duration(seconds * float64(time.Second))
+		}
+	}
+
+	return q, nil
+}
+
+// parseTime parses a unix timestamp in seconds, fractions allowed, like the Prometheus HTTP API.
+func parseTime(s string, fallback time.Time) (time.Time, error) {
+	if s == "" {
+		return fallback, nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid unix timestamp %q", s)
+	}
+	sec, frac := math.Modf(f)
+
+	return time.Unix(int64(sec), int64(frac*float64(time.Second))), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write response: %v\n", err)
+	}
+}
@@ -0,0 +1,239 @@
+// heatmap draws the latency of a histogram over time, like the Grafana heatmap panel, for an incident report:
+// as an SVG, or right in the terminal.
+//
+//	./cmd/heatmap/run.sh -store.path data/ -since 3h -step 5m -match endpoint=/ping
+//	./cmd/heatmap/run.sh -scrapes 30 -every 10s http://localhost:8090/metrics
+//	./cmd/heatmap/run.sh -svg incident.svg snapshots/*.txt
+//
+// The buckets come from the store of cmd/aggregator, or from a sequence of scrapes: files saved with curl,
+// or a URL scraped every -every.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"learn-prometheus/heatmap"
+	"learn-prometheus/metricstore"
+	"learn-prometheus/scrape"
+)
+
+func main() {
+	var (
+		metric    = flag.String("metric", "ping_process", "name of the histogram")
+		match     = flag.String("match", "", "only the series with these labels, e.g. endpoint=/ping,handler=normalPing. The others are summed")
+		storePath = flag.String("store.path", "", "read the buckets from the store of cmd/aggregator in this directory, instead of the scrapes given as arguments")
+		since     = flag.Duration("since", time.Hour, "with -store.path, how far back to go when -from isn't set")
+		step      = flag.Duration("step", time.Minute, "with -store.path, the interval of every frame, like the [1m] of increase()")
+		scrapes   = flag.Int("scrapes", 1, "scrape the URLs this many times, -every apart")
+		every     = flag.Duration("every", 10*time.Second, "time between two scrapes of the URLs")
+		timeout   = flag.Duration("timeout", 10*time.Second, "timeout of a scrape")
+
+		from      = flag.String("from", "", "start of the time axis, RFC3339. Defaults to the first snapshot")
+		to        = flag.String("to", "", "end of the time axis, RFC3339. Defaults to the last snapshot")
+		columns   = flag.Int("columns", 0, "number of columns, one per frame by default (at most 100 in the terminal)")
+		scale     = flag.String("scale", "log", "scale of the latency axis, log or linear")
+		minLat    = flag.Duration("min", 0, "bottom of the latency axis, a tenth of the lowest bucket on a log scale by default, 0 on a linear one")
+		maxLat    = flag.Duration("max", 0, "top of the latency axis, the highest bucket by default")
+		rows      = flag.Int("rows", 20, "number of rows")
+		quantiles = flag.String("quantiles", "0.5,0.9,0.99", "quantiles drawn over the cells")
+
+		svgPath = flag.String("svg", "", "write an SVG to this file instead of printing the heatmap")
+		width   = flag.Int("width", 1000, "width of the SVG")
+		height  = flag.Int("height", 400, "height of the SVG")
+		plain   = flag.Bool("plain", false, "no colors in the terminal, the cells are shaded with ░▒▓█ instead")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [file or URL...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	labels, err := parseMatch(*match)
+	if err != nil {
+		fail(err)
+	}
+	opts := heatmap.Options{
+		Columns: *columns,
+		Scale:   heatmap.Scale(*scale),
+		Min:     minLat.Seconds(),
+		Max:     maxLat.Seconds(),
+		Rows:    *rows,
+	}
+	if opts.Quantiles, err = parseQuantiles(*quantiles); err != nil {
+		fail(err)
+	}
+	if opts.From, err = parseTime("-from", *from); err != nil {
+		fail(err)
+	}
+	if opts.To, err = parseTime("-to", *to); err != nil {
+		fail(err)
+	}
+
+	var frames []heatmap.Frame
+	if *storePath != "" {
+		if flag.NArg() > 0 {
+			fail(fmt.Errorf("either -store.path or scrapes, not both"))
+		}
+		frames, err = fromStore(*storePath, *metric, labels, &opts, *since, *step)
+	} else {
+		if flag.NArg() == 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		frames, err = fromScrapes(flag.Args(), *metric, labels, *scrapes, *every, *timeout)
+	}
+	if err != nil {
+		fail(err)
+	}
+
+	if *columns == 0 && *svgPath == "" && max(opts.Columns, len(frames)) > 100 {
+		opts.Columns = 100
+	}
+	h, err := heatmap.New(frames, opts)
+	if err != nil {
+		fail(err)
+	}
+
+	if *svgPath == "" {
+		if err := h.ANSI(os.Stdout, !*plain); err != nil {
+			fail(err)
+		}
+		return
+	}
+
+	f, err := os.Create(*svgPath)
+	if err != nil {
+		fail(err)
+	}
+	title := *metric
+	if *match != "" {
+		title += "{" + *match + "}"
+	}
+	err = h.SVG(f, heatmap.SVGOptions{Width: *width, Height: *height, Title: title})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(2)
+}
+
+// fromStore reads the frames from the store, the time axis defaults to the last -since.
+// The store must not be in use by the aggregator, see the README.
+func fromStore(dir, metric string, labels map[string]string, opts *heatmap.Options, since, step time.Duration) ([]heatmap.Frame, error) {
+	if opts.To.IsZero() {
+		opts.To = time.Now()
+	}
+	if opts.From.IsZero() {
+		opts.From = opts.To.Add(-since)
+	}
+	if opts.Columns == 0 {
+		// One column per step, the steps without data stay empty instead of being squeezed out.
+		opts.Columns = max(int(opts.To.Sub(opts.From)/step), 1)
+	}
+
+	var matchers []*metricstore.Matcher
+	for name, value := range labels {
+		m, err := metricstore.NewMatcher(metricstore.MatchEqual, name, value)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	store, err := metricstore.Open(dir, metricstore.Options{})
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	// The first step ends one step after the start of the axis.
+	return heatmap.FromStore(store, metric, opts.From.Add(step).UnixMilli(), opts.To.UnixMilli(), step, matchers...)
+}
+
+// fromScrapes loads the files in order, or scrapes a single URL n times.
+func fromScrapes(sources []string, metric string, labels map[string]string, n int, every, timeout time.Duration) ([]heatmap.Frame, error) {
+	if len(sources) > 1 && n > 1 {
+		// The snapshots of several processes would be interleaved, a frame would be the diff between two processes.
+		return nil, fmt.Errorf("-scrapes only works with a single URL")
+	}
+
+	var snapshots []*scrape.Snapshot
+	for round := 0; round < max(n, 1); round++ {
+		if round > 0 {
+			time.Sleep(every)
+		}
+
+		for _, source := range sources {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			s, err := scrape.Load(ctx, source)
+			cancel()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", source, err)
+			}
+			snapshots = append(snapshots, s)
+		}
+		if n > 1 {
+			fmt.Fprintf(os.Stderr, "scraped %d/%d\n", round+1, n)
+		}
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].Time.Before(snapshots[j].Time) })
+
+	return heatmap.FromScrapes(snapshots, metric, labels), nil
+}
+
+func parseMatch(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if s == "" {
+		return labels, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid -match %q, want name=value", pair)
+		}
+		labels[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	return labels, nil
+}
+
+func parseQuantiles(s string) ([]float64, error) {
+	var qs []float64
+	for _, field := range strings.Split(s, ",") {
+		q, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || q < 0 || q > 1 {
+			return nil, fmt.Errorf("invalid quantile %q", field)
+		}
+		qs = append(qs, q)
+	}
+
+	return qs, nil
+}
+
+func parseTime(flagName, s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %w", flagName, err)
+	}
+
+	return t, nil
+}
@@ -0,0 +1,201 @@
+// loadgen sends open-loop traffic to the ping server, then compares the latency it saw
+// with what the server's histogram says.
+//
+//	./cmd/loadgen/run.sh -stages const:50:30s,ramp:50:300:1m,burst:500,const:50:30s
+//
+// The server quantiles are estimated from the ping_process buckets with quantile.BucketQuantile,
+// the same interpolation as histogram_quantile, so the difference shows how wrong the estimate can be
+// with the buckets we picked.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+
+	"learn-prometheus/loadgen"
+	"learn-prometheus/quantile"
+	"learn-prometheus/scrape"
+	"learn-prometheus/webconfig"
+)
+
+// targets is a flag that can be repeated.
+type targets []string
+
+func (t *targets) String() string     { return strings.Join(*t, ",") }
+func (t *targets) Set(v string) error { *t = append(*t, v); return nil }
+
+func main() {
+	var (
+		endpoints   targets
+		stageSpec   = flag.String("stages", "const:20:30s", "traffic shape: comma separated const:<rps>:<duration>, ramp:<from>:<to>:<duration>, burst:<requests>, pause:<duration>")
+		timeout     = flag.Duration("timeout", 10*time.Second, "timeout of a request")
+		maxInFlight = flag.Int("max-inflight", 1000, "max requests in flight, requests due past that are dropped and counted")
+		metricsURL  = flag.String("metrics", "", "metrics URL of the server, defaults to /metrics on the host of the first target, \"none\" to skip the comparison")
+		histogram   = flag.String("histogram", "ping_process", "server histogram to compare the client latency with")
+		label       = flag.String("endpoint-label", "endpoint", "label of the server histogram holding the path of the request")
+		listenAddr  = flag.String("listen", "", "address to serve the load generator's own /metrics on, e.g. :8099, off by default")
+		webConfig   = flag.String("web.config.file", "", "web.yml with the TLS and auth config of -listen, see web.example.yml")
+	)
+	flag.Var(&endpoints, "target", "URL to send requests to, can be repeated (default http://localhost:8090/ping and http://localhost:8090/pingPing)")
+	flag.Parse()
+
+	if len(endpoints) == 0 {
+		endpoints = targets{"http://localhost:8090/ping", "http://localhost:8090/pingPing"}
+	}
+
+	stages, err := loadgen.ParseStages(*stageSpec)
+	if err != nil {
+		log.Fatalf("invalid stages: %v", err)
+	}
+
+	gen, err := loadgen.New(endpoints, *timeout, *maxInFlight)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *metricsURL == "" {
+		u, _ := url.Parse(endpoints[0])
+		*metricsURL = (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/metrics"}).String()
+	}
+
+	if *listenAddr != "" {
+		web, err := webconfig.New(*webConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(gen, web)
+		go func() {
+			log.Printf("serving the load generator metrics at %s/metrics\n", *listenAddr)
+			srv := &http.Server{Addr: *listenAddr, Handler: promhttp.HandlerFor(reg, promhttp.HandlerOpts{})}
+			if err := web.ListenAndServe(srv); err != nil {
+				log.Printf("failed to serve metrics: %v\n", err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// The server histogram counts everything since it started, only the difference is our traffic.
+	var before []*dto.MetricFamily
+	if *metricsURL != "none" {
+		if before, err = fetch(*metricsURL); err != nil {
+			log.Printf("failed to scrape %s before the run, the server numbers include older traffic: %v\n", *metricsURL, err)
+		}
+	}
+
+	log.Printf("sending %d requests over %s (%d stages) to %s\n", loadgen.Requests(stages), loadgen.Duration(stages), len(stages), endpoints.String())
+	gen.Run(ctx, loadgen.Offsets(stages))
+
+	var after []*dto.MetricFamily
+	if *metricsURL != "none" {
+		if after, err = fetch(*metricsURL); err != nil {
+			log.Printf("failed to scrape %s, skipping the comparison: %v\n", *metricsURL, err)
+		}
+	}
+
+	results := gen.Results()
+	printSummary(results)
+	if after != nil {
+		printComparison(results, scrape.Find(before, *histogram), scrape.Find(after, *histogram), *histogram, *label)
+	}
+}
+
+func fetch(url string) ([]*dto.MetricFamily, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return scrape.Fetch(ctx, url)
+}
+
+func printSummary(results []*loadgen.Result) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tSENT\tERRORS\tDROPPED\tCODES")
+	for _, r := range results {
+		var codes []string
+		for code, n := range r.Codes {
+			codes = append(codes, fmt.Sprintf("%d:%d", code, n))
+		}
+		sort.Strings(codes)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", r.Endpoint, r.Sent, r.Errors, r.Dropped, strings.Join(codes, " "))
+	}
+	w.Flush()
+	fmt.Println()
+}
+
+func printComparison(results []*loadgen.Result, before, after *dto.MetricFamily, histogram, label string) {
+	if after == nil {
+		log.Printf("no %s histogram on the server, skipping the comparison\n", histogram)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ENDPOINT\tQUANTILE\tCLIENT (exact)\tSERVER (%s, bucketQuantile)\tDIFF\n", histogram)
+	for _, r := range results {
+		match := map[string]string{label: r.Endpoint}
+		buckets := delta(scrape.Buckets(after, match), scrape.Buckets(before, match))
+
+		for _, q := range []float64{0.5, 0.95, 0.99} {
+			client := r.Quantile(q)
+			server := math.NaN()
+			if buckets != nil {
+				server = quantile.BucketQuantile(q, append(quantile.Buckets(nil), buckets...))
+			}
+
+			diff := "-"
+			if !math.IsNaN(client) && !math.IsNaN(server) && client > 0 {
+				diff = fmt.Sprintf("%+.1f%%", (server-client)/client*100)
+			}
+			fmt.Fprintf(w, "%s\tp%g\t%s\t%s\t%s\n", r.Endpoint, q*100, formatSeconds(client), formatSeconds(server), diff)
+		}
+	}
+	w.Flush()
+
+	fmt.Println("\nThe client latency includes the network and the time spent waiting in the server's queue, the server one doesn't.")
+}
+
+// delta is after - before, bucket by bucket. A bucket missing from before (no scrape, new series) counts from 0.
+func delta(after, before quantile.Buckets) quantile.Buckets {
+	if after == nil {
+		return nil
+	}
+
+	old := make(map[float64]float64, len(before))
+	for _, b := range before {
+		old[b.UpperBound] = b.Count
+	}
+
+	result := make(quantile.Buckets, 0, len(after))
+	for _, b := range after {
+		result = append(result, quantile.Bucket{UpperBound: b.UpperBound, Count: b.Count - old[b.UpperBound]})
+	}
+
+	return result
+}
+
+func formatSeconds(s float64) string {
+	if math.IsNaN(s) {
+		return "-"
+	}
+	if math.IsInf(s, +1) {
+		return "+Inf"
+	}
+
+	return fmt.Sprintf("%.1fms", s*1000)
+}
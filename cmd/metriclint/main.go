@@ -0,0 +1,91 @@
+// metriclint checks the metrics exposed by any /metrics endpoint against the naming rules from prometheus.txt.
+//
+//	./cmd/metriclint/run.sh http://localhost:8090/metrics http://localhost:8091/metrics
+//
+// It exits with 1 if any metric breaks the rules, so it can fail a CI step.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"learn-prometheus/metriclint"
+	"learn-prometheus/scrape"
+)
+
+func main() {
+	var (
+		timeout = flag.Duration("timeout", 10*time.Second, "timeout of each scrape")
+		asJSON  = flag.Bool("json", false, "print the violations as JSON instead of a table")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <metrics URL>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	found := false
+	results := make(map[string][]metriclint.Violation)
+	for _, url := range flag.Args() {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		families, err := scrape.Fetch(ctx, url)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", url, err)
+			os.Exit(2)
+		}
+
+		violations := metriclint.LintFamilies(families)
+		results[url] = violations
+		found = found || len(violations) > 0
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	} else {
+		for _, url := range flag.Args() {
+			printTable(url, results[url])
+		}
+	}
+
+	if found {
+		os.Exit(1)
+	}
+}
+
+func printTable(url string, violations []metriclint.Violation) {
+	if len(violations) == 0 {
+		fmt.Printf("%s: every metric follows the naming rules\n\n", url)
+		return
+	}
+
+	fmt.Printf("%s: %d metric(s) break the naming rules\n", url, len(violations))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "METRIC\tTYPE\tSUGGESTED\tPROBLEMS")
+	for _, v := range violations {
+		suggested := v.Suggested
+		if suggested == "" {
+			suggested = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", v.Metric, v.Type, suggested, strings.Join(v.Problems, "; "))
+	}
+	w.Flush()
+	fmt.Println()
+}
@@ -0,0 +1,3 @@
+#!/bin/bash
+
+go run ./cmd/metriclint/main.go "$@"
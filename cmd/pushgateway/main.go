@@ -0,0 +1,74 @@
+// pushgateway is a minimal Pushgateway, for the batch jobs to push their metrics to
+// and for Prometheus to scrape them from, without running the real one.
+//
+//	./cmd/pushgateway/run.sh -listen :9091
+//	./cmd/pushjob/run.sh -gateway http://localhost:9091
+//	curl -s localhost:9091/metrics
+//
+// Prometheus has to scrape it with honor_labels: true, see the README.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"learn-prometheus/pushgateway"
+	"learn-prometheus/webconfig"
+)
+
+func main() {
+	listenAddr := flag.String("listen", ":9091", "address to receive the pushes and serve /metrics on")
+	webConfig := flag.String("web.config.file", "", "web.yml with the TLS and auth config of the pushes and /metrics, see web.example.yml, reloaded on SIGHUP")
+	flag.Parse()
+
+	// The same config for the jobs pushing and Prometheus scraping, its auth failures are in /metrics too.
+	web, err := webconfig.New(*webConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(web)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := web.Reload(); err != nil {
+				log.Printf("failed to reload the web config: %v\n", err)
+			}
+		}
+	}()
+
+	receiver := pushgateway.NewReceiver()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics/", receiver)
+	mux.Handle("/metrics", promhttp.HandlerFor(prometheus.Gatherers{receiver, reg}, promhttp.HandlerOpts{}))
+
+	srv := &http.Server{Addr: *listenAddr, Handler: mux}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("receiving pushes on %s/metrics/job/<job>{/<label>/<value>}\n", *listenAddr)
+	if err := web.ListenAndServe(srv); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,3 @@
+#!/bin/bash
+
+go run ./cmd/pushgateway/main.go "$@"
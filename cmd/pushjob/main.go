@@ -0,0 +1,144 @@
+// pushjob is a batch job with the same instruments as the ping server, that exits before any scrape.
+// It pushes its metrics to a Pushgateway when it's done, even if it failed or was interrupted.
+//
+//	./cmd/pushgateway/run.sh &
+//	./cmd/pushjob/run.sh -gateway http://localhost:9091 -instance batch1 -pings 50
+//	curl -s localhost:9091/metrics | grep ping_
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"learn-prometheus/pushgateway"
+)
+
+func main() {
+	var (
+		gateway  = flag.String("gateway", "http://localhost:9091", "URL of the Pushgateway")
+		job      = flag.String("job", "pushjob", "job label of the pushed metrics")
+		instance = flag.String("instance", "", "instance label added to the grouping key, none if empty")
+		pings    = flag.Int("pings", 20, "number of pings the job does")
+		failRate = flag.Float64("fail-rate", 0, "ratio of the pings that fail, to see the failures in the pushed metrics")
+		method   = flag.String("method", "post", "put replaces every metric of the group, post only the pushed ones")
+		del      = flag.Bool("delete", false, "delete the group instead of running the job")
+	)
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// A registry of its own: the Go and process metrics of a job that ran for a second aren't worth pushing.
+	reg := prometheus.NewRegistry()
+
+	pingCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ping_request_count",
+		Help: "Number of request handled by Ping handler",
+	})
+	histogramVec := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ping_process",
+			Help:    "Histogram of the ping process",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.02, 0.03, 0.05, 0.1, 0.2, 0.5, 1, 5},
+		},
+		[]string{"endpoint", "handler", "status"},
+	)
+	// The usual batch job metrics: alert when the last success is too old, not on a failure.
+	// lastSuccess is only registered, so pushed, once the job succeeded: with POST a failed run
+	// keeps the timestamp of the previous success in the Pushgateway.
+	lastSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pushjob_last_success_timestamp_seconds",
+		Help: "Last time the job finished without error.",
+	})
+	duration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pushjob_duration_seconds",
+		Help: "How long the last run of the job took.",
+	})
+	reg.MustRegister(pingCounter, histogramVec, duration)
+
+	client := pushgateway.NewClient(*gateway, *job, reg)
+	if *instance != "" {
+		client.Grouping("instance", *instance)
+	}
+
+	if *del {
+		if err := client.Delete(ctx); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	pushMethod := pushgateway.Replace
+	switch *method {
+	case "put":
+	case "post":
+		pushMethod = pushgateway.Add
+	default:
+		log.Fatalf("-method is put or post, not %q", *method)
+	}
+
+	start := time.Now()
+	err := client.PushOnExit(ctx, pushMethod, func(ctx context.Context) error {
+		defer func() { duration.Set(time.Since(start).Seconds()) }()
+
+		var failed int
+		for i := 0; i < *pings; i++ {
+			pingCounter.Inc()
+
+			startHandlingTime := time.Now()
+			status := "ok"
+			if err := ping(ctx, *failRate); err != nil {
+				if ctx.Err() != nil {
+					histogramVec.WithLabelValues("/ping", "pushjob", "canceled").Observe(time.Since(startHandlingTime).Seconds())
+					return ctx.Err()
+				}
+				status = "error"
+				failed++
+			}
+			histogramVec.WithLabelValues("/ping", "pushjob", status).Observe(time.Since(startHandlingTime).Seconds())
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d pings failed", failed, *pings)
+		}
+		lastSuccess.SetToCurrentTime()
+		reg.MustRegister(lastSuccess)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The password of the web config of the gateway can be in the URL.
+	pushedTo := *gateway
+	if u, err := url.Parse(*gateway); err == nil {
+		pushedTo = u.Redacted()
+	}
+	log.Printf("%d pings done in %s, metrics pushed to %s\n", *pings, time.Since(start).Round(time.Millisecond), pushedTo)
+}
+
+// ping does the same work as the ping handler of the server.
+func ping(ctx context.Context, failRate float64) error {
+	select {
+	case <-time.After(time.Duration(rand.Intn(100)) * time.Millisecond):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if rand.Float64() < failRate {
+		return errors.New("ping failed")
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+// scrapediff compares two snapshots of a /metrics endpoint, instead of curling it twice and eyeballing the numbers.
+//
+//	curl -s localhost:8090/metrics > before.txt
+//	# ... the incident ...
+//	./cmd/scrapediff/run.sh before.txt http://localhost:8090/metrics
+//
+// Counters get their increase and rate, histograms the quantiles of what was observed in between,
+// gauges how much they moved. New and vanished series, and counter resets, are flagged.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"learn-prometheus/scrape"
+)
+
+func main() {
+	var (
+		asJSON    = flag.Bool("json", false, "print the report as JSON instead of a table")
+		all       = flag.Bool("all", false, "also print the series that didn't change")
+		match     = flag.String("match", "", "only compare the metrics whose name matches this regexp")
+		interval  = flag.Duration("interval", 0, "time between the snapshots for the rates, defaults to the scrape times (or the file modification times)")
+		quantiles = flag.String("quantiles", "0.5,0.9,0.99", "quantiles to estimate for every histogram")
+		timeout   = flag.Duration("timeout", 10*time.Second, "timeout of a scrape")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <before file or URL> <after file or URL>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	qs, err := parseQuantiles(*quantiles)
+	if err != nil {
+		fail(err)
+	}
+	var nameRe *regexp.Regexp
+	if *match != "" {
+		if nameRe, err = regexp.Compile(*match); err != nil {
+			fail(fmt.Errorf("invalid -match: %w", err))
+		}
+	}
+
+	var snapshots [2]*scrape.Snapshot
+	for i, source := range flag.Args() {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		snapshots[i], err = scrape.Load(ctx, source)
+		cancel()
+		if err != nil {
+			fail(fmt.Errorf("%s: %w", source, err))
+		}
+	}
+
+	report := scrape.Diff(snapshots[0], snapshots[1], interval.Seconds(), qs)
+
+	kept := report.Series[:0]
+	for _, s := range report.Series {
+		if (nameRe == nil || nameRe.MatchString(s.Name)) && (*all || s.Status != scrape.StatusUnchanged) {
+			kept = append(kept, s)
+		}
+	}
+	report.Series = kept
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fail(err)
+		}
+		return
+	}
+
+	printTable(report)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(2)
+}
+
+func parseQuantiles(s string) ([]float64, error) {
+	var qs []float64
+	for _, field := range strings.Split(s, ",") {
+		q, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || q < 0 || q > 1 {
+			return nil, fmt.Errorf("invalid quantile %q", field)
+		}
+		qs = append(qs, q)
+	}
+
+	return qs, nil
+}
+
+func printTable(report *scrape.Report) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tSERIES\tTYPE\tBEFORE\tAFTER\tDELTA\tRATE/S\tWINDOW")
+
+	counts := make(map[scrape.Status]int)
+	for _, s := range report.Series {
+		counts[s.Status]++
+
+		rate := "-"
+		if s.Rate != nil {
+			rate = formatFloat(*s.Rate)
+		}
+		before, delta := formatFloat(s.Before), formatFloat(s.Delta)
+		if s.Status == scrape.StatusNew {
+			before = "-"
+		}
+		after := formatFloat(s.After)
+		if s.Status == scrape.StatusVanished {
+			after, delta = "-", "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%s%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.Status, s.Name, s.Labels, s.Type, before, after, delta, rate, window(s.Histogram))
+	}
+	w.Flush()
+
+	fmt.Printf("\n%d series over %.1fs: %d changed, %d new, %d vanished, %d counter resets\n",
+		len(report.Series), report.Interval,
+		counts[scrape.StatusChanged], counts[scrape.StatusNew], counts[scrape.StatusVanished], counts[scrape.StatusReset])
+}
+
+// window sums up the observations made between the snapshots.
+func window(h *scrape.HistogramDiff) string {
+	if h == nil {
+		return ""
+	}
+
+	var parts []string
+	for _, q := range h.Quantiles {
+		parts = append(parts, fmt.Sprintf("p%g=%s", q.Q*100, formatFloat(q.Value)))
+	}
+	if h.Mean != nil {
+		parts = append(parts, "mean="+formatFloat(*h.Mean))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func formatFloat(v scrape.Value) string {
+	return strconv.FormatFloat(float64(v), 'g', 6, 64)
+}
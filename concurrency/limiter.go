@@ -0,0 +1,226 @@
+// Package concurrency limits how many requests a handler works on at the same time, and adapts the limit
+// to the latency: when the handler gets slower, the limit goes down and the excess requests are shed
+// right away, instead of piling up and making everything slower.
+//
+// The limit follows the gradient algorithm of Netflix' concurrency-limits (Gradient2):
+// every window, the mean latency of the window (short) is compared with its long term average (long).
+//
+//	gradient = clamp(tolerance * long / short, 0.5, 1)
+//	newLimit = limit * gradient + sqrt(limit)
+//	limit    = limit * (1 - smoothing) + newLimit * smoothing
+//
+// As long as the latency stays around its average, the gradient is 1 and the limit grows by sqrt(limit),
+// a bit of queueing is allowed. When the latency goes up, the limit shrinks, at most by half per window.
+package concurrency
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Options of a Limiter, the zero value of a field means its default.
+type Options struct {
+	// InitialLimit is the limit on startup, 20 by default.
+	InitialLimit int
+	// MinLimit and MaxLimit bound the limit, 5 and 1000 by default.
+	MinLimit, MaxLimit int
+	// Window is how often the limit is updated, 1s by default.
+	// A window with fewer than MinWindowSamples samples (10 by default) is extended, a few samples say nothing.
+	Window           time.Duration
+	MinWindowSamples int
+	// LongWindows is the number of windows the long term latency is averaged over, 60 by default.
+	LongWindows int
+	// Tolerance is how much slower than usual the latency can get before the limit goes down, 1.5 by default.
+	Tolerance float64
+	// Smoothing is how fast the limit moves to its new value, from 0 to 1, 0.2 by default.
+	Smoothing float64
+}
+
+func (o *Options) setDefaults() {
+	if o.InitialLimit <= 0 {
+		o.InitialLimit = 20
+	}
+	if o.MinLimit <= 0 {
+		o.MinLimit = 5
+	}
+	if o.MaxLimit <= 0 {
+		o.MaxLimit = 1000
+	}
+	if o.Window <= 0 {
+		o.Window = time.Second
+	}
+	if o.MinWindowSamples <= 0 {
+		o.MinWindowSamples = 10
+	}
+	if o.LongWindows <= 0 {
+		o.LongWindows = 60
+	}
+	if o.Tolerance <= 0 {
+		o.Tolerance = 1.5
+	}
+	if o.Smoothing <= 0 || o.Smoothing > 1 {
+		o.Smoothing = 0.2
+	}
+}
+
+// Limiter is the adaptive limit of one route.
+//
+// It doesn't measure anything itself: the caller passes the latency it measured to Release,
+// the same value it observes in its own histogram, so the limiter sees exactly what the dashboards see.
+//
+// It's a prometheus.Collector, exporting the limit, the requests in flight and the shed requests.
+type Limiter struct {
+	opts Options
+	now  func() time.Time
+
+	mtx         sync.Mutex
+	limit       float64
+	inFlight    int
+	maxInFlight int // in the current window
+	shed        uint64
+	windowStart time.Time
+	windowSum   time.Duration
+	windowCount int
+	short, long time.Duration
+
+	limitDesc    *prometheus.Desc
+	inFlightDesc *prometheus.Desc
+	shedDesc     *prometheus.Desc
+	latencyDesc  *prometheus.Desc
+}
+
+// New creates the limiter of a route, the route is a constant label of its metrics.
+func New(route string, opts Options) *Limiter {
+	opts.setDefaults()
+
+	labels := prometheus.Labels{"route": route}
+	l := &Limiter{
+		opts:  opts,
+		now:   time.Now,
+		limit: float64(opts.InitialLimit),
+		limitDesc: prometheus.NewDesc(
+			"concurrency_limit",
+			"Current max number of requests handled at the same time, past that requests are shed.",
+			nil, labels,
+		),
+		inFlightDesc: prometheus.NewDesc(
+			"concurrency_in_flight_requests",
+			"Number of requests being handled.",
+			nil, labels,
+		),
+		shedDesc: prometheus.NewDesc(
+			"concurrency_shed_requests_total",
+			"Number of requests answered with 503 because the limit was reached.",
+			nil, labels,
+		),
+		latencyDesc: prometheus.NewDesc(
+			"concurrency_latency_seconds",
+			"Latency the limit is computed from: the mean of the last window (short) and its long term average (long).",
+			[]string{"window"}, labels,
+		),
+	}
+	l.windowStart = l.now()
+
+	return l
+}
+
+// Acquire takes a slot for a request, false if the limit is reached: the request must be shed.
+// Every successful Acquire must be followed by a Release or an Abandon.
+func (l *Limiter) Acquire() bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.inFlight >= int(l.limit) {
+		l.shed++
+		return false
+	}
+
+	l.inFlight++
+	l.maxInFlight = max(l.maxInFlight, l.inFlight)
+
+	return true
+}
+
+// Release gives the slot back, with how long the request took.
+func (l *Limiter) Release(latency time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.inFlight--
+	l.windowSum += latency
+	l.windowCount++
+
+	if now := l.now(); now.Sub(l.windowStart) >= l.opts.Window && l.windowCount >= l.opts.MinWindowSamples {
+		l.update()
+		l.windowStart = now
+		l.windowSum, l.windowCount = 0, 0
+		l.maxInFlight = l.inFlight
+	}
+}
+
+// Abandon gives the slot back without a latency, for a request that was canceled:
+// it stopped early, its latency says nothing about the handler.
+func (l *Limiter) Abandon() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.inFlight--
+}
+
+// update computes the new limit at the end of a window.
+func (l *Limiter) update() {
+	l.short = l.windowSum / time.Duration(l.windowCount)
+
+	if l.long == 0 {
+		l.long = l.short
+	} else {
+		factor := 2 / (float64(l.opts.LongWindows) + 1)
+		l.long += time.Duration(factor * float64(l.short-l.long))
+	}
+	// After an overload the long term average is still high for a while,
+	// pull it down faster once the latency is back to normal, or the limit would grow too fast.
+	if l.long > 2*l.short {
+		l.long = l.long * 95 / 100
+	}
+
+	// The limit wasn't even half used, the latency says nothing about what a higher limit would do.
+	if float64(l.maxInFlight) < l.limit/2 {
+		return
+	}
+
+	gradient := math.Max(0.5, math.Min(1, l.opts.Tolerance*float64(l.long)/float64(l.short)))
+	newLimit := l.limit*gradient + math.Sqrt(l.limit)
+	newLimit = l.limit*(1-l.opts.Smoothing) + newLimit*l.opts.Smoothing
+
+	l.limit = math.Max(float64(l.opts.MinLimit), math.Min(float64(l.opts.MaxLimit), newLimit))
+}
+
+// Limit returns the current limit.
+func (l *Limiter) Limit() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return int(l.limit)
+}
+
+func (l *Limiter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- l.limitDesc
+	ch <- l.inFlightDesc
+	ch <- l.shedDesc
+	ch <- l.latencyDesc
+}
+
+func (l *Limiter) Collect(ch chan<- prometheus.Metric) {
+	l.mtx.Lock()
+	limit, inFlight, shed, short, long := int(l.limit), l.inFlight, l.shed, l.short, l.long
+	l.mtx.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(l.limitDesc, prometheus.GaugeValue, float64(limit))
+	ch <- prometheus.MustNewConstMetric(l.inFlightDesc, prometheus.GaugeValue, float64(inFlight))
+	ch <- prometheus.MustNewConstMetric(l.shedDesc, prometheus.CounterValue, float64(shed))
+	ch <- prometheus.MustNewConstMetric(l.latencyDesc, prometheus.GaugeValue, short.Seconds(), "short")
+	ch <- prometheus.MustNewConstMetric(l.latencyDesc, prometheus.GaugeValue, long.Seconds(), "long")
+}
@@ -0,0 +1,96 @@
+package concurrency
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// windows runs n windows where the limit is fully used and every request takes latency.
+func windows(l *Limiter, now *time.Time, n int, latency time.Duration) {
+	for range n {
+		limit := l.Limit()
+		for range limit {
+			if !l.Acquire() {
+				panic("the limit isn't reached yet")
+			}
+		}
+		*now = now.Add(l.opts.Window)
+		for range limit {
+			l.Release(latency)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(1739000000, 0)
+	l := New("/ping", Options{InitialLimit: 10, MaxLimit: 100})
+	l.now = func() time.Time { return now }
+	l.windowStart = now
+
+	// Steady latency, the limit grows.
+	windows(l, &now, 20, 10*time.Millisecond)
+	grown := l.Limit()
+	if grown <= 20 {
+		t.Fatalf("got limit %d after a steady latency, want it to grow from 10", grown)
+	}
+
+	// The handler gets 10 times slower, the limit goes down.
+	// Not forever: the long term average catches up, a handler that stays slow gets a stable limit.
+	windows(l, &now, 10, 100*time.Millisecond)
+	if shrunk := l.Limit(); shrunk >= grown*2/3 {
+		t.Fatalf("got limit %d after the latency went up, want less than 2/3 of %d", shrunk, grown)
+	}
+
+	// Back to normal, it grows again.
+	shrunk := l.Limit()
+	windows(l, &now, 20, 10*time.Millisecond)
+	if l.Limit() <= shrunk {
+		t.Errorf("got limit %d after the latency went back to normal, want more than %d", l.Limit(), shrunk)
+	}
+
+	// Past the limit, the requests are shed.
+	limit := l.Limit()
+	for range limit {
+		l.Acquire()
+	}
+	if l.Acquire() {
+		t.Error("got a slot past the limit")
+	}
+	l.Abandon()
+	if !l.Acquire() {
+		t.Error("got no slot after one was given back")
+	}
+
+	expected := `
+# HELP concurrency_shed_requests_total Number of requests answered with 503 because the limit was reached.
+# TYPE concurrency_shed_requests_total counter
+concurrency_shed_requests_total{route="/ping"} 1
+`
+	if err := testutil.CollectAndCompare(l, strings.NewReader(expected), "concurrency_shed_requests_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLimiterAppLimited(t *testing.T) {
+	now := time.Unix(1739000000, 0)
+	l := New("/ping", Options{InitialLimit: 50})
+	l.now = func() time.Time { return now }
+	l.windowStart = now
+
+	// 2 requests at a time, the limit of 50 is never close to being used: it must not grow forever.
+	for range 100 {
+		for range 10 {
+			l.Acquire()
+			l.Acquire()
+			l.Release(10 * time.Millisecond)
+			l.Release(10 * time.Millisecond)
+		}
+		now = now.Add(time.Second)
+	}
+	if l.Limit() != 50 {
+		t.Errorf("got limit %d, want it to stay at 50", l.Limit())
+	}
+}
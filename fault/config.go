@@ -0,0 +1,237 @@
+// Package fault slows down and breaks the ping handlers on purpose, to see how the dashboards and the alerts react.
+//
+// Everything comes from a YAML config, reloaded at runtime (SIGHUP or the admin endpoint):
+//
+//	routes:
+//	  /ping:
+//	    latency: {distribution: normal, mean: 50ms, stddev: 10ms}
+//	  "*":
+//	    errors:
+//	      - {rate: 0.01, status: 503}
+//	scenarios:
+//	  # 1 minute after the config is loaded, the p99 of /ping jumps to 2s for 5 minutes.
+//	  - {at: 60s, for: 5m, route: /ping, latency: {distribution: longtail, p50: 50ms, p99: 2s}}
+package fault
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Distribution is how the injected latency is drawn.
+type Distribution string
+
+const (
+	// DistFixed always waits Value.
+	DistFixed Distribution = "fixed"
+	// DistUniform waits anything between Min and Max.
+	DistUniform Distribution = "uniform"
+	// DistNormal waits around Mean, with Stddev, never less than 0.
+	DistNormal Distribution = "normal"
+	// DistLongTail is a log-normal distribution with the given P50 and P99:
+	// most requests are around the median, a few are really slow. It's what real latencies look like.
+	DistLongTail Distribution = "longtail"
+)
+
+// Config is the whole fault injection config.
+type Config struct {
+	// Routes by path, "*" is used for the routes not listed.
+	Routes    map[string]Route `yaml:"routes" json:"routes"`
+	Scenarios []Scenario       `yaml:"scenarios" json:"scenarios"`
+}
+
+// Route is what's injected in the requests of one route.
+type Route struct {
+	Latency *Latency    `yaml:"latency,omitempty" json:"latency,omitempty"`
+	Errors  []ErrorRule `yaml:"errors,omitempty" json:"errors,omitempty"`
+}
+
+// Latency is added before the handler runs. The zero value adds nothing.
+type Latency struct {
+	Distribution Distribution `yaml:"distribution" json:"distribution"`
+	Value        Duration     `yaml:"value,omitempty" json:"value,omitempty"`
+	Min          Duration     `yaml:"min,omitempty" json:"min,omitempty"`
+	Max          Duration     `yaml:"max,omitempty" json:"max,omitempty"`
+	Mean         Duration     `yaml:"mean,omitempty" json:"mean,omitempty"`
+	Stddev       Duration     `yaml:"stddev,omitempty" json:"stddev,omitempty"`
+	P50          Duration     `yaml:"p50,omitempty" json:"p50,omitempty"`
+	P99          Duration     `yaml:"p99,omitempty" json:"p99,omitempty"`
+}
+
+// ErrorRule answers Rate (0 to 1) of the requests with Status, without calling the handler.
+type ErrorRule struct {
+	Rate   float64 `yaml:"rate" json:"rate"`
+	Status int     `yaml:"status" json:"status"`
+}
+
+// Scenario replaces the latency and/or the errors of a route for a while.
+// At is relative to when the config was loaded, For 0 means until the next reload.
+type Scenario struct {
+	Name    string      `yaml:"name,omitempty" json:"name,omitempty"`
+	At      Duration    `yaml:"at" json:"at"`
+	For     Duration    `yaml:"for,omitempty" json:"for,omitempty"`
+	Route   string      `yaml:"route" json:"route"`
+	Latency *Latency    `yaml:"latency,omitempty" json:"latency,omitempty"`
+	Errors  []ErrorRule `yaml:"errors,omitempty" json:"errors,omitempty"`
+}
+
+// scenarioName is the name of the i-th scenario, or #<position> if it has none.
+func scenarioName(s Scenario, i int) string {
+	if s.Name != "" {
+		return s.Name
+	}
+
+	return fmt.Sprintf("#%d", i+1)
+}
+
+// Duration is a time.Duration written like "1.5s" in the config and in the JSON of the admin endpoint.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid duration %q", value.Line, value.Value)
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// ParseConfig reads and checks a YAML (or JSON) config.
+func ParseConfig(b []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+func (c *Config) Validate() error {
+	for path, route := range c.Routes {
+		if err := validate(route.Latency, route.Errors); err != nil {
+			return fmt.Errorf("route %s: %w", path, err)
+		}
+	}
+
+	for i, s := range c.Scenarios {
+		name := scenarioName(s, i)
+		if s.Route == "" {
+			return fmt.Errorf("scenario %s: no route", name)
+		}
+		if s.At < 0 || s.For < 0 {
+			return fmt.Errorf("scenario %s: negative time", name)
+		}
+		if s.Latency == nil && s.Errors == nil {
+			return fmt.Errorf("scenario %s: neither latency nor errors", name)
+		}
+		if err := validate(s.Latency, s.Errors); err != nil {
+			return fmt.Errorf("scenario %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func validate(latency *Latency, errors []ErrorRule) error {
+	if latency != nil {
+		if err := latency.validate(); err != nil {
+			return err
+		}
+	}
+
+	total := 0.0
+	for _, e := range errors {
+		if e.Rate < 0 || e.Rate > 1 {
+			return fmt.Errorf("error rate %g is not between 0 and 1", e.Rate)
+		}
+		if e.Status < 100 || e.Status > 599 || http.StatusText(e.Status) == "" {
+			return fmt.Errorf("invalid status code %d", e.Status)
+		}
+		total += e.Rate
+	}
+	if total > 1 {
+		return fmt.Errorf("the error rates add up to %g, more than 1", total)
+	}
+
+	return nil
+}
+
+func (l *Latency) validate() error {
+	if l.Value < 0 || l.Min < 0 || l.Max < 0 || l.Mean < 0 || l.Stddev < 0 || l.P50 < 0 || l.P99 < 0 {
+		return fmt.Errorf("negative latency")
+	}
+
+	switch l.Distribution {
+	case DistFixed:
+	case DistUniform:
+		if l.Max < l.Min {
+			return fmt.Errorf("uniform latency: max is less than min")
+		}
+	case DistNormal:
+	case DistLongTail:
+		if l.P50 <= 0 || l.P99 < l.P50 {
+			return fmt.Errorf("longtail latency: p50 must be positive and p99 at least p50")
+		}
+	default:
+		return fmt.Errorf("unknown latency distribution %q, want fixed, uniform, normal or longtail", l.Distribution)
+	}
+
+	return nil
+}
+
+// z99 is how many standard deviations the 99th percentile is above the median of a normal distribution.
+const z99 = 2.3263478740408408
+
+// Sample draws a latency.
+func (l *Latency) Sample() time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	var d float64
+	switch l.Distribution {
+	case DistFixed:
+		d = float64(l.Value)
+	case DistUniform:
+		d = float64(l.Min) + rand.Float64()*float64(l.Max-l.Min)
+	case DistNormal:
+		d = float64(l.Mean) + rand.NormFloat64()*float64(l.Stddev)
+	case DistLongTail:
+		// ln(latency) is normal: its median is ln(p50), and ln(p99) is z99 standard deviations above.
+		mu := math.Log(float64(l.P50))
+		sigma := (math.Log(float64(l.P99)) - mu) / z99
+		d = math.Exp(mu + rand.NormFloat64()*sigma)
+	}
+
+	return time.Duration(max(0, d))
+}
+
+// pickError returns the status code to answer with, 0 to let the request through.
+func pickError(errors []ErrorRule) int {
+	r := rand.Float64()
+	for _, e := range errors {
+		if r < e.Rate {
+			return e.Status
+		}
+		r -= e.Rate
+	}
+
+	return 0
+}
@@ -0,0 +1,155 @@
+package fault
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencySample(t *testing.T) {
+	testCases := []struct {
+		latency  Latency
+		p50, p99 time.Duration
+	}{
+		{latency: Latency{Distribution: DistFixed, Value: Duration(30 * time.Millisecond)}, p50: 30 * time.Millisecond, p99: 30 * time.Millisecond},
+		{latency: Latency{Distribution: DistUniform, Min: Duration(0), Max: Duration(100 * time.Millisecond)}, p50: 50 * time.Millisecond, p99: 99 * time.Millisecond},
+		{latency: Latency{Distribution: DistNormal, Mean: Duration(100 * time.Millisecond), Stddev: Duration(10 * time.Millisecond)}, p50: 100 * time.Millisecond, p99: 123 * time.Millisecond},
+		{latency: Latency{Distribution: DistLongTail, P50: Duration(50 * time.Millisecond), P99: Duration(2 * time.Second)}, p50: 50 * time.Millisecond, p99: 2 * time.Second},
+	}
+
+	for _, tc := range testCases {
+		samples := make([]time.Duration, 100_000)
+		for i := range samples {
+			samples[i] = tc.latency.Sample()
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+		p50, p99 := samples[len(samples)/2], samples[len(samples)*99/100]
+		if !near(p50, tc.p50) || !near(p99, tc.p99) {
+			t.Errorf("%s: got p50 %s and p99 %s, want %s and %s", tc.latency.Distribution, p50, p99, tc.p50, tc.p99)
+		}
+	}
+}
+
+// near is within 5%, the samples are random.
+func near(got, want time.Duration) bool {
+	return math.Abs(float64(got-want)) <= 0.05*float64(want)
+}
+
+func TestParseConfig(t *testing.T) {
+	b, err := os.ReadFile("../faults.example.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ParseConfig(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Routes) != 3 || len(cfg.Scenarios) != 2 || cfg.Scenarios[0].At != Duration(time.Minute) {
+		t.Errorf("got %+v", cfg)
+	}
+
+	for _, invalid := range []string{
+		`routes: {/ping: {latency: {distribution: pareto}}}`,
+		`routes: {/ping: {latency: {distribution: uniform, min: 2s, max: 1s}}}`,
+		`routes: {/ping: {latency: {distribution: longtail, p50: 1s, p99: 10ms}}}`,
+		`routes: {/ping: {errors: [{rate: 0.7, status: 500}, {rate: 0.7, status: 503}]}}`,
+		`routes: {/ping: {errors: [{rate: 0.1, status: 999}]}}`,
+		`scenarios: [{at: 10s, route: /ping}]`,
+		`scenarios: [{at: soon, route: /ping, errors: [{rate: 1, status: 500}]}]`,
+	} {
+		if _, err := ParseConfig([]byte(invalid)); err == nil {
+			t.Errorf("%s: got no error", invalid)
+		}
+	}
+}
+
+func TestInjector(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "faults.yml")
+	config := `
+routes:
+  "*":
+    latency: {distribution: fixed, value: 1ms}
+scenarios:
+  - {name: outage, at: 60s, for: 30s, route: /ping, errors: [{rate: 1, status: 503}]}
+`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	inj, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := inj.loadedAt
+	inj.now = func() time.Time { return now }
+
+	called := 0
+	h := inj.Wrap("/ping", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called++ }))
+	serve := func() int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ping", nil))
+		return rec.Code
+	}
+
+	start := time.Now()
+	if code := serve(); code != http.StatusOK || called != 1 {
+		t.Fatalf("got %d before the scenario, want 200", code)
+	}
+	if time.Since(start) < time.Millisecond {
+		t.Error("the latency of * wasn't injected")
+	}
+
+	now = now.Add(70 * time.Second)
+	if code := serve(); code != http.StatusServiceUnavailable || called != 1 {
+		t.Errorf("got %d during the scenario, want 503", code)
+	}
+	if s := inj.State().Scenarios[0].State; s != "active" {
+		t.Errorf("got scenario %s, want active", s)
+	}
+
+	now = now.Add(30 * time.Second)
+	if code := serve(); code != http.StatusOK || called != 2 {
+		t.Errorf("got %d after the scenario, want 200", code)
+	}
+
+	// A reload restarts the scenarios.
+	rec := httptest.NewRecorder()
+	inj.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/faults?action=reload", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"state":"pending"`) {
+		t.Errorf("got %d %s after the reload", rec.Code, rec.Body)
+	}
+
+	// A config PUT on the admin endpoint replaces the file one, an invalid one is refused.
+	rec = httptest.NewRecorder()
+	inj.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/admin/faults", strings.NewReader(`{"routes": {"/ping": {"errors": [{"rate": 1, "status": 500}]}}}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d %s for the PUT", rec.Code, rec.Body)
+	}
+	if code := serve(); code != http.StatusInternalServerError {
+		t.Errorf("got %d after the PUT, want 500", code)
+	}
+
+	rec = httptest.NewRecorder()
+	inj.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/admin/faults", strings.NewReader(`routes: {/ping: {errors: [{rate: 2, status: 500}]}}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got %d for an invalid config, want 400", rec.Code)
+	}
+}
+
+// TestInjectorWithoutConfig checks a reload (SIGHUP) without -fault.config does nothing.
+func TestInjectorWithoutConfig(t *testing.T) {
+	inj, err := New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inj.Reload(); err != nil {
+		t.Errorf("reload without a config file: %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+package fault
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Injector applies the config to the wrapped handlers.
+//
+// It's a prometheus.Collector, exporting what it injected, so a dashboard can tell
+// a real incident from a rehearsal.
+type Injector struct {
+	path string
+	now  func() time.Time
+
+	mtx      sync.RWMutex
+	cfg      *Config
+	loadedAt time.Time
+
+	injectedErrors  *prometheus.CounterVec
+	injectedLatency *prometheus.CounterVec
+	activeDesc      *prometheus.Desc
+}
+
+// New loads the config file at path. An empty path starts with an empty config, that injects nothing
+// until a config is PUT on the admin endpoint.
+func New(path string) (*Injector, error) {
+	i := &Injector{
+		path: path,
+		now:  time.Now,
+		cfg:  &Config{},
+		injectedErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "fault_injected_errors_total",
+				Help: "Number of requests answered with an injected error instead of calling the handler.",
+			},
+			[]string{"route", "code"},
+		),
+		injectedLatency: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "fault_injected_latency_seconds_total",
+				Help: "Total latency added to the requests.",
+			},
+			[]string{"route"},
+		),
+		activeDesc: prometheus.NewDesc(
+			"fault_scenario_active",
+			"1 if the scenario is running.",
+			[]string{"scenario", "route"}, nil,
+		),
+	}
+	i.loadedAt = i.now()
+
+	if path != "" {
+		if err := i.Reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	return i, nil
+}
+
+// Reload reads the config file again. The scenarios start over from now.
+// The current config is kept if the new one is invalid. Without a config file there's nothing to do.
+func (i *Injector) Reload() error {
+	if i.path == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(i.path)
+	if err != nil {
+		return err
+	}
+	cfg, err := ParseConfig(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", i.path, err)
+	}
+
+	i.Set(cfg)
+	log.Printf("fault: loaded %s, %d route(s) and %d scenario(s)\n", i.path, len(cfg.Routes), len(cfg.Scenarios))
+
+	return nil
+}
+
+// Set replaces the config, the scenarios start over from now.
+func (i *Injector) Set(cfg *Config) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	i.cfg = cfg
+	i.loadedAt = i.now()
+}
+
+// current returns what to inject in a request to route right now: the route config (or "*"),
+// overridden by the active scenarios, the last one wins.
+func (i *Injector) current(route string) (latency *Latency, errors []ErrorRule) {
+	i.mtx.RLock()
+	defer i.mtx.RUnlock()
+
+	rc, ok := i.cfg.Routes[route]
+	if !ok {
+		rc = i.cfg.Routes["*"]
+	}
+	latency, errors = rc.Latency, rc.Errors
+
+	elapsed := i.now().Sub(i.loadedAt)
+	for _, s := range i.cfg.Scenarios {
+		if (s.Route != route && s.Route != "*") || !active(s, elapsed) {
+			continue
+		}
+		if s.Latency != nil {
+			latency = s.Latency
+		}
+		if s.Errors != nil {
+			errors = s.Errors
+		}
+	}
+
+	return latency, errors
+}
+
+func active(s Scenario, elapsed time.Duration) bool {
+	start := time.Duration(s.At)
+	return elapsed >= start && (s.For == 0 || elapsed < start+time.Duration(s.For))
+}
+
+// Wrap injects the faults of route in h: first the latency, then maybe an error instead of calling h.
+// Wrap the part of the handler that's measured, so the injected latency shows up in the histograms.
+func (i *Injector) Wrap(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		latency, errors := i.current(route)
+
+		if d := latency.Sample(); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+				i.injectedLatency.WithLabelValues(route).Add(d.Seconds())
+			case <-r.Context().Done():
+				// The client is gone, there's nobody to answer to.
+				timer.Stop()
+				return
+			}
+		}
+
+		if code := pickError(errors); code != 0 {
+			i.injectedErrors.WithLabelValues(route, strconv.Itoa(code)).Inc()
+			http.Error(w, "injected fault: "+http.StatusText(code), code)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ScenarioState is a scenario with where it's at.
+type ScenarioState struct {
+	Scenario
+	// State is pending, active or done.
+	State string `json:"state"`
+}
+
+// State is what the admin endpoint shows.
+type State struct {
+	ConfigFile string           `json:"configFile,omitempty"`
+	LoadedAt   time.Time        `json:"loadedAt"`
+	Routes     map[string]Route `json:"routes"`
+	Scenarios  []ScenarioState  `json:"scenarios"`
+}
+
+func (i *Injector) State() State {
+	i.mtx.RLock()
+	defer i.mtx.RUnlock()
+
+	state := State{ConfigFile: i.path, LoadedAt: i.loadedAt, Routes: i.cfg.Routes, Scenarios: []ScenarioState{}}
+	elapsed := i.now().Sub(i.loadedAt)
+	for _, s := range i.cfg.Scenarios {
+		st := ScenarioState{Scenario: s, State: "pending"}
+		switch {
+		case active(s, elapsed):
+			st.State = "active"
+		case elapsed >= time.Duration(s.At):
+			st.State = "done"
+		}
+		state.Scenarios = append(state.Scenarios, st)
+	}
+
+	return state
+}
+
+// Handler is the admin endpoint:
+//   - GET shows the config and the state of the scenarios as JSON.
+//   - PUT replaces the config with the YAML (or JSON) body, until the next reload.
+//   - POST ?action=reload reads the config file again.
+func (i *Injector) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+
+		case http.MethodPut:
+			b, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			cfg, err := ParseConfig(b)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			i.Set(cfg)
+			log.Printf("fault: config replaced from %s, %d route(s) and %d scenario(s)\n", r.RemoteAddr, len(cfg.Routes), len(cfg.Scenarios))
+
+		case http.MethodPost:
+			if r.URL.Query().Get("action") != "reload" {
+				http.Error(w, "unknown action, want ?action=reload", http.StatusBadRequest)
+				return
+			}
+			if err := i.Reload(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(i.State()); err != nil {
+			log.Printf("fault: failed to write state: %v\n", err)
+		}
+	})
+}
+
+func (i *Injector) Describe(ch chan<- *prometheus.Desc) {
+	i.injectedErrors.Describe(ch)
+	i.injectedLatency.Describe(ch)
+	ch <- i.activeDesc
+}
+
+func (i *Injector) Collect(ch chan<- prometheus.Metric) {
+	i.injectedErrors.Collect(ch)
+	i.injectedLatency.Collect(ch)
+
+	state := i.State()
+	seen := make(map[[2]string]bool)
+	for n, s := range state.Scenarios {
+		name := scenarioName(s.Scenario, n)
+		key := [2]string{name, s.Route}
+		if seen[key] {
+			// Two scenarios with the same name on the same route, the first one is enough.
+			continue
+		}
+		seen[key] = true
+
+		v := 0.0
+		if s.State == "active" {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(i.activeDesc, prometheus.GaugeValue, v, name, s.Route)
+	}
+}
@@ -0,0 +1,113 @@
+package heatmap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// markers of the quantiles in the terminal, in the order of Options.Quantiles.
+const markers = "ox+*#@"
+
+// shades are used instead of colors in plain text, from a few observations to the most.
+var shades = []rune{'░', '▒', '▓', '█'}
+
+// ANSI writes the heatmap for a terminal, one character per cell, the highest latencies on top.
+// With color, the cells have 24-bit background colors. Without it, they're shaded with ░▒▓█,
+// which survives being pasted in a ticket or a text file.
+// The quantiles are marked in the cell they fall in, see the legend under the time axis.
+func (h *Heatmap) ANSI(w io.Writer, color bool) error {
+	labels := make([]string, h.opts.Rows)
+	width := 0
+	for r := range labels {
+		_, upper := h.RowBounds(r)
+		labels[r] = formatLatency(upper)
+		width = max(width, len([]rune(labels[r])))
+	}
+
+	// marks[column][row] is the marker of the quantile in the cell, if any. The higher quantiles win.
+	marks := make([][]byte, h.opts.Columns)
+	for c := range marks {
+		marks[c] = make([]byte, h.opts.Rows)
+	}
+	for i, values := range h.Quantiles {
+		for c, v := range values {
+			if !math.IsNaN(v) {
+				marks[c][h.row(v)] = markers[i%len(markers)]
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	for r := h.opts.Rows - 1; r >= 0; r-- {
+		fmt.Fprintf(&b, "%*s │", width, labels[r])
+		for c := range h.Cells {
+			h.writeCell(&b, h.Cells[c][r], marks[c][r], color)
+		}
+		b.WriteString("\n")
+	}
+
+	// The time axis: the start on the left, the end on the right and the middle in between if there's room.
+	fmt.Fprintf(&b, "%*s └%s\n", width, "", strings.Repeat("─", h.opts.Columns))
+	start, end := h.formatTime(h.opts.From), h.formatTime(h.opts.To)
+	// The start is always there, even if it's wider than the heatmap.
+	axis := []rune(strings.Repeat(" ", max(h.opts.Columns, len(start))))
+	place := func(at int, label string) {
+		copy(axis[min(max(at, 0), len(axis)-len(label)):], []rune(label))
+	}
+	if h.opts.Columns >= 3*len(start)+4 {
+		middle := h.opts.From.Add(h.opts.To.Sub(h.opts.From) / 2)
+		place(h.opts.Columns/2-len(start)/2, h.formatTime(middle))
+	}
+	if h.opts.Columns >= 2*len(start)+2 {
+		place(h.opts.Columns-len(end), end)
+	}
+	place(0, start)
+	fmt.Fprintf(&b, "%*s  %s\n", width, "", strings.TrimRight(string(axis), " "))
+
+	var legend []string
+	for i, q := range h.opts.Quantiles {
+		legend = append(legend, fmt.Sprintf("%c %s", markers[i%len(markers)], quantileName(q)))
+	}
+	fmt.Fprintf(&b, "%*s  %s   max %.4g per cell, %.0f observations\n", width, "", strings.Join(legend, "  "), h.MaxCount, h.Total())
+
+	_, err := b.WriteTo(w)
+	return err
+}
+
+func (h *Heatmap) writeCell(b *bytes.Buffer, count float64, mark byte, color bool) {
+	frac := 0.0
+	if h.MaxCount > 0 {
+		frac = count / h.MaxCount
+	}
+
+	if !color {
+		switch {
+		case mark != 0:
+			b.WriteByte(mark)
+		case count <= 0:
+			b.WriteByte(' ')
+		default:
+			b.WriteRune(shades[min(int(frac*float64(len(shades))), len(shades)-1)])
+		}
+		return
+	}
+
+	ch := byte(' ')
+	if mark != 0 {
+		ch = mark
+	}
+	if count <= 0 {
+		if mark != 0 {
+			fmt.Fprintf(b, "\x1b[1;97m%c\x1b[0m", ch)
+		} else {
+			b.WriteByte(' ')
+		}
+		return
+	}
+
+	red, green, blue := cellColor(frac)
+	fmt.Fprintf(b, "\x1b[1;97;48;2;%d;%d;%dm%c\x1b[0m", red, green, blue, ch)
+}
@@ -0,0 +1,399 @@
+// Package heatmap draws a latency histogram over time like the Grafana heatmap panel,
+// but offline: an SVG for the incident report, or right in the terminal.
+//
+// Every column is the histogram of what was observed during its interval, the increase of the buckets
+// like increase(ping_process_bucket[1m]) in Grafana. A cell is colored by how many observations fell in its
+// latency range, and the quantiles of every column are drawn on top, as histogram_quantile would compute them.
+package heatmap
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"learn-prometheus/quantile"
+)
+
+// Snapshot is a cumulative histogram at some point: what was observed since the process started.
+// The buckets end with +Inf.
+type Snapshot struct {
+	Time    time.Time
+	Buckets quantile.Buckets
+}
+
+// Frame is what was observed during (Start, End]: the increase of every bucket.
+// The buckets are still cumulative over le and end with +Inf, like the ones of a Snapshot.
+type Frame struct {
+	Start, End time.Time
+	Buckets    quantile.Buckets
+}
+
+// FromSnapshots makes one frame between every two consecutive snapshots, sorted by time.
+// After a counter reset (the process restarted, a bucket went down) or a change of buckets,
+// the frame is the later snapshot on its own: everything it has was observed since the restart.
+func FromSnapshots(snapshots []Snapshot) []Frame {
+	sorted := append([]Snapshot(nil), snapshots...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+
+	var frames []Frame
+	for i := 1; i < len(sorted); i++ {
+		prev, cur := sorted[i-1], sorted[i]
+		if len(cur.Buckets) == 0 {
+			continue
+		}
+
+		delta := append(quantile.Buckets(nil), cur.Buckets...)
+		if !reset(prev.Buckets, cur.Buckets) {
+			for j := range delta {
+				delta[j].Count -= prev.Buckets[j].Count
+			}
+		}
+		frames = append(frames, Frame{Start: prev.Time, End: cur.Time, Buckets: delta})
+	}
+
+	return frames
+}
+
+func reset(prev, cur quantile.Buckets) bool {
+	if len(prev) != len(cur) {
+		return true
+	}
+	for i := range cur {
+		if prev[i].UpperBound != cur[i].UpperBound || cur[i].Count < prev[i].Count {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Scale is how the latency axis is laid out.
+type Scale string
+
+const (
+	// Log gives as much room to 1ms-10ms as to 100ms-1s, latencies usually span several orders of magnitude.
+	Log    Scale = "log"
+	Linear Scale = "linear"
+)
+
+// Options are the axes of the heatmap. The zero value fits the axes to the frames.
+type Options struct {
+	// From and To are the time axis, from the start of the first frame to the end of the last one by default.
+	From, To time.Time
+	// Columns splits the time axis, one column per frame by default.
+	// The frames ending in the same column add up.
+	Columns int
+
+	// Scale of the latency axis, Log by default.
+	Scale Scale
+	// Min and Max are the latency axis, in seconds. Max is the highest bucket bound by default,
+	// Min is 0, or a tenth of the lowest bound on a log scale.
+	// What's out of the axis is counted in the first or the last row, the +Inf bucket always ends up in the last row.
+	Min, Max float64
+	// Rows splits the latency axis, 20 by default.
+	Rows int
+
+	// Quantiles are drawn over the cells, p50, p90 and p99 by default.
+	Quantiles []float64
+}
+
+// Heatmap is the grid of cells, ready to be drawn.
+type Heatmap struct {
+	opts Options
+	// bounds are the latencies between the rows, Rows+1 of them from Min to Max.
+	bounds []float64
+
+	// Cells[column][row] is the number of observations in the cell, row 0 is the lowest latency.
+	// Observations are spread evenly inside their bucket, so a cell can have a fraction of one.
+	Cells [][]float64
+	// Quantiles[i][column] is the Options.Quantiles[i] of the column, NaN when nothing was observed.
+	Quantiles [][]float64
+	// MaxCount is the highest cell, the top of the color scale.
+	MaxCount float64
+}
+
+// New lays the frames out on the grid.
+func New(frames []Frame, opts Options) (*Heatmap, error) {
+	if len(frames) == 0 {
+		return nil, errors.New("no frames: no histogram in the time range, or less than two snapshots")
+	}
+	if err := setDefaults(&opts, frames); err != nil {
+		return nil, err
+	}
+
+	h := &Heatmap{opts: opts, bounds: make([]float64, opts.Rows+1)}
+	for r := range h.bounds {
+		h.bounds[r] = h.value(float64(r) / float64(opts.Rows))
+	}
+
+	h.Cells = make([][]float64, opts.Columns)
+	for c := range h.Cells {
+		h.Cells[c] = make([]float64, opts.Rows)
+	}
+	// columns are the buckets of every column, summed by le, for the quantiles.
+	columns := make([]map[float64]float64, opts.Columns)
+
+	for _, f := range frames {
+		c, ok := h.column(f.End)
+		if !ok {
+			continue
+		}
+
+		buckets := append(quantile.Buckets(nil), f.Buckets...)
+		sort.Sort(buckets)
+		h.spread(h.Cells[c], buckets)
+
+		if columns[c] == nil {
+			columns[c] = make(map[float64]float64)
+		}
+		for _, b := range buckets {
+			columns[c][b.UpperBound] += b.Count
+		}
+	}
+
+	for _, cells := range h.Cells {
+		for _, count := range cells {
+			h.MaxCount = max(h.MaxCount, count)
+		}
+	}
+
+	h.Quantiles = make([][]float64, len(opts.Quantiles))
+	for i, q := range opts.Quantiles {
+		h.Quantiles[i] = make([]float64, opts.Columns)
+		for c, counts := range columns {
+			h.Quantiles[i][c] = math.NaN()
+			if counts[math.Inf(+1)] <= 0 {
+				continue
+			}
+
+			buckets := make(quantile.Buckets, 0, len(counts))
+			for upperBound, count := range counts {
+				buckets = append(buckets, quantile.Bucket{UpperBound: upperBound, Count: count})
+			}
+			h.Quantiles[i][c] = quantile.BucketQuantile(q, buckets)
+		}
+	}
+
+	return h, nil
+}
+
+func setDefaults(opts *Options, frames []Frame) error {
+	if opts.From.IsZero() {
+		opts.From = frames[0].Start
+		for _, f := range frames {
+			if f.Start.Before(opts.From) {
+				opts.From = f.Start
+			}
+		}
+	}
+	if opts.To.IsZero() {
+		for _, f := range frames {
+			if f.End.After(opts.To) {
+				opts.To = f.End
+			}
+		}
+	}
+	if !opts.To.After(opts.From) {
+		return fmt.Errorf("the time axis is empty: %s to %s", opts.From.Format(time.RFC3339), opts.To.Format(time.RFC3339))
+	}
+	if opts.Columns <= 0 {
+		opts.Columns = len(frames)
+	}
+
+	if opts.Scale == "" {
+		opts.Scale = Log
+	}
+	if opts.Scale != Log && opts.Scale != Linear {
+		return fmt.Errorf("unknown scale %q, must be %s or %s", opts.Scale, Log, Linear)
+	}
+
+	lowest, highest := math.Inf(+1), 0.0
+	for _, f := range frames {
+		for _, b := range f.Buckets {
+			if b.UpperBound > 0 && !math.IsInf(b.UpperBound, +1) {
+				lowest, highest = min(lowest, b.UpperBound), max(highest, b.UpperBound)
+			}
+		}
+	}
+	if opts.Max <= 0 {
+		if highest == 0 {
+			return errors.New("the buckets have no positive bound, set the latency axis")
+		}
+		opts.Max = highest
+	}
+	if opts.Min <= 0 && opts.Scale == Log {
+		opts.Min = min(lowest, opts.Max) / 10
+	}
+	if opts.Min < 0 || opts.Min >= opts.Max {
+		return fmt.Errorf("the latency axis is empty: %g to %g", opts.Min, opts.Max)
+	}
+	if opts.Rows <= 0 {
+		opts.Rows = 20
+	}
+
+	if len(opts.Quantiles) == 0 {
+		opts.Quantiles = []float64{0.5, 0.9, 0.99}
+	}
+	for _, q := range opts.Quantiles {
+		if q < 0 || q > 1 {
+			return fmt.Errorf("invalid quantile %g", q)
+		}
+	}
+
+	return nil
+}
+
+// Options returns the options with their defaults, the actual axes of the heatmap.
+func (h *Heatmap) Options() Options {
+	return h.opts
+}
+
+// column is the column of a frame ending at t: column c covers (From + c*d, From + (c+1)*d].
+func (h *Heatmap) column(t time.Time) (int, bool) {
+	if !t.After(h.opts.From) || t.After(h.opts.To) {
+		return 0, false
+	}
+
+	frac := float64(t.Sub(h.opts.From)) / float64(h.opts.To.Sub(h.opts.From))
+	c := int(math.Ceil(frac*float64(h.opts.Columns))) - 1
+
+	return min(max(c, 0), h.opts.Columns-1), true
+}
+
+// ColumnTime is the end of the column.
+func (h *Heatmap) ColumnTime(c int) time.Time {
+	d := h.opts.To.Sub(h.opts.From)
+	return h.opts.From.Add(time.Duration(float64(d) * float64(c+1) / float64(h.opts.Columns)))
+}
+
+// RowBounds is the latency range of the row, in seconds.
+func (h *Heatmap) RowBounds(r int) (lower, upper float64) {
+	return h.bounds[r], h.bounds[r+1]
+}
+
+// position is where v is on the latency axis, 0 at Min and 1 at Max. It's not clamped.
+func (h *Heatmap) position(v float64) float64 {
+	if h.opts.Scale == Linear {
+		return (v - h.opts.Min) / (h.opts.Max - h.opts.Min)
+	}
+	if v <= 0 {
+		return math.Inf(-1)
+	}
+
+	return math.Log(v/h.opts.Min) / math.Log(h.opts.Max/h.opts.Min)
+}
+
+// value is the latency at a position of the axis, the other way around.
+func (h *Heatmap) value(pos float64) float64 {
+	if h.opts.Scale == Linear {
+		return h.opts.Min + pos*(h.opts.Max-h.opts.Min)
+	}
+
+	return h.opts.Min * math.Pow(h.opts.Max/h.opts.Min, pos)
+}
+
+// row is the row holding v, the first or the last one if v is out of the axis.
+func (h *Heatmap) row(v float64) int {
+	pos := h.position(v) * float64(h.opts.Rows)
+	if pos <= 0 {
+		return 0
+	}
+	if pos >= float64(h.opts.Rows) {
+		return h.opts.Rows - 1
+	}
+
+	return int(pos)
+}
+
+// spread adds the observations of every bucket to the rows it overlaps, assuming they're spread evenly
+// inside the bucket, the same guess histogram_quantile makes. The first bucket starts at 0.
+func (h *Heatmap) spread(cells []float64, buckets quantile.Buckets) {
+	lower, below := 0.0, 0.0
+	for _, b := range buckets {
+		count := b.Count - below
+		below = b.Count
+
+		switch {
+		case count <= 0:
+		case math.IsInf(b.UpperBound, +1):
+			// No upper bound, nothing to spread over.
+			cells[h.opts.Rows-1] += count
+		case b.UpperBound <= lower:
+			cells[h.row(b.UpperBound)] += count
+		default:
+			h.spreadRange(cells, lower, b.UpperBound, count)
+		}
+		lower = max(lower, b.UpperBound)
+	}
+}
+
+func (h *Heatmap) spreadRange(cells []float64, lower, upper, count float64) {
+	width := upper - lower
+	overlap := func(from, to float64) float64 {
+		return max(0, min(upper, to)-max(lower, from)) / width
+	}
+
+	cells[0] += count * overlap(math.Inf(-1), h.opts.Min)
+	cells[h.opts.Rows-1] += count * overlap(h.opts.Max, math.Inf(+1))
+	for r := range cells {
+		cells[r] += count * overlap(h.bounds[r], h.bounds[r+1])
+	}
+}
+
+// Total is the number of observations on the heatmap.
+func (h *Heatmap) Total() float64 {
+	var total float64
+	for _, cells := range h.Cells {
+		for _, count := range cells {
+			total += count
+		}
+	}
+
+	return total
+}
+
+// quantileName is p50 for 0.5, p99.9 for 0.999.
+func quantileName(q float64) string {
+	return fmt.Sprintf("p%g", q*100)
+}
+
+// formatLatency is 3 significant digits in the unit that fits: 12.6ms, 1.5s, 250µs.
+func formatLatency(seconds float64) string {
+	switch {
+	case seconds == 0:
+		return "0"
+	case seconds < 1e-3:
+		return fmt.Sprintf("%.3gµs", seconds*1e6)
+	case seconds < 1:
+		return fmt.Sprintf("%.3gms", seconds*1e3)
+	default:
+		return fmt.Sprintf("%.3gs", seconds)
+	}
+}
+
+// formatTime drops the date when the whole axis is within a day.
+func (h *Heatmap) formatTime(t time.Time) string {
+	if h.opts.To.Sub(h.opts.From) < 24*time.Hour {
+		return t.Format("15:04:05")
+	}
+
+	return t.Format("01-02 15:04")
+}
+
+// palette goes from dark purple for a few observations to light yellow for the most, like inferno in Grafana.
+var palette = [][3]float64{{27, 12, 65}, {120, 28, 109}, {237, 105, 37}, {252, 255, 164}}
+
+// cellColor is the color of a cell, frac is its count over MaxCount.
+func cellColor(frac float64) (r, g, b uint8) {
+	frac = min(max(frac, 0), 1)
+	pos := frac * float64(len(palette)-1)
+	i := min(int(pos), len(palette)-2)
+	t := pos - float64(i)
+
+	from, to := palette[i], palette[i+1]
+	mix := func(k int) uint8 { return uint8(math.Round(from[k] + t*(to[k]-from[k]))) }
+
+	return mix(0), mix(1), mix(2)
+}
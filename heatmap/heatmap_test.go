@@ -0,0 +1,185 @@
+package heatmap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"learn-prometheus/metricstore"
+	"learn-prometheus/quantile"
+)
+
+var start = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// cumulative builds the buckets 0.01, 0.1, 1 and +Inf from the number of observations in each.
+func cumulative(fast, medium, slow, overflow float64) quantile.Buckets {
+	return quantile.Buckets{
+		{UpperBound: 0.01, Count: fast},
+		{UpperBound: 0.1, Count: fast + medium},
+		{UpperBound: 1, Count: fast + medium + slow},
+		{UpperBound: math.Inf(+1), Count: fast + medium + slow + overflow},
+	}
+}
+
+func TestFromSnapshots(t *testing.T) {
+	frames := FromSnapshots([]Snapshot{
+		{Time: start.Add(20 * time.Second), Buckets: cumulative(10, 0, 5, 0)},
+		{Time: start, Buckets: nil},
+		{Time: start.Add(10 * time.Second), Buckets: cumulative(10, 0, 0, 0)},
+		// The process restarted.
+		{Time: start.Add(30 * time.Second), Buckets: cumulative(1, 0, 0, 0)},
+	})
+
+	if len(frames) != 3 {
+		t.Fatalf("got %d frames, want 3", len(frames))
+	}
+	// The histogram appeared: everything counts.
+	if got := frames[0].Buckets[3].Count; got != 10 || !frames[0].End.Equal(start.Add(10*time.Second)) {
+		t.Errorf("frame 0: got %v observations ending at %s, want 10 at 12:00:10", got, frames[0].End)
+	}
+	if got := frames[1].Buckets; got[0].Count != 0 || got[2].Count != 5 {
+		t.Errorf("frame 1: got %v, want the 5 slow observations only", got)
+	}
+	if got := frames[2].Buckets[3].Count; got != 1 {
+		t.Errorf("frame 2: got %v observations after the reset, want 1", got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	// A minute of fast requests, then a minute of slow ones.
+	var snapshots []Snapshot
+	var fast, slow float64
+	for i := 0; i <= 12; i++ {
+		snapshots = append(snapshots, Snapshot{Time: start.Add(time.Duration(i) * 10 * time.Second), Buckets: cumulative(fast, 0, slow, 1)})
+		if i < 6 {
+			fast += 100
+		} else {
+			slow += 100
+		}
+	}
+
+	h, err := New(FromSnapshots(snapshots), Options{Columns: 6, Rows: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := h.Options()
+	if opts.Scale != Log || opts.Min != 0.001 || opts.Max != 1 || !opts.From.Equal(start) || len(h.Cells) != 6 {
+		t.Fatalf("got axes %+v, want 6 columns, 1ms to 1s on a log scale", opts)
+	}
+	// Nothing is lost: the +Inf observation of the first snapshot doesn't count, it was there before.
+	if got := h.Total(); math.Abs(got-1200) > 1e-9 {
+		t.Errorf("got %v observations, want 1200", got)
+	}
+
+	p50 := h.Quantiles[0]
+	if h.row(p50[0]) >= 4 || h.row(p50[5]) < 8 {
+		t.Errorf("got p50 in rows %d and %d, want the bottom then the top", h.row(p50[0]), h.row(p50[5]))
+	}
+	// Each fast column has 200 observations over the 4 rows of 1ms-10ms, what's under 1ms is in the first row.
+	if got := h.Cells[0][1]; math.Abs(got-200*0.001/0.01*(math.Pow(10, 0.5)-math.Pow(10, 0.25))) > 1e-9 {
+		t.Errorf("got %v in the second row, want the share of 1.78ms-3.16ms", got)
+	}
+
+	var plain bytes.Buffer
+	if err := h.ANSI(&plain, false); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(plain.String(), "\n"); len(lines) != 12+4 || !strings.Contains(plain.String(), "o p50") {
+		t.Errorf("got:\n%s\nwant 12 rows, the axis and the legend", plain.String())
+	}
+	if strings.Contains(plain.String(), "\x1b[") {
+		t.Error("the plain heatmap has escape codes")
+	}
+
+	var colored bytes.Buffer
+	if err := h.ANSI(&colored, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(colored.String(), "\x1b[1;97;48;2;") {
+		t.Error("the colored heatmap has no colored cell")
+	}
+
+	var svg bytes.Buffer
+	if err := h.SVG(&svg, SVGOptions{Title: `ping_process{endpoint="/ping"} & co`}); err != nil {
+		t.Fatal(err)
+	}
+	dec := xml.NewDecoder(&svg)
+	polylines := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid SVG: %v", err)
+		}
+		if el, ok := tok.(xml.StartElement); ok && el.Name.Local == "polyline" {
+			polylines++
+		}
+	}
+	if polylines != 3 {
+		t.Errorf("got %d quantile lines, want 3", polylines)
+	}
+}
+
+func TestNewAxes(t *testing.T) {
+	frames := FromSnapshots([]Snapshot{
+		{Time: start, Buckets: cumulative(0, 0, 0, 0)},
+		{Time: start.Add(time.Minute), Buckets: cumulative(0, 10, 0, 0)},
+	})
+
+	h, err := New(frames, Options{Scale: Linear, Min: 0, Max: 0.2, Rows: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10ms-100ms is spread over the rows 0-50ms and 50ms-100ms, evenly.
+	want := []float64{10 * 40.0 / 90, 10 * 50.0 / 90, 0, 0}
+	for r, count := range h.Cells[0] {
+		if math.Abs(count-want[r]) > 1e-9 {
+			t.Errorf("row %d: got %v, want %v", r, count, want[r])
+		}
+	}
+
+	// Broken axes are refused.
+	if _, err := New(frames, Options{From: start.Add(time.Hour), To: start}); err == nil {
+		t.Error("an empty time axis must be refused")
+	}
+	if _, err := New(frames, Options{Scale: "sqrt"}); err == nil {
+		t.Error("an unknown scale must be refused")
+	}
+}
+
+func TestFromStore(t *testing.T) {
+	s := metricstore.New()
+	for i := int64(0); i <= 10; i++ {
+		for _, b := range []struct {
+			le    string
+			count float64
+		}{{"0.01", 5}, {"0.1", 8}, {"+Inf", 10}} {
+			lset := metricstore.FromMap(map[string]string{"__name__": "ping_process_bucket", "endpoint": "/ping", "le": b.le})
+			if err := s.Append(lset, start.Add(time.Duration(i)*10*time.Second).UnixMilli(), b.count*float64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	frames, err := FromStore(s, "ping_process", start.Add(time.Minute).UnixMilli(), start.Add(100*time.Second).UnixMilli(), 20*time.Second,
+		metricstore.MustNewMatcher(metricstore.MatchEqual, "endpoint", "/ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(frames) != 3 {
+		t.Fatalf("got %d frames, want 3", len(frames))
+	}
+	for _, f := range frames {
+		if len(f.Buckets) != 3 || f.Buckets[0].Count != 10 || f.Buckets[2].Count != 20 || f.End.Sub(f.Start) != 20*time.Second {
+			t.Errorf("got %+v, want 20 observations in 20s, 10 under 10ms", f)
+		}
+	}
+}
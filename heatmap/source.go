@@ -0,0 +1,76 @@
+package heatmap
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"learn-prometheus/metricstore"
+	"learn-prometheus/quantile"
+	"learn-prometheus/scrape"
+)
+
+// FromScrapes turns a sequence of scrapes of a /metrics endpoint into frames, one between every two scrapes.
+// The series of the histogram matching the labels are summed, like sum by (le) in PromQL.
+// A scrape without the histogram counts as empty: the process wasn't up, or hadn't observed anything yet.
+func FromScrapes(snapshots []*scrape.Snapshot, name string, match map[string]string) []Frame {
+	histograms := make([]Snapshot, 0, len(snapshots))
+	for _, s := range snapshots {
+		histograms = append(histograms, Snapshot{
+			Time:    s.Time,
+			Buckets: scrape.Buckets(scrape.Find(s.Families, name), match),
+		})
+	}
+
+	return FromSnapshots(histograms)
+}
+
+// FromStore reads the <name>_bucket series of a histogram from the store, one frame per step between mint and maxt
+// (milliseconds), like sum by (le) (increase(<name>_bucket[step])) in Grafana.
+func FromStore(s *metricstore.Store, name string, mint, maxt int64, step time.Duration, matchers ...*metricstore.Matcher) ([]Frame, error) {
+	matchers = append(matchers, metricstore.MustNewMatcher(metricstore.MatchEqual, metricstore.MetricName, name+"_bucket"))
+
+	increases, err := s.QueryRange(metricstore.FuncIncrease, mint, maxt, step, matchers...)
+	if err != nil {
+		return nil, err
+	}
+
+	// counts[t][le] is the increase of the bucket in the step ending at t.
+	counts := make(map[int64]map[float64]float64)
+	for _, series := range increases.Series {
+		le := series.Labels.Get("le")
+		upperBound, err := strconv.ParseFloat(le, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid le label %q", series.Labels, le)
+		}
+
+		for _, sample := range series.Samples {
+			if counts[sample.T] == nil {
+				counts[sample.T] = make(map[float64]float64)
+			}
+			counts[sample.T][upperBound] += sample.V
+		}
+	}
+
+	frames := make([]Frame, 0, len(counts))
+	for t, byLe := range counts {
+		if _, ok := byLe[math.Inf(+1)]; !ok {
+			// Only some of the buckets made it to the store, no way to tell how many observations there were.
+			continue
+		}
+
+		buckets := make(quantile.Buckets, 0, len(byLe))
+		for upperBound, count := range byLe {
+			buckets = append(buckets, quantile.Bucket{UpperBound: upperBound, Count: count})
+		}
+		sort.Sort(buckets)
+
+		end := time.UnixMilli(t)
+		frames = append(frames, Frame{Start: end.Add(-step), End: end, Buckets: buckets})
+	}
+	sort.Slice(frames, func(i, j int) bool { return frames[i].End.Before(frames[j].End) })
+
+	return frames, nil
+}
@@ -0,0 +1,193 @@
+package heatmap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// SVGOptions is the size of the picture, in pixels.
+type SVGOptions struct {
+	// Width and Height are 1000x400 by default.
+	Width, Height int
+	// Title is written above the heatmap, e.g. the metric and its labels.
+	Title string
+}
+
+// The colors of Grafana's dark theme, the quantile lines stand out from the palette.
+const (
+	svgBackground = "#181b1f"
+	svgEmpty      = "#111217"
+	svgText       = "#ccccdc"
+	svgGrid       = "#2c3235"
+)
+
+var lineColors = []string{"#73bf69", "#5794f2", "#ffffff", "#b877d9", "#8ab8ff"}
+
+// Margins around the plot, for the axes and the legend.
+const (
+	marginLeft   = 70
+	marginRight  = 20
+	marginTop    = 40
+	marginBottom = 40
+)
+
+// SVG writes the heatmap as a standalone SVG. Hovering a cell shows its time, latency range and count.
+func (h *Heatmap) SVG(w io.Writer, opts SVGOptions) error {
+	if opts.Width <= 0 {
+		opts.Width = 1000
+	}
+	if opts.Height <= 0 {
+		opts.Height = 400
+	}
+	plotWidth := float64(opts.Width - marginLeft - marginRight)
+	plotHeight := float64(opts.Height - marginTop - marginBottom)
+	if plotWidth <= 0 || plotHeight <= 0 {
+		return fmt.Errorf("%dx%d is too small for the axes", opts.Width, opts.Height)
+	}
+
+	cellWidth := plotWidth / float64(h.opts.Columns)
+	cellHeight := plotHeight / float64(h.opts.Rows)
+	// y is the vertical pixel of a position on the latency axis.
+	y := func(pos float64) float64 {
+		return marginTop + plotHeight*(1-min(max(pos, 0), 1))
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`+"\n",
+		opts.Width, opts.Height, opts.Width, opts.Height)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="%s"/>`+"\n", svgBackground)
+	fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%.1f" height="%.1f" fill="%s"/>`+"\n", marginLeft, marginTop, plotWidth, plotHeight, svgEmpty)
+	if opts.Title != "" {
+		fmt.Fprintf(&b, `<text x="%d" y="20" fill="%s" font-size="13">%s</text>`+"\n", marginLeft, svgText, escape(opts.Title))
+	}
+
+	// The cells first, the axes and the lines go over them.
+	b.WriteString("<g>\n")
+	for c, cells := range h.Cells {
+		for r, count := range cells {
+			if count <= 0 {
+				continue
+			}
+			red, green, blue := cellColor(count / h.MaxCount)
+			lower, upper := h.RowBounds(r)
+			fmt.Fprintf(&b, `<rect x="%.2f" y="%.2f" width="%.2f" height="%.2f" fill="#%02x%02x%02x"><title>%s %s-%s: %.4g</title></rect>`+"\n",
+				marginLeft+float64(c)*cellWidth, marginTop+plotHeight-float64(r+1)*cellHeight, cellWidth, cellHeight,
+				red, green, blue, h.formatTime(h.ColumnTime(c)), formatLatency(lower), formatLatency(upper), count)
+		}
+	}
+	b.WriteString("</g>\n")
+
+	for _, tick := range h.latencyTicks() {
+		ty := y(h.position(tick))
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%s" stroke-opacity="0.6"/>`+"\n",
+			marginLeft, ty, marginLeft+plotWidth, ty, svgGrid)
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" fill="%s" text-anchor="end" dominant-baseline="middle">%s</text>`+"\n",
+			marginLeft-6, ty, svgText, formatLatency(tick))
+	}
+	for _, tick := range h.timeTicks(6) {
+		tx := marginLeft + plotWidth*float64(tick.Sub(h.opts.From))/float64(h.opts.To.Sub(h.opts.From))
+		fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%s"/>`+"\n",
+			tx, marginTop+plotHeight, tx, marginTop+plotHeight+4, svgText)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" fill="%s" text-anchor="middle">%s</text>`+"\n",
+			tx, marginTop+plotHeight+18, svgText, h.formatTime(tick))
+	}
+
+	// One line per quantile through the middle of the columns, broken where nothing was observed.
+	for i, values := range h.Quantiles {
+		stroke := lineColors[i%len(lineColors)]
+
+		var points [][2]float64
+		flush := func() {
+			switch len(points) {
+			case 0:
+			case 1:
+				fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="2" fill="%s"/>`+"\n", points[0][0], points[0][1], stroke)
+			default:
+				coords := make([]string, len(points))
+				for j, p := range points {
+					coords[j] = fmt.Sprintf("%.1f,%.1f", p[0], p[1])
+				}
+				fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="1.5"/>`+"\n", strings.Join(coords, " "), stroke)
+			}
+			points = points[:0]
+		}
+		for c, v := range values {
+			if math.IsNaN(v) {
+				flush()
+				continue
+			}
+			points = append(points, [2]float64{marginLeft + (float64(c)+0.5)*cellWidth, y(h.position(v))})
+		}
+		flush()
+
+		lx := opts.Width - marginRight - 60*(len(h.Quantiles)-i)
+		fmt.Fprintf(&b, `<line x1="%d" y1="16" x2="%d" y2="16" stroke="%s" stroke-width="2"/>`+"\n", lx, lx+16, stroke)
+		fmt.Fprintf(&b, `<text x="%d" y="20" fill="%s">%s</text>`+"\n", lx+20, svgText, quantileName(h.opts.Quantiles[i]))
+	}
+
+	fmt.Fprintf(&b, `<text x="%d" y="%d" fill="%s">max %.4g per cell, %.0f observations</text>`+"\n",
+		marginLeft, opts.Height-6, svgText, h.MaxCount, h.Total())
+	b.WriteString("</svg>\n")
+
+	_, err := b.WriteTo(w)
+	return err
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// latencyTicks are 1, 2 and 5 times the powers of 10 on a log axis (only the powers of 10 if that's too many),
+// or about 5 round numbers on a linear one.
+func (h *Heatmap) latencyTicks() []float64 {
+	lo, hi := h.opts.Min, h.opts.Max
+	var ticks []float64
+
+	if h.opts.Scale == Log {
+		for _, mantissas := range [][]float64{{1, 2, 5}, {1}} {
+			ticks = ticks[:0]
+			for e := math.Floor(math.Log10(lo)); e <= math.Ceil(math.Log10(hi)); e++ {
+				for _, m := range mantissas {
+					if v := m * math.Pow(10, e); v >= lo*(1-1e-9) && v <= hi*(1+1e-9) {
+						ticks = append(ticks, v)
+					}
+				}
+			}
+			if len(ticks) <= 10 {
+				break
+			}
+		}
+		return ticks
+	}
+
+	step := math.Pow(10, math.Floor(math.Log10((hi-lo)/5)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if (hi-lo)/(step*m) <= 6 {
+			step *= m
+			break
+		}
+	}
+	for v := math.Ceil(lo/step) * step; v <= hi*(1+1e-9); v += step {
+		ticks = append(ticks, v)
+	}
+
+	return ticks
+}
+
+// timeTicks splits the time axis evenly, both ends included.
+func (h *Heatmap) timeTicks(n int) []time.Time {
+	d := h.opts.To.Sub(h.opts.From)
+	ticks := make([]time.Time, 0, n+1)
+	for i := 0; i <= n; i++ {
+		ticks = append(ticks, h.opts.From.Add(d*time.Duration(i)/time.Duration(n)))
+	}
+
+	return ticks
+}
@@ -0,0 +1,232 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Generator sends requests to a set of endpoints, round-robin.
+//
+// It's a prometheus.Collector, exporting the latency it saw in its own histogram,
+// so the load generator can be scraped next to the server.
+type Generator struct {
+	client   *http.Client
+	targets  []*url.URL
+	inFlight chan struct{}
+
+	duration *prometheus.HistogramVec
+	dropped  *prometheus.CounterVec
+
+	mtx     sync.Mutex
+	results map[string]*Result
+}
+
+// Result is what happened to the requests of one endpoint.
+type Result struct {
+	// Endpoint is the path of the target URL, the same as the endpoint label of ping_process.
+	Endpoint string
+	Sent     int
+	Errors   int
+	// Dropped requests were never sent because too many requests were already in flight.
+	Dropped int
+	// Codes counts the responses by status code, 0 for requests that got no response.
+	Codes map[int]int
+	// Latencies are in seconds, sorted once Run is done.
+	Latencies []float64
+}
+
+// Quantile is the exact φ-quantile of the latencies, not an estimation from buckets.
+func (r *Result) Quantile(q float64) float64 {
+	if len(r.Latencies) == 0 {
+		return math.NaN()
+	}
+
+	i := int(math.Ceil(q*float64(len(r.Latencies)))) - 1
+	return r.Latencies[max(0, min(i, len(r.Latencies)-1))]
+}
+
+// New creates a Generator for the targets. A request times out after timeout,
+// and at most maxInFlight requests are sent at the same time.
+func New(targets []string, timeout time.Duration, maxInFlight int) (*Generator, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no target")
+	}
+	if maxInFlight <= 0 {
+		return nil, fmt.Errorf("max in flight must be positive")
+	}
+
+	g := &Generator{
+		client: &http.Client{
+			Timeout: timeout,
+			// The default keeps 2 idle connections per host, so most requests would open a new one.
+			Transport: &http.Transport{MaxIdleConnsPerHost: maxInFlight},
+		},
+		inFlight: make(chan struct{}, maxInFlight),
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name: "loadgen_request_duration_seconds",
+				Help: "Latency seen by the load generator, from when the request was due to the end of the response.",
+				// Finer than the server buckets, from 1ms to 10s.
+				Buckets: prometheus.ExponentialBucketsRange(0.001, 10, 30),
+			},
+			[]string{"endpoint", "code"},
+		),
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "loadgen_dropped_requests_total",
+				Help: "Number of requests not sent because too many requests were in flight.",
+			},
+			[]string{"endpoint"},
+		),
+		results: make(map[string]*Result),
+	}
+
+	for _, target := range targets {
+		u, err := url.Parse(target)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid target %q", target)
+		}
+		g.targets = append(g.targets, u)
+
+		if _, ok := g.results[u.Path]; !ok {
+			g.results[u.Path] = &Result{Endpoint: u.Path, Codes: make(map[int]int)}
+		}
+	}
+
+	return g, nil
+}
+
+// Run sends a request at every offset from now, and waits for the responses.
+// Once ctx is done, no new request is sent but the ones in flight are still waited for.
+//
+// The latency is measured from when the request was due, not from when it was actually sent:
+// if the generator falls behind, the delay is part of what a user would have seen.
+func (g *Generator) Run(ctx context.Context, offsets iter.Seq[time.Duration]) {
+	var (
+		wg    sync.WaitGroup
+		start = time.Now()
+		timer = time.NewTimer(0)
+		i     int
+	)
+	defer timer.Stop()
+
+	for offset := range offsets {
+		// Behind schedule or in a burst, nothing waits on ctx below.
+		if ctx.Err() != nil {
+			break
+		}
+
+		target := g.targets[i%len(g.targets)]
+		i++
+		due := start.Add(offset)
+
+		if wait := time.Until(due); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-ctx.Done():
+			case <-timer.C:
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		select {
+		case g.inFlight <- struct{}{}:
+		default:
+			g.dropped.WithLabelValues(target.Path).Inc()
+			g.record(target.Path, func(r *Result) { r.Dropped++ })
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-g.inFlight }()
+
+			g.send(context.WithoutCancel(ctx), target, due)
+		}()
+	}
+
+	wg.Wait()
+	g.sortLatencies()
+}
+
+func (g *Generator) send(ctx context.Context, target *url.URL, due time.Time) {
+	code := 0
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = g.client.Do(req); err == nil {
+			// Read the whole body, the server isn't done until it's sent, and the connection can be reused.
+			_, err = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			code = resp.StatusCode
+		}
+	}
+
+	latency := time.Since(due).Seconds()
+	g.duration.WithLabelValues(target.Path, strconv.Itoa(code)).Observe(latency)
+
+	g.record(target.Path, func(r *Result) {
+		r.Sent++
+		r.Codes[code]++
+		if err != nil || code >= 400 {
+			r.Errors++
+		}
+		r.Latencies = append(r.Latencies, latency)
+	})
+}
+
+func (g *Generator) record(endpoint string, fn func(r *Result)) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	fn(g.results[endpoint])
+}
+
+func (g *Generator) sortLatencies() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	for _, r := range g.results {
+		sort.Float64s(r.Latencies)
+	}
+}
+
+// Results returns the result of every endpoint, sorted by endpoint.
+// Only call it once Run is done.
+func (g *Generator) Results() []*Result {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	results := make([]*Result, 0, len(g.results))
+	for _, r := range g.results {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Endpoint < results[j].Endpoint })
+
+	return results
+}
+
+func (g *Generator) Describe(ch chan<- *prometheus.Desc) {
+	g.duration.Describe(ch)
+	g.dropped.Describe(ch)
+}
+
+func (g *Generator) Collect(ch chan<- prometheus.Metric) {
+	g.duration.Collect(ch)
+	g.dropped.Collect(ch)
+}
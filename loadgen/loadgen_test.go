@@ -0,0 +1,138 @@
+package loadgen
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestOffsets(t *testing.T) {
+	stages, err := ParseStages("const:50:2s, ramp:0:100:2s, burst:10, pause:1s, ramp:100:0:2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Duration(stages); got != 7*time.Second {
+		t.Errorf("got duration %s, want 7s", got)
+	}
+
+	offsets := slices.Collect(Offsets(stages))
+
+	// 100 for the const, (0+100)/2*2 = 100 for each ramp, 10 for the burst.
+	if len(offsets) != 310 || Requests(stages) != 310 {
+		t.Fatalf("got %d requests, %d counted, want 310", len(offsets), Requests(stages))
+	}
+	for i := 1; i < len(offsets); i++ {
+		if offsets[i] < offsets[i-1] {
+			t.Fatalf("offset %d (%s) is before offset %d (%s)", i, offsets[i], i-1, offsets[i-1])
+		}
+	}
+
+	// The ramp up sends a quarter of its requests in the first half: the rate goes from 0 to 50 rps.
+	firstHalf := 0
+	for _, o := range offsets[100:200] {
+		if o < 3*time.Second {
+			firstHalf++
+		}
+	}
+	if firstHalf != 25 {
+		t.Errorf("got %d requests in the first half of the ramp, want 25", firstHalf)
+	}
+
+	// The burst is sent at once, right after the ramp.
+	for _, o := range offsets[200:210] {
+		if o != 4*time.Second {
+			t.Errorf("got burst offset %s, want 4s", o)
+		}
+	}
+	// Then nothing during the pause.
+	if offsets[210] != 5*time.Second {
+		t.Errorf("got first request after the pause at %s, want 5s", offsets[210])
+	}
+}
+
+func TestParseStagesErrors(t *testing.T) {
+	for _, spec := range []string{"", "const:50", "const:-1:1s", "ramp:1:2", "burst:0", "pause:0s", "wave:1:1s"} {
+		if _, err := ParseStages(spec); err == nil {
+			t.Errorf("%q: got no error", spec)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	gen, err := New([]string{srv.URL + "/slow", srv.URL + "/fail"}, 5*time.Second, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 slow requests fill the in flight slots, the others are dropped until they're released.
+	stages := []Stage{{Kind: KindBurst, Count: 6}, {Kind: KindPause, Duration: 50 * time.Millisecond}, {Kind: KindBurst, Count: 2}}
+	go func() {
+		time.Sleep(25 * time.Millisecond)
+		close(release)
+	}()
+	gen.Run(context.Background(), Offsets(stages))
+
+	results := gen.Results()
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	fail, slow := results[0], results[1]
+
+	if slow.Endpoint != "/slow" || slow.Sent+slow.Dropped != 4 || slow.Errors != 0 {
+		t.Errorf("got %+v for /slow", slow)
+	}
+	if fail.Endpoint != "/fail" || fail.Sent+fail.Dropped != 4 || fail.Errors != fail.Sent || fail.Codes[http.StatusServiceUnavailable] != fail.Sent {
+		t.Errorf("got %+v for /fail", fail)
+	}
+	if dropped := slow.Dropped + fail.Dropped; dropped < 3 {
+		t.Errorf("got %d dropped requests, want at least 3 (the burst of 6 with 2 slots)", dropped)
+	}
+	if slow.Quantile(1) < 0.02 {
+		t.Errorf("got max %fs for /slow, want at least the 25ms the first request was held", slow.Quantile(1))
+	}
+}
+
+// TestRunCanceled checks a generator behind schedule stops once ctx is done, not once every request is sent.
+func TestRunCanceled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	gen, err := New([]string{srv.URL + "/ping"}, 5*time.Second, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Way more than can be sent or dropped before the end of the test.
+	stages := []Stage{{Kind: KindBurst, Count: 1 << 40}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		gen.Run(ctx, Offsets(stages))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't stop once ctx was done")
+	}
+
+	if r := gen.Results()[0]; r.Sent+r.Dropped == 0 {
+		t.Errorf("got %+v, want some requests sent or dropped before ctx was done", r)
+	}
+}
@@ -0,0 +1,208 @@
+// Package loadgen sends requests on a schedule, open-loop: a request is sent when it's due,
+// whether the previous ones are done or not, like real users would. A closed-loop generator
+// (send, wait for the response, send the next one) slows down with the server and hides its latency.
+package loadgen
+
+import (
+	"fmt"
+	"iter"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind is what a Stage does.
+type Kind string
+
+const (
+	// KindConst sends From requests per second for Duration.
+	KindConst Kind = "const"
+	// KindRamp goes linearly from From to To requests per second over Duration.
+	KindRamp Kind = "ramp"
+	// KindBurst sends Count requests at once.
+	KindBurst Kind = "burst"
+	// KindPause sends nothing for Duration.
+	KindPause Kind = "pause"
+)
+
+// Stage is one part of the traffic shape, the stages run one after the other.
+type Stage struct {
+	Kind     Kind
+	From, To float64
+	Duration time.Duration
+	Count    int
+}
+
+func (s Stage) String() string {
+	switch s.Kind {
+	case KindConst:
+		return fmt.Sprintf("const:%g:%s", s.From, s.Duration)
+	case KindRamp:
+		return fmt.Sprintf("ramp:%g:%g:%s", s.From, s.To, s.Duration)
+	case KindBurst:
+		return fmt.Sprintf("burst:%d", s.Count)
+	case KindPause:
+		return fmt.Sprintf("pause:%s", s.Duration)
+	}
+
+	return string(s.Kind)
+}
+
+// ParseStages reads stages separated by commas:
+//
+//	const:<rps>:<duration>               const:50:30s
+//	ramp:<from rps>:<to rps>:<duration>  ramp:10:200:1m
+//	burst:<requests>                     burst:500
+//	pause:<duration>                     pause:10s
+func ParseStages(spec string) ([]Stage, error) {
+	var stages []Stage
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		fields := strings.Split(part, ":")
+		stage := Stage{Kind: Kind(fields[0])}
+
+		var (
+			args = fields[1:]
+			err  error
+		)
+		switch stage.Kind {
+		case KindConst:
+			if len(args) != 2 {
+				return nil, fmt.Errorf("%q: want const:<rps>:<duration>", part)
+			}
+			if stage.From, err = parseRate(args[0]); err == nil {
+				stage.Duration, err = parseDuration(args[1])
+			}
+		case KindRamp:
+			if len(args) != 3 {
+				return nil, fmt.Errorf("%q: want ramp:<from rps>:<to rps>:<duration>", part)
+			}
+			if stage.From, err = parseRate(args[0]); err == nil {
+				if stage.To, err = parseRate(args[1]); err == nil {
+					stage.Duration, err = parseDuration(args[2])
+				}
+			}
+		case KindBurst:
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%q: want burst:<requests>", part)
+			}
+			if stage.Count, err = strconv.Atoi(args[0]); err == nil && stage.Count <= 0 {
+				err = fmt.Errorf("the number of requests must be positive")
+			}
+		case KindPause:
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%q: want pause:<duration>", part)
+			}
+			stage.Duration, err = parseDuration(args[0])
+		default:
+			return nil, fmt.Errorf("%q: unknown stage %q, want const, ramp, burst or pause", part, stage.Kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", part, err)
+		}
+
+		stages = append(stages, stage)
+	}
+
+	if len(stages) == 0 {
+		return nil, fmt.Errorf("no stage")
+	}
+
+	return stages, nil
+}
+
+func parseRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+
+	return rate, nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+
+	return d, nil
+}
+
+// Duration is how long the stages take.
+func Duration(stages []Stage) time.Duration {
+	var total time.Duration
+	for _, s := range stages {
+		total += s.Duration
+	}
+
+	return total
+}
+
+// Offsets yields when each request is due, relative to the start of the first stage.
+// They're computed as they're needed: a long profile at a high rate is millions of requests.
+//
+// The requests are evenly spaced, in a ramp the k-th request is sent when the area under the rate line reaches k:
+//
+//	k = from*t + (to-from)/duration * t²/2
+func Offsets(stages []Stage) iter.Seq[time.Duration] {
+	return func(yield func(time.Duration) bool) {
+		var start time.Duration
+
+		for _, s := range stages {
+			switch s.Kind {
+			case KindBurst:
+				for i := 0; i < s.Count; i++ {
+					if !yield(start) {
+						return
+					}
+				}
+
+			case KindConst, KindRamp:
+				from, to := s.From, s.To
+				if s.Kind == KindConst {
+					to = from
+				}
+				seconds := s.Duration.Seconds()
+				a := (to - from) / seconds / 2
+				b := from
+
+				for k := 0.0; ; k++ {
+					var t float64
+					switch {
+					case a != 0:
+						t = (-b + math.Sqrt(b*b+4*a*k)) / (2 * a)
+					case b != 0:
+						t = k / b
+					default:
+						t = math.Inf(1)
+					}
+					if math.IsNaN(t) || t >= seconds {
+						break
+					}
+					if !yield(start + time.Duration(t*float64(time.Second))) {
+						return
+					}
+				}
+			}
+
+			start += s.Duration
+		}
+	}
+}
+
+// Requests is the number of requests the stages send, without keeping their offsets.
+func Requests(stages []Stage) int {
+	n := 0
+	for range Offsets(stages) {
+		n++
+	}
+
+	return n
+}
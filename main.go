@@ -3,66 +3,163 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log"
 	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"learn-prometheus/metriclint"
 )
 
 func main() {
-	pingCounter := prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "ping_request_count",
-			Help: "Number of request handled by Ping handler",
-		},
-	)
-
-	histogramVec := prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "ping_process",
-			Help:    "Histogram of the ping process",
-			Buckets: []float64{0.001, 0.005, 0.01, 0.02, 0.03, 0.05, 0.1, 0.2, 0.5, 1, 5},
-		},
-		[]string{"endpoint", "handler"},
-	)
-
-	prometheus.MustRegister(pingCounter)
-	prometheus.MustRegister(histogramVec)
-
-	http.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
-		pingCounter.Inc()
-
-		startHandlingTime := time.Now().UTC()
-
-		ping(w, r)
-
-		histogramVec.WithLabelValues("/ping", "normalPing").Observe(time.Since(startHandlingTime).Seconds())
+	lintFail := flag.Bool("lint.fail", false, "refuse to start if a metric breaks the naming rules, instead of only logging it")
+	faultsConfig := flag.String("faults.config", "", "fault injection config file, see faults.example.yml, reloaded on SIGHUP")
+	pingDeadline := flag.Duration("deadline.ping", time.Second, "time /ping has to answer before it gives up with a 504, 0 for no deadline")
+	pingPingDeadline := flag.Duration("deadline.pingPing", 2*time.Second, "time /pingPing has to answer before it gives up with a 504, 0 for no deadline")
+	adaptiveLimit := flag.Bool("concurrency.adaptive", true, "shed requests with a 503 past an adaptive concurrency limit, computed from the ping_process latency")
+	webConfig := flag.String("web.config.file", "", "web.yml with the TLS and auth config of every endpoint, see web.example.yml, reloaded on SIGHUP")
+	goCollector := flag.Bool("collector.go", true, "expose the go_* metrics: goroutines, GC, memstats")
+	goRuntimeMetrics := flag.Bool("collector.go.runtime-metrics", false, "also expose everything from runtime/metrics, e.g. the scheduler latencies, needs -collector.go")
+	processCollector := flag.Bool("collector.process", true, "expose the process_* metrics: CPU, memory, file descriptors")
+	buildInfo := flag.Bool("collector.build-info", true, "expose ping_build_info with the version and the commit")
+	shutdownTimeout := flag.Duration("shutdown.timeout", 10*time.Second, "how long to wait for the requests in flight on shutdown, before cancelling them")
+	flag.Parse()
+
+	lintMode := metriclint.Warn
+	if *lintFail {
+		lintMode = metriclint.Fail
+	}
+
+	s, err := newServer(serverOptions{
+		LintMode:         lintMode,
+		FaultsConfig:     *faultsConfig,
+		WebConfig:        *webConfig,
+		PingDeadline:     *pingDeadline,
+		PingPingDeadline: *pingPingDeadline,
+		AdaptiveLimit:    *adaptiveLimit,
+		GoCollector:      *goCollector,
+		GoRuntimeMetrics: *goRuntimeMetrics,
+		ProcessCollector: *processCollector,
+		BuildInfo:        *buildInfo,
 	})
+	if err != nil {
+		panic(err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			s.Reload()
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go s.stats.Run(ctx)
+
+	srv := &http.Server{Addr: ":8090"}
+
+	srvErr := make(chan error, 1)
+	go func() {
+		srvErr <- s.ListenAndServe(srv)
+	}()
+
+	select {
+	case err := <-srvErr:
+		// Error when the server starts.
+		log.Printf("failed to serve: %v\n", err)
+	case <-ctx.Done():
+		stop()
+		fmt.Println("Gracefully shutdown...")
+
+		// Shutdown stops accepting requests and waits for the ones in flight.
+		// Past the timeout, Close cancels their context: they stop waiting and are counted as canceled.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("requests still in flight after %s, cancelling them: %v\n", *shutdownTimeout, err)
+			srv.Close()
+		}
+	}
+}
 
-	http.HandleFunc("/pingPing", func(w http.ResponseWriter, r *http.Request) {
-		pingCounter.Inc()
+// Values of the status label of ping_process.
+const (
+	statusOK       = "ok"
+	statusError    = "error"
+	statusTimeout  = "timeout"
+	statusCanceled = "canceled"
+	statusShed     = "shed"
+)
 
-		startHandlingTime := time.Now().UTC()
+// requestStatus tells how the request ended. A handler that answered before the context was done
+// is ok (or error for a 5xx), even if the deadline expired right after.
+func requestStatus(ctx context.Context, sw *statusWriter) string {
+	if sw.code == 0 {
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			return statusTimeout
+		case errors.Is(ctx.Err(), context.Canceled):
+			return statusCanceled
+		}
+	}
+	if sw.code >= 500 {
+		return statusError
+	}
+
+	return statusOK
+}
 
-		ping(w, r)
-		time.Sleep(100 * time.Millisecond)
+// statusWriter remembers the status code of the response, 0 if nothing was written.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
 
-		histogramVec.WithLabelValues("/pingPing", "heavyPing").Observe(time.Since(startHandlingTime).Seconds())
-	})
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
 
-	http.Handle("/metrics", promhttp.Handler())
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
 
-	http.ListenAndServe(":8090", nil)
+// wait is time.Sleep that stops early when ctx is done, returning why.
+func wait(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func ping(w http.ResponseWriter, _ *http.Request) {
-	rand.New(rand.NewSource(time.Now().UnixNano()))
-	n := rand.Intn(100) // n will be between 0 and 1000
+func ping(w http.ResponseWriter, r *http.Request) {
+	n := rand.Intn(100) // n will be between 0 and 100
 	fmt.Printf("Sleeping %d milliseconds...\n", n)
-	time.Sleep(time.Duration(n) * time.Millisecond)
+	if err := wait(r.Context(), time.Duration(n)*time.Millisecond); err != nil {
+		// Nobody is waiting for the pong anymore.
+		fmt.Printf("Stopped: %v\n", err)
+		return
+	}
 	fmt.Println("Done")
 
 	fmt.Fprintf(w, "pong")
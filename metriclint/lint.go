@@ -0,0 +1,241 @@
+// Package metriclint checks metric names and labels against the naming rules from prometheus.txt:
+//   - counters end in _total, and nothing else does.
+//   - the unit is in the name, and it's a base unit: seconds, not milliseconds. Bytes, not kilobytes.
+//   - _count, _sum and _bucket belong to histograms and summaries, and so do the le and quantile labels.
+//   - names are snake_case.
+//
+// Every violation comes with a suggested name, e.g. ping_request_count should be ping_request_total.
+package metriclint
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Metric is what the linter looks at. Type is nil when it's not known,
+// then the rules depending on the type are skipped.
+type Metric struct {
+	Name       string
+	Help       string
+	Type       *dto.MetricType
+	LabelNames []string
+}
+
+// Violation is everything wrong with one metric.
+type Violation struct {
+	Metric   string   `json:"metric"`
+	Type     string   `json:"type"`
+	Problems []string `json:"problems"`
+	// Suggested is the name fixing every naming problem, empty if the name is fine.
+	Suggested string `json:"suggested,omitempty"`
+}
+
+func (v Violation) String() string {
+	s := fmt.Sprintf("%s (%s): %s", v.Metric, v.Type, strings.Join(v.Problems, "; "))
+	if v.Suggested != "" {
+		s += fmt.Sprintf(", suggested name: %s", v.Suggested)
+	}
+
+	return s
+}
+
+// baseUnits are the units a name should use, see https://prometheus.io/docs/practices/naming/#base-units.
+var baseUnits = map[string]bool{
+	"seconds": true, "bytes": true, "meters": true, "grams": true, "joules": true,
+	"volts": true, "amperes": true, "celsius": true, "ratio": true,
+}
+
+// nonBaseUnits maps the usual name parts that are units, but not base units, to their base unit.
+var nonBaseUnits = map[string]string{
+	"nanoseconds": "seconds", "ns": "seconds",
+	"microseconds": "seconds", "us": "seconds",
+	"milliseconds": "seconds", "millis": "seconds", "ms": "seconds",
+	"minutes": "seconds", "hours": "seconds", "days": "seconds",
+	"kilobytes": "bytes", "kb": "bytes",
+	"megabytes": "bytes", "mb": "bytes",
+	"gigabytes": "bytes", "gb": "bytes",
+	"millimeters": "meters", "centimeters": "meters", "kilometers": "meters",
+	"milligrams": "grams", "kilograms": "grams",
+	"percent": "ratio", "percentage": "ratio",
+}
+
+// reservedSuffixes are the suffixes of the series a histogram or a summary is exposed as.
+var reservedSuffixes = []string{"_count", "_sum", "_bucket"}
+
+// Lint checks one metric, ok is false if there's nothing wrong with it.
+func Lint(m Metric) (v Violation, ok bool) {
+	v = Violation{Metric: m.Name, Type: typeName(m.Type)}
+	name := m.Name
+
+	// -1 matches no case below.
+	metricType := dto.MetricType(-1)
+	if m.Type != nil {
+		metricType = *m.Type
+	}
+
+	if snake := snakeCase(name); snake != name {
+		v.Problems = append(v.Problems, "name is not snake_case")
+		name = snake
+	}
+
+	parts := strings.Split(name, "_")
+	for i, part := range parts {
+		if unit, ok := nonBaseUnits[part]; ok {
+			v.Problems = append(v.Problems, fmt.Sprintf("%s is not a base unit, use %s (and convert the values)", part, unit))
+			parts[i] = unit
+		}
+	}
+	name = strings.Join(parts, "_")
+
+	switch metricType {
+	case dto.MetricType_COUNTER:
+		if !strings.HasSuffix(name, "_total") {
+			v.Problems = append(v.Problems, "counter name doesn't end in _total")
+			name = trimSuffixes(name, append([]string{"_counter"}, reservedSuffixes...)) + "_total"
+		}
+
+	case dto.MetricType_GAUGE:
+		if strings.HasSuffix(name, "_total") {
+			v.Problems = append(v.Problems, "_total is for counters, a gauge can go down")
+			name = strings.TrimSuffix(name, "_total")
+		}
+		if trimmed := trimSuffixes(name, reservedSuffixes); trimmed != name {
+			v.Problems = append(v.Problems, fmt.Sprintf("%s is reserved for histograms and summaries", name[len(trimmed):]))
+			name = trimmed
+		}
+
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM, dto.MetricType_SUMMARY:
+		// ping_process_count would be exposed with ping_process_count_count, and so on.
+		if trimmed := trimSuffixes(name, append([]string{"_total"}, reservedSuffixes...)); trimmed != name {
+			v.Problems = append(v.Problems, fmt.Sprintf("%s is added to the exposed series, it's not part of the name", name[len(trimmed):]))
+			name = trimmed
+		}
+		if !hasBaseUnit(name) {
+			// Nearly every histogram measures how long something takes,
+			// for the few others the suggestion is still a reminder that a unit is missing.
+			v.Problems = append(v.Problems, "no unit in the name, e.g. _seconds for a duration or _bytes for a size")
+			if hasPart(name, "duration", "latency", "time") {
+				name += "_seconds"
+			} else {
+				name += "_duration_seconds"
+			}
+		}
+	}
+
+	if m.Help == "" {
+		v.Problems = append(v.Problems, "no help text")
+	}
+
+	for _, label := range m.LabelNames {
+		switch {
+		case label == "le" && metricType != dto.MetricType_HISTOGRAM && metricType != dto.MetricType_GAUGE_HISTOGRAM:
+			v.Problems = append(v.Problems, "label le is reserved for histogram buckets")
+		case label == "quantile" && metricType != dto.MetricType_SUMMARY:
+			v.Problems = append(v.Problems, "label quantile is reserved for summaries")
+		case strings.HasPrefix(label, "__"):
+			v.Problems = append(v.Problems, fmt.Sprintf("label %s starts with __, which is reserved for Prometheus", label))
+		case snakeCase(label) != label:
+			v.Problems = append(v.Problems, fmt.Sprintf("label %s is not snake_case, use %s", label, snakeCase(label)))
+		}
+	}
+
+	if len(v.Problems) == 0 {
+		return Violation{}, false
+	}
+	if name != m.Name {
+		v.Suggested = name
+	}
+
+	return v, true
+}
+
+// LintFamilies checks gathered or parsed metric families, sorted by name.
+func LintFamilies(families []*dto.MetricFamily) []Violation {
+	var violations []Violation
+
+	for _, mf := range families {
+		labels := make(map[string]bool)
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = true
+			}
+		}
+
+		m := Metric{Name: mf.GetName(), Help: mf.GetHelp(), Type: mf.Type}
+		for label := range labels {
+			m.LabelNames = append(m.LabelNames, label)
+		}
+		sort.Strings(m.LabelNames)
+
+		if v, ok := Lint(m); ok {
+			violations = append(violations, v)
+		}
+	}
+
+	sort.Slice(violations, func(i, j int) bool { return violations[i].Metric < violations[j].Metric })
+
+	return violations
+}
+
+func typeName(t *dto.MetricType) string {
+	if t == nil {
+		return "unknown"
+	}
+
+	return strings.ToLower(t.String())
+}
+
+// snakeCase turns camelCase into snake_case: playerID is player_id, HTTPRequests is http_requests.
+func snakeCase(s string) string {
+	runes := []rune(s)
+
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+
+	return b.String()
+}
+
+func trimSuffixes(name string, suffixes []string) string {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+
+	return name
+}
+
+func hasBaseUnit(name string) bool {
+	for _, part := range strings.Split(name, "_") {
+		if baseUnits[part] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasPart(name string, parts ...string) bool {
+	for _, part := range strings.Split(name, "_") {
+		for _, p := range parts {
+			if part == p {
+				return true
+			}
+		}
+	}
+
+	return false
+}
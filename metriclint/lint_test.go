@@ -0,0 +1,117 @@
+package metriclint
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"learn-prometheus/cardinality"
+)
+
+func TestLint(t *testing.T) {
+	testCases := []struct {
+		metric    Metric
+		ok        bool
+		suggested string
+	}{
+		{metric: Metric{Name: "ping_request_count", Help: "h", Type: dto.MetricType_COUNTER.Enum()}, ok: true, suggested: "ping_request_total"},
+		{metric: Metric{Name: "http_requests_total", Help: "h", Type: dto.MetricType_COUNTER.Enum()}},
+		{metric: Metric{Name: "ping_process", Help: "h", Type: dto.MetricType_HISTOGRAM.Enum()}, ok: true, suggested: "ping_process_duration_seconds"},
+		{metric: Metric{Name: "request_latency_ms", Help: "h", Type: dto.MetricType_HISTOGRAM.Enum()}, ok: true, suggested: "request_latency_seconds"},
+		{metric: Metric{Name: "http_request_duration_seconds", Help: "h", Type: dto.MetricType_HISTOGRAM.Enum(), LabelNames: []string{"method"}}},
+		{metric: Metric{Name: "queueSize_total", Help: "h", Type: dto.MetricType_GAUGE.Enum()}, ok: true, suggested: "queue_size"},
+		{metric: Metric{Name: "cache_hit_percent", Help: "h", Type: dto.MetricType_GAUGE.Enum()}, ok: true, suggested: "cache_hit_ratio"},
+		// Only the labels are wrong, there's no better name to suggest.
+		{metric: Metric{Name: "players_total", Help: "h", Type: dto.MetricType_COUNTER.Enum(), LabelNames: []string{"le", "playerID"}}, ok: true},
+		{metric: Metric{Name: "players", Type: dto.MetricType_GAUGE.Enum()}, ok: true},
+		// Unknown type, only the rules that don't depend on it apply.
+		{metric: Metric{Name: "ping_request_count", Help: "h"}},
+	}
+
+	for _, tc := range testCases {
+		v, ok := Lint(tc.metric)
+		if ok != tc.ok {
+			t.Errorf("%s: got violation %t, want %t (%v)", tc.metric.Name, ok, tc.ok, v.Problems)
+			continue
+		}
+		if v.Suggested != tc.suggested {
+			t.Errorf("%s: got suggestion %q, want %q", tc.metric.Name, v.Suggested, tc.suggested)
+		}
+	}
+}
+
+func TestRegisterer(t *testing.T) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "ping_request_count", Help: "Number of request handled by Ping handler"})
+	histogramVec := cardinality.NewLimiter().NewHistogramVec(
+		prometheus.HistogramOpts{Name: "ping_process", Help: "Histogram of the ping process"},
+		[]string{"endpoint", "handler"},
+		10,
+	)
+	good := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "queue_size", Help: "Number of jobs waiting.", ConstLabels: prometheus.Labels{"queue": "default"}}, []string{"priority"})
+
+	reg := prometheus.NewRegistry()
+	strict := NewRegisterer(reg, Fail)
+
+	if err := strict.Register(good); err != nil {
+		t.Fatalf("got error registering a good gauge: %v", err)
+	}
+
+	err := strict.Register(counter)
+	var lintErr *Error
+	if !errors.As(err, &lintErr) || len(lintErr.Violations) != 1 || lintErr.Violations[0].Suggested != "ping_request_total" {
+		t.Fatalf("got %v, want the ping_request_count violation", err)
+	}
+	if strict.Unregister(counter) {
+		t.Error("a refused collector must not be registered")
+	}
+
+	// The vec has no series yet, its type has to come from the wrapped HistogramVec.
+	lenient := NewRegisterer(reg, Warn)
+	lenient.MustRegister(counter, histogramVec)
+	if !lenient.Unregister(histogramVec) {
+		t.Error("Warn must register the collector anyway")
+	}
+
+	violations := lenient.Violations()
+	if len(violations) != 2 || violations[1].Type != "histogram" || violations[1].Suggested != "ping_process_duration_seconds" {
+		t.Errorf("got %v, want ping_request_count and ping_process", violations)
+	}
+	if lenient.Err() == nil {
+		t.Error("Err must report the violations of a Warn registerer")
+	}
+}
+
+func TestLintFamilies(t *testing.T) {
+	exposition := `# HELP ping_request_count Number of request handled by Ping handler
+# TYPE ping_request_count counter
+ping_request_count 12
+# HELP ping_process_seconds Histogram of the ping process
+# TYPE ping_process_seconds histogram
+ping_process_seconds_bucket{endpoint="/ping",le="0.1"} 3
+ping_process_seconds_bucket{endpoint="/ping",le="+Inf"} 4
+ping_process_seconds_sum{endpoint="/ping"} 0.3
+ping_process_seconds_count{endpoint="/ping"} 4
+# HELP temperature Temperature.
+# TYPE temperature gauge
+temperature{le="1"} 30
+`
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(exposition))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list []*dto.MetricFamily
+	for _, mf := range families {
+		list = append(list, mf)
+	}
+
+	violations := LintFamilies(list)
+	if len(violations) != 2 || violations[0].Metric != "ping_request_count" || violations[1].Metric != "temperature" {
+		t.Errorf("got %v, want ping_request_count and temperature", violations)
+	}
+}
@@ -0,0 +1,247 @@
+package metriclint
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Mode is what a Registerer does with a collector breaking the rules.
+type Mode int
+
+const (
+	// Warn logs the violations and registers the collector anyway.
+	Warn Mode = iota
+	// Fail refuses to register the collector, so MustRegister panics and the binary doesn't start.
+	Fail
+)
+
+// Error lists the violations of a collector, or of every collector for Registerer.Err.
+type Error struct {
+	Violations []Violation
+}
+
+func (e *Error) Error() string {
+	lines := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		lines = append(lines, v.String())
+	}
+
+	return fmt.Sprintf("%d metric(s) break the naming rules:\n%s", len(e.Violations), strings.Join(lines, "\n"))
+}
+
+// Registerer lints every collector before handing it to the wrapped prometheus.Registerer.
+type Registerer struct {
+	inner prometheus.Registerer
+	mode  Mode
+
+	mtx        sync.Mutex
+	violations []Violation
+}
+
+var _ prometheus.Registerer = (*Registerer)(nil)
+
+func NewRegisterer(inner prometheus.Registerer, mode Mode) *Registerer {
+	return &Registerer{inner: inner, mode: mode}
+}
+
+func (r *Registerer) Register(c prometheus.Collector) error {
+	violations := LintCollector(c)
+
+	if len(violations) > 0 {
+		r.mtx.Lock()
+		r.violations = append(r.violations, violations...)
+		r.mtx.Unlock()
+
+		if r.mode == Fail {
+			return &Error{Violations: violations}
+		}
+		for _, v := range violations {
+			log.Printf("metriclint: %s\n", v)
+		}
+	}
+
+	return r.inner.Register(c)
+}
+
+// MustRegister works like prometheus.Registerer.MustRegister, it panics on the first failure.
+func (r *Registerer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (r *Registerer) Unregister(c prometheus.Collector) bool {
+	return r.inner.Unregister(c)
+}
+
+// Violations returns the violations of every collector registered so far, refused ones included.
+func (r *Registerer) Violations() []Violation {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return append([]Violation(nil), r.violations...)
+}
+
+// Err returns an *Error with every violation seen so far, nil if there's none.
+// A test registering its metrics in Warn mode can fail on it.
+func (r *Registerer) Err() error {
+	if violations := r.Violations(); len(violations) > 0 {
+		return &Error{Violations: violations}
+	}
+
+	return nil
+}
+
+// LintGatherer checks everything the gatherer exposes.
+// Unlike a Registerer it sees every collector, but a vec with no observation yet isn't exposed so it's not checked.
+func LintGatherer(g prometheus.Gatherer) ([]Violation, error) {
+	families, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	return LintFamilies(families), nil
+}
+
+// LintCollector checks the metrics a collector describes.
+//
+// A prometheus.Desc doesn't say what type the metric is, so the collector is collected once:
+// the type is read from each metric it returns. A vec with no observation yet returns nothing,
+// its type comes from the vec itself. Collectors wrapping a vec, like the cardinality limiter ones,
+// can tell which vec they wrap with an Unwrap() prometheus.Collector method.
+func LintCollector(c prometheus.Collector) []Violation {
+	types := make(map[*prometheus.Desc]*dto.MetricType)
+	for _, m := range collect(c) {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			continue
+		}
+		if t := metricType(&pb); t != nil {
+			types[m.Desc()] = t
+		}
+	}
+	vecType := collectorType(c)
+
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(descs)
+		close(descs)
+	}()
+
+	var violations []Violation
+	for desc := range descs {
+		m, ok := parseDesc(desc)
+		if !ok {
+			continue
+		}
+
+		m.Type = vecType
+		if t, ok := types[desc]; ok {
+			m.Type = t
+		}
+
+		if v, ok := Lint(m); ok {
+			violations = append(violations, v)
+		}
+	}
+
+	return violations
+}
+
+func collect(c prometheus.Collector) []prometheus.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var metrics []prometheus.Metric
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+
+	return metrics
+}
+
+func metricType(m *dto.Metric) *dto.MetricType {
+	switch {
+	case m.Counter != nil:
+		return dto.MetricType_COUNTER.Enum()
+	case m.Gauge != nil:
+		return dto.MetricType_GAUGE.Enum()
+	case m.Histogram != nil:
+		return dto.MetricType_HISTOGRAM.Enum()
+	case m.Summary != nil:
+		return dto.MetricType_SUMMARY.Enum()
+	}
+
+	return nil
+}
+
+func collectorType(c prometheus.Collector) *dto.MetricType {
+	for {
+		u, ok := c.(interface{ Unwrap() prometheus.Collector })
+		if !ok {
+			break
+		}
+		c = u.Unwrap()
+	}
+
+	switch c.(type) {
+	case *prometheus.CounterVec:
+		return dto.MetricType_COUNTER.Enum()
+	case *prometheus.GaugeVec:
+		return dto.MetricType_GAUGE.Enum()
+	case *prometheus.HistogramVec:
+		return dto.MetricType_HISTOGRAM.Enum()
+	case *prometheus.SummaryVec:
+		return dto.MetricType_SUMMARY.Enum()
+	}
+
+	return nil
+}
+
+var (
+	descRe       = regexp.MustCompile(`^Desc\{fqName: ("(?:[^"\\]|\\.)*"), help: ("(?:[^"\\]|\\.)*"), constLabels: \{(.*)\}, variableLabels: \{(.*)\}\}$`)
+	constLabelRe = regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_]*)="(?:[^"\\]|\\.)*"`)
+)
+
+// parseDesc reads the name, help and labels of a Desc from its String(), the only way to get them out of it.
+func parseDesc(desc *prometheus.Desc) (Metric, bool) {
+	match := descRe.FindStringSubmatch(desc.String())
+	if match == nil {
+		return Metric{}, false
+	}
+
+	name, err := strconv.Unquote(match[1])
+	if err != nil {
+		return Metric{}, false
+	}
+	help, err := strconv.Unquote(match[2])
+	if err != nil {
+		return Metric{}, false
+	}
+
+	m := Metric{Name: name, Help: help}
+	for _, lp := range constLabelRe.FindAllStringSubmatch(match[3], -1) {
+		m.LabelNames = append(m.LabelNames, lp[1])
+	}
+	if match[4] != "" {
+		for _, label := range strings.Split(match[4], ",") {
+			// Labels with a constraint are shown as c(name).
+			label = strings.TrimSuffix(strings.TrimPrefix(label, "c("), ")")
+			m.LabelNames = append(m.LabelNames, label)
+		}
+	}
+
+	return m, true
+}
@@ -0,0 +1,286 @@
+package metricstore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A block is an immutable, time-bounded piece of the store on disk, compacted from the head:
+//
+//	blocks/<id>/
+//	├── meta.json   time range and a few numbers about the block.
+//	├── index.json  every series of the block with where its chunks are.
+//	└── chunks      the samples, split in chunks of at most maxChunkSamples.
+//
+// The index says which chunks of the file cover which time range,
+// so a query only reads the chunks it needs.
+const (
+	metaFilename   = "meta.json"
+	indexFilename  = "index.json"
+	chunksFilename = "chunks"
+
+	// Same as Prometheus, 120 samples is 2h of data at a 1m scrape interval.
+	maxChunkSamples = 120
+)
+
+// BlockMeta describes a block. MinTime is inclusive, MaxTime is exclusive.
+type BlockMeta struct {
+	ID      string `json:"id"`
+	MinTime int64  `json:"minTime"`
+	MaxTime int64  `json:"maxTime"`
+	// Resolution is the downsampling window in milliseconds, 0 for raw data.
+	Resolution int64 `json:"resolution"`
+
+	NumSeries  int `json:"numSeries"`
+	NumSamples int `json:"numSamples"`
+	NumChunks  int `json:"numChunks"`
+}
+
+type chunkMeta struct {
+	MinTime int64 `json:"minTime"`
+	MaxTime int64 `json:"maxTime"`
+	Offset  int64 `json:"offset"`
+	Length  int64 `json:"length"`
+}
+
+type indexEntry struct {
+	Labels Labels      `json:"labels"`
+	Chunks []chunkMeta `json:"chunks"`
+}
+
+type block struct {
+	dir   string
+	meta  BlockMeta
+	index []indexEntry
+	size  int64
+}
+
+func blockID(mint, maxt, res int64) string {
+	if res == 0 {
+		return fmt.Sprintf("%013d-%013d", mint, maxt)
+	}
+
+	return fmt.Sprintf("%013d-%013d-%s", mint, maxt, ResolutionName(res))
+}
+
+// ResolutionName is the short name of a resolution: raw, 5m, 1h.
+func ResolutionName(res int64) string {
+	switch res {
+	case 0:
+		return "raw"
+	case Res5m:
+		return "5m"
+	case Res1h:
+		return "1h"
+	}
+
+	return fmt.Sprintf("%dms", res)
+}
+
+// writeBlock writes the series as a new block under dir.
+// It's written to a temporary directory first and renamed at the end,
+// so a crash never leaves a half written block behind.
+func writeBlock(dir string, mint, maxt, res int64, series []Series) (*block, error) {
+	meta := BlockMeta{ID: blockID(mint, maxt, res), MinTime: mint, MaxTime: maxt, Resolution: res}
+
+	var (
+		chunks []byte
+		index  = make([]indexEntry, 0, len(series))
+	)
+	for _, s := range series {
+		if len(s.Samples) == 0 {
+			continue
+		}
+
+		entry := indexEntry{Labels: s.Labels}
+		for start := 0; start < len(s.Samples); start += maxChunkSamples {
+			end := min(start+maxChunkSamples, len(s.Samples))
+			samples := s.Samples[start:end]
+
+			offset := int64(len(chunks))
+			chunks = appendChunk(chunks, samples)
+			entry.Chunks = append(entry.Chunks, chunkMeta{
+				MinTime: samples[0].T,
+				MaxTime: samples[len(samples)-1].T,
+				Offset:  offset,
+				Length:  int64(len(chunks)) - offset,
+			})
+		}
+
+		index = append(index, entry)
+		meta.NumSeries++
+		meta.NumSamples += len(s.Samples)
+		meta.NumChunks += len(entry.Chunks)
+	}
+
+	final := filepath.Join(dir, meta.ID)
+	tmp := final + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create block dir: %w", err)
+	}
+
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	metaJSON, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	for name, content := range map[string][]byte{
+		chunksFilename: chunks,
+		indexFilename:  indexJSON,
+		metaFilename:   metaJSON,
+	} {
+		if err := writeFileSync(filepath.Join(tmp, name), content); err != nil {
+			return nil, fmt.Errorf("failed to write block %s: %w", name, err)
+		}
+	}
+
+	if err := os.Rename(tmp, final); err != nil {
+		return nil, fmt.Errorf("failed to rename block dir: %w", err)
+	}
+
+	return &block{dir: final, meta: meta, index: index, size: dirSize(final)}, nil
+}
+
+// openBlock loads the meta and the index of a block, the chunks stay on disk until queried.
+func openBlock(dir string) (*block, error) {
+	b := &block{dir: dir}
+
+	metaJSON, err := os.ReadFile(filepath.Join(dir, metaFilename))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(metaJSON, &b.meta); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", metaFilename, err)
+	}
+
+	indexJSON, err := os.ReadFile(filepath.Join(dir, indexFilename))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(indexJSON, &b.index); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", indexFilename, err)
+	}
+
+	b.size = dirSize(dir)
+
+	return b, nil
+}
+
+// selectSeries returns the samples between mint and maxt (inclusive) of the matching series.
+func (b *block) selectSeries(mint, maxt int64, matchers []*Matcher) ([]Series, error) {
+	if mint >= b.meta.MaxTime || maxt < b.meta.MinTime {
+		return nil, nil
+	}
+
+	var (
+		f      *os.File
+		result []Series
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	for _, entry := range b.index {
+		if !matchLabels(entry.Labels, matchers) {
+			continue
+		}
+
+		var samples []Sample
+		for _, c := range entry.Chunks {
+			if c.MaxTime < mint || c.MinTime > maxt {
+				continue
+			}
+
+			if f == nil {
+				var err error
+				if f, err = os.Open(filepath.Join(b.dir, chunksFilename)); err != nil {
+					return nil, fmt.Errorf("block %s: %w", b.meta.ID, err)
+				}
+			}
+
+			raw := make([]byte, c.Length)
+			if _, err := f.ReadAt(raw, c.Offset); err != nil {
+				return nil, fmt.Errorf("block %s: failed to read chunk: %w", b.meta.ID, err)
+			}
+			chunk, err := decodeChunk(raw)
+			if err != nil {
+				return nil, fmt.Errorf("block %s: %w", b.meta.ID, err)
+			}
+
+			from := sort.Search(len(chunk), func(i int) bool { return chunk[i].T >= mint })
+			to := sort.Search(len(chunk), func(i int) bool { return chunk[i].T > maxt })
+			samples = append(samples, chunk[from:to]...)
+		}
+
+		if len(samples) > 0 {
+			result = append(result, Series{Labels: entry.Labels.Copy(), Samples: samples})
+		}
+	}
+
+	return result, nil
+}
+
+// A chunk is:
+//
+//	<number of samples: uvarint> <first timestamp: varint> (<timestamp delta: uvarint> <value: 8 bytes>)... <CRC32: 4 bytes>
+//
+// The first sample's timestamp delta is 0.
+// Timestamps are scraped at a regular interval, so the deltas are small and take 1-2 bytes.
+func appendChunk(b []byte, samples []Sample) []byte {
+	start := len(b)
+
+	b = binary.AppendUvarint(b, uint64(len(samples)))
+	b = binary.AppendVarint(b, samples[0].T)
+
+	prev := samples[0].T
+	for _, s := range samples {
+		b = binary.AppendUvarint(b, uint64(s.T-prev))
+		b = binary.BigEndian.AppendUint64(b, math.Float64bits(s.V))
+		prev = s.T
+	}
+
+	return binary.BigEndian.AppendUint32(b, crc32.Checksum(b[start:], castagnoli))
+}
+
+func decodeChunk(b []byte) ([]Sample, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("%w: chunk too short", errCorruptRecord)
+	}
+	data, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.Checksum(data, castagnoli) != sum {
+		return nil, fmt.Errorf("%w: chunk checksum mismatch", errCorruptRecord)
+	}
+
+	d := decoder{b: data}
+	n := d.uvarint()
+	t := d.varint()
+	if d.err != nil || n > uint64(len(data)) {
+		return nil, fmt.Errorf("%w: bad chunk header", errCorruptRecord)
+	}
+
+	samples := make([]Sample, 0, n)
+	for i := uint64(0); i < n; i++ {
+		t += int64(d.uvarint())
+		samples = append(samples, Sample{T: t, V: d.float64()})
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("%w: bad chunk", errCorruptRecord)
+	}
+
+	return samples, nil
+}
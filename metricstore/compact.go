@@ -0,0 +1,249 @@
+package metricstore
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Run compacts the head and applies the retention every minute until ctx is done.
+func (s *Store) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Compact(); err != nil {
+				log.Printf("metricstore: compaction failed: %v\n", err)
+			}
+		}
+	}
+}
+
+// Compact cuts the old part of the head into blocks, checkpoints the WAL,
+// downsamples the new blocks, then applies the retention.
+//
+// Like Prometheus, a block is only cut once the head spans 1.5 block durations,
+// so the most recent half block always stays in memory, that's the data being queried the most.
+// Does nothing for an in-memory store.
+func (s *Store) Compact() error {
+	if s.wal == nil {
+		return nil
+	}
+
+	s.compactMtx.Lock()
+	defer s.compactMtx.Unlock()
+
+	blockDuration := s.opts.BlockDuration.Milliseconds()
+
+	compacted := false
+	for {
+		mint, maxt, ok := s.headTimeRange()
+		if !ok || maxt-mint < blockDuration*3/2 {
+			break
+		}
+
+		// Blocks are aligned on the block duration, e.g. 00:00-02:00, 02:00-04:00, ...
+		start := mint - mod(mint, blockDuration)
+		if err := s.compactHead(start, start+blockDuration); err != nil {
+			return err
+		}
+		compacted = true
+	}
+
+	if compacted {
+		if err := s.wal.checkpoint(s.headSnapshot); err != nil {
+			return fmt.Errorf("failed to checkpoint WAL: %w", err)
+		}
+	}
+
+	if err := s.downsampleBlocks(); err != nil {
+		return err
+	}
+
+	return s.applyRetention()
+}
+
+// mod is % that is never negative.
+func mod(a, b int64) int64 {
+	return ((a % b) + b) % b
+}
+
+// headTimeRange returns the oldest and the newest timestamp in the head.
+func (s *Store) headTimeRange() (mint, maxt int64, ok bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	for _, series := range s.series {
+		series.mtx.Lock()
+		if n := len(series.samples); n > 0 {
+			if !ok || series.samples[0].T < mint {
+				mint = series.samples[0].T
+			}
+			if !ok || series.samples[n-1].T > maxt {
+				maxt = series.samples[n-1].T
+			}
+			ok = true
+		}
+		series.mtx.Unlock()
+	}
+
+	return mint, maxt, ok
+}
+
+// compactHead writes the head samples in [start, end) to a new block, then drops them from the head.
+func (s *Store) compactHead(start, end int64) error {
+	// From now on, nothing older than end can be appended.
+	// An append already past that check holds the series lock, so it's done before we collect the series below.
+	if end > s.minValidTime.Load() {
+		s.minValidTime.Store(end)
+	}
+
+	s.mtx.RLock()
+	all := make([]*memSeries, 0, len(s.series))
+	for _, series := range s.series {
+		all = append(all, series)
+	}
+	s.mtx.RUnlock()
+
+	var series []Series
+	for _, ms := range all {
+		samples := ms.rangeSamples(start, end-1)
+		if len(samples) > 0 {
+			series = append(series, Series{Labels: ms.lset.Copy(), Samples: samples})
+		}
+	}
+
+	if len(series) > 0 {
+		b, err := writeBlock(s.blocksDir(), start, end, 0, series)
+		if err != nil {
+			return err
+		}
+
+		s.blocksMtx.Lock()
+		s.blocks = append(s.blocks, b)
+		sortBlocks(s.blocks)
+		s.blocksMtx.Unlock()
+
+		log.Printf("metricstore: compacted block %s with %d series and %d samples\n", b.meta.ID, b.meta.NumSeries, b.meta.NumSamples)
+	}
+
+	// The block is safely on disk, drop the samples from the head.
+	var empty []*memSeries
+	for _, ms := range all {
+		ms.mtx.Lock()
+		i := 0
+		for i < len(ms.samples) && ms.samples[i].T < end {
+			i++
+		}
+		ms.samples = append([]Sample(nil), ms.samples[i:]...)
+		if len(ms.samples) == 0 {
+			empty = append(empty, ms)
+		}
+		ms.mtx.Unlock()
+	}
+
+	// Series without any sample left are removed from the head, they come back if they get a new sample.
+	s.mtx.Lock()
+	for _, ms := range empty {
+		ms.mtx.Lock()
+		if len(ms.samples) == 0 {
+			ms.deleted = true
+			delete(s.series, ms.lset.key())
+		}
+		ms.mtx.Unlock()
+	}
+	s.mtx.Unlock()
+
+	return nil
+}
+
+// headSnapshot encodes what the head holds as WAL records, for the checkpoint.
+func (s *Store) headSnapshot() []byte {
+	s.mtx.RLock()
+	all := make([]*memSeries, 0, len(s.series))
+	for _, series := range s.series {
+		all = append(all, series)
+	}
+	s.mtx.RUnlock()
+
+	var b []byte
+	for _, ms := range all {
+		ms.mtx.Lock()
+		b = appendRecord(b, recordSeries, encodeSeries(ms.ref, ms.lset))
+
+		samples := make([]refSample, 0, len(ms.samples))
+		for _, sample := range ms.samples {
+			samples = append(samples, refSample{ref: ms.ref, t: sample.T, v: sample.V})
+		}
+		if len(samples) > 0 {
+			b = appendRecord(b, recordSamples, encodeSamples(samples))
+		}
+		ms.mtx.Unlock()
+	}
+
+	return b
+}
+
+// applyRetention deletes the blocks that are too old for their resolution,
+// then the oldest blocks until the size fits.
+//
+// "Too old" is relative to the newest sample in the store and not to the wall clock,
+// so data loaded from last week isn't thrown away right after a restart.
+func (s *Store) applyRetention() error {
+	s.blocksMtx.Lock()
+	defer s.blocksMtx.Unlock()
+
+	if len(s.blocks) == 0 {
+		return nil
+	}
+
+	newest := s.minValidTime.Load()
+	if _, maxt, ok := s.headTimeRange(); ok && maxt > newest {
+		newest = maxt
+	}
+
+	var size int64
+	for _, b := range s.blocks {
+		size += b.size
+	}
+	size += s.wal.size()
+
+	kept := s.blocks[:0]
+	for _, b := range s.blocks {
+		retention := s.retention(b.meta.Resolution)
+		tooOld := retention > 0 && b.meta.MaxTime <= newest-retention.Milliseconds()
+		// The blocks are sorted oldest first, so the size limit eats the oldest ones.
+		tooBig := s.opts.RetentionSize > 0 && size > s.opts.RetentionSize
+		if !tooOld && !tooBig {
+			kept = append(kept, b)
+			continue
+		}
+
+		if err := os.RemoveAll(b.dir); err != nil {
+			return fmt.Errorf("failed to delete block %s: %w", b.meta.ID, err)
+		}
+		log.Printf("metricstore: deleted block %s (too old: %t, over size: %t)\n", b.meta.ID, tooOld, tooBig)
+
+		size -= b.size
+	}
+	s.blocks = kept
+
+	return nil
+}
+
+func (s *Store) retention(res int64) time.Duration {
+	switch res {
+	case Res5m:
+		return s.opts.Retention5m
+	case Res1h:
+		return s.opts.Retention1h
+	}
+
+	return s.opts.RetentionDuration
+}
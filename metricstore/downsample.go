@@ -0,0 +1,246 @@
+package metricstore
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// Downsampling, the Thanos way: a raw block is rewritten with one point per 5m window (then per 1h window),
+// and each point keeps enough aggregates to answer the usual queries:
+//   - count, sum, min, max: for gauges, avg_over_time = sum / count, and so on.
+//   - counter, first, last: for counters. counter is how much the counter increased inside the window,
+//     resets included. first and last are the raw values at the edges of the window,
+//     so the increase between 2 windows (even from 2 different blocks) can be computed too.
+//
+// Histogram _bucket series are counters, so their downsampled increases still feed histogram_quantile.
+//
+// A downsampled block stores each aggregate as its own series with an extra __aggr__ label.
+const (
+	Res5m = int64(5 * time.Minute / time.Millisecond)
+	Res1h = int64(time.Hour / time.Millisecond)
+
+	aggrLabel = "__aggr__"
+)
+
+var aggrNames = []string{"count", "sum", "min", "max", "counter", "first", "last"}
+
+// aggrSample is one point of a downsampled series.
+// T is the timestamp of the last raw sample of the window, so the point always falls inside its window.
+type aggrSample struct {
+	T       int64
+	Count   float64
+	Sum     float64
+	Min     float64
+	Max     float64
+	Counter float64
+	First   float64
+	Last    float64
+}
+
+func (a aggrSample) values() []float64 {
+	return []float64{a.Count, a.Sum, a.Min, a.Max, a.Counter, a.First, a.Last}
+}
+
+// aggrSeries is a series as seen by the query layer, raw or downsampled.
+type aggrSeries struct {
+	Labels Labels
+	Points []aggrSample
+}
+
+// rawToAggr turns raw samples into points of their own "window".
+func rawToAggr(samples []Sample) []aggrSample {
+	points := make([]aggrSample, 0, len(samples))
+	for _, s := range samples {
+		points = append(points, aggrSample{T: s.T, Count: 1, Sum: s.V, Min: s.V, Max: s.V, First: s.V, Last: s.V})
+	}
+
+	return points
+}
+
+// counterJump is how much a counter went up from prev to cur.
+// If it went down, the counter was reset (the process restarted), it went up by cur from 0.
+func counterJump(prev, cur float64) float64 {
+	if cur < prev {
+		return cur
+	}
+
+	return cur - prev
+}
+
+// windowEnd is the end of the downsampling window holding t.
+// Windows are (end-res, end], the same way a query looks at (t-step, t],
+// so a query step that is a multiple of the resolution sees whole windows only.
+func windowEnd(t, res int64) int64 {
+	return t + mod(-t, res)
+}
+
+// downsample merges the points into windows of res milliseconds.
+func downsample(points []aggrSample, res int64) []aggrSample {
+	var result []aggrSample
+
+	for i, p := range points {
+		if i > 0 && windowEnd(p.T, res) == windowEnd(points[i-1].T, res) {
+			w := &result[len(result)-1]
+			w.T = p.T
+			w.Count += p.Count
+			w.Sum += p.Sum
+			w.Min = math.Min(w.Min, p.Min)
+			w.Max = math.Max(w.Max, p.Max)
+			w.Counter += counterJump(w.Last, p.First) + p.Counter
+			w.Last = p.Last
+			continue
+		}
+
+		result = append(result, p)
+	}
+
+	return result
+}
+
+// aggrToSeries splits the points into one series per aggregate, the way they are stored in a block.
+func aggrToSeries(lset Labels, points []aggrSample) []Series {
+	series := make([]Series, len(aggrNames))
+	for i, name := range aggrNames {
+		series[i].Labels = append(lset.Copy(), Label{Name: aggrLabel, Value: name})
+		sort.Sort(series[i].Labels)
+		series[i].Samples = make([]Sample, 0, len(points))
+	}
+
+	for _, p := range points {
+		for i, v := range p.values() {
+			series[i].Samples = append(series[i].Samples, Sample{T: p.T, V: v})
+		}
+	}
+
+	return series
+}
+
+// seriesToAggr puts back together the aggregate series read from a downsampled block.
+func seriesToAggr(series []Series) []aggrSeries {
+	grouped := make(map[string]*aggrSeries)
+	var order []string
+
+	for _, s := range series {
+		aggr := s.Labels.Get(aggrLabel)
+		lset := make(Labels, 0, len(s.Labels)-1)
+		for _, l := range s.Labels {
+			if l.Name != aggrLabel {
+				lset = append(lset, l)
+			}
+		}
+
+		key := lset.key()
+		as, ok := grouped[key]
+		if !ok {
+			as = &aggrSeries{Labels: lset, Points: make([]aggrSample, len(s.Samples))}
+			grouped[key] = as
+			order = append(order, key)
+		}
+
+		for i, sample := range s.Samples {
+			if i >= len(as.Points) {
+				break
+			}
+			p := &as.Points[i]
+			p.T = sample.T
+			switch aggr {
+			case "count":
+				p.Count = sample.V
+			case "sum":
+				p.Sum = sample.V
+			case "min":
+				p.Min = sample.V
+			case "max":
+				p.Max = sample.V
+			case "counter":
+				p.Counter = sample.V
+			case "first":
+				p.First = sample.V
+			case "last":
+				p.Last = sample.V
+			}
+		}
+	}
+
+	result := make([]aggrSeries, 0, len(order))
+	for _, key := range order {
+		result = append(result, *grouped[key])
+	}
+
+	return result
+}
+
+// selectAggr reads the block as aggregated series, raw blocks are converted on the fly.
+func (b *block) selectAggr(mint, maxt int64, matchers []*Matcher) ([]aggrSeries, error) {
+	series, err := b.selectSeries(mint, maxt, matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.meta.Resolution > 0 {
+		return seriesToAggr(series), nil
+	}
+
+	result := make([]aggrSeries, 0, len(series))
+	for _, s := range series {
+		result = append(result, aggrSeries{Labels: s.Labels, Points: rawToAggr(s.Samples)})
+	}
+
+	return result, nil
+}
+
+// downsampleBlocks writes the 5m version of every raw block, and the 1h version of every 5m block,
+// unless it already exists.
+func (s *Store) downsampleBlocks() error {
+	for _, step := range []struct{ from, to int64 }{{0, Res5m}, {Res5m, Res1h}} {
+		s.blocksMtx.RLock()
+		existing := make(map[string]bool, len(s.blocks))
+		for _, b := range s.blocks {
+			existing[blockID(b.meta.MinTime, b.meta.MaxTime, b.meta.Resolution)] = true
+		}
+		var todo []*block
+		for _, b := range s.blocks {
+			if b.meta.Resolution == step.from && !existing[blockID(b.meta.MinTime, b.meta.MaxTime, step.to)] {
+				todo = append(todo, b)
+			}
+		}
+		s.blocksMtx.RUnlock()
+
+		for _, src := range todo {
+			if err := s.downsampleBlock(src, step.to); err != nil {
+				return fmt.Errorf("failed to downsample block %s: %w", src.meta.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) downsampleBlock(src *block, res int64) error {
+	all, err := src.selectAggr(src.meta.MinTime, src.meta.MaxTime-1, nil)
+	if err != nil {
+		return err
+	}
+
+	var series []Series
+	for _, as := range all {
+		series = append(series, aggrToSeries(as.Labels, downsample(as.Points, res))...)
+	}
+
+	b, err := writeBlock(s.blocksDir(), src.meta.MinTime, src.meta.MaxTime, res, series)
+	if err != nil {
+		return err
+	}
+
+	s.blocksMtx.Lock()
+	s.blocks = append(s.blocks, b)
+	sortBlocks(s.blocks)
+	s.blocksMtx.Unlock()
+
+	log.Printf("metricstore: downsampled block %s into %s\n", src.meta.ID, b.meta.ID)
+
+	return nil
+}
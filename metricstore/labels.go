@@ -0,0 +1,144 @@
+package metricstore
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetricName is the reserved label holding the metric name,
+// same as Prometheus: http_requests_total{...} is really {__name__="http_requests_total", ...}.
+const MetricName = "__name__"
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// Label is a single name/value pair of a series.
+type Label struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Labels is the identity of a series. It's always kept sorted by name,
+// so two label sets with the same pairs produce the same key.
+type Labels []Label
+
+func (ls Labels) Len() int           { return len(ls) }
+func (ls Labels) Swap(i, j int)      { ls[i], ls[j] = ls[j], ls[i] }
+func (ls Labels) Less(i, j int) bool { return ls[i].Name < ls[j].Name }
+
+// FromMap builds a sorted label set from a map.
+func FromMap(m map[string]string) Labels {
+	ls := make(Labels, 0, len(m))
+	for name, value := range m {
+		ls = append(ls, Label{Name: name, Value: value})
+	}
+	sort.Sort(ls)
+
+	return ls
+}
+
+// Get returns the value of the label with the given name, or "" if it's not there.
+func (ls Labels) Get(name string) string {
+	for _, l := range ls {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+
+	return ""
+}
+
+// Map returns the label set as a map, handy for JSON output.
+func (ls Labels) Map() map[string]string {
+	m := make(map[string]string, len(ls))
+	for _, l := range ls {
+		m[l.Name] = l.Value
+	}
+
+	return m
+}
+
+// Copy returns a deep copy, so callers can't mutate a stored series by accident.
+func (ls Labels) Copy() Labels {
+	return append(Labels(nil), ls...)
+}
+
+// String renders the label set the way Prometheus prints it:
+// metric_name{a="1", b="2"}.
+func (ls Labels) String() string {
+	var b strings.Builder
+
+	b.WriteString(ls.Get(MetricName))
+	b.WriteByte('{')
+
+	first := true
+	for _, l := range ls {
+		if l.Name == MetricName {
+			continue
+		}
+		if !first {
+			b.WriteString(", ")
+		}
+		first = false
+
+		b.WriteString(l.Name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l.Value))
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+// Validate checks the label set the same way the Prometheus remote_write receiver does:
+//   - There must be a valid metric name.
+//   - Label names must be valid and must not repeat.
+//   - Label values must not be empty, an empty value means "no label" in Prometheus.
+//
+// The label set must be sorted.
+func (ls Labels) Validate() error {
+	if len(ls) == 0 {
+		return fmt.Errorf("%w: empty label set", ErrInvalidLabels)
+	}
+
+	name := ls.Get(MetricName)
+	if name == "" {
+		return fmt.Errorf("%w: missing metric name in %s", ErrInvalidLabels, ls)
+	}
+	if !metricNameRE.MatchString(name) {
+		return fmt.Errorf("%w: invalid metric name %q", ErrInvalidLabels, name)
+	}
+
+	for i, l := range ls {
+		if i > 0 && ls[i-1].Name == l.Name {
+			return fmt.Errorf("%w: duplicate label name %q in %s", ErrInvalidLabels, l.Name, ls)
+		}
+		if l.Name != MetricName && !labelNameRE.MatchString(l.Name) {
+			return fmt.Errorf("%w: invalid label name %q in %s", ErrInvalidLabels, l.Name, ls)
+		}
+		if l.Value == "" {
+			return fmt.Errorf("%w: empty value for label %q in %s", ErrInvalidLabels, l.Name, ls)
+		}
+	}
+
+	return nil
+}
+
+// key is the identity of the label set inside the store.
+// The label set is sorted so the same pairs always give the same key.
+func (ls Labels) key() string {
+	var b strings.Builder
+	for _, l := range ls {
+		b.WriteString(l.Name)
+		b.WriteByte(0xff)
+		b.WriteString(l.Value)
+		b.WriteByte(0xff)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,186 @@
+package metricstore
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MatchType is one of the 4 label matching operators from PromQL: =, !=, =~, !~.
+type MatchType int
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+func (t MatchType) String() string {
+	switch t {
+	case MatchEqual:
+		return "="
+	case MatchNotEqual:
+		return "!="
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	}
+
+	return fmt.Sprintf("MatchType(%d)", int(t))
+}
+
+// Matcher filters series by one of their labels.
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// NewMatcher builds a matcher. Regexps are anchored on both ends, same as PromQL,
+// so {job=~".*server"} means "ends with server" and not "contains server".
+func NewMatcher(t MatchType, name, value string) (*Matcher, error) {
+	m := &Matcher{Type: t, Name: name, Value: value}
+
+	if t == MatchRegexp || t == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp %q for label %q: %w", value, name, err)
+		}
+		m.re = re
+	}
+
+	return m, nil
+}
+
+// MustNewMatcher is NewMatcher that panics, for matchers written in code.
+func MustNewMatcher(t MatchType, name, value string) *Matcher {
+	m, err := NewMatcher(t, name, value)
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+// Matches checks a label value. A missing label has the value "".
+func (m *Matcher) Matches(v string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+
+	return false
+}
+
+func (m *Matcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Name, m.Type, m.Value)
+}
+
+func matchLabels(lset Labels, matchers []*Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(lset.Get(m.Name)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ParseSelector parses the subset of PromQL we need for looking things up:
+//
+//	ping_process_bucket
+//	ping_process_bucket{endpoint="/ping", le!="+Inf"}
+//	{__name__=~"ping_.*", handler!~"heavy.*"}
+func ParseSelector(s string) ([]*Matcher, error) {
+	s = strings.TrimSpace(s)
+
+	var matchers []*Matcher
+
+	name := s
+	if i := strings.IndexByte(s, '{'); i >= 0 {
+		name = strings.TrimSpace(s[:i])
+		if !strings.HasSuffix(s, "}") {
+			return nil, fmt.Errorf("selector %q: missing closing brace", s)
+		}
+
+		ms, err := parseMatchers(s[i+1 : len(s)-1])
+		if err != nil {
+			return nil, fmt.Errorf("selector %q: %w", s, err)
+		}
+		matchers = ms
+	}
+
+	if name != "" {
+		if !metricNameRE.MatchString(name) {
+			return nil, fmt.Errorf("selector %q: invalid metric name %q", s, name)
+		}
+		matchers = append(matchers, MustNewMatcher(MatchEqual, MetricName, name))
+	}
+
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("selector %q: need a metric name or at least one matcher", s)
+	}
+
+	return matchers, nil
+}
+
+// parseMatchers parses the inside of the braces: a="1", b=~"2.*".
+func parseMatchers(s string) ([]*Matcher, error) {
+	var matchers []*Matcher
+
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if s == "" {
+			return matchers, nil
+		}
+
+		i := strings.IndexAny(s, "=!")
+		if i <= 0 {
+			return nil, fmt.Errorf("expected label matcher at %q", s)
+		}
+		name := strings.TrimSpace(s[:i])
+		s = s[i:]
+
+		var t MatchType
+		switch {
+		case strings.HasPrefix(s, "=~"):
+			t, s = MatchRegexp, s[2:]
+		case strings.HasPrefix(s, "!~"):
+			t, s = MatchNotRegexp, s[2:]
+		case strings.HasPrefix(s, "!="):
+			t, s = MatchNotEqual, s[2:]
+		case strings.HasPrefix(s, "="):
+			t, s = MatchEqual, s[1:]
+		default:
+			return nil, fmt.Errorf("unknown operator at %q", s)
+		}
+
+		s = strings.TrimSpace(s)
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("expected quoted value for label %q at %q", name, s)
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for label %q: %w", name, err)
+		}
+		s = s[len(quoted):]
+
+		m, err := NewMatcher(t, name, value)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+}
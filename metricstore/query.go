@@ -0,0 +1,311 @@
+package metricstore
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"learn-prometheus/quantile"
+)
+
+// Function is what QueryRange computes for each step, named after the PromQL function doing the same.
+// Every function looks at the window (t-step, t] for each step t.
+type Function string
+
+const (
+	// FuncIncrease is how much a counter went up in the window, resets included.
+	// Unlike PromQL, it's not extrapolated: it's the sum of the increases between consecutive samples,
+	// counting from the last sample before the window. So the increases of consecutive windows add up
+	// exactly to the total increase, at any resolution.
+	FuncIncrease Function = "increase"
+	// FuncRate is FuncIncrease per second.
+	FuncRate          Function = "rate"
+	FuncAvgOverTime   Function = "avg_over_time"
+	FuncMinOverTime   Function = "min_over_time"
+	FuncMaxOverTime   Function = "max_over_time"
+	FuncSumOverTime   Function = "sum_over_time"
+	FuncCountOverTime Function = "count_over_time"
+	FuncLastOverTime  Function = "last_over_time"
+)
+
+// ParseFunction checks the name of a function.
+func ParseFunction(name string) (Function, error) {
+	switch fn := Function(name); fn {
+	case FuncIncrease, FuncRate, FuncAvgOverTime, FuncMinOverTime, FuncMaxOverTime,
+		FuncSumOverTime, FuncCountOverTime, FuncLastOverTime:
+		return fn, nil
+	}
+
+	return "", fmt.Errorf("unknown function %q", name)
+}
+
+// QueryResult holds the evaluated series, and which resolution was used to compute them.
+type QueryResult struct {
+	Resolution string   `json:"resolution"`
+	Series     []Series `json:"series"`
+}
+
+// PickResolution returns the coarsest resolution that still has at least 5 points per step,
+// same rule as Thanos' auto downsampling. A week-long graph with a 1h step reads the 5m data,
+// a 1 day graph with a 1m step reads the raw data.
+func PickResolution(step time.Duration) int64 {
+	for _, res := range []int64{Res1h, Res5m} {
+		if res <= step.Milliseconds()/5 {
+			return res
+		}
+	}
+
+	return 0
+}
+
+// QueryRange evaluates fn for every step between mint and maxt (milliseconds, inclusive)
+// on the series matching the matchers. The result drops the metric name, like PromQL.
+func (s *Store) QueryRange(fn Function, mint, maxt int64, step time.Duration, matchers ...*Matcher) (*QueryResult, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	if maxt < mint {
+		return nil, fmt.Errorf("end is before start")
+	}
+	if (maxt-mint)/step.Milliseconds() > 11_000 {
+		// Same limit as Prometheus, nobody needs that many points on a graph.
+		return nil, fmt.Errorf("too many steps, use a bigger step")
+	}
+
+	res := PickResolution(step)
+
+	// The first window starts at mint-step, and an increase needs the point before that as well.
+	series, err := s.selectAggr(res, mint-2*step.Milliseconds(), maxt, matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &QueryResult{Resolution: ResolutionName(res), Series: []Series{}}
+	for _, as := range series {
+		samples := evalPoints(fn, as.Points, mint, maxt, step.Milliseconds())
+		if len(samples) == 0 {
+			continue
+		}
+
+		lset := make(Labels, 0, len(as.Labels))
+		for _, l := range as.Labels {
+			if l.Name != MetricName {
+				lset = append(lset, l)
+			}
+		}
+		result.Series = append(result.Series, Series{Labels: lset, Samples: samples})
+	}
+
+	return result, nil
+}
+
+// HistogramQuantile is histogram_quantile(q, increase(<_bucket series>[step])) for every step,
+// grouped by every label except le.
+func (s *Store) HistogramQuantile(q float64, mint, maxt int64, step time.Duration, matchers ...*Matcher) (*QueryResult, error) {
+	increases, err := s.QueryRange(FuncIncrease, mint, maxt, step, matchers...)
+	if err != nil {
+		return nil, err
+	}
+
+	type group struct {
+		lset    Labels
+		buckets map[int64]quantile.Buckets
+	}
+	groups := make(map[string]*group)
+
+	for _, series := range increases.Series {
+		upperBound, err := parseLe(series.Labels.Get("le"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", series.Labels, err)
+		}
+
+		lset := make(Labels, 0, len(series.Labels))
+		for _, l := range series.Labels {
+			if l.Name != "le" {
+				lset = append(lset, l)
+			}
+		}
+
+		g, ok := groups[lset.key()]
+		if !ok {
+			g = &group{lset: lset, buckets: make(map[int64]quantile.Buckets)}
+			groups[lset.key()] = g
+		}
+		for _, sample := range series.Samples {
+			g.buckets[sample.T] = append(g.buckets[sample.T], quantile.Bucket{UpperBound: upperBound, Count: sample.V})
+		}
+	}
+
+	result := &QueryResult{Resolution: increases.Resolution, Series: []Series{}}
+	for _, g := range groups {
+		var samples []Sample
+		for t, buckets := range g.buckets {
+			if v := quantile.BucketQuantile(q, buckets); !math.IsNaN(v) {
+				samples = append(samples, Sample{T: t, V: v})
+			}
+		}
+		if len(samples) == 0 {
+			continue
+		}
+
+		sort.Slice(samples, func(i, j int) bool { return samples[i].T < samples[j].T })
+		result.Series = append(result.Series, Series{Labels: g.lset, Samples: samples})
+	}
+	sort.Slice(result.Series, func(i, j int) bool { return result.Series[i].Labels.key() < result.Series[j].Labels.key() })
+
+	return result, nil
+}
+
+func parseLe(le string) (float64, error) {
+	if le == "" {
+		return 0, fmt.Errorf("not a histogram bucket, missing le label")
+	}
+
+	v, err := strconv.ParseFloat(le, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid le label %q", le)
+	}
+
+	return v, nil
+}
+
+// selectAggr reads the matching series at the given resolution.
+//
+// Downsampled blocks don't always exist for the whole range (the newest data is still raw,
+// a block may not be downsampled yet), so each time range is read from the coarsest data available,
+// up to res, falling back to finer data where needed.
+func (s *Store) selectAggr(res, mint, maxt int64, matchers []*Matcher) ([]aggrSeries, error) {
+	s.blocksMtx.RLock()
+	blocks := append([]*block(nil), s.blocks...)
+	s.blocksMtx.RUnlock()
+
+	var chosen []*block
+	for _, r := range []int64{Res1h, Res5m, 0} {
+		if r > res {
+			continue
+		}
+
+		for _, b := range blocks {
+			if b.meta.Resolution != r || b.meta.MinTime > maxt || b.meta.MaxTime <= mint {
+				continue
+			}
+
+			covered := false
+			for _, c := range chosen {
+				if b.meta.MinTime < c.meta.MaxTime && c.meta.MinTime < b.meta.MaxTime {
+					covered = true
+					break
+				}
+			}
+			if !covered {
+				chosen = append(chosen, b)
+			}
+		}
+	}
+	sortBlocks(chosen)
+
+	merged := make(map[string]*aggrSeries)
+	add := func(series []aggrSeries) {
+		for _, as := range series {
+			key := as.Labels.key()
+
+			m, ok := merged[key]
+			if !ok {
+				merged[key] = &aggrSeries{Labels: as.Labels, Points: as.Points}
+				continue
+			}
+
+			last := m.Points[len(m.Points)-1].T
+			for _, p := range as.Points {
+				if p.T > last {
+					m.Points = append(m.Points, p)
+				}
+			}
+		}
+	}
+
+	for _, b := range chosen {
+		series, err := b.selectAggr(mint, maxt, matchers)
+		if err != nil {
+			return nil, err
+		}
+		add(series)
+	}
+	for _, series := range s.selectHead(mint, maxt, matchers) {
+		add([]aggrSeries{{Labels: series.Labels, Points: rawToAggr(series.Samples)}})
+	}
+
+	result := make([]aggrSeries, 0, len(merged))
+	for _, as := range merged {
+		result = append(result, *as)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Labels.key() < result[j].Labels.key() })
+
+	return result, nil
+}
+
+// evalPoints evaluates fn over the window (t-step, t] for every step t from mint to maxt.
+// Steps with no point in their window have no output sample.
+func evalPoints(fn Function, points []aggrSample, mint, maxt, step int64) []Sample {
+	var result []Sample
+
+	for t := mint; t <= maxt; t += step {
+		from := sort.Search(len(points), func(i int) bool { return points[i].T > t-step })
+		to := sort.Search(len(points), func(i int) bool { return points[i].T > t })
+		if from >= to {
+			continue
+		}
+
+		window := points[from:to]
+
+		var v float64
+		switch fn {
+		case FuncIncrease, FuncRate:
+			for i, p := range window {
+				v += p.Counter
+				if from+i > 0 {
+					v += counterJump(points[from+i-1].Last, p.First)
+				}
+			}
+			if fn == FuncRate {
+				v /= float64(step) / 1000
+			}
+
+		case FuncSumOverTime, FuncAvgOverTime, FuncCountOverTime:
+			var sum, count float64
+			for _, p := range window {
+				sum += p.Sum
+				count += p.Count
+			}
+			switch fn {
+			case FuncSumOverTime:
+				v = sum
+			case FuncCountOverTime:
+				v = count
+			default:
+				v = sum / count
+			}
+
+		case FuncMinOverTime:
+			v = math.Inf(1)
+			for _, p := range window {
+				v = math.Min(v, p.Min)
+			}
+
+		case FuncMaxOverTime:
+			v = math.Inf(-1)
+			for _, p := range window {
+				v = math.Max(v, p.Max)
+			}
+
+		case FuncLastOverTime:
+			v = window[len(window)-1].Last
+		}
+
+		result = append(result, Sample{T: t, V: v})
+	}
+
+	return result
+}
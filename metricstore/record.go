@@ -0,0 +1,198 @@
+package metricstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// Everything written to the WAL and the checkpoints is a record framed like this:
+//
+//	┌──────────┬───────────────────┬─────────────────────┬─────────────────┐
+//	│ type(1B) │ payload length(4B)│ CRC32 of payload(4B)│ payload(length) │
+//	└──────────┴───────────────────┴─────────────────────┴─────────────────┘
+//
+// The CRC is how a half written record (crash in the middle of a write) or a flipped bit is detected.
+const (
+	recordHeaderSize = 9
+
+	// recordSeries introduces a new series: ref, then its labels.
+	// The samples records refer to the series by ref, so the labels are not repeated for every sample.
+	recordSeries byte = 1
+	// recordSamples is a batch of (ref, timestamp, value).
+	recordSamples byte = 2
+)
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptRecord = errors.New("corrupt record")
+)
+
+type refSample struct {
+	ref uint64
+	t   int64
+	v   float64
+}
+
+// appendRecord frames the payload and appends it to b.
+func appendRecord(b []byte, typ byte, payload []byte) []byte {
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(payload)))
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(payload, castagnoli))
+
+	return append(b, payload...)
+}
+
+// readRecord reads the record at the start of b.
+// It returns the number of bytes the record takes, so the caller can move on to the next one.
+func readRecord(b []byte) (typ byte, payload []byte, n int, err error) {
+	if len(b) < recordHeaderSize {
+		return 0, nil, 0, fmt.Errorf("%w: truncated header", errCorruptRecord)
+	}
+
+	typ = b[0]
+	length := binary.BigEndian.Uint32(b[1:5])
+	sum := binary.BigEndian.Uint32(b[5:9])
+
+	if typ != recordSeries && typ != recordSamples {
+		return 0, nil, 0, fmt.Errorf("%w: unknown record type %d", errCorruptRecord, typ)
+	}
+	if uint64(len(b)-recordHeaderSize) < uint64(length) {
+		return 0, nil, 0, fmt.Errorf("%w: truncated payload", errCorruptRecord)
+	}
+
+	payload = b[recordHeaderSize : recordHeaderSize+int(length)]
+	if crc32.Checksum(payload, castagnoli) != sum {
+		return 0, nil, 0, fmt.Errorf("%w: checksum mismatch", errCorruptRecord)
+	}
+
+	return typ, payload, recordHeaderSize + int(length), nil
+}
+
+func encodeSeries(ref uint64, lset Labels) []byte {
+	b := binary.AppendUvarint(nil, ref)
+	b = binary.AppendUvarint(b, uint64(len(lset)))
+	for _, l := range lset {
+		b = appendString(b, l.Name)
+		b = appendString(b, l.Value)
+	}
+
+	return b
+}
+
+func decodeSeries(b []byte) (uint64, Labels, error) {
+	d := decoder{b: b}
+
+	ref := d.uvarint()
+	n := d.uvarint()
+	if d.err != nil || n > uint64(len(b)) {
+		return 0, nil, fmt.Errorf("%w: bad series record", errCorruptRecord)
+	}
+
+	lset := make(Labels, 0, n)
+	for i := uint64(0); i < n; i++ {
+		lset = append(lset, Label{Name: d.string(), Value: d.string()})
+	}
+	if d.err != nil || len(d.b) != 0 {
+		return 0, nil, fmt.Errorf("%w: bad series record", errCorruptRecord)
+	}
+
+	return ref, lset, nil
+}
+
+func encodeSamples(samples []refSample) []byte {
+	var b []byte
+	for _, s := range samples {
+		b = binary.AppendUvarint(b, s.ref)
+		b = binary.AppendVarint(b, s.t)
+		b = binary.BigEndian.AppendUint64(b, math.Float64bits(s.v))
+	}
+
+	return b
+}
+
+func decodeSamples(b []byte) ([]refSample, error) {
+	d := decoder{b: b}
+
+	var samples []refSample
+	for len(d.b) > 0 && d.err == nil {
+		samples = append(samples, refSample{ref: d.uvarint(), t: d.varint(), v: d.float64()})
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("%w: bad samples record", errCorruptRecord)
+	}
+
+	return samples, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// decoder reads varints and strings one after another,
+// remembering the first error so the caller only checks once at the end.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errCorruptRecord
+		return 0
+	}
+	d.b = d.b[n:]
+
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errCorruptRecord
+		return 0
+	}
+	d.b = d.b[n:]
+
+	return v
+}
+
+func (d *decoder) float64() float64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 8 {
+		d.err = errCorruptRecord
+		return 0
+	}
+	v := math.Float64frombits(binary.BigEndian.Uint64(d.b))
+	d.b = d.b[8:]
+
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.b)) < n {
+		d.err = errCorruptRecord
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+
+	return s
+}
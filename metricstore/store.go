@@ -0,0 +1,507 @@
+// Package metricstore is a small local time series store for the samples
+// that our step services push via Prometheus remote_write.
+//
+// It is not trying to be Prometheus' TSDB, it keeps the same rules and the same layout though:
+//   - A series is identified by its sorted label set, and samples of a series must
+//     come in with increasing timestamps.
+//   - New samples go to the in-memory head, and to the write-ahead log so they survive a restart.
+//   - The old part of the head is compacted into immutable blocks on disk.
+//   - Blocks older than the retention are deleted.
+package metricstore
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrInvalidLabels is returned when the label set of a sample can't be stored.
+	ErrInvalidLabels = errors.New("invalid labels")
+	// ErrOutOfOrderSample is returned when a sample is older than the newest sample of its series.
+	ErrOutOfOrderSample = errors.New("out of order sample")
+	// ErrDuplicateSampleForTimestamp is returned when a sample has the same timestamp
+	// as a sample of its series in the head, but a different value.
+	ErrDuplicateSampleForTimestamp = errors.New("duplicate sample for timestamp")
+	// ErrOutOfBounds is returned when a sample is older than the head,
+	// that time range is already compacted into a block and blocks are immutable.
+	ErrOutOfBounds = errors.New("out of bounds")
+)
+
+// IsBadData reports whether err is caused by the data itself.
+// Resending the same data will fail the same way, so the sender should not retry.
+func IsBadData(err error) bool {
+	return errors.Is(err, ErrInvalidLabels) ||
+		errors.Is(err, ErrOutOfOrderSample) ||
+		errors.Is(err, ErrDuplicateSampleForTimestamp) ||
+		errors.Is(err, ErrOutOfBounds)
+}
+
+// Options configures a store on disk.
+type Options struct {
+	// BlockDuration is the time range of a block cut from the head.
+	BlockDuration time.Duration
+	// RetentionDuration is how long the raw data is kept. 0 keeps it forever.
+	RetentionDuration time.Duration
+	// Retention5m and Retention1h are how long the downsampled data is kept. 0 keeps it forever.
+	// They should be longer than RetentionDuration, that's the point of downsampling.
+	Retention5m time.Duration
+	Retention1h time.Duration
+	// RetentionSize is the max number of bytes for the blocks and the WAL.
+	// The oldest blocks are deleted first. 0 means no limit.
+	RetentionSize int64
+	// WALSegmentSize is the max size of a WAL segment file.
+	WALSegmentSize int64
+}
+
+// DefaultOptions are the same defaults as Prometheus,
+// plus 3 months of 5m data and a year of 1h data.
+func DefaultOptions() Options {
+	return Options{
+		BlockDuration:     2 * time.Hour,
+		RetentionDuration: 15 * 24 * time.Hour,
+		Retention5m:       90 * 24 * time.Hour,
+		Retention1h:       365 * 24 * time.Hour,
+		WALSegmentSize:    16 << 20,
+	}
+}
+
+// Sample is a single value at a timestamp in milliseconds, same unit as remote_write.
+type Sample struct {
+	T int64   `json:"t"`
+	V float64 `json:"v"`
+}
+
+// Series is a label set with its samples in the queried time range.
+type Series struct {
+	Labels  Labels   `json:"labels"`
+	Samples []Sample `json:"samples"`
+}
+
+// memSeries is a series living in the head.
+type memSeries struct {
+	mtx     sync.Mutex
+	ref     uint64
+	lset    Labels
+	samples []Sample
+	// deleted is set when compaction removed the series from the head,
+	// an appender still holding it must look the series up again.
+	deleted bool
+}
+
+// checkAppend tells if the sample can be appended to the series. s.mtx must be held.
+// A sample identical to one in the head is a no-op, dup is true then: a batch retried after
+// a storage error in the middle of it resends the samples appended before the error.
+func (s *memSeries) checkAppend(t int64, v float64) (dup bool, err error) {
+	n := len(s.samples)
+	if n == 0 || t > s.samples[n-1].T {
+		return false, nil
+	}
+
+	i := sort.Search(n, func(i int) bool { return s.samples[i].T >= t })
+	switch {
+	case s.samples[i].T != t:
+		return false, fmt.Errorf("%w: %s at %d, newest is %d", ErrOutOfOrderSample, s.lset, t, s.samples[n-1].T)
+	// Bitwise, so that a resent NaN (e.g. a staleness marker) is the same value.
+	case math.Float64bits(s.samples[i].V) != math.Float64bits(v):
+		return false, fmt.Errorf("%w: %s at %d", ErrDuplicateSampleForTimestamp, s.lset, t)
+	}
+
+	return true, nil
+}
+
+// rangeSamples returns a copy of the samples between mint and maxt (both inclusive).
+func (s *memSeries) rangeSamples(mint, maxt int64) []Sample {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	from := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].T >= mint })
+	to := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].T > maxt })
+	if from >= to {
+		return nil
+	}
+
+	return append([]Sample(nil), s.samples[from:to]...)
+}
+
+// Store is the head in memory, plus the blocks and the WAL on disk.
+// A store created with New has no disk part at all.
+type Store struct {
+	dir  string
+	opts Options
+	wal  *wal
+
+	mtx     sync.RWMutex
+	series  map[string]*memSeries
+	nextRef uint64
+
+	// minValidTime is the end of the newest block.
+	// Anything older is already on disk and can't be appended anymore.
+	minValidTime atomic.Int64
+
+	blocksMtx sync.RWMutex
+	blocks    []*block // Sorted by MinTime.
+
+	// compactMtx makes sure only one compaction runs at a time.
+	compactMtx sync.Mutex
+}
+
+// New returns an empty store that only lives in memory.
+func New() *Store {
+	s := &Store{
+		opts:   DefaultOptions(),
+		series: make(map[string]*memSeries),
+	}
+	s.minValidTime.Store(minTime)
+
+	return s
+}
+
+// minTime is the lowest timestamp, "no block yet".
+const minTime = -1 << 63
+
+// Open opens (or creates) the store in dir:
+// loads the blocks, then replays the WAL to rebuild the head.
+func Open(dir string, opts Options) (*Store, error) {
+	defaults := DefaultOptions()
+	if opts.BlockDuration <= 0 {
+		opts.BlockDuration = defaults.BlockDuration
+	}
+	if opts.WALSegmentSize <= 0 {
+		opts.WALSegmentSize = defaults.WALSegmentSize
+	}
+
+	s := New()
+	s.dir, s.opts = dir, opts
+
+	if err := s.loadBlocks(); err != nil {
+		return nil, err
+	}
+
+	w, err := openWAL(filepath.Join(dir, "wal"), opts.WALSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+	// WAL records refer to the series by ref, only needed while replaying.
+	refs := make(map[uint64]*memSeries)
+	err = w.replay(func(typ byte, payload []byte) error {
+		return s.replayRecord(refs, typ, payload)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to replay WAL: %w", err)
+	}
+	s.wal = w
+
+	stats := s.Stats()
+	log.Printf("metricstore: opened %s with %d blocks, %d series and %d samples in the head\n",
+		dir, stats.NumBlocks, stats.NumSeries, stats.NumSamples)
+
+	return s, nil
+}
+
+// Close flushes the WAL. The store must not be used after that.
+func (s *Store) Close() error {
+	if s.wal == nil {
+		return nil
+	}
+
+	return s.wal.close()
+}
+
+func (s *Store) blocksDir() string {
+	return filepath.Join(s.dir, "blocks")
+}
+
+// loadBlocks opens every block on disk.
+// A block that can't be read is skipped with a log, the rest of the data is still usable.
+func (s *Store) loadBlocks() error {
+	if err := os.MkdirAll(s.blocksDir(), 0o755); err != nil {
+		return fmt.Errorf("failed to create blocks dir: %w", err)
+	}
+
+	entries, err := os.ReadDir(s.blocksDir())
+	if err != nil {
+		return fmt.Errorf("failed to list blocks: %w", err)
+	}
+
+	for _, e := range entries {
+		path := filepath.Join(s.blocksDir(), e.Name())
+		if !e.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			// A compaction that never finished, the data is still in the WAL.
+			os.RemoveAll(path)
+			continue
+		}
+
+		b, err := openBlock(path)
+		if err != nil {
+			log.Printf("metricstore: skipping unreadable block %s: %v\n", path, err)
+			continue
+		}
+		s.blocks = append(s.blocks, b)
+
+		if b.meta.MaxTime > s.minValidTime.Load() {
+			s.minValidTime.Store(b.meta.MaxTime)
+		}
+	}
+	sortBlocks(s.blocks)
+
+	return nil
+}
+
+func sortBlocks(blocks []*block) {
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].meta.MinTime < blocks[j].meta.MinTime })
+}
+
+// replayRecord rebuilds the head from a WAL record.
+// Anything that doesn't fit anymore (already in a block, out of order) is skipped silently,
+// it was either accepted before the compaction or rejected when it was first appended.
+func (s *Store) replayRecord(refs map[uint64]*memSeries, typ byte, payload []byte) error {
+	switch typ {
+	case recordSeries:
+		ref, lset, err := decodeSeries(payload)
+		if err != nil {
+			return err
+		}
+
+		key := lset.key()
+		series, ok := s.series[key]
+		if !ok {
+			series = &memSeries{ref: ref, lset: lset}
+			s.series[key] = series
+		}
+		refs[ref] = series
+		if ref >= s.nextRef {
+			s.nextRef = ref + 1
+		}
+
+	case recordSamples:
+		samples, err := decodeSamples(payload)
+		if err != nil {
+			return err
+		}
+
+		for _, sample := range samples {
+			series, ok := refs[sample.ref]
+			if !ok || sample.t < s.minValidTime.Load() {
+				continue
+			}
+			if dup, err := series.checkAppend(sample.t, sample.v); err != nil || dup {
+				continue
+			}
+			series.samples = append(series.samples, Sample{T: sample.t, V: sample.v})
+		}
+	}
+
+	return nil
+}
+
+// Append stores one sample for the series identified by lset.
+func (s *Store) Append(lset Labels, t int64, v float64) error {
+	lset = lset.Copy()
+	sort.Sort(lset)
+
+	if err := lset.Validate(); err != nil {
+		return err
+	}
+
+	for {
+		series, err := s.getOrCreate(lset)
+		if err != nil {
+			return err
+		}
+
+		retry, err := s.appendTo(series, t, v)
+		if !retry {
+			return err
+		}
+	}
+}
+
+// appendTo writes the sample to the WAL, then to the series.
+// It returns retry=true if the series was removed from the head in the meantime.
+func (s *Store) appendTo(series *memSeries, t int64, v float64) (retry bool, err error) {
+	series.mtx.Lock()
+	defer series.mtx.Unlock()
+
+	if series.deleted {
+		return true, nil
+	}
+
+	if minValid := s.minValidTime.Load(); t < minValid {
+		return false, fmt.Errorf("%w: %s at %d, head starts at %d", ErrOutOfBounds, series.lset, t, minValid)
+	}
+	dup, err := series.checkAppend(t, v)
+	if err != nil || dup {
+		return false, err
+	}
+
+	if s.wal != nil {
+		if err := s.wal.log(recordSamples, encodeSamples([]refSample{{ref: series.ref, t: t, v: v}})); err != nil {
+			return false, err
+		}
+	}
+	series.samples = append(series.samples, Sample{T: t, V: v})
+
+	return false, nil
+}
+
+// getOrCreate returns the series for lset, creating it if it's the first time we see it.
+func (s *Store) getOrCreate(lset Labels) (*memSeries, error) {
+	key := lset.key()
+
+	s.mtx.RLock()
+	series, ok := s.series[key]
+	s.mtx.RUnlock()
+	if ok {
+		return series, nil
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// Someone else may have created it while we were waiting for the lock.
+	if series, ok := s.series[key]; ok {
+		return series, nil
+	}
+
+	series = &memSeries{ref: s.nextRef, lset: lset}
+
+	// The series record has to be in the WAL before any of its samples,
+	// holding s.mtx guarantees nobody can append to it before that.
+	if s.wal != nil {
+		if err := s.wal.log(recordSeries, encodeSeries(series.ref, lset)); err != nil {
+			return nil, err
+		}
+	}
+
+	s.nextRef++
+	s.series[key] = series
+
+	return series, nil
+}
+
+// Select returns all the raw series matching every matcher,
+// with their samples between mint and maxt (both inclusive, in milliseconds).
+// Series with no sample in the range are left out.
+// Downsampled data is only used by QueryRange.
+func (s *Store) Select(mint, maxt int64, matchers ...*Matcher) ([]Series, error) {
+	merged := make(map[string]*Series)
+	add := func(series []Series) {
+		for _, ss := range series {
+			key := ss.Labels.key()
+
+			m, ok := merged[key]
+			if !ok {
+				merged[key] = &Series{Labels: ss.Labels, Samples: ss.Samples}
+				continue
+			}
+
+			// Sources are added oldest first. While a compaction is running,
+			// the same samples can be both in the new block and in the head, skip them.
+			last := m.Samples[len(m.Samples)-1].T
+			for _, sample := range ss.Samples {
+				if sample.T > last {
+					m.Samples = append(m.Samples, sample)
+				}
+			}
+		}
+	}
+
+	s.blocksMtx.RLock()
+	blocks := append([]*block(nil), s.blocks...)
+	s.blocksMtx.RUnlock()
+
+	for _, b := range blocks {
+		if b.meta.Resolution != 0 {
+			continue
+		}
+
+		series, err := b.selectSeries(mint, maxt, matchers)
+		if err != nil {
+			return nil, err
+		}
+		add(series)
+	}
+	add(s.selectHead(mint, maxt, matchers))
+
+	result := make([]Series, 0, len(merged))
+	for _, series := range merged {
+		result = append(result, *series)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Labels.key() < result[j].Labels.key() })
+
+	return result, nil
+}
+
+func (s *Store) selectHead(mint, maxt int64, matchers []*Matcher) []Series {
+	s.mtx.RLock()
+	candidates := make([]*memSeries, 0, len(s.series))
+	for _, series := range s.series {
+		if matchLabels(series.lset, matchers) {
+			candidates = append(candidates, series)
+		}
+	}
+	s.mtx.RUnlock()
+
+	result := make([]Series, 0, len(candidates))
+	for _, series := range candidates {
+		samples := series.rangeSamples(mint, maxt)
+		if len(samples) == 0 {
+			continue
+		}
+
+		result = append(result, Series{Labels: series.lset.Copy(), Samples: samples})
+	}
+
+	return result
+}
+
+// Stats is a quick summary of what the store holds.
+type Stats struct {
+	// NumSeries and NumSamples are for the head only.
+	NumSeries  int         `json:"numSeries"`
+	NumSamples int         `json:"numSamples"`
+	NumBlocks  int         `json:"numBlocks"`
+	Blocks     []BlockMeta `json:"blocks,omitempty"`
+	// DiskSize is the bytes used by the blocks and the WAL.
+	DiskSize int64 `json:"diskSize"`
+}
+
+// Stats counts the series and samples currently in the store.
+func (s *Store) Stats() Stats {
+	var stats Stats
+
+	s.mtx.RLock()
+	stats.NumSeries = len(s.series)
+	for _, series := range s.series {
+		series.mtx.Lock()
+		stats.NumSamples += len(series.samples)
+		series.mtx.Unlock()
+	}
+	s.mtx.RUnlock()
+
+	s.blocksMtx.RLock()
+	stats.NumBlocks = len(s.blocks)
+	for _, b := range s.blocks {
+		stats.Blocks = append(stats.Blocks, b.meta)
+		stats.DiskSize += b.size
+	}
+	s.blocksMtx.RUnlock()
+
+	if s.wal != nil {
+		stats.DiskSize += s.wal.size()
+	}
+
+	return stats
+}
@@ -0,0 +1,221 @@
+package metricstore
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var pingCount = Labels{{Name: MetricName, Value: "ping_request_count"}}
+
+func mustOpen(t *testing.T, dir string, opts Options) *Store {
+	t.Helper()
+
+	s, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func countSamples(t *testing.T, s *Store) int {
+	t.Helper()
+
+	series, err := s.Select(minTime, 1<<62, MustNewMatcher(MatchEqual, MetricName, "ping_request_count"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for _, ss := range series {
+		n += len(ss.Samples)
+		for i := 1; i < len(ss.Samples); i++ {
+			if ss.Samples[i].T <= ss.Samples[i-1].T {
+				t.Fatalf("samples not sorted or duplicated at %d: %+v", i, ss.Samples[i-1:i+1])
+			}
+		}
+	}
+
+	return n
+}
+
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	s := mustOpen(t, dir, Options{})
+	for i := int64(0); i < 100; i++ {
+		if err := s.Append(pingCount, i*1000, float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	s = mustOpen(t, dir, Options{})
+	if got := countSamples(t, s); got != 100 {
+		t.Fatalf("got %d samples after restart, want 100", got)
+	}
+
+	// Ordering is still enforced against the replayed data.
+	if err := s.Append(pingCount, 50_000, 1); err == nil {
+		t.Fatal("expected out of order error after replay")
+	}
+}
+
+func TestWALCorruption(t *testing.T) {
+	dir := t.TempDir()
+
+	s := mustOpen(t, dir, Options{})
+	for i := int64(0); i < 10; i++ {
+		if err := s.Append(pingCount, i*1000, float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	// Flip the last byte of the segment, the last sample's value.
+	segment := filepath.Join(dir, "wal", "00000001")
+	b, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	if err := os.WriteFile(segment, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = mustOpen(t, dir, Options{})
+	if got := countSamples(t, s); got != 9 {
+		t.Fatalf("got %d samples after corruption, want 9", got)
+	}
+
+	// The store keeps working after the repair.
+	if err := s.Append(pingCount, 9000, 42); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = mustOpen(t, dir, Options{})
+	if got := countSamples(t, s); got != 10 {
+		t.Fatalf("got %d samples after repair and restart, want 10", got)
+	}
+}
+
+func TestCompactionAndRetention(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{BlockDuration: time.Hour, RetentionDuration: 3 * time.Hour}
+
+	// 6 hours of data, 1 sample per minute.
+	s := mustOpen(t, dir, opts)
+	for i := int64(0); i < 6*60; i++ {
+		if err := s.Append(pingCount, i*time.Minute.Milliseconds(), float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The head keeps less than 1.5 blocks, so 5 blocks are cut (00-01 ... 04-05),
+	// and the first 2 end more than 3h before the newest sample (05:59).
+	var raw []BlockMeta
+	for _, b := range s.Stats().Blocks {
+		if b.Resolution == 0 {
+			raw = append(raw, b)
+		}
+	}
+	if len(raw) != 3 {
+		t.Fatalf("got %d raw blocks, want 3: %+v", len(raw), raw)
+	}
+	if got, want := countSamples(t, s), 4*60; got != want {
+		t.Fatalf("got %d samples, want %d", got, want)
+	}
+
+	if err := s.Append(pingCount, 0, 1); err == nil {
+		t.Fatal("expected out of bounds error for a sample older than the head")
+	}
+	s.Close()
+
+	// Blocks and the checkpointed WAL come back after a restart.
+	s = mustOpen(t, dir, opts)
+	if got, want := countSamples(t, s), 4*60; got != want {
+		t.Fatalf("got %d samples after restart, want %d", got, want)
+	}
+}
+
+func TestDownsampling(t *testing.T) {
+	dir := t.TempDir()
+	s := mustOpen(t, dir, Options{BlockDuration: 2 * time.Hour})
+
+	bucket := func(le string) Labels {
+		return Labels{{Name: MetricName, Value: "ping_process_bucket"}, {Name: "le", Value: le}}
+	}
+
+	// 13 hours of a histogram scraped every 15s: every scrape sees 2 more requests,
+	// one <= 0.1s and one slower. The process restarts at 03:00, so the counters reset.
+	const scrape = 15 * time.Second
+	var fast, all float64
+	for ts := time.Duration(0); ts < 13*time.Hour; ts += scrape {
+		if ts == 3*time.Hour {
+			fast, all = 0, 0
+		}
+		fast, all = fast+1, all+2
+
+		if err := s.Append(bucket("0.1"), ts.Milliseconds(), fast); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Append(bucket("+Inf"), ts.Milliseconds(), all); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	le := MustNewMatcher(MatchEqual, "le", "+Inf")
+	for _, tc := range []struct {
+		step       time.Duration
+		resolution string
+	}{
+		{step: 5 * time.Minute, resolution: "raw"},
+		{step: time.Hour, resolution: "5m"},
+		{step: 6 * time.Hour, resolution: "1h"},
+	} {
+		// 00:00 - 10:00 is in the blocks, 10:00 - 13:00 is still in the head.
+		mint, maxt := tc.step.Milliseconds(), (12 * time.Hour).Milliseconds()
+		res, err := s.QueryRange(FuncIncrease, mint, maxt, tc.step, le)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Resolution != tc.resolution {
+			t.Fatalf("step %s: got resolution %s, want %s", tc.step, res.Resolution, tc.resolution)
+		}
+		if len(res.Series) != 1 {
+			t.Fatalf("step %s: got %d series, want 1", tc.step, len(res.Series))
+		}
+
+		// 2 requests per scrape, the reset doesn't lose anything.
+		want := 2 * float64(tc.step/scrape)
+		for _, sample := range res.Series[0].Samples {
+			if sample.V != want {
+				t.Fatalf("step %s: increase at %d is %v, want %v", tc.step, sample.T, sample.V, want)
+			}
+		}
+
+		q, err := s.HistogramQuantile(0.25, mint, maxt, tc.step, MustNewMatcher(MatchEqual, MetricName, "ping_process_bucket"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(q.Series) != 1 || len(q.Series[0].Samples) == 0 {
+			t.Fatalf("step %s: no quantile: %+v", tc.step, q)
+		}
+		for _, sample := range q.Series[0].Samples {
+			if math.Abs(sample.V-0.05) > 1e-9 {
+				t.Fatalf("step %s: p25 at %d is %v, want 0.05", tc.step, sample.T, sample.V)
+			}
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package metricstore
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// wal is the write-ahead log of the head: every new series and every sample is written here
+// before it's added to memory, so the head can be rebuilt after a restart.
+//
+// The log is split in numbered segment files (wal/00000001, wal/00000002, ...).
+// When a segment is full a new one is started, so old data can be dropped a whole file at a time.
+//
+// Once the head has been compacted into a block, the segments are mostly useless:
+// a checkpoint (wal/checkpoint.00000005) is written with just what the head still holds,
+// and every segment up to 00000005 is deleted.
+// Replay = the newest checkpoint + every segment after it.
+type wal struct {
+	dir         string
+	segmentSize int64
+
+	mtx        sync.Mutex
+	segment    *os.File
+	segmentIdx int
+	written    int64
+}
+
+const checkpointPrefix = "checkpoint."
+
+func openWAL(dir string, segmentSize int64) (*wal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create WAL dir: %w", err)
+	}
+
+	return &wal{dir: dir, segmentSize: segmentSize}, nil
+}
+
+// replay feeds every record of the newest checkpoint and the segments after it to fn.
+//
+// A corrupted segment doesn't stop the startup. Everything from the first bad record on is thrown away:
+// the segment is truncated there and the segments after it are deleted, since they'd be missing
+// whatever was lost in between.
+//
+// After the replay, new records go to a fresh segment.
+func (w *wal) replay(fn func(typ byte, payload []byte) error) error {
+	checkpointIdx, err := w.replayCheckpoint(fn)
+	if err != nil {
+		return err
+	}
+
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+
+	lastIdx := checkpointIdx
+	for i, idx := range segments {
+		path := w.segmentPath(idx)
+
+		if idx <= checkpointIdx {
+			// Leftover from a crash between writing the checkpoint and cleaning up.
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("failed to remove old WAL segment: %w", err)
+			}
+			continue
+		}
+		lastIdx = idx
+
+		goodSize, err := replayFile(path, fn)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, errCorruptRecord) {
+			return err
+		}
+
+		log.Printf("metricstore: WAL segment %s is corrupted at offset %d (%v), truncating it and dropping %d segments after it\n",
+			path, goodSize, err, len(segments)-i-1)
+
+		if err := os.Truncate(path, goodSize); err != nil {
+			return fmt.Errorf("failed to truncate corrupted WAL segment: %w", err)
+		}
+		for _, later := range segments[i+1:] {
+			if err := os.Remove(w.segmentPath(later)); err != nil {
+				return fmt.Errorf("failed to remove WAL segment after corruption: %w", err)
+			}
+		}
+		break
+	}
+
+	return w.openSegment(lastIdx + 1)
+}
+
+// replayCheckpoint replays the newest checkpoint and returns the index of the last segment it covers.
+func (w *wal) replayCheckpoint(fn func(typ byte, payload []byte) error) (int, error) {
+	idx, err := w.lastCheckpoint()
+	if err != nil || idx == 0 {
+		return 0, err
+	}
+
+	path := w.checkpointPath(idx)
+	goodSize, err := replayFile(path, fn)
+	if errors.Is(err, errCorruptRecord) {
+		// The segments it replaced are gone, so there's no way back.
+		// Keep whatever could be read instead of refusing to start.
+		log.Printf("metricstore: WAL checkpoint %s is corrupted at offset %d (%v), data after it is lost\n", path, goodSize, err)
+		return idx, nil
+	}
+
+	return idx, err
+}
+
+// replayFile calls fn for every record of the file.
+// It returns the size of the valid part of the file, which is where a corrupted file should be cut.
+func replayFile(path string, fn func(typ byte, payload []byte) error) (int64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var offset int
+	for offset < len(b) {
+		typ, payload, n, err := readRecord(b[offset:])
+		if err != nil {
+			return int64(offset), err
+		}
+		if err := fn(typ, payload); err != nil {
+			return int64(offset), err
+		}
+		offset += n
+	}
+
+	return int64(offset), nil
+}
+
+// log appends one record to the current segment, starting a new segment when it's full.
+func (w *wal) log(typ byte, payload []byte) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.segment == nil {
+		return errors.New("WAL is closed")
+	}
+
+	if w.written > 0 && w.written+int64(recordHeaderSize+len(payload)) > w.segmentSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	rec := appendRecord(nil, typ, payload)
+	n, err := w.segment.Write(rec)
+	w.written += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write WAL record: %w", err)
+	}
+
+	return nil
+}
+
+// rotate closes the current segment and starts the next one. w.mtx must be held.
+func (w *wal) rotate() error {
+	if err := w.closeSegment(); err != nil {
+		return err
+	}
+
+	return w.openSegment(w.segmentIdx + 1)
+}
+
+func (w *wal) openSegment(idx int) error {
+	f, err := os.OpenFile(w.segmentPath(idx), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL segment: %w", err)
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat WAL segment: %w", err)
+	}
+
+	w.segment, w.segmentIdx, w.written = f, idx, stat.Size()
+
+	return nil
+}
+
+func (w *wal) closeSegment() error {
+	if w.segment == nil {
+		return nil
+	}
+
+	if err := w.segment.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL segment: %w", err)
+	}
+	err := w.segment.Close()
+	w.segment = nil
+
+	return err
+}
+
+// checkpoint replaces every segment written so far with a single checkpoint file.
+//
+// The current segment is closed first, then snapshot is called to get the records of what the head holds.
+// Anything appended from now on goes to the new segment,
+// and anything appended before is either in the snapshot or was already compacted into a block.
+func (w *wal) checkpoint(snapshot func() []byte) error {
+	w.mtx.Lock()
+	last := w.segmentIdx
+	err := w.rotate()
+	w.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	path := w.checkpointPath(last)
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, snapshot()); err != nil {
+		return fmt.Errorf("failed to write WAL checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to rename WAL checkpoint: %w", err)
+	}
+
+	// The checkpoint is safely on disk, what it replaces can go.
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, idx := range segments {
+		if idx <= last {
+			if err := os.Remove(w.segmentPath(idx)); err != nil {
+				return fmt.Errorf("failed to remove WAL segment: %w", err)
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list WAL dir: %w", err)
+	}
+	for _, e := range entries {
+		if idx, ok := parseCheckpointName(e.Name()); ok && idx < last {
+			if err := os.Remove(filepath.Join(w.dir, e.Name())); err != nil {
+				return fmt.Errorf("failed to remove old WAL checkpoint: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (w *wal) close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	return w.closeSegment()
+}
+
+// size is how much disk space the WAL takes, segments and checkpoint included.
+func (w *wal) size() int64 {
+	return dirSize(w.dir)
+}
+
+func (w *wal) segmentPath(idx int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%08d", idx))
+}
+
+func (w *wal) checkpointPath(idx int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%s%08d", checkpointPrefix, idx))
+}
+
+// segments lists the segment indexes in order.
+func (w *wal) segments() ([]int, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list WAL dir: %w", err)
+	}
+
+	var idxs []int
+	for _, e := range entries {
+		idx, err := strconv.Atoi(e.Name())
+		if err != nil || e.IsDir() {
+			continue
+		}
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+
+	return idxs, nil
+}
+
+// lastCheckpoint returns the index of the newest checkpoint, 0 if there's none.
+func (w *wal) lastCheckpoint() (int, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list WAL dir: %w", err)
+	}
+
+	last := 0
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			// A checkpoint that never finished, the segments it was meant to replace are still there.
+			os.Remove(filepath.Join(w.dir, e.Name()))
+			continue
+		}
+		if idx, ok := parseCheckpointName(e.Name()); ok && idx > last {
+			last = idx
+		}
+	}
+
+	return last, nil
+}
+
+func parseCheckpointName(name string) (int, bool) {
+	if !strings.HasPrefix(name, checkpointPrefix) || strings.HasSuffix(name, ".tmp") {
+		return 0, false
+	}
+
+	idx, err := strconv.Atoi(strings.TrimPrefix(name, checkpointPrefix))
+
+	return idx, err == nil
+}
+
+// writeFileSync is os.WriteFile with an fsync, so a rename after it never exposes a half written file.
+func writeFileSync(path string, b []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// dirSize sums the size of every file under dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
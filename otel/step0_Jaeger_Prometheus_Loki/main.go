@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -12,8 +14,10 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
+	promclient "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/contrib/bridges/otelslog"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -32,6 +36,8 @@ import (
 	sdkMetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdkTrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"learn-prometheus/webconfig"
 )
 
 var (
@@ -47,9 +53,29 @@ var (
 const packageName = "learn-prometheus"
 
 func main() {
+	webConfig := flag.String("web.config.file", "", "web.yml with the TLS and auth config of both servers, see web.example.yml at the root of the repo")
+	flag.Parse()
+
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
+	// The same TLS and auth for both servers, and the failures show up in :8091/metrics.
+	web, err := webconfig.New(*webConfig)
+	if err != nil {
+		panic(err)
+	}
+	promclient.MustRegister(web)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := web.Reload(); err != nil {
+				log.Printf("failed to reload the web config: %v\n", err)
+			}
+		}
+	}()
+
 	exp, err := newJaegerExporter(ctx)
 	// exp, err := newConsoleExporter()
 	if err != nil {
@@ -159,7 +185,7 @@ func main() {
 	}
 	srvErr := make(chan error, 1)
 	go func() {
-		srvErr <- srv.ListenAndServe()
+		srvErr <- web.ListenAndServe(srv)
 	}()
 
 	// Start another Server to export prometheus metrics.
@@ -167,8 +193,8 @@ func main() {
 	go func() {
 		log.Printf("serving metrics at localhost:8091/metrics")
 		http.Handle("/metrics", promhttp.Handler())
-		err := http.ListenAndServe(":8091", nil)
-		if err != nil {
+		err := web.ListenAndServe(&http.Server{Addr: ":8091"})
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			fmt.Printf("error serving http: %v", err)
 			return
 		}
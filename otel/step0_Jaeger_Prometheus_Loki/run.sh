@@ -8,4 +8,4 @@
 # Prometheus in the prometheus-server, may need to adjust the prometheus.yml file to match with the export endpoint.
 # ./prometheus --config.file=/home/piapip/Desktop/Tutorial/prometheus/otel/step0_Jaeger_Prometheus_Loki/docker/prometheus.yml
 
-OTEL_RESOURCE_ATTRIBUTES="service.name=dice,service.version=0.1.0" go run ./otel/step0_Jaeger_Prometheus_Loki/main.go
+OTEL_RESOURCE_ATTRIBUTES="service.name=dice,service.version=0.1.0" go run ./otel/step0_Jaeger_Prometheus_Loki/main.go "$@"
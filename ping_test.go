@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWait(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := wait(ctx, time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the deadline error", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("wait didn't stop at the deadline")
+	}
+
+	if err := wait(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("got %v, want no error", err)
+	}
+}
+
+func TestRequestStatus(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	timedOut, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+
+	testCases := []struct {
+		name string
+		ctx  context.Context
+		code int
+		want string
+	}{
+		{name: "pong", ctx: context.Background(), code: 200, want: statusOK},
+		{name: "injected fault", ctx: context.Background(), code: 503, want: statusError},
+		{name: "client left", ctx: canceled, want: statusCanceled},
+		{name: "deadline", ctx: timedOut, want: statusTimeout},
+		// Answered right before the deadline.
+		{name: "late pong", ctx: timedOut, code: 200, want: statusOK},
+	}
+
+	for _, tc := range testCases {
+		sw := &statusWriter{ResponseWriter: httptest.NewRecorder()}
+		if tc.code != 0 {
+			sw.WriteHeader(tc.code)
+		}
+		if got := requestStatus(tc.ctx, sw); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
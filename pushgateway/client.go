@@ -0,0 +1,188 @@
+// Package pushgateway is for the jobs that exit before Prometheus gets a chance to scrape them.
+//
+// A Client pushes everything a registry gathered to a Pushgateway (or anything talking the same API),
+// which keeps it until it's replaced or deleted, and exposes it on its own /metrics.
+// The metrics are stored per group: the job name and the grouping key, e.g. job="backup",instance="db1".
+// A Receiver is a minimal Pushgateway, running in the same process or on its own with cmd/pushgateway.
+//
+// The API, see https://github.com/prometheus/pushgateway#api:
+//   - PUT /metrics/job/<job>{/<label>/<value>}: replaces every metric of the group.
+//   - POST: replaces the metrics of the group with the same name as the pushed ones, keeps the others.
+//   - DELETE: deletes the group.
+//
+// A value with a / in it, or an empty one, is base64 encoded: /metrics/job/backup/path@base64/L3Zhci9sb2c=.
+package pushgateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Method is how a push treats the metrics already in the group.
+type Method string
+
+const (
+	// Replace is PUT: the group ends up with the pushed metrics only.
+	Replace Method = http.MethodPut
+	// Add is POST: the pushed metrics replace the ones with the same name, the others stay.
+	Add Method = http.MethodPost
+)
+
+// Client pushes the metrics of a Gatherer to one group.
+type Client struct {
+	url      string
+	job      string
+	grouping map[string]string
+	gatherer prometheus.Gatherer
+	client   *http.Client
+}
+
+// NewClient pushes to the Pushgateway at gatewayURL, e.g. http://localhost:9091, with the job as the group.
+// Add more grouping labels with Grouping.
+func NewClient(gatewayURL, job string, gatherer prometheus.Gatherer) *Client {
+	return &Client{
+		url:      strings.TrimSuffix(gatewayURL, "/"),
+		job:      job,
+		grouping: make(map[string]string),
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Grouping adds a label to the grouping key. The pushed metrics get it when they're scraped,
+// they must not have it themselves.
+func (c *Client) Grouping(name, value string) *Client {
+	c.grouping[name] = value
+	return c
+}
+
+// Push replaces every metric of the group (PUT).
+func (c *Client) Push(ctx context.Context) error {
+	return c.push(ctx, Replace)
+}
+
+// Add replaces the metrics of the group with the same name as the pushed ones (POST).
+func (c *Client) Add(ctx context.Context) error {
+	return c.push(ctx, Add)
+}
+
+// Delete deletes the group, with all its metrics.
+func (c *Client) Delete(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, nil)
+}
+
+// PushOnExit runs the job and pushes its metrics when it's done, whatever happened:
+// when it fails, when ctx is canceled (on SIGTERM for instance), and when it panics.
+// The push uses its own timeout, ctx may be canceled already.
+func (c *Client) PushOnExit(ctx context.Context, method Method, job func(context.Context) error) (err error) {
+	defer func() {
+		pushCtx, cancel := context.WithTimeout(context.Background(), c.client.Timeout)
+		defer cancel()
+		pushErr := c.push(pushCtx, method)
+
+		if r := recover(); r != nil {
+			// The metrics are out, the panic can go on.
+			panic(r)
+		}
+		err = errors.Join(err, pushErr)
+	}()
+
+	return job(ctx)
+}
+
+func (c *Client) push(ctx context.Context, method Method) error {
+	families, err := c.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	// The Pushgateway adds the grouping labels, a metric with one of them would be refused.
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if _, ok := c.grouping[lp.GetName()]; ok || lp.GetName() == "job" {
+					return fmt.Errorf("metric %s has the grouping label %s", mf.GetName(), lp.GetName())
+				}
+			}
+		}
+	}
+
+	var body bytes.Buffer
+	enc := expfmt.NewEncoder(&body, expfmt.NewFormat(expfmt.TypeProtoDelim))
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			return fmt.Errorf("failed to encode %s: %w", mf.GetName(), err)
+		}
+	}
+
+	return c.do(ctx, string(method), &body)
+}
+
+func (c *Client) do(ctx context.Context, method string, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.url+GroupPath(c.job, c.grouping), body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", string(expfmt.NewFormat(expfmt.TypeProtoDelim)))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to %s metrics: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+// GroupPath is the path of a group, the grouping labels sorted by name.
+func GroupPath(job string, grouping map[string]string) string {
+	var b strings.Builder
+	b.WriteString("/metrics/job")
+	writeLabel(&b, job)
+
+	names := make([]string, 0, len(grouping))
+	for name := range grouping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		b.WriteString("/" + name)
+		writeLabel(&b, grouping[name])
+	}
+
+	return b.String()
+}
+
+func writeLabel(b *strings.Builder, value string) {
+	if value == "" || strings.Contains(value, "/") {
+		// An empty value is encoded as =, the base64 of nothing being nothing.
+		encoded := base64.RawURLEncoding.EncodeToString([]byte(value))
+		if encoded == "" {
+			encoded = "="
+		}
+		b.WriteString("@base64/" + encoded)
+		return
+	}
+
+	b.WriteString("/" + url.PathEscape(value))
+}
@@ -0,0 +1,150 @@
+package pushgateway
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPushAndScrape(t *testing.T) {
+	receiver := NewReceiver()
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	processed := prometheus.NewCounter(prometheus.CounterOpts{Name: "backup_files_processed_total", Help: "Files backed up."})
+	lastSuccess := prometheus.NewGauge(prometheus.GaugeOpts{Name: "backup_last_success_timestamp_seconds", Help: "Last time the backup succeeded."})
+	reg.MustRegister(processed, lastSuccess)
+
+	ctx := context.Background()
+	client := NewClient(srv.URL, "backup", reg).Grouping("instance", "db1").Grouping("path", "/var/lib")
+
+	processed.Add(3)
+	lastSuccess.Set(1700000000)
+	if err := client.Push(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP backup_files_processed_total Files backed up.
+# TYPE backup_files_processed_total counter
+backup_files_processed_total{instance="db1",job="backup",path="/var/lib"} 3
+`
+	if err := testutil.GatherAndCompare(receiver, strings.NewReader(want), "backup_files_processed_total"); err != nil {
+		t.Error(err)
+	}
+
+	// POST only replaces what's pushed, PUT replaces everything.
+	other := prometheus.NewRegistry()
+	other.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "backup_size_bytes", Help: "Size of the backup."}))
+	otherClient := NewClient(srv.URL, "backup", other).Grouping("instance", "db1").Grouping("path", "/var/lib")
+
+	if err := otherClient.Add(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := testutil.GatherAndCount(receiver, "backup_files_processed_total", "backup_size_bytes"); err != nil || n != 2 {
+		t.Errorf("after POST: got %d series (%v), want both metrics", n, err)
+	}
+
+	if err := otherClient.Push(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := testutil.GatherAndCount(receiver, "backup_files_processed_total", "backup_size_bytes"); err != nil || n != 1 {
+		t.Errorf("after PUT: got %d series (%v), want backup_size_bytes only", n, err)
+	}
+
+	if err := client.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := testutil.GatherAndCount(receiver); err != nil || n != 0 {
+		t.Errorf("after DELETE: got %d series (%v), want none", n, err)
+	}
+}
+
+func TestPushOnExit(t *testing.T) {
+	receiver := NewReceiver()
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	failures := prometheus.NewCounter(prometheus.CounterOpts{Name: "job_failures_total", Help: "Failed runs."})
+	reg.MustRegister(failures)
+
+	jobErr := errors.New("disk full")
+	err := NewClient(srv.URL, "cleanup", reg).PushOnExit(context.Background(), Replace, func(context.Context) error {
+		failures.Inc()
+		return jobErr
+	})
+	if !errors.Is(err, jobErr) {
+		t.Errorf("got %v, want the job error", err)
+	}
+
+	if n, err := testutil.GatherAndCount(receiver, "job_failures_total", "push_time_seconds"); err != nil || n != 2 {
+		t.Errorf("got %d series (%v), want the metrics pushed even though the job failed", n, err)
+	}
+}
+
+func TestReceiverRefuses(t *testing.T) {
+	receiver := NewReceiver()
+
+	push := func(method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		receiver.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := push(http.MethodPut, "/metrics/job/a/instance/x", "# TYPE jobs counter\njobs_total 1\n"); code != http.StatusOK {
+		t.Fatalf("got %d for a good text push", code)
+	}
+
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{name: "no job", method: http.MethodPut, path: "/metrics/instance/x", body: "up 1\n"},
+		{name: "label without value", method: http.MethodPut, path: "/metrics/job/a/instance", body: "up 1\n"},
+		{name: "timestamp", method: http.MethodPut, path: "/metrics/job/a", body: "up 1 1700000000000\n"},
+		{name: "grouping label mismatch", method: http.MethodPut, path: "/metrics/job/a", body: `up{job="b"} 1` + "\n"},
+		{name: "type conflict with another group", method: http.MethodPost, path: "/metrics/job/b", body: "# TYPE jobs_total gauge\njobs_total 1\n"},
+		{name: "not text", method: http.MethodPut, path: "/metrics/job/a", body: "{}"},
+		{name: "GET", method: http.MethodGet, path: "/metrics/job/a"},
+	}
+
+	for _, tc := range testCases {
+		if code := push(tc.method, tc.path, tc.body); code/100 != 4 {
+			t.Errorf("%s: got %d, want a 4xx", tc.name, code)
+		}
+	}
+
+	// The job name itself can be base64 encoded, the group is the same.
+	if code := push(http.MethodDelete, "/metrics/job@base64/YQ/instance/x", ""); code != http.StatusAccepted {
+		t.Fatalf("got %d deleting the group", code)
+	}
+	if n, err := testutil.GatherAndCount(receiver); err != nil || n != 0 {
+		t.Errorf("got %d series (%v), want none", n, err)
+	}
+}
+
+func TestGroupPath(t *testing.T) {
+	got := GroupPath("backup", map[string]string{"path": "/var/lib", "instance": "db 1", "env": ""})
+	want := "/metrics/job/backup/env@base64/=/instance/db%201/path@base64/L3Zhci9saWI"
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	labels, err := parseGroupPath("/metrics/job/backup/env@base64/=/instance/db 1/path@base64/L3Zhci9saWI=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labels["env"] != "" || labels["instance"] != "db 1" || labels["path"] != "/var/lib" || len(labels) != 4 {
+		t.Errorf("got %v", labels)
+	}
+}
@@ -0,0 +1,305 @@
+package pushgateway
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxPushSize caps the body of a push, a batch job has no reason to push thousands of series.
+const maxPushSize = 16 << 20
+
+// Receiver is a minimal Pushgateway: it stores what's pushed to /metrics/job/... and gathers it for /metrics,
+// with the grouping labels added to every metric.
+//
+// Like the Pushgateway, every group also gets push_time_seconds, the last time it was pushed to,
+// to alert on jobs that haven't run for too long: time() - push_time_seconds{job="backup"} > 86400.
+// Nothing expires, a group stays until it's deleted.
+//
+// Prometheus has to scrape it with honor_labels: true, so the job and instance labels of the pushed metrics
+// aren't overwritten by the ones of the Receiver.
+type Receiver struct {
+	mtx    sync.Mutex
+	groups map[string]*group
+	now    func() time.Time
+}
+
+type group struct {
+	labels   map[string]string
+	families map[string]*dto.MetricFamily
+	pushTime time.Time
+}
+
+var _ prometheus.Gatherer = (*Receiver)(nil)
+
+func NewReceiver() *Receiver {
+	return &Receiver{groups: make(map[string]*group), now: time.Now}
+}
+
+// ServeHTTP handles /metrics/job/<job>{/<label>/<value>}, with PUT, POST and DELETE.
+// Both the text format and the delimited protobuf one are accepted, depending on the Content-Type.
+func (rc *Receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	labels, err := parseGroupPath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := GroupPath(labels["job"], without(labels, "job"))
+
+	switch r.Method {
+	case http.MethodDelete:
+		rc.mtx.Lock()
+		delete(rc.groups, key)
+		rc.mtx.Unlock()
+
+		w.WriteHeader(http.StatusAccepted)
+		return
+
+	case http.MethodPut, http.MethodPost:
+
+	default:
+		w.Header().Set("Allow", "PUT, POST, DELETE")
+		http.Error(w, "push with PUT or POST, delete with DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	families, err := decode(http.MaxBytesReader(w, r.Body, maxPushSize), expfmt.ResponseFormat(r.Header))
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if err := rc.push(key, labels, families, r.Method == http.MethodPut); err != nil {
+		log.Printf("pushgateway: push to %s refused: %v\n", key, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 200 like the Pushgateway, the metrics are stored when it answers.
+	w.WriteHeader(http.StatusOK)
+}
+
+func decode(body io.Reader, format expfmt.Format) (families map[string]*dto.MetricFamily, err error) {
+	// The text parser panics on some garbage, e.g. a body starting with {.
+	defer func() {
+		if r := recover(); r != nil {
+			families, err = nil, fmt.Errorf("failed to decode the pushed metrics: %v", r)
+		}
+	}()
+
+	dec := expfmt.NewDecoder(body, format)
+
+	families = make(map[string]*dto.MetricFamily)
+	for {
+		mf := &dto.MetricFamily{}
+		err := dec.Decode(mf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the pushed metrics: %w", err)
+		}
+		if _, ok := families[mf.GetName()]; ok {
+			return nil, fmt.Errorf("metric %s pushed twice", mf.GetName())
+		}
+		families[mf.GetName()] = mf
+	}
+
+	return families, nil
+}
+
+// push checks the pushed metrics first, a push is applied entirely or not at all.
+func (rc *Receiver) push(key string, labels map[string]string, families map[string]*dto.MetricFamily, replace bool) error {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+
+	for name, mf := range families {
+		if name == "push_time_seconds" {
+			return errors.New("push_time_seconds is added by the receiver, it can't be pushed")
+		}
+
+		for _, m := range mf.GetMetric() {
+			if m.TimestampMs != nil {
+				return fmt.Errorf("metric %s has a timestamp, pushed metrics can't have one", name)
+			}
+			for _, lp := range m.GetLabel() {
+				if value, ok := labels[lp.GetName()]; ok && value != lp.GetValue() {
+					return fmt.Errorf("metric %s has %s=%q, the grouping key says %q", name, lp.GetName(), lp.GetValue(), value)
+				}
+			}
+		}
+
+		// The same name in another group with another type couldn't be exposed as one family.
+		for otherKey, other := range rc.groups {
+			if otherMF, ok := other.families[name]; ok && otherKey != key && otherMF.GetType() != mf.GetType() {
+				return fmt.Errorf("metric %s is a %s, it's a %s in %s", name, mf.GetType(), otherMF.GetType(), otherKey)
+			}
+		}
+	}
+
+	g, ok := rc.groups[key]
+	if !ok || replace {
+		g = &group{labels: labels, families: make(map[string]*dto.MetricFamily)}
+		rc.groups[key] = g
+	}
+	for name, mf := range families {
+		g.families[name] = mf
+	}
+	g.pushTime = rc.now()
+
+	return nil
+}
+
+// Gather returns the metrics of every group, each with the labels of its grouping key.
+func (rc *Receiver) Gather() ([]*dto.MetricFamily, error) {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+
+	merged := make(map[string]*dto.MetricFamily)
+	add := func(mf *dto.MetricFamily, metrics ...*dto.Metric) {
+		out, ok := merged[mf.GetName()]
+		if !ok {
+			out = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+			merged[mf.GetName()] = out
+		}
+		out.Metric = append(out.Metric, metrics...)
+	}
+
+	for _, g := range rc.groups {
+		for _, mf := range g.families {
+			for _, m := range mf.GetMetric() {
+				add(mf, withGroupLabels(m, g.labels))
+			}
+		}
+
+		pushTime := &dto.MetricFamily{
+			Name: proto.String("push_time_seconds"),
+			Help: proto.String("Last Unix time when changing this group in the Pushgateway succeeded."),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+		add(pushTime, withGroupLabels(&dto.Metric{
+			Gauge: &dto.Gauge{Value: proto.Float64(float64(g.pushTime.UnixNano()) / 1e9)},
+		}, g.labels))
+	}
+
+	families := make([]*dto.MetricFamily, 0, len(merged))
+	for _, mf := range merged {
+		sort.Slice(mf.Metric, func(i, j int) bool { return labelsKey(mf.Metric[i]) < labelsKey(mf.Metric[j]) })
+		families = append(families, mf)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+
+	return families, nil
+}
+
+// withGroupLabels copies m with the grouping labels, the labels are sorted by name like the registry does it.
+func withGroupLabels(m *dto.Metric, groupLabels map[string]string) *dto.Metric {
+	out := proto.Clone(m).(*dto.Metric)
+
+	have := make(map[string]bool, len(out.Label))
+	for _, lp := range out.Label {
+		have[lp.GetName()] = true
+	}
+	for name, value := range groupLabels {
+		if !have[name] {
+			out.Label = append(out.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+		}
+	}
+	sort.Slice(out.Label, func(i, j int) bool { return out.Label[i].GetName() < out.Label[j].GetName() })
+
+	return out
+}
+
+func labelsKey(m *dto.Metric) string {
+	var b strings.Builder
+	for _, lp := range m.GetLabel() {
+		b.WriteString(lp.GetName() + "\xff" + lp.GetValue() + "\xff")
+	}
+
+	return b.String()
+}
+
+// parseGroupPath reads the grouping key from /metrics/job/<job>{/<label>/<value>}.
+func parseGroupPath(path string) (map[string]string, error) {
+	rest, ok := strings.CutPrefix(path, "/metrics/")
+	if !ok {
+		return nil, fmt.Errorf("%s is not a group, expected /metrics/job/<job>{/<label>/<value>}", path)
+	}
+
+	parts := strings.Split(strings.TrimSuffix(rest, "/"), "/")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%s is not a group, expected /metrics/job/<job>{/<label>/<value>}", path)
+	}
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("%s: label %s has no value", path, parts[len(parts)-1])
+	}
+
+	labels := make(map[string]string, len(parts)/2)
+	for i := 0; i < len(parts); i += 2 {
+		name, value := parts[i], parts[i+1]
+
+		if encoded, ok := strings.CutSuffix(name, "@base64"); ok {
+			name = encoded
+			decoded, err := decodeBase64(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid base64 value for %s: %w", path, name, err)
+			}
+			value = decoded
+		}
+
+		if i == 0 && name != "job" {
+			return nil, fmt.Errorf("%s: the grouping key starts with the job", path)
+		}
+		if !model.LabelName(name).IsValidLegacy() || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("%s: invalid label name %q", path, name)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("%s: label %s given twice", path, name)
+		}
+		if name == "job" && value == "" {
+			return nil, fmt.Errorf("%s: the job can't be empty", path)
+		}
+		labels[name] = value
+	}
+
+	return labels, nil
+}
+
+// decodeBase64 accepts the URL safe alphabet, padded or not, = alone being the empty string.
+func decodeBase64(s string) (string, error) {
+	if s == "=" {
+		return "", nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	return string(b), err
+}
+
+func without(labels map[string]string, name string) map[string]string {
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if k != name {
+			out[k] = v
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,142 @@
+// Package quantile is the histogram_quantile algorithm of Prometheus,
+// the same one I walked through by hand in prometheus.txt and main_test.go,
+// so the tools in this repo can estimate p50/p99/... from histogram buckets without a Prometheus server.
+//
+// Source: https://github.com/prometheus/prometheus/blob/caa173d2aac4c390546b1f78302104b1ccae0878/promql/quantile.go#L49-L73
+package quantile
+
+import (
+	"math"
+	"sort"
+)
+
+// Bucket is a cumulative histogram bucket: Count is the number of observations <= UpperBound,
+// same as the le label of a _bucket series.
+type Bucket struct {
+	UpperBound float64
+	Count      float64
+}
+
+// Buckets implements sort.Interface.
+type Buckets []Bucket
+
+func (b Buckets) Len() int           { return len(b) }
+func (b Buckets) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b Buckets) Less(i, j int) bool { return b[i].UpperBound < b[j].UpperBound }
+
+// BucketQuantile calculates the φ-quantile (q) of the buckets.
+// The counts can be raw counts or rates/increases, the result is the same.
+//
+// The buckets are sorted in place, and there must be a +Inf bucket, otherwise the result is NaN.
+// The result is an educated guess: it assumes the observations are spread evenly inside a bucket,
+// so it's linearly interpolated between the lower and the upper bound of the bucket holding the quantile.
+func BucketQuantile(q float64, buckets Buckets) float64 {
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(+1)
+	}
+	if len(buckets) == 0 {
+		return math.NaN()
+	}
+	sort.Sort(buckets)
+	if !math.IsInf(buckets[len(buckets)-1].UpperBound, +1) {
+		return math.NaN()
+	}
+
+	buckets = coalesceBuckets(buckets)
+	ensureMonotonic(buckets)
+
+	if len(buckets) < 2 {
+		return math.NaN()
+	}
+	observations := buckets[len(buckets)-1].Count
+	if observations == 0 {
+		return math.NaN()
+	}
+	rank := q * observations
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].Count >= rank })
+
+	if b == len(buckets)-1 {
+		return buckets[len(buckets)-2].UpperBound
+	}
+	if b == 0 && buckets[0].UpperBound <= 0 {
+		return buckets[0].UpperBound
+	}
+	var (
+		bucketStart float64
+		bucketEnd   = buckets[b].UpperBound
+		count       = buckets[b].Count
+	)
+	if b > 0 {
+		bucketStart = buckets[b-1].UpperBound
+		count -= buckets[b-1].Count
+		rank -= buckets[b-1].Count
+	}
+
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
+}
+
+// coalesceBuckets merges buckets with the same upper bound.
+//
+// The input buckets must be sorted.
+func coalesceBuckets(buckets Buckets) Buckets {
+	last := buckets[0]
+	i := 0
+	for _, b := range buckets[1:] {
+		if b.UpperBound == last.UpperBound {
+			last.Count += b.Count
+		} else {
+			buckets[i] = last
+			last = b
+			i++
+		}
+	}
+	buckets[i] = last
+	return buckets[:i+1]
+}
+
+// The assumption that bucket counts increase monotonically with increasing
+// upperBound may be violated during:
+//
+//   - Recording rule evaluation of histogram_quantile, especially when rate()
+//     has been applied to the underlying bucket timeseries.
+//   - Evaluation of histogram_quantile computed over federated bucket
+//     timeseries, especially when rate() has been applied.
+//
+// This is because scraped data is not made available to rule evaluation or
+// federation atomically, so some buckets are computed with data from the
+// most recent scrapes, but the other buckets are missing data from the most
+// recent scrape.
+//
+// Monotonicity is usually guaranteed because if a bucket with upper bound
+// u1 has count c1, then any bucket with a higher upper bound u > u1 must
+// have counted all c1 observations and perhaps more, so that c  >= c1.
+//
+// Randomly interspersed partial sampling breaks that guarantee, and rate()
+// exacerbates it. Specifically, suppose bucket le=1000 has a count of 10 from
+// 4 samples but the bucket with le=2000 has a count of 7 from 3 samples. The
+// monotonicity is broken. It is exacerbated by rate() because under normal
+// operation, cumulative counting of buckets will cause the bucket counts to
+// diverge such that small differences from missing samples are not a problem.
+// rate() removes this divergence.)
+//
+// BucketQuantile depends on that monotonicity to do a binary search for the
+// bucket with the φ-quantile count, so breaking the monotonicity
+// guarantee causes BucketQuantile() to return undefined (nonsense) results.
+//
+// As a somewhat hacky solution until ingestion is atomic per scrape, we
+// calculate the "envelope" of the histogram buckets, essentially removing
+// any decreases in the count between successive buckets.
+func ensureMonotonic(buckets Buckets) {
+	max := buckets[0].Count
+	for i := 1; i < len(buckets); i++ {
+		switch {
+		case buckets[i].Count > max:
+			max = buckets[i].Count
+		case buckets[i].Count < max:
+			buckets[i].Count = max
+		}
+	}
+}
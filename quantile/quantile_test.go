@@ -0,0 +1,70 @@
+package quantile
+
+import (
+	"math"
+	"testing"
+)
+
+// buckets of prometheus.txt: 0.99 falls in the (1, 2] bucket.
+func example() Buckets {
+	return Buckets{
+		{UpperBound: 0.01, Count: 900_000},
+		{UpperBound: 0.05, Count: 1_800_000},
+		{UpperBound: 0.1, Count: 2_250_000},
+		{UpperBound: 0.2, Count: 2_550_000},
+		{UpperBound: 0.3, Count: 2_790_000},
+		{UpperBound: 0.5, Count: 2_910_000},
+		{UpperBound: 1, Count: 2_970_000},
+		{UpperBound: 2, Count: 2_982_000},
+		{UpperBound: 5, Count: 2_983_500},
+		{UpperBound: math.Inf(+1), Count: 2_983_800},
+	}
+}
+
+func TestBucketQuantile(t *testing.T) {
+	inf := math.Inf(+1)
+	tests := []struct {
+		name    string
+		q       float64
+		buckets Buckets
+		want    float64
+	}{
+		// rank 2_953_962 is 43_962 into the 60_000 of (0.5, 1].
+		{name: "p99", q: 0.99, buckets: example(), want: 0.5 + 0.5*43_962/60_000},
+		{name: "p50", q: 0.5, buckets: example(), want: 0.01 + 0.04*(1_491_900-900_000)/900_000},
+		{name: "q=0", q: 0, buckets: example(), want: 0},
+		{name: "q=1 in +Inf", q: 1, buckets: example(), want: 5},
+		{name: "q<0", q: -0.1, buckets: example(), want: math.Inf(-1)},
+		{name: "q>1", q: 1.1, buckets: example(), want: math.Inf(+1)},
+		{name: "no buckets", q: 0.5, want: math.NaN()},
+		{name: "no +Inf", q: 0.5, buckets: Buckets{{UpperBound: 1, Count: 10}}, want: math.NaN()},
+		{name: "only +Inf", q: 0.5, buckets: Buckets{{UpperBound: inf, Count: 10}}, want: math.NaN()},
+		{name: "no observations", q: 0.5, buckets: Buckets{{UpperBound: 1}, {UpperBound: inf}}, want: math.NaN()},
+		// Everything above the last finite bound: its upper bound is the best guess.
+		{name: "all in +Inf", q: 0.5, buckets: Buckets{{UpperBound: 1}, {UpperBound: inf, Count: 10}}, want: 1},
+		// The first bucket goes down to 0, or is the answer if it's not above 0.
+		{name: "first bucket", q: 0.5, buckets: Buckets{{UpperBound: 2, Count: 10}, {UpperBound: inf, Count: 10}}, want: 1},
+		{name: "first bucket negative", q: 0.5, buckets: Buckets{{UpperBound: -1, Count: 10}, {UpperBound: inf, Count: 10}}, want: -1},
+		{
+			name:    "unsorted, duplicated, not monotonic",
+			q:       0.5,
+			buckets: Buckets{{UpperBound: inf, Count: 10}, {UpperBound: 2, Count: 4}, {UpperBound: 1, Count: 4}, {UpperBound: 3, Count: 2}, {UpperBound: 2, Count: 2}},
+			// 1: 4, 2: 6, 3: 6 raised from 2, +Inf: 10: rank 5 is halfway in (1, 2].
+			want: 1.5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := BucketQuantile(tt.q, tt.buckets)
+			if math.IsNaN(tt.want) {
+				if !math.IsNaN(got) {
+					t.Errorf("got %v, want NaN", got)
+				}
+				return
+			}
+			if math.Abs(got-tt.want) > 1e-9 && got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package remotewrite
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/golang/snappy"
+
+	"learn-prometheus/metricstore"
+)
+
+// maxDecodedSize caps how big a single WriteRequest can be after decompression.
+// Prometheus sends batches of max 2000 samples by default (queue_config.max_samples_per_send),
+// so 32MB is way more than enough.
+const maxDecodedSize = 32 << 20
+
+// Appender is where the received samples end up, metricstore.Store is one.
+type Appender interface {
+	Append(lset metricstore.Labels, t int64, v float64) error
+}
+
+// Handler receives remote_write requests and appends every sample to the Appender.
+//
+// The response code tells the sender what to do next, the same way Prometheus does it:
+//   - 2xx: all good.
+//   - 4xx: the data is bad (can't decode, invalid labels, out of order, ...), resending won't help,
+//     so the sender drops the batch.
+//   - 5xx: something is wrong on our side, the sender keeps the batch and retries later.
+type Handler struct {
+	appender Appender
+}
+
+func NewHandler(appender Appender) *Handler {
+	return &Handler{appender: appender}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "remote_write only accepts POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if enc := r.Header.Get("Content-Encoding"); enc != "" && enc != "snappy" {
+		http.Error(w, fmt.Sprintf("unsupported Content-Encoding %q, expected snappy", enc), http.StatusUnsupportedMediaType)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" && ct != "application/x-protobuf" {
+		http.Error(w, fmt.Sprintf("unsupported Content-Type %q, expected application/x-protobuf", ct), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	req, status, err := decodeRequest(r)
+	if err != nil {
+		log.Printf("remote_write: failed to decode request from %s: %v\n", r.RemoteAddr, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if err := h.append(req); err != nil {
+		status := http.StatusInternalServerError
+		if metricstore.IsBadData(err) {
+			status = http.StatusBadRequest
+		}
+
+		log.Printf("remote_write: failed to append samples from %s: %v\n", r.RemoteAddr, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeRequest reads, decompresses and decodes the request body.
+// The returned status code is the one to answer with when the error is not nil.
+func decodeRequest(r *http.Request) (*WriteRequest, int, error) {
+	compressed, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxDecodedSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("request body is larger than %d bytes", maxDecodedSize)
+		}
+		// The sender hung up or the connection broke in the middle, let it try again.
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to read request body: %w", err)
+	}
+
+	decodedLen, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid snappy payload: %w", err)
+	}
+	if decodedLen > maxDecodedSize {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("decoded request is %d bytes, max is %d", decodedLen, maxDecodedSize)
+	}
+
+	raw, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid snappy payload: %w", err)
+	}
+
+	var req WriteRequest
+	if err := req.Unmarshal(raw); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid protobuf payload: %w", err)
+	}
+
+	return &req, 0, nil
+}
+
+// append stores everything it can.
+// Bad samples don't stop the good ones in the same batch from being stored,
+// otherwise one broken series would make the sender drop everything else too.
+// Storage errors do stop it though, since the whole batch will be retried:
+// the samples appended before the error are identical in the retry, the store accepts them again.
+func (h *Handler) append(req *WriteRequest) error {
+	var (
+		firstBadErr error
+		badSamples  int
+	)
+
+	for _, ts := range req.Timeseries {
+		lset := make(metricstore.Labels, 0, len(ts.Labels))
+		for _, l := range ts.Labels {
+			lset = append(lset, metricstore.Label{Name: l.Name, Value: l.Value})
+		}
+
+		for _, s := range ts.Samples {
+			err := h.appender.Append(lset, s.Timestamp, s.Value)
+			if err == nil {
+				continue
+			}
+			if !metricstore.IsBadData(err) {
+				return err
+			}
+
+			badSamples++
+			if firstBadErr == nil {
+				firstBadErr = err
+			}
+		}
+	}
+
+	if firstBadErr != nil {
+		return fmt.Errorf("rejected %d samples, first error: %w", badSamples, firstBadErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package remotewrite
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+
+	"learn-prometheus/metricstore"
+)
+
+func send(t *testing.T, h http.Handler, req *WriteRequest) int {
+	t.Helper()
+
+	body := snappy.Encode(nil, req.Marshal())
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(body))
+	r.Header.Set("Content-Encoding", "snappy")
+	r.Header.Set("Content-Type", "application/x-protobuf")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w.Code
+}
+
+func series(name string, samples ...Sample) TimeSeries {
+	return TimeSeries{
+		Labels:  []Label{{Name: "__name__", Value: name}, {Name: "endpoint", Value: "/ping"}},
+		Samples: samples,
+	}
+}
+
+func TestHandler(t *testing.T) {
+	store := metricstore.New()
+	h := NewHandler(store)
+
+	ok := &WriteRequest{Timeseries: []TimeSeries{
+		series("ping_request_count", Sample{Value: 1, Timestamp: 1000}, Sample{Value: 2, Timestamp: 2000}),
+	}}
+	if code := send(t, h, ok); code != http.StatusNoContent {
+		t.Fatalf("valid request: got %d, want %d", code, http.StatusNoContent)
+	}
+
+	// Resending the newest sample (a retry after a timeout) is fine.
+	retry := &WriteRequest{Timeseries: []TimeSeries{
+		series("ping_request_count", Sample{Value: 2, Timestamp: 2000}),
+	}}
+	if code := send(t, h, retry); code != http.StatusNoContent {
+		t.Fatalf("resent request: got %d, want %d", code, http.StatusNoContent)
+	}
+
+	outOfOrder := &WriteRequest{Timeseries: []TimeSeries{
+		series("ping_request_count", Sample{Value: 3, Timestamp: 1500}),
+		// The good series in the same batch must still be stored.
+		series("ping_other", Sample{Value: 1, Timestamp: 1500}),
+	}}
+	if code := send(t, h, outOfOrder); code != http.StatusBadRequest {
+		t.Fatalf("out of order request: got %d, want %d", code, http.StatusBadRequest)
+	}
+
+	badLabels := &WriteRequest{Timeseries: []TimeSeries{{
+		Labels:  []Label{{Name: "__name__", Value: "ping"}, {Name: "0bad", Value: "x"}},
+		Samples: []Sample{{Value: 1, Timestamp: 1000}},
+	}}}
+	if code := send(t, h, badLabels); code != http.StatusBadRequest {
+		t.Fatalf("invalid labels: got %d, want %d", code, http.StatusBadRequest)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader([]byte("definitely not snappy")))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("garbage body: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	stats := store.Stats()
+	if stats.NumSeries != 2 || stats.NumSamples != 3 {
+		t.Fatalf("got %+v, want 2 series and 3 samples", stats)
+	}
+
+	got, err := store.Select(0, 5000, metricstore.MustNewMatcher(metricstore.MatchEqual, "__name__", "ping_request_count"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || len(got[0].Samples) != 2 {
+		t.Fatalf("unexpected select result: %+v", got)
+	}
+}
+
+// failingAppender fails with a storage error once it appended ok samples.
+type failingAppender struct {
+	*metricstore.Store
+	ok int
+}
+
+func (a *failingAppender) Append(lset metricstore.Labels, t int64, v float64) error {
+	if a.ok == 0 {
+		return errors.New("disk full")
+	}
+	a.ok--
+	return a.Store.Append(lset, t, v)
+}
+
+func TestHandlerRetry(t *testing.T) {
+	store := metricstore.New()
+
+	batch := &WriteRequest{Timeseries: []TimeSeries{
+		series("ping_request_count", Sample{Value: 1, Timestamp: 1000}, Sample{Value: 2, Timestamp: 2000}, Sample{Value: 3, Timestamp: 3000}),
+		series("ping_other", Sample{Value: math.NaN(), Timestamp: 1000}),
+	}}
+	if code := send(t, NewHandler(&failingAppender{Store: store, ok: 2}), batch); code != http.StatusInternalServerError {
+		t.Fatalf("failed half-way: got %d, want %d", code, http.StatusInternalServerError)
+	}
+
+	// The retry resends the 2 samples appended before the error.
+	h := NewHandler(store)
+	if code := send(t, h, batch); code != http.StatusNoContent {
+		t.Fatalf("retry: got %d, want %d", code, http.StatusNoContent)
+	}
+	if code := send(t, h, batch); code != http.StatusNoContent {
+		t.Fatalf("second retry: got %d, want %d", code, http.StatusNoContent)
+	}
+	if stats := store.Stats(); stats.NumSeries != 2 || stats.NumSamples != 4 {
+		t.Fatalf("got %+v, want 2 series and 4 samples", stats)
+	}
+
+	// A different value for a sample already stored is still bad data.
+	changed := &WriteRequest{Timeseries: []TimeSeries{
+		series("ping_request_count", Sample{Value: 5, Timestamp: 2000}),
+	}}
+	if code := send(t, h, changed); code != http.StatusBadRequest {
+		t.Fatalf("changed value: got %d, want %d", code, http.StatusBadRequest)
+	}
+}
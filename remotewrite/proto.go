@@ -0,0 +1,203 @@
+// Package remotewrite speaks the Prometheus remote_write protocol (v1):
+// a snappy compressed protobuf WriteRequest sent via HTTP POST.
+//
+// Pulling in github.com/prometheus/prometheus just for prompb is way too much,
+// so the few messages we need are decoded by hand with protowire.
+// The field numbers are from https://github.com/prometheus/prometheus/blob/main/prompb/types.proto
+// and https://github.com/prometheus/prometheus/blob/main/prompb/remote.proto.
+package remotewrite
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// WriteRequest is the body of a remote_write call.
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+// TimeSeries is one series with a batch of its samples.
+// Exemplars and native histograms are not supported, they are skipped when decoding.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample has its timestamp in milliseconds.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+const (
+	// WriteRequest
+	fieldTimeseries protowire.Number = 1
+
+	// TimeSeries
+	fieldLabels  protowire.Number = 1
+	fieldSamples protowire.Number = 2
+
+	// Label
+	fieldLabelName  protowire.Number = 1
+	fieldLabelValue protowire.Number = 2
+
+	// Sample
+	fieldSampleValue     protowire.Number = 1
+	fieldSampleTimestamp protowire.Number = 2
+)
+
+// Marshal encodes the request to protobuf (not compressed yet).
+func (req *WriteRequest) Marshal() []byte {
+	var b []byte
+	for _, ts := range req.Timeseries {
+		b = protowire.AppendTag(b, fieldTimeseries, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts.marshal())
+	}
+
+	return b
+}
+
+func (ts *TimeSeries) marshal() []byte {
+	var b []byte
+	for _, l := range ts.Labels {
+		var lb []byte
+		lb = protowire.AppendTag(lb, fieldLabelName, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.Name)
+		lb = protowire.AppendTag(lb, fieldLabelValue, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.Value)
+
+		b = protowire.AppendTag(b, fieldLabels, protowire.BytesType)
+		b = protowire.AppendBytes(b, lb)
+	}
+	for _, s := range ts.Samples {
+		var sb []byte
+		sb = protowire.AppendTag(sb, fieldSampleValue, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.Value))
+		sb = protowire.AppendTag(sb, fieldSampleTimestamp, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.Timestamp))
+
+		b = protowire.AppendTag(b, fieldSamples, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+
+	return b
+}
+
+// Unmarshal decodes a protobuf WriteRequest (already decompressed).
+func (req *WriteRequest) Unmarshal(b []byte) error {
+	req.Timeseries = req.Timeseries[:0]
+
+	return eachField(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != fieldTimeseries {
+			return nil
+		}
+		if typ != protowire.BytesType {
+			return fmt.Errorf("WriteRequest.timeseries: unexpected wire type %d", typ)
+		}
+
+		var ts TimeSeries
+		if err := ts.unmarshal(v); err != nil {
+			return err
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+
+		return nil
+	})
+}
+
+func (ts *TimeSeries) unmarshal(b []byte) error {
+	return eachField(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch num {
+		case fieldLabels:
+			if typ != protowire.BytesType {
+				return fmt.Errorf("TimeSeries.labels: unexpected wire type %d", typ)
+			}
+
+			var l Label
+			err := eachField(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				if typ != protowire.BytesType {
+					return fmt.Errorf("Label: unexpected wire type %d", typ)
+				}
+				switch num {
+				case fieldLabelName:
+					l.Name = string(v)
+				case fieldLabelValue:
+					l.Value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Labels = append(ts.Labels, l)
+
+		case fieldSamples:
+			if typ != protowire.BytesType {
+				return fmt.Errorf("TimeSeries.samples: unexpected wire type %d", typ)
+			}
+
+			var s Sample
+			err := eachField(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch {
+				case num == fieldSampleValue && typ == protowire.Fixed64Type:
+					bits, _ := protowire.ConsumeFixed64(v)
+					s.Value = math.Float64frombits(bits)
+				case num == fieldSampleTimestamp && typ == protowire.VarintType:
+					t, _ := protowire.ConsumeVarint(v)
+					s.Timestamp = int64(t)
+				case num == fieldSampleValue || num == fieldSampleTimestamp:
+					return fmt.Errorf("Sample: unexpected wire type %d for field %d", typ, num)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, s)
+		}
+
+		return nil
+	})
+}
+
+// eachField walks the top level fields of a message.
+// For varint and fixed fields, v is the raw encoded value; for bytes fields, v is the content.
+// Unknown fields are passed along too, the callback decides to skip them.
+func eachField(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("malformed protobuf tag: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		var v []byte
+		if typ == protowire.BytesType {
+			content, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return fmt.Errorf("malformed protobuf field %d: %w", num, protowire.ParseError(n))
+			}
+			v, b = content, b[n:]
+		} else {
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return fmt.Errorf("malformed protobuf field %d: %w", num, protowire.ParseError(n))
+			}
+			v, b = b[:n], b[n:]
+		}
+
+		if err := fn(num, typ, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,303 @@
+package scrape
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"learn-prometheus/quantile"
+)
+
+// Status is how a series changed between two snapshots.
+type Status string
+
+const (
+	StatusUnchanged Status = "unchanged"
+	StatusChanged   Status = "changed"
+	// StatusNew series are only in the second snapshot.
+	StatusNew Status = "new"
+	// StatusVanished series are only in the first snapshot.
+	StatusVanished Status = "vanished"
+	// StatusReset is a counter (or histogram, or summary) that went down: the process restarted in between.
+	StatusReset Status = "reset"
+)
+
+// Report is the difference between two snapshots.
+type Report struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Interval is what the rates are divided by, in seconds. 0 if unknown, then there's no rate.
+	Interval float64      `json:"interval"`
+	Series   []SeriesDiff `json:"series"`
+}
+
+// Value is a sample value, written as a string in JSON like in the exposition format:
+// NaN and ±Inf are valid values (a gauge can be NaN), but not valid JSON numbers.
+type Value float64
+
+func (v Value) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatFloat(float64(v), 'g', -1, 64))
+}
+
+func (v *Value) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sample value %q", s)
+	}
+	*v = Value(f)
+
+	return nil
+}
+
+// SeriesDiff is the difference of one series.
+//
+// For a histogram or a summary, Before, After and Delta are about the number of observations,
+// and Histogram has the details.
+type SeriesDiff struct {
+	Name   string `json:"name"`
+	Labels string `json:"labels"`
+	Type   string `json:"type"`
+	Status Status `json:"status"`
+
+	Before Value `json:"before"`
+	After  Value `json:"after"`
+	Delta  Value `json:"delta"`
+	// Rate is Delta per second, for counters, histograms and summaries.
+	Rate *Value `json:"rate,omitempty"`
+
+	Histogram *HistogramDiff `json:"histogram,omitempty"`
+}
+
+// HistogramDiff is what happened in the window: only the observations made between the 2 snapshots.
+type HistogramDiff struct {
+	Count Value `json:"count"`
+	Sum   Value `json:"sum"`
+	// Mean is Sum / Count, nil when there was no observation.
+	Mean    *Value        `json:"mean,omitempty"`
+	Buckets []BucketDelta `json:"buckets,omitempty"`
+	// Quantiles are estimated from the bucket deltas, like histogram_quantile(q, increase(...[window])).
+	Quantiles []QuantileValue `json:"quantiles,omitempty"`
+}
+
+// BucketDelta is the increase of a cumulative bucket.
+type BucketDelta struct {
+	// Le is a string because +Inf isn't valid JSON.
+	Le    string `json:"le"`
+	Delta Value  `json:"delta"`
+}
+
+type QuantileValue struct {
+	Q     float64 `json:"q"`
+	Value Value   `json:"value"`
+}
+
+// Diff compares two snapshots of the same endpoint. interval is the time between them in seconds,
+// if it's 0 the times of the snapshots are used.
+// The quantiles are estimated for every histogram, from the observations made in between.
+func Diff(before, after *Snapshot, interval float64, quantiles []float64) *Report {
+	report := &Report{From: before.Time, To: after.Time, Interval: interval}
+	if report.Interval <= 0 {
+		report.Interval = math.Max(0, after.Time.Sub(before.Time).Seconds())
+	}
+
+	old := indexSeries(before.Families)
+	cur := indexSeries(after.Families)
+
+	for key, a := range cur {
+		b, ok := old[key]
+		if !ok {
+			d := seriesDiff(a, nil, report.Interval, quantiles)
+			d.Status = StatusNew
+			report.Series = append(report.Series, d)
+			continue
+		}
+
+		report.Series = append(report.Series, seriesDiff(a, b, report.Interval, quantiles))
+	}
+	for key, b := range old {
+		if _, ok := cur[key]; !ok {
+			report.Series = append(report.Series, SeriesDiff{
+				Name:   b.name,
+				Labels: b.labels,
+				Type:   typeName(b.typ),
+				Status: StatusVanished,
+				Before: value(b),
+			})
+		}
+	}
+
+	sort.Slice(report.Series, func(i, j int) bool {
+		a, b := report.Series[i], report.Series[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Labels < b.Labels
+	})
+
+	return report
+}
+
+type series struct {
+	name   string
+	labels string
+	typ    dto.MetricType
+	metric *dto.Metric
+}
+
+func indexSeries(families []*dto.MetricFamily) map[string]*series {
+	index := make(map[string]*series)
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			s := &series{name: mf.GetName(), labels: formatLabels(m), typ: mf.GetType(), metric: m}
+			index[s.name+s.labels] = s
+		}
+	}
+
+	return index
+}
+
+func formatLabels(m *dto.Metric) string {
+	pairs := make([]string, 0, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", lp.GetName(), lp.GetValue()))
+	}
+	sort.Strings(pairs)
+
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+func typeName(t dto.MetricType) string {
+	return strings.ToLower(t.String())
+}
+
+// value is the number a series is compared with: the value for counters and gauges,
+// the number of observations for histograms and summaries.
+func value(s *series) Value {
+	m := s.metric
+	switch s.typ {
+	case dto.MetricType_COUNTER:
+		return Value(m.GetCounter().GetValue())
+	case dto.MetricType_GAUGE:
+		return Value(m.GetGauge().GetValue())
+	case dto.MetricType_HISTOGRAM:
+		return Value(m.GetHistogram().GetSampleCount())
+	case dto.MetricType_SUMMARY:
+		return Value(m.GetSummary().GetSampleCount())
+	}
+
+	return Value(m.GetUntyped().GetValue())
+}
+
+// seriesDiff compares a with b, b is nil for a new series: then everything a counted happened in the window.
+func seriesDiff(a, b *series, interval float64, quantiles []float64) SeriesDiff {
+	d := SeriesDiff{Name: a.name, Labels: a.labels, Type: typeName(a.typ), After: value(a)}
+	if b != nil {
+		d.Before = value(b)
+	}
+	if b != nil && b.typ != a.typ {
+		// Same name, different type, the process was changed and restarted.
+		d.Type = fmt.Sprintf("%s (was %s)", typeName(a.typ), typeName(b.typ))
+	}
+
+	cumulative := a.typ == dto.MetricType_COUNTER || a.typ == dto.MetricType_HISTOGRAM || a.typ == dto.MetricType_SUMMARY
+	reset := cumulative && b != nil && d.After < d.Before
+
+	switch {
+	case reset:
+		// The counter restarted from 0, all we know is that it went up by at least its current value.
+		d.Status = StatusReset
+		d.Delta = d.After
+	case b == nil && cumulative:
+		d.Delta = d.After
+	case b != nil:
+		d.Delta = d.After - d.Before
+	}
+
+	if d.Status == "" {
+		d.Status = StatusUnchanged
+		// A gauge that stays NaN or +Inf has a NaN delta, it didn't change though.
+		if d.Delta != 0 && (b == nil || math.Float64bits(float64(d.After)) != math.Float64bits(float64(d.Before))) {
+			d.Status = StatusChanged
+		}
+	}
+
+	if cumulative && interval > 0 {
+		rate := d.Delta / Value(interval)
+		d.Rate = &rate
+	}
+
+	switch a.typ {
+	case dto.MetricType_HISTOGRAM:
+		var prev *dto.Histogram
+		if b != nil && !reset && b.typ == a.typ {
+			prev = b.metric.GetHistogram()
+		}
+		d.Histogram = histogramDiff(a.metric.GetHistogram(), prev, quantiles)
+
+	case dto.MetricType_SUMMARY:
+		// The quantiles of a summary are computed by the client over its own window, they can't be subtracted.
+		// Only the count and the sum can.
+		d.Histogram = &HistogramDiff{Count: d.Delta, Sum: Value(a.metric.GetSummary().GetSampleSum())}
+		if b != nil && !reset && b.typ == a.typ {
+			d.Histogram.Sum -= Value(b.metric.GetSummary().GetSampleSum())
+		}
+		d.Histogram.Mean = mean(d.Histogram.Sum, d.Histogram.Count)
+	}
+
+	return d
+}
+
+func histogramDiff(cur, prev *dto.Histogram, quantiles []float64) *HistogramDiff {
+	h := &HistogramDiff{
+		Count: Value(cur.GetSampleCount()) - Value(prev.GetSampleCount()),
+		Sum:   Value(cur.GetSampleSum() - prev.GetSampleSum()),
+	}
+	h.Mean = mean(h.Sum, h.Count)
+
+	old := make(map[float64]float64)
+	for _, b := range prev.GetBucket() {
+		old[b.GetUpperBound()] = float64(b.GetCumulativeCount())
+	}
+
+	var buckets quantile.Buckets
+	for _, b := range cur.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), +1) {
+			continue
+		}
+		delta := float64(b.GetCumulativeCount()) - old[b.GetUpperBound()]
+		buckets = append(buckets, quantile.Bucket{UpperBound: b.GetUpperBound(), Count: delta})
+	}
+	// Like in Buckets, the +Inf bucket is the count, whether the format had it or not.
+	buckets = append(buckets, quantile.Bucket{UpperBound: math.Inf(+1), Count: float64(h.Count)})
+
+	for _, b := range buckets {
+		h.Buckets = append(h.Buckets, BucketDelta{Le: strconv.FormatFloat(b.UpperBound, 'g', -1, 64), Delta: Value(b.Count)})
+	}
+
+	for _, q := range quantiles {
+		if v := quantile.BucketQuantile(q, append(quantile.Buckets(nil), buckets...)); !math.IsNaN(v) {
+			h.Quantiles = append(h.Quantiles, QuantileValue{Q: q, Value: Value(v)})
+		}
+	}
+
+	return h
+}
+
+func mean(sum, count Value) *Value {
+	if count <= 0 {
+		return nil
+	}
+
+	m := sum / count
+	return &m
+}
@@ -0,0 +1,153 @@
+package scrape
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+const before = `# HELP ping_request_count Number of request handled by Ping handler
+# TYPE ping_request_count counter
+ping_request_count 100
+# HELP restarts_total A counter that gets reset.
+# TYPE restarts_total counter
+restarts_total 50
+# HELP queue_size Jobs waiting.
+# TYPE queue_size gauge
+queue_size{queue="a"} 10
+queue_size{queue="gone"} 3
+# HELP ping_process Histogram of the ping process
+# TYPE ping_process histogram
+ping_process_bucket{endpoint="/ping",le="0.1"} 90
+ping_process_bucket{endpoint="/ping",le="0.5"} 100
+ping_process_bucket{endpoint="/ping",le="+Inf"} 100
+ping_process_sum{endpoint="/ping"} 5
+ping_process_count{endpoint="/ping"} 100
+`
+
+const after = `# HELP ping_request_count Number of request handled by Ping handler
+# TYPE ping_request_count counter
+ping_request_count 160
+# HELP restarts_total A counter that gets reset.
+# TYPE restarts_total counter
+restarts_total 7
+# HELP queue_size Jobs waiting.
+# TYPE queue_size gauge
+queue_size{queue="a"} 4
+queue_size{queue="new"} 1
+# HELP ping_process Histogram of the ping process
+# TYPE ping_process histogram
+ping_process_bucket{endpoint="/ping",le="0.1"} 90
+ping_process_bucket{endpoint="/ping",le="0.5"} 200
+ping_process_bucket{endpoint="/ping",le="+Inf"} 200
+ping_process_sum{endpoint="/ping"} 35
+ping_process_count{endpoint="/ping"} 200
+`
+
+func snapshot(t *testing.T, text string, at time.Time) *Snapshot {
+	t.Helper()
+
+	families, err := Parse(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Snapshot{Time: at, Families: families}
+}
+
+func TestDiff(t *testing.T) {
+	start := time.Unix(1739000000, 0)
+	report := Diff(snapshot(t, before, start), snapshot(t, after, start.Add(30*time.Second)), 0, []float64{0.5, 0.99})
+
+	if report.Interval != 30 {
+		t.Errorf("got interval %g, want 30", report.Interval)
+	}
+
+	series := make(map[string]SeriesDiff)
+	for _, s := range report.Series {
+		series[s.Name+s.Labels] = s
+	}
+	if len(series) != 6 {
+		t.Fatalf("got %d series, want 6: %v", len(series), report.Series)
+	}
+
+	counter := series["ping_request_count{}"]
+	if counter.Status != StatusChanged || counter.Delta != 60 || counter.Rate == nil || *counter.Rate != 2 {
+		t.Errorf("got %+v for the counter", counter)
+	}
+
+	reset := series["restarts_total{}"]
+	if reset.Status != StatusReset || reset.Delta != 7 {
+		t.Errorf("got %+v for the reset counter", reset)
+	}
+
+	if g := series[`queue_size{queue="a"}`]; g.Status != StatusChanged || g.Delta != -6 || g.Rate != nil {
+		t.Errorf("got %+v for the gauge", g)
+	}
+	if g := series[`queue_size{queue="gone"}`]; g.Status != StatusVanished || g.Before != 3 {
+		t.Errorf("got %+v for the vanished gauge", g)
+	}
+	if g := series[`queue_size{queue="new"}`]; g.Status != StatusNew || g.After != 1 {
+		t.Errorf("got %+v for the new gauge", g)
+	}
+
+	// The 100 observations of the window are all between 0.1 and 0.5, even though 90% of all time are below 0.1.
+	h := series[`ping_process{endpoint="/ping"}`]
+	if h.Status != StatusChanged || h.Histogram == nil || h.Histogram.Count != 100 || *h.Histogram.Mean != 0.3 {
+		t.Fatalf("got %+v for the histogram", h)
+	}
+	if len(h.Histogram.Buckets) != 3 || h.Histogram.Buckets[0].Delta != 0 || h.Histogram.Buckets[2].Le != "+Inf" {
+		t.Errorf("got buckets %+v", h.Histogram.Buckets)
+	}
+	if len(h.Histogram.Quantiles) != 2 || math.Abs(float64(h.Histogram.Quantiles[0].Value)-0.3) > 1e-9 || math.Abs(float64(h.Histogram.Quantiles[1].Value)-0.496) > 1e-9 {
+		t.Errorf("got quantiles %+v, want p50 0.3 and p99 0.496", h.Histogram.Quantiles)
+	}
+}
+
+// TestDiffJSON checks the values that aren't JSON numbers, valid in the exposition format, still make it to JSON.
+func TestDiffJSON(t *testing.T) {
+	const before = `# TYPE temperature gauge
+temperature{sensor="broken"} NaN
+temperature{sensor="fixed"} NaN
+temperature{sensor="hot"} 1
+`
+	const after = `# TYPE temperature gauge
+temperature{sensor="broken"} NaN
+temperature{sensor="fixed"} 20
+temperature{sensor="hot"} +Inf
+temperature{sensor="cold"} -Inf
+`
+	start := time.Unix(1739000000, 0)
+	report := Diff(snapshot(t, before, start), snapshot(t, after, start.Add(30*time.Second)), 0, nil)
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	series := make(map[string]SeriesDiff)
+	for _, s := range decoded.Series {
+		series[s.Labels] = s
+	}
+	if s := series[`{sensor="broken"}`]; s.Status != StatusUnchanged || !math.IsNaN(float64(s.After)) {
+		t.Errorf("got %+v for the gauge staying NaN", s)
+	}
+	if s := series[`{sensor="fixed"}`]; s.Status != StatusChanged || !math.IsNaN(float64(s.Before)) || s.After != 20 {
+		t.Errorf("got %+v for the gauge going from NaN to 20", s)
+	}
+	if s := series[`{sensor="hot"}`]; s.Status != StatusChanged || !math.IsInf(float64(s.Delta), +1) {
+		t.Errorf("got %+v for the gauge going to +Inf", s)
+	}
+	if s := series[`{sensor="cold"}`]; s.Status != StatusNew || !math.IsInf(float64(s.After), -1) {
+		t.Errorf("got %+v for the new -Inf gauge", s)
+	}
+	if !strings.Contains(string(data), `"after":"+Inf"`) {
+		t.Errorf("+Inf isn't written like in the exposition format: %s", data)
+	}
+}
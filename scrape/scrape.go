@@ -0,0 +1,164 @@
+// Package scrape reads the Prometheus text exposition format, what any /metrics endpoint serves,
+// for the command line tools that look at metrics without a Prometheus server.
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"learn-prometheus/quantile"
+)
+
+// Fetch scrapes url and returns its metric families, sorted by name.
+func Fetch(ctx context.Context, url string) ([]*dto.MetricFamily, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// The text format, the one every client library can serve.
+	req.Header.Set("Accept", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return Parse(resp.Body)
+}
+
+// Parse reads the text exposition format, the families are sorted by name.
+func Parse(r io.Reader) ([]*dto.MetricFamily, error) {
+	var parser expfmt.TextParser
+	parsed, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the metrics: %w", err)
+	}
+
+	families := make([]*dto.MetricFamily, 0, len(parsed))
+	for _, mf := range parsed {
+		families = append(families, mf)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+
+	return families, nil
+}
+
+// Snapshot is what a /metrics endpoint returned at some point.
+type Snapshot struct {
+	Source   string
+	Time     time.Time
+	Families []*dto.MetricFamily
+}
+
+// Load reads a snapshot from a http(s) URL, scraped now, or from a file saved with curl,
+// then its time is the modification time of the file.
+func Load(ctx context.Context, source string) (*Snapshot, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		now := time.Now()
+		families, err := Fetch(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Snapshot{Source: source, Time: now, Families: families}, nil
+	}
+
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	families, err := Parse(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{Source: source, Time: info.ModTime(), Families: families}, nil
+}
+
+// Find returns the family with that name, nil if there's none.
+func Find(families []*dto.MetricFamily, name string) *dto.MetricFamily {
+	for _, mf := range families {
+		if mf.GetName() == name {
+			return mf
+		}
+	}
+
+	return nil
+}
+
+// Labels returns the labels of a metric as a map.
+func Labels(m *dto.Metric) map[string]string {
+	labels := make(map[string]string, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+
+	return labels
+}
+
+// Buckets sums the buckets of the histogram series matching the labels, like sum by (le) in PromQL.
+// It always ends with the +Inf bucket, so it can go straight to quantile.BucketQuantile.
+func Buckets(mf *dto.MetricFamily, match map[string]string) quantile.Buckets {
+	if mf == nil || mf.GetType() != dto.MetricType_HISTOGRAM {
+		return nil
+	}
+
+	counts := make(map[float64]float64)
+	for _, m := range mf.GetMetric() {
+		if !matches(m, match) {
+			continue
+		}
+
+		h := m.GetHistogram()
+		for _, b := range h.GetBucket() {
+			if !math.IsInf(b.GetUpperBound(), +1) {
+				counts[b.GetUpperBound()] += float64(b.GetCumulativeCount())
+			}
+		}
+		// The text format has a +Inf bucket, the protobuf one doesn't: it's the total count either way.
+		counts[math.Inf(+1)] += float64(h.GetSampleCount())
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+
+	buckets := make(quantile.Buckets, 0, len(counts))
+	for upperBound, count := range counts {
+		buckets = append(buckets, quantile.Bucket{UpperBound: upperBound, Count: count})
+	}
+	sort.Sort(buckets)
+
+	return buckets
+}
+
+func matches(m *dto.Metric, match map[string]string) bool {
+	labels := Labels(m)
+	for name, value := range match {
+		if labels[name] != value {
+			return false
+		}
+	}
+
+	return true
+}
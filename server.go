@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"learn-prometheus/cardinality"
+	"learn-prometheus/concurrency"
+	"learn-prometheus/fault"
+	"learn-prometheus/metriclint"
+	"learn-prometheus/webconfig"
+	"learn-prometheus/window"
+)
+
+// serverOptions configures newServer. The zero value is a ping server without deadlines, concurrency limit,
+// faults or web config, exposing its own metrics only.
+type serverOptions struct {
+	LintMode metriclint.Mode
+	// FaultsConfig and WebConfig are files, none if empty.
+	FaultsConfig string
+	WebConfig    string
+
+	// PingDeadline and PingPingDeadline are the time the routes have to answer, 0 for no deadline.
+	PingDeadline     time.Duration
+	PingPingDeadline time.Duration
+	AdaptiveLimit    bool
+
+	// GoCollector exposes the go_* metrics: goroutines, GC, memstats.
+	GoCollector bool
+	// GoRuntimeMetrics adds everything runtime/metrics has on top of that, like the scheduler latencies
+	// and the GC pauses as histograms. Only with GoCollector.
+	GoRuntimeMetrics bool
+	// ProcessCollector exposes the process_* metrics: CPU, memory, file descriptors, start time.
+	ProcessCollector bool
+	// BuildInfo exposes ping_build_info, always 1, with the version and the commit in its labels.
+	BuildInfo bool
+}
+
+// server is the ping server with a registry of its own, so tests can run as many as they want side by side,
+// each with its own metrics.
+type server struct {
+	registry *prometheus.Registry
+	mux      *http.ServeMux
+
+	pingCounter  prometheus.Counter
+	histogramVec *cardinality.HistogramVec
+
+	injector *fault.Injector
+	web      *webconfig.Server
+	// stats is ping_process over the last 1m, 5m and 15m, see /stats. Nothing moves until its Run is started.
+	stats *window.Ring
+}
+
+var _ http.Handler = (*server)(nil)
+
+func newServer(opts serverOptions) (*server, error) {
+	s := &server{
+		registry: prometheus.NewRegistry(),
+		mux:      http.NewServeMux(),
+	}
+
+	s.pingCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ping_request_count",
+			Help: "Number of request handled by Ping handler",
+		},
+	)
+
+	// The limiter folds any label value past the limit into "__overflow__",
+	// so a label like playerID can't blow up the number of series.
+	// Check /admin/cardinality to see who's hitting the limit.
+	limiter := cardinality.NewLimiter()
+
+	s.histogramVec = limiter.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ping_process",
+			Help:    "Histogram of the ping process",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.02, 0.03, 0.05, 0.1, 0.2, 0.5, 1, 5},
+		},
+		// status is ok, error (5xx), timeout (the route deadline), canceled (the client left, or the server was shut down)
+		// or shed (too many requests in flight).
+		[]string{"endpoint", "handler", "status"},
+		50,
+	)
+
+	// Every metric of ours is checked against the naming rules of prometheus.txt when it's registered.
+	// ping_request_count doesn't end in _total and ping_process has no unit, they're only logged by default.
+	registerer := metriclint.NewRegisterer(s.registry, opts.LintMode)
+	ours := []prometheus.Collector{s.pingCounter, s.histogramVec, limiter}
+
+	// Latency and errors injected on purpose, to exercise the dashboards and the alerts.
+	// See /admin/faults for what's going on.
+	var err error
+	if s.injector, err = fault.New(opts.FaultsConfig); err != nil {
+		return nil, err
+	}
+
+	// TLS and auth for every endpoint, /metrics and the admin ones included.
+	if s.web, err = webconfig.New(opts.WebConfig); err != nil {
+		return nil, err
+	}
+	ours = append(ours, s.injector, s.web)
+
+	// Each route gets its own concurrency limit: /pingPing getting slow must not shed /ping requests.
+	var pingLimiter, pingPingLimiter *concurrency.Limiter
+	if opts.AdaptiveLimit {
+		pingLimiter = concurrency.New("/ping", concurrency.Options{})
+		pingPingLimiter = concurrency.New("/pingPing", concurrency.Options{})
+		ours = append(ours, pingLimiter, pingPingLimiter)
+	}
+
+	if opts.BuildInfo {
+		ours = append(ours, buildInfo())
+	}
+
+	for _, c := range ours {
+		if err := registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// The standard collectors aren't linted, their names are what every dashboard expects.
+	if err := s.registerStandardCollectors(opts); err != nil {
+		return nil, err
+	}
+
+	// The faults are injected inside the measured part, so they show up in ping_process.
+	normalPing := s.injector.Wrap("/ping", http.HandlerFunc(ping))
+	heavyPing := s.injector.Wrap("/pingPing", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ping(w, r)
+		wait(r.Context(), 100*time.Millisecond)
+	}))
+
+	s.mux.HandleFunc("/ping", s.instrument("/ping", "normalPing", opts.PingDeadline, pingLimiter, normalPing))
+	s.mux.HandleFunc("/pingPing", s.instrument("/pingPing", "heavyPing", opts.PingPingDeadline, pingPingLimiter, heavyPing))
+
+	// The shed requests fail in no time, counted with the others p50 and the mean would go down as the server
+	// gets overloaded. The canceled ones stay: the client gave up, often because it was too slow.
+	s.stats = window.New(s.histogramVec, []string{"endpoint", "handler"}, window.Options{
+		Exclude: map[string][]string{"status": {statusShed}},
+	})
+	s.mux.Handle("/stats", s.stats.Handler())
+
+	s.mux.Handle("/metrics", promhttp.InstrumentMetricHandler(s.registry, promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{Registry: s.registry})))
+	s.mux.Handle("/admin/cardinality", limiter.Handler())
+	s.mux.Handle("/admin/faults", s.injector.Handler())
+
+	return s, nil
+}
+
+func (s *server) registerStandardCollectors(opts serverOptions) error {
+	var standard []prometheus.Collector
+
+	if opts.GoCollector {
+		goCollector := collectors.NewGoCollector()
+		if opts.GoRuntimeMetrics {
+			goCollector = collectors.NewGoCollector(collectors.WithGoCollectorRuntimeMetrics(collectors.MetricsAll))
+		}
+		standard = append(standard, goCollector)
+	} else if opts.GoRuntimeMetrics {
+		return errors.New("the runtime/metrics set is part of the Go collector, it needs the Go collector too")
+	}
+
+	if opts.ProcessCollector {
+		standard = append(standard, collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+
+	for _, c := range standard {
+		if err := s.registry.Register(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// buildInfo is the usual <name>_build_info metric: always 1, the interesting part is in the labels,
+// e.g. count by (revision) (ping_build_info) shows a rollout.
+func buildInfo() prometheus.Collector {
+	version, revision, goVersion := "unknown", "unknown", "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version, goVersion = info.Main.Version, info.GoVersion
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				revision = setting.Value
+			}
+		}
+	}
+
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "ping_build_info",
+		Help:        "Version of the ping server, always 1.",
+		ConstLabels: prometheus.Labels{"version": version, "revision": revision, "goversion": goVersion},
+	})
+	g.Set(1)
+
+	return g
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Reload rereads the fault config and the web config, an error is only logged.
+func (s *server) Reload() {
+	if err := s.injector.Reload(); err != nil {
+		log.Printf("failed to reload the fault config: %v\n", err)
+	}
+	if err := s.web.Reload(); err != nil {
+		log.Printf("failed to reload the web config: %v\n", err)
+	}
+}
+
+// ListenAndServe serves on srv.Addr, with the TLS and auth of the web config.
+func (s *server) ListenAndServe(srv *http.Server) error {
+	srv.Handler = s
+	return s.web.ListenAndServe(srv)
+}
+
+// instrument counts and measures the requests, with the route deadline and concurrency limit.
+func (s *server) instrument(endpoint, handler string, deadline time.Duration, limiter *concurrency.Limiter, h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.pingCounter.Inc()
+
+		startHandlingTime := time.Now().UTC()
+
+		if limiter != nil && !limiter.Acquire() {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests in flight, retry later", http.StatusServiceUnavailable)
+			s.histogramVec.WithLabelValues(endpoint, handler, statusShed).Observe(time.Since(startHandlingTime).Seconds())
+			return
+		}
+
+		ctx := r.Context()
+		if deadline > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, deadline)
+			defer cancel()
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r.WithContext(ctx))
+
+		status := requestStatus(ctx, sw)
+		if status == statusTimeout {
+			http.Error(w, "deadline exceeded", http.StatusGatewayTimeout)
+		}
+
+		// The limiter adapts on the very same latency as the histogram.
+		latency := time.Since(startHandlingTime)
+		s.histogramVec.WithLabelValues(endpoint, handler, status).Observe(latency.Seconds())
+
+		if limiter != nil {
+			if status == statusCanceled {
+				limiter.Abandon()
+			} else {
+				limiter.Release(latency)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"learn-prometheus/concurrency"
+)
+
+func TestNewServerIsolated(t *testing.T) {
+	a, err := newServer(serverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newServer(serverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ping", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got %d from /ping", rec.Code)
+		}
+	}
+
+	if got := testutil.ToFloat64(a.pingCounter); got != 3 {
+		t.Errorf("got %v requests on a, want 3", got)
+	}
+	if got := testutil.ToFloat64(b.pingCounter); got != 0 {
+		t.Errorf("got %v requests on b, want 0: the servers share their metrics", got)
+	}
+
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `ping_process_count{endpoint="/ping",handler="normalPing",status="ok"} 3`) {
+		t.Errorf("/metrics doesn't have the 3 pings:\n%s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if !strings.Contains(rec.Body.String(), `"count": 3,`) {
+		t.Errorf("/stats doesn't have the 3 pings:\n%s", rec.Body.String())
+	}
+}
+
+func TestNewServerCollectors(t *testing.T) {
+	testCases := []struct {
+		name    string
+		opts    serverOptions
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "none",
+			notWant: []string{"go_goroutines", "process_start_time_seconds", "ping_build_info", "go_sched_latencies_seconds"},
+		},
+		{
+			name:    "go",
+			opts:    serverOptions{GoCollector: true},
+			want:    []string{"go_goroutines"},
+			notWant: []string{"go_sched_latencies_seconds", "process_start_time_seconds"},
+		},
+		{
+			name: "go with runtime/metrics",
+			opts: serverOptions{GoCollector: true, GoRuntimeMetrics: true},
+			want: []string{"go_goroutines", "go_sched_latencies_seconds"},
+		},
+		{
+			name: "process and build info",
+			opts: serverOptions{ProcessCollector: true, BuildInfo: true},
+			want: []string{"process_start_time_seconds", "ping_build_info"},
+		},
+	}
+
+	for _, tc := range testCases {
+		s, err := newServer(tc.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		families, err := s.registry.Gather()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		names := make(map[string]bool)
+		for _, mf := range families {
+			names[mf.GetName()] = true
+		}
+
+		for _, name := range tc.want {
+			if !names[name] {
+				t.Errorf("%s: %s is missing", tc.name, name)
+			}
+		}
+		for _, name := range tc.notWant {
+			if names[name] {
+				t.Errorf("%s: %s must not be exposed", tc.name, name)
+			}
+		}
+	}
+
+	if _, err := newServer(serverOptions{GoRuntimeMetrics: true}); err == nil {
+		t.Error("the runtime/metrics set without the Go collector must be refused")
+	}
+}
+
+// TestStatsShed checks the shed requests, answered in no time, don't bring the quantiles of /stats down.
+func TestStatsShed(t *testing.T) {
+	s, err := newServer(serverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { time.Sleep(20 * time.Millisecond) })
+	full := concurrency.New("/ping", concurrency.Options{InitialLimit: 1, MinLimit: 1, MaxLimit: 1})
+	full.Acquire()
+	for range 3 {
+		rec := httptest.NewRecorder()
+		s.instrument("/ping", "normalPing", 0, nil, slow)(rec, httptest.NewRequest(http.MethodGet, "/ping", nil))
+	}
+	before := s.stats.Stats()[0].Windows[0]
+
+	for range 100 {
+		rec := httptest.NewRecorder()
+		s.instrument("/ping", "normalPing", 0, full, slow)(rec, httptest.NewRequest(http.MethodGet, "/ping", nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("got %d, want the request shed", rec.Code)
+		}
+	}
+	after := s.stats.Stats()[0].Windows[0]
+
+	if after.Count != 3 || *after.Mean != *before.Mean || *after.Quantiles["p50"] != *before.Quantiles["p50"] {
+		t.Errorf("got %+v after shedding, want the same as %+v", after, before)
+	}
+}
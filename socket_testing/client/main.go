@@ -2,62 +2,266 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	"golang.org/x/net/websocket"
+	"learn-prometheus/socket_testing/protocol"
+	"learn-prometheus/socket_testing/tracing"
 )
 
 func main() {
-	fmt.Printf("Your endpoint: ")
+	var (
+		server      = flag.String("server", "localhost:3001", "address of the chat server")
+		readTimeout = flag.Duration("read-timeout", 90*time.Second, "how long the server can stay silent before the connection is considered lost, it pings every 30s by default")
+		maxBackoff  = flag.Duration("max-backoff", 30*time.Second, "max delay between two attempts to reconnect")
+		otlp        = flag.String("otlp.endpoint", "", "OTLP HTTP endpoint the traces of the chat messages are sent to, like localhost:4318. Empty for no tracing")
+	)
+	flag.Parse()
 
-	var endpoint string
-	fmt.Scanln(&endpoint)
+	fmt.Printf("Your name: ")
 
-	socket, err := websocket.Dial("ws://localhost:3001/ws", "", fmt.Sprintf("http://localhost:%s", endpoint))
+	var name string
+	fmt.Scanln(&name)
+
+	token, err := login(*server, name)
 	if err != nil {
-		panic(err)
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
-	serverClosed := make(chan struct{})
+	tracerProvider, shutdownTracing, err := tracing.NewProvider(context.Background(), *otlp, "chat-client")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// The last spans are sent on the way out.
+	defer shutdownTracing(context.Background())
 
-	go subscribeSocket(socket, serverClosed)
-	go sendToServer(socket)
+	out := make(chan *protocol.Envelope, 64)
+	go sendToServer(out)
 
-	for range serverClosed {
-		fmt.Println("Server is closed")
+	// Until the user is done typing (Ctrl+D), whatever happens to the connection.
+	newSession(*server, name, token, *readTimeout, *maxBackoff, tracerProvider.Tracer(tracing.Name)).run(out)
+}
+
+// login gets a token for the name, the server refuses the names already connected.
+func login(server, name string) (string, error) {
+	resp, err := http.PostForm("http://"+server+"/login", url.Values{"name": {name}})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
 
-		close(serverClosed)
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("login failed: %s", strings.TrimSpace(string(msg)))
 	}
+	var login struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&login); err != nil {
+		return "", err
+	}
+
+	return login.Token, nil
 }
 
-// SubscribeSocket waits for the response from the client.
-// If the server is closed, this will push some data to the serverChan to signal the program to terminate.
-func subscribeSocket(ws *websocket.Conn, serverChan chan struct{}) {
-	for {
-		var message string
+// format is how a message from the server is printed, "" for the ones not worth printing.
+func format(env *protocol.Envelope) string {
+	switch env.Type {
+	case protocol.TypeChat:
+		var p protocol.ChatPayload
+		env.DecodePayload(&p)
+		return fmt.Sprintf("[%s] [#%s] %s: %s", env.Time.Local().Format("15:04:05"), env.Room, env.Sender, p.Text)
+
+	case protocol.TypeJoin:
+		var p protocol.JoinPayload
+		env.DecodePayload(&p)
+		return fmt.Sprintf("* %s joined #%s, %d members: %s", env.Sender, env.Room, len(p.Members), strings.Join(p.Members, ", "))
+
+	case protocol.TypeLeave:
+		return fmt.Sprintf("* %s left #%s", env.Sender, env.Room)
+
+	case protocol.TypeSystem:
+		var p protocol.SystemPayload
+		env.DecodePayload(&p)
+		lines := []string{}
+		if p.Text != "" {
+			lines = append(lines, "* "+p.Text)
+		}
+		if p.Rooms != nil {
+			lines = append(lines, fmt.Sprintf("* %d rooms:", len(p.Rooms)))
+		}
+		for _, r := range p.Rooms {
+			line := fmt.Sprintf("*   #%s %d", r.Name, r.Members)
+			if r.Limit > 0 {
+				line += fmt.Sprintf("/%d", r.Limit)
+			}
+			line += " members"
+			if r.Joined {
+				line += " (joined)"
+			}
+			lines = append(lines, line)
+		}
+		if p.Command == protocol.CommandHistory {
+			lines = append(lines, formatHistory(env.Room, p)...)
+		}
+		return strings.Join(lines, "\n")
 
-		err := websocket.Message.Receive(ws, &message)
-		if err == io.EOF {
-			serverChan <- struct{}{}
-			return
-		} else if err != nil {
-			panic(err)
+	case protocol.TypeError:
+		var p protocol.ErrorPayload
+		env.DecodePayload(&p)
+		return fmt.Sprintf("! %s: %s", p.Code, p.Message)
+	}
+
+	// Acks and pings.
+	return ""
+}
+
+// formatHistory prints the messages of the history like the others, with the command to get the older ones.
+func formatHistory(room string, p protocol.SystemPayload) []string {
+	if len(p.History) == 0 {
+		if p.Text == "" {
+			return []string{fmt.Sprintf("* nothing older in #%s", room)}
 		}
+		return nil
+	}
 
-		fmt.Println(message)
+	var lines []string
+	oldest := ""
+	for i, data := range p.History {
+		env, err := protocol.Parse(data)
+		if err != nil {
+			continue
+		}
+		if i == 0 {
+			oldest = env.ID
+		}
+		lines = append(lines, format(env))
+	}
+	if p.More {
+		lines = append(lines, fmt.Sprintf("* older messages: /history %s %s", room, oldest))
 	}
+
+	return lines
 }
 
-// sendToServer sends message from the client to the server.
-func sendToServer(ws *websocket.Conn) {
+// sendToServer turns what the user types into messages for the server, out is closed once stdin is.
+// The messages go to the current room, the one joined last or picked with /switch, the lobby at first.
+// While the connection is lost they wait in out, they're sent once reconnected.
+func sendToServer(out chan<- *protocol.Envelope) {
+	defer close(out)
+
 	scanner := bufio.NewScanner(os.Stdin)
+	current := protocol.Lobby
 
-	for {
-		scanner.Scan()
+	for scanner.Scan() {
+		env, room := command(scanner.Text(), current)
+		if room != current {
+			current = room
+			fmt.Printf("* now talking in #%s\n", current)
+		}
+		if env != nil {
+			out <- env
+		}
+	}
+}
+
+const help = `* /join <room> [limit]  join a room and talk in it, a new room can have a member limit
+* /leave <room>         leave a room
+* /rooms                list the rooms
+* /history [room] [id]  the messages of a room before that ID, the latest ones by default
+* /switch <room>        talk in another room you joined
+* /to <room> <text>     say something in a room without switching
+* /help                 this help
+* anything else goes to the current room`
 
-		msg := scanner.Text()
-		ws.Write([]byte(msg))
+// command turns what the user typed into the message to send to the server, nil for nothing, and the new current room.
+// The server checks the room names and the texts, the client only checks the commands are complete.
+func command(line, current string) (*protocol.Envelope, string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, current
 	}
+
+	switch fields[0] {
+	case "/help":
+		fmt.Println(help)
+		return nil, current
+
+	case "/switch":
+		if len(fields) != 2 {
+			fmt.Println("* usage: /switch <room>")
+			return nil, current
+		}
+		return nil, fields[1]
+
+	case "/join":
+		if len(fields) < 2 || len(fields) > 3 {
+			fmt.Println("* usage: /join <room> [limit]")
+			return nil, current
+		}
+		var p protocol.JoinPayload
+		if len(fields) == 3 {
+			limit, err := strconv.Atoi(fields[2])
+			if err != nil || limit <= 0 {
+				fmt.Printf("* invalid limit %q, must be a positive number\n", fields[2])
+				return nil, current
+			}
+			p.Limit = limit
+		}
+		return protocol.New(protocol.TypeJoin, fields[1], p), fields[1]
+
+	case "/leave":
+		if len(fields) != 2 {
+			fmt.Println("* usage: /leave <room>")
+			return nil, current
+		}
+		if fields[1] == current {
+			current = protocol.Lobby
+		}
+		return protocol.New(protocol.TypeLeave, fields[1], nil), current
+
+	case "/rooms":
+		return protocol.New(protocol.TypeSystem, "", protocol.SystemPayload{Command: protocol.CommandRooms}), current
+
+	case "/history":
+		if len(fields) > 3 {
+			fmt.Println("* usage: /history [room] [id]")
+			return nil, current
+		}
+		room, p := current, protocol.SystemPayload{Command: protocol.CommandHistory}
+		if len(fields) >= 2 {
+			room = fields[1]
+		}
+		if len(fields) == 3 {
+			p.Before = fields[2]
+		}
+		return protocol.New(protocol.TypeSystem, room, p), current
+
+	case "/to":
+		// The text keeps its spaces, only the command and the room are cut.
+		rest := strings.TrimLeft(strings.TrimPrefix(line, "/to"), " ")
+		room, text, ok := strings.Cut(rest, " ")
+		if !ok || strings.TrimSpace(text) == "" {
+			fmt.Println("* usage: /to <room> <text>")
+			return nil, current
+		}
+		return protocol.New(protocol.TypeChat, room, protocol.ChatPayload{Text: text}), current
+	}
+	if strings.HasPrefix(line, "/") {
+		fmt.Printf("* unknown command %s, /help lists them\n", fields[0])
+		return nil, current
+	}
+
+	return protocol.New(protocol.TypeChat, current, protocol.ChatPayload{Text: line}), current
 }
@@ -1,3 +1,3 @@
 #!/bin/bash
 
-go run ./socket_testing/client/main.go
+go run ./socket_testing/client "$@"
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/websocket"
+
+	"learn-prometheus/socket_testing/protocol"
+	"learn-prometheus/socket_testing/tracing"
+)
+
+// errQuit is the user done typing, the session ends instead of reconnecting.
+var errQuit = errors.New("quit")
+
+// session is the connection to the server, again and again: when it's lost, the session reconnects
+// with a backoff and resumes where it was, in the same rooms, with the messages missed in between.
+type session struct {
+	server, name, token string
+	// readTimeout is how long the server can stay silent, it pings every 30s by default.
+	readTimeout time.Duration
+	backoff     backoff
+	tracer      trace.Tracer
+
+	// lastID is the last message seen, and rooms the rooms joined: what's needed to resume.
+	// A room stays until it's left, or refused when it's joined again: a connection lost before the server
+	// confirmed the joins doesn't forget it. rejoins are the IDs of the joins sent on connecting, by room.
+	// Only used by run.
+	lastID  uint64
+	rooms   map[string]bool
+	rejoins map[string]string
+	// pending is a message that failed to be sent, it's sent again once reconnected.
+	// sending is its span, it ends once it's sent: the outage is in the trace.
+	pending *protocol.Envelope
+	sending trace.Span
+}
+
+func newSession(server, name, token string, readTimeout, maxBackoff time.Duration, tracer trace.Tracer) *session {
+	return &session{
+		server:      server,
+		name:        name,
+		token:       token,
+		readTimeout: readTimeout,
+		backoff:     backoff{min: 500 * time.Millisecond, max: maxBackoff},
+		tracer:      tracer,
+		rooms:       make(map[string]bool),
+	}
+}
+
+// run sends the messages of out until it's closed, reconnecting whenever the connection is lost.
+func (s *session) run(out <-chan *protocol.Envelope) {
+	fmt.Printf("* connecting to %s...\n", s.server)
+
+	for {
+		ws, err := s.connect()
+		if err != nil {
+			delay := s.backoff.next()
+			fmt.Printf("* can't connect (%v), retrying in %s\n", err, delay.Round(100*time.Millisecond))
+			time.Sleep(delay)
+			continue
+		}
+
+		if s.lastID == 0 {
+			fmt.Printf("* connected as %s, you're in #%s, /help for the room commands\n", s.name, protocol.Lobby)
+		} else {
+			fmt.Printf("* reconnected, catching up on what was missed\n")
+		}
+		s.backoff.reset()
+
+		err = s.serve(ws, out)
+		if errors.Is(err, errQuit) {
+			return
+		}
+		delay := s.backoff.next()
+		fmt.Printf("* connection lost (%v), reconnecting in %s\n", err, delay.Round(100*time.Millisecond))
+		time.Sleep(delay)
+	}
+}
+
+// connect opens a connection, resuming the session if there's one. A token the server refuses
+// (expired?) is replaced by a new one.
+func (s *session) connect() (*websocket.Conn, error) {
+	u := url.URL{Scheme: "ws", Host: s.server, Path: "/ws"}
+	if s.lastID > 0 {
+		u.RawQuery = url.Values{protocol.ResumeParam: {strconv.FormatUint(s.lastID, 10)}}.Encode()
+	}
+	config, err := websocket.NewConfig(u.String(), "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+	config.Header.Set("Authorization", "Bearer "+s.token)
+
+	ws, err := websocket.DialConfig(config)
+	var dialErr *websocket.DialError
+	if errors.As(err, &dialErr) && dialErr.Err == websocket.ErrBadStatus {
+		// Refused before the upgrade: the token, or the name taken while we were away.
+		if token, loginErr := login(s.server, s.name); loginErr == nil {
+			s.token = token
+		} else {
+			err = loginErr
+		}
+	}
+
+	return ws, err
+}
+
+// serve rejoins the rooms, then reads and writes until the connection is lost or the user is done.
+func (s *session) serve(ws *websocket.Conn, out <-chan *protocol.Envelope) error {
+	defer ws.Close()
+
+	// The server puts everyone in the lobby, the other rooms are joined again with what was missed since lastID.
+	// Before anything the user typed meanwhile: it may be for one of them.
+	s.rejoins = make(map[string]string)
+	for room := range s.rooms {
+		if room == protocol.Lobby {
+			continue
+		}
+		join := protocol.New(protocol.TypeJoin, room, protocol.JoinPayload{After: strconv.FormatUint(s.lastID, 10)})
+		s.rejoins[join.ID] = room
+		if err := s.send(ws, join); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	writeErr := make(chan error, 1)
+	go func() { writeErr <- s.writeLoop(ws, out, done) }()
+
+	err := s.readLoop(ws)
+	close(done)
+	ws.Close()
+	if errors.Is(<-writeErr, errQuit) {
+		return errQuit
+	}
+
+	return err
+}
+
+// writeLoop sends what the user typed, starting with what couldn't be sent on the last connection.
+func (s *session) writeLoop(ws *websocket.Conn, out <-chan *protocol.Envelope, done <-chan struct{}) error {
+	for {
+		if s.pending == nil {
+			select {
+			case <-done:
+				return nil
+			case env, ok := <-out:
+				if !ok {
+					// Closed cleanly: the server counts it as such, and the reader stops.
+					ws.Close()
+					return errQuit
+				}
+				s.pending, s.sending = env, s.startSend(env)
+			}
+		}
+
+		if err := s.send(ws, s.pending); err != nil {
+			s.sending.AddEvent("send failed, waiting for the connection", trace.WithAttributes(attribute.String("error", err.Error())))
+			return err
+		}
+		s.sending.End()
+		s.pending = nil
+	}
+}
+
+// readLoop prints what the server sends until the connection is lost.
+func (s *session) readLoop(ws *websocket.Conn) error {
+	for {
+		var data []byte
+		ws.SetReadDeadline(time.Now().Add(s.readTimeout))
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			return err
+		}
+
+		env, err := protocol.Parse(data)
+		if err != nil {
+			fmt.Printf("! unreadable message from the server: %v\n", err)
+			continue
+		}
+		if env.Type == protocol.TypePing {
+			// The heartbeat: a client not answering is disconnected.
+			if err := s.send(ws, protocol.New(protocol.TypeAck, "", protocol.AckPayload{Ref: env.ID})); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// The IDs of the server are growing numbers, the pings' aside. Anything up to lastID was seen already.
+		if id, err := strconv.ParseUint(env.ID, 10, 64); err == nil {
+			if id <= s.lastID && env.Type == protocol.TypeChat {
+				continue
+			}
+			s.lastID = max(s.lastID, id)
+		}
+		if env.Sender == s.name {
+			switch env.Type {
+			case protocol.TypeJoin:
+				s.rooms[env.Room] = true
+			case protocol.TypeLeave:
+				delete(s.rooms, env.Room)
+			}
+		}
+		if env.Type == protocol.TypeError {
+			// A room that can't be joined again (full?) is forgotten, it's not retried on every reconnection.
+			var p protocol.ErrorPayload
+			if err := env.DecodePayload(&p); err == nil && p.Code != protocol.CodeAlreadyInRoom {
+				if room, ok := s.rejoins[p.Ref]; ok {
+					delete(s.rooms, room)
+				}
+			}
+		}
+
+		// The end of the trace of a chat message, from the trace context of the server routing it.
+		var span trace.Span
+		if env.Type == protocol.TypeChat {
+			_, span = s.tracer.Start(tracing.Extract(context.Background(), env.Trace), "chat receive", trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithAttributes(attribute.String("chat.room", env.Room), attribute.String("chat.message.id", env.ID)))
+		}
+		if line := format(env); line != "" {
+			fmt.Println(line)
+		}
+		if span != nil {
+			span.End()
+		}
+	}
+}
+
+// startSend starts the span of a chat message the user typed, and puts its trace context in the message.
+// The rest isn't traced, its span does nothing.
+func (s *session) startSend(env *protocol.Envelope) trace.Span {
+	if env.Type != protocol.TypeChat {
+		return trace.SpanFromContext(context.Background())
+	}
+
+	// Who said it, for the server and the other clients: the baggage travels with the trace context.
+	ctx := context.Background()
+	if member, err := baggage.NewMemberRaw("chat.user", s.name); err == nil {
+		bag, _ := baggage.New(member)
+		ctx = baggage.ContextWithBaggage(ctx, bag)
+	}
+	ctx, span := s.tracer.Start(ctx, "chat send", trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("chat.room", env.Room), attribute.String("chat.message.ref", env.ID)))
+	env.Trace = tracing.Inject(ctx)
+	return span
+}
+
+func (s *session) send(ws *websocket.Conn, env *protocol.Envelope) error {
+	return websocket.Message.Send(ws, string(protocol.Encode(env)))
+}
+
+// backoff is an exponential backoff with jitter: the clients disconnected by a restart of the server
+// don't all come back at the same time.
+type backoff struct {
+	min, max time.Duration
+	attempt  int
+}
+
+// next is a random delay between half and all of min*2^attempt, capped at max.
+func (b *backoff) next() time.Duration {
+	d := b.min << min(b.attempt, 20)
+	if d <= 0 || d > b.max {
+		d = b.max
+	}
+	b.attempt++
+
+	return d/2 + rand.N(d/2+1)
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdkTrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/net/websocket"
+
+	"learn-prometheus/socket_testing/protocol"
+)
+
+func TestBackoff(t *testing.T) {
+	b := backoff{min: 100 * time.Millisecond, max: time.Second}
+
+	// Half to all of 100ms, 200ms, 400ms, 800ms, then 1s over and over.
+	for i, ceiling := range []time.Duration{100, 200, 400, 800, 1000, 1000, 1000} {
+		ceiling *= time.Millisecond
+		for range 20 {
+			attempt := b.attempt
+			d := b.next()
+			if d < ceiling/2 || d > ceiling {
+				t.Fatalf("attempt %d: got %s, want %s to %s", i, d, ceiling/2, ceiling)
+			}
+			b.attempt = attempt
+		}
+		b.next()
+	}
+
+	// No overflow after a long outage.
+	b.attempt = 1000
+	if d := b.next(); d < b.max/2 || d > b.max {
+		t.Errorf("attempt 1000: got %s, want %s to %s", d, b.max/2, b.max)
+	}
+
+	b.reset()
+	if d := b.next(); d > b.min {
+		t.Errorf("after a reset: got %s, want at most %s", d, b.min)
+	}
+}
+
+// fromServer is a message as the server sends it, id is the ID it gave.
+func fromServer(typ protocol.Type, id, room, sender string, payload any) string {
+	env := protocol.New(typ, room, payload)
+	env.ID, env.Sender, env.Time = id, sender, time.Now().UTC()
+	return string(protocol.Encode(env))
+}
+
+// receive reads the next message of the client.
+func receive(t *testing.T, ws *websocket.Conn) *protocol.Envelope {
+	t.Helper()
+
+	var data []byte
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		t.Errorf("failed to read from the client: %v", err)
+		return nil
+	}
+	env, err := protocol.Decode(data)
+	if err != nil {
+		t.Errorf("invalid message from the client: %v", err)
+	}
+	return env
+}
+
+// TestSessionResume drops the connection of a client in rooms, twice, and checks it comes back where it was.
+func TestSessionResume(t *testing.T) {
+	out := make(chan *protocol.Envelope)
+	var conns atomic.Int32
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		resume := ws.Request().URL.Query().Get(protocol.ResumeParam)
+
+		switch conns.Add(1) {
+		case 1:
+			if resume != "" {
+				t.Errorf("first connection resuming from %s", resume)
+			}
+			websocket.Message.Send(ws, fromServer(protocol.TypeJoin, "5", "ops", "alice", nil))
+			websocket.Message.Send(ws, fromServer(protocol.TypeJoin, "6", "dev", "alice", nil))
+			websocket.Message.Send(ws, fromServer(protocol.TypeChat, "10", "ops", "bob", protocol.ChatPayload{Text: "hi"}))
+			// Lost once what was sent is read: the next connection resumes from 10.
+			time.Sleep(100 * time.Millisecond)
+
+		case 2:
+			// Lost again before the joins are confirmed.
+			rejoined := map[string]bool{}
+			for range 2 {
+				if env := receive(t, ws); env != nil {
+					rejoined[env.Room] = true
+				}
+			}
+			if resume != "10" || !rejoined["ops"] || !rejoined["dev"] {
+				t.Errorf("resuming from %q in %v, want 10 in ops and dev", resume, rejoined)
+			}
+
+		case 3:
+			// The rooms are still known, dev is full by now.
+			for range 2 {
+				env := receive(t, ws)
+				if env == nil {
+					return
+				}
+				var p protocol.JoinPayload
+				if env.Type != protocol.TypeJoin || env.DecodePayload(&p) != nil || p.After != "10" {
+					t.Errorf("got %s %s %s, want a join after 10", env.Type, env.Room, env.Payload)
+				}
+				switch env.Room {
+				case "ops":
+					websocket.Message.Send(ws, fromServer(protocol.TypeJoin, "11", "ops", "alice", nil))
+				case "dev":
+					websocket.Message.Send(ws, string(protocol.Encode(protocol.NewError(&protocol.Error{Code: protocol.CodeRoomFull, Message: "#dev is full"}, env.ID))))
+				}
+			}
+			// 10 was seen already.
+			websocket.Message.Send(ws, fromServer(protocol.TypeChat, "10", "ops", "bob", protocol.ChatPayload{Text: "hi"}))
+			websocket.Message.Send(ws, fromServer(protocol.TypeChat, "12", "ops", "bob", protocol.ChatPayload{Text: "still there?"}))
+			// The pings are answered in order: once it's acked, the messages before it were read.
+			ping := protocol.NewID()
+			websocket.Message.Send(ws, fromServer(protocol.TypePing, ping, "", "", nil))
+			var ack protocol.AckPayload
+			if env := receive(t, ws); env == nil || env.Type != protocol.TypeAck || env.DecodePayload(&ack) != nil || ack.Ref != ping {
+				t.Errorf("got %+v, want the ack of the ping", env)
+			}
+
+			out <- protocol.New(protocol.TypeChat, "ops", protocol.ChatPayload{Text: "yes"})
+			if env := receive(t, ws); env != nil && (env.Type != protocol.TypeChat || env.Room != "ops") {
+				t.Errorf("got %s %s, want the chat message", env.Type, env.Room)
+			}
+			close(out)
+			// Until the client closes.
+			var data []byte
+			websocket.Message.Receive(ws, &data)
+
+		default:
+			t.Error("reconnected after the user was done")
+		}
+	}))
+	defer srv.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdkTrace.NewTracerProvider(sdkTrace.WithSpanProcessor(recorder))
+	s := newSession(strings.TrimPrefix(srv.URL, "http://"), "alice", "token", 5*time.Second, 50*time.Millisecond, provider.Tracer("test"))
+
+	done := make(chan struct{})
+	go func() {
+		s.run(out)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the session didn't end")
+	}
+
+	if s.lastID != 12 {
+		t.Errorf("last ID is %d, want 12", s.lastID)
+	}
+	if len(s.rooms) != 1 || !s.rooms["ops"] {
+		t.Errorf("in %v, want ops", s.rooms)
+	}
+	// One receive span per chat message: 10 once, 12.
+	received := 0
+	for _, span := range recorder.Ended() {
+		if span.Name() == "chat receive" {
+			received++
+		}
+	}
+	if received != 2 {
+		t.Errorf("got %d chat messages, want 2", received)
+	}
+}
+
+// TestSessionPending checks a message that failed to be sent is the first one sent on the next connection.
+func TestSessionPending(t *testing.T) {
+	received := make(chan *protocol.Envelope, 1)
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			// The connection lost on purpose.
+			return
+		}
+		env, err := protocol.Decode(data)
+		if err != nil {
+			t.Errorf("invalid message from the client: %v", err)
+		}
+		received <- env
+	}))
+	defer srv.Close()
+
+	provider := sdkTrace.NewTracerProvider()
+	s := newSession(strings.TrimPrefix(srv.URL, "http://"), "alice", "token", 5*time.Second, time.Second, provider.Tracer("test"))
+
+	lost, err := s.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost.Close()
+
+	out := make(chan *protocol.Envelope, 1)
+	sent := protocol.New(protocol.TypeChat, protocol.Lobby, protocol.ChatPayload{Text: "anyone?"})
+	out <- sent
+	if err := s.writeLoop(lost, out, make(chan struct{})); err == nil {
+		t.Fatal("sent on a closed connection")
+	}
+	if s.pending != sent {
+		t.Fatal("the message isn't pending")
+	}
+
+	ws, err := s.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go s.writeLoop(ws, out, done)
+
+	select {
+	case env := <-received:
+		if env == nil || env.ID != sent.ID {
+			t.Errorf("got %+v, want the pending message", env)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pending message wasn't sent")
+	}
+}
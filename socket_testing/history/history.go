@@ -0,0 +1,556 @@
+// Package history keeps the messages of the chat rooms on disk, so the ones joining late
+// (or after a restart of the server) can read what was said before.
+//
+// Every room has its own append-only log, split in numbered segment files like the WAL of metricstore:
+//
+//	history/ops/00000001
+//	history/ops/00000002
+//
+// A message is only ever appended, and the retention drops whole segments, the oldest first.
+// So a room keeps at least MaxMessages messages and MaxAge of them, a bit more until a segment is complete.
+// It's applied on every Append to the room, before a replay, and every minute by Run for the rooms gone quiet:
+// a room where everything is older than MaxAge is dropped altogether. The last ID is kept in history/.lastid then,
+// the IDs must keep growing after a restart even when every room is gone.
+package history
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every message is a record framed like this:
+//
+//	┌───────────┬──────────┬────────┬────────────────┬─────────┐
+//	│ length(4B)│ CRC32(4B)│ ID(8B) │ unix nanos(8B) │ message │
+//	└───────────┴──────────┴────────┴────────────────┴─────────┘
+//
+// The length and the CRC are of everything after them: a record half written by a crash is detected on Open.
+const recordHeaderSize = 8 + 16
+
+// lastIDFile has the last ID appended, saved when a room is dropped and on Close.
+// A room name can't start with a dot.
+const lastIDFile = ".lastid"
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptRecord = errors.New("corrupt record")
+)
+
+type Options struct {
+	// SegmentSize is the size of a segment file, 1MiB by default.
+	SegmentSize int64
+	// MaxAge is how long a message is kept, 0 for ever.
+	MaxAge time.Duration
+	// MaxMessages is the number of messages kept per room, 0 for no limit.
+	MaxMessages int
+}
+
+// Message is a message as it was appended.
+type Message struct {
+	ID   uint64
+	Time time.Time
+	// Data is what the server sent, the encoded envelope.
+	Data []byte
+}
+
+// Store is the logs of every room. It's safe to use from several goroutines, the chat server only uses it from its hub.
+type Store struct {
+	dir  string
+	opts Options
+	now  func() time.Time
+
+	mtx    sync.Mutex
+	rooms  map[string]*roomLog
+	lastID uint64
+}
+
+// roomLog is the log of one room: the metadata of its segments, and the last one open for appending.
+type roomLog struct {
+	dir      string
+	segments []*segment
+	file     *os.File
+}
+
+// segment is what's in a segment file, read once on Open and kept up to date by Append.
+type segment struct {
+	idx         int
+	first, last uint64
+	lastTime    time.Time
+	count       int
+	size        int64
+}
+
+// Open loads the logs of every room in dir, creating dir if needed.
+// A segment cut in the middle of a record (the server crashed while writing) is truncated at its last good record.
+func Open(dir string, opts Options) (*Store, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = 1 << 20
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create history dir: %w", err)
+	}
+
+	s := &Store{dir: dir, opts: opts, now: time.Now, rooms: make(map[string]*roomLog)}
+
+	data, err := os.ReadFile(filepath.Join(dir, lastIDFile))
+	switch {
+	case err == nil:
+		if s.lastID, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", lastIDFile, err)
+		}
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("failed to read %s: %w", lastIDFile, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list history dir: %w", err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() || checkRoom(e.Name()) != nil {
+			continue
+		}
+		r, err := loadRoom(filepath.Join(dir, e.Name()))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.rooms[e.Name()] = r
+		if n := len(r.segments); n > 0 {
+			s.lastID = max(s.lastID, r.segments[n-1].last)
+		}
+		if err := s.applyRetention(r); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func loadRoom(dir string) (*roomLog, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list history dir: %w", err)
+	}
+
+	var idxs []int
+	for _, e := range entries {
+		idx, err := strconv.Atoi(e.Name())
+		if err != nil || e.IsDir() {
+			continue
+		}
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+
+	r := &roomLog{dir: dir}
+	for _, idx := range idxs {
+		seg := &segment{idx: idx}
+		path := r.segmentPath(idx)
+		goodSize, err := readSegment(path, func(m Message) bool {
+			if seg.count == 0 {
+				seg.first = m.ID
+			}
+			seg.last, seg.lastTime = m.ID, m.Time
+			seg.count++
+			return true
+		})
+		if errors.Is(err, errCorruptRecord) {
+			// The messages are independent, unlike the records of a WAL: the segments after it are fine.
+			log.Printf("history: segment %s is corrupted at offset %d (%v), truncating it\n", path, goodSize, err)
+			if err := os.Truncate(path, goodSize); err != nil {
+				return nil, fmt.Errorf("failed to truncate corrupted history segment: %w", err)
+			}
+		} else if err != nil {
+			return nil, err
+		}
+
+		seg.size = goodSize
+		if seg.count == 0 {
+			os.Remove(path)
+			continue
+		}
+		r.segments = append(r.segments, seg)
+	}
+
+	return r, nil
+}
+
+// Append adds a message to the log of the room. The IDs must grow, they're what Before pages by.
+func (s *Store) Append(room string, m Message) error {
+	if err := checkRoom(room); err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.rooms == nil {
+		return errors.New("history is closed")
+	}
+	if m.ID <= s.lastID {
+		return fmt.Errorf("message ID %d isn't after the last one, %d", m.ID, s.lastID)
+	}
+
+	r, ok := s.rooms[room]
+	if !ok {
+		if err := os.MkdirAll(filepath.Join(s.dir, room), 0o755); err != nil {
+			return fmt.Errorf("failed to create history dir: %w", err)
+		}
+		r = &roomLog{dir: filepath.Join(s.dir, room)}
+		s.rooms[room] = r
+	}
+
+	rec := appendRecord(nil, m)
+	seg := r.current()
+	if seg == nil || r.file == nil || (seg.size > 0 && seg.size+int64(len(rec)) > s.opts.SegmentSize) {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+		seg = r.current()
+	}
+
+	n, err := r.file.Write(rec)
+	seg.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write history record: %w", err)
+	}
+	if seg.count == 0 {
+		seg.first = m.ID
+	}
+	seg.last, seg.lastTime = m.ID, m.Time
+	seg.count++
+	s.lastID = m.ID
+
+	return s.applyRetention(r)
+}
+
+// Before returns up to n messages of the room with an ID lower than before, the latest ones, oldest first.
+// before is 0 for the latest messages. more is whether there are older ones.
+func (s *Store) Before(room string, before uint64, n int) (msgs []Message, more bool, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	r, err := s.replayed(room)
+	if r == nil || err != nil || n <= 0 {
+		return nil, false, err
+	}
+	if before == 0 {
+		before = ^uint64(0)
+	}
+
+	// From the newest segment back, each one read whole: a segment is small, and it's in the page cache.
+	for i := len(r.segments) - 1; i >= 0; i-- {
+		seg := r.segments[i]
+		if seg.first >= before {
+			continue
+		}
+
+		var found []Message
+		if _, err := readSegment(r.segmentPath(seg.idx), func(m Message) bool {
+			if m.ID >= before {
+				return false
+			}
+			found = append(found, m)
+			return true
+		}); err != nil {
+			return nil, false, err
+		}
+
+		if need := n - len(msgs); len(found) > need {
+			found, more = found[len(found)-need:], true
+		}
+		msgs = append(found, msgs...)
+		if len(msgs) == n {
+			more = more || i > 0
+			break
+		}
+	}
+
+	return msgs, more, nil
+}
+
+// Since returns up to n messages of the room with an ID greater than after, the latest ones, oldest first:
+// what a client missed while it was away. more is whether there are older ones it missed too.
+func (s *Store) Since(room string, after uint64, n int) (msgs []Message, more bool, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	r, err := s.replayed(room)
+	if r == nil || err != nil || n <= 0 {
+		return nil, false, err
+	}
+
+	for i := len(r.segments) - 1; i >= 0 && r.segments[i].last > after; i-- {
+		var found []Message
+		if _, err := readSegment(r.segmentPath(r.segments[i].idx), func(m Message) bool {
+			if m.ID > after {
+				found = append(found, m)
+			}
+			return true
+		}); err != nil {
+			return nil, false, err
+		}
+		msgs = append(found, msgs...)
+		if len(msgs) > n {
+			return msgs[len(msgs)-n:], true, nil
+		}
+	}
+
+	return msgs, false, nil
+}
+
+// replayed is the log of the room about to be read, without what's past the retention. nil if there's none.
+// s.mtx must be held.
+func (s *Store) replayed(room string) (*roomLog, error) {
+	if _, ok := s.rooms[room]; !ok {
+		return nil, nil
+	}
+	if err := s.expire(room); err != nil {
+		return nil, err
+	}
+
+	return s.rooms[room], nil
+}
+
+// Run applies the retention every minute until ctx is done, to the rooms nobody writes to anymore too.
+func (s *Store) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.ApplyRetention(); err != nil {
+				log.Printf("history: retention failed: %v\n", err)
+			}
+		}
+	}
+}
+
+// ApplyRetention drops the segments of every room past MaxMessages or MaxAge.
+func (s *Store) ApplyRetention() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var errs []error
+	for room := range s.rooms {
+		errs = append(errs, s.expire(room))
+	}
+
+	return errors.Join(errs...)
+}
+
+// expire applies the retention to the room, and drops it if even its last message is older than MaxAge.
+// s.mtx must be held.
+func (s *Store) expire(room string) error {
+	r := s.rooms[room]
+	if err := s.applyRetention(r); err != nil {
+		return err
+	}
+
+	seg := r.current()
+	if s.opts.MaxAge <= 0 || seg == nil || s.now().Sub(seg.lastTime) <= s.opts.MaxAge {
+		return nil
+	}
+	if err := r.closeFile(); err != nil {
+		return err
+	}
+	if err := os.Remove(r.segmentPath(seg.idx)); err != nil {
+		return fmt.Errorf("failed to remove history segment: %w", err)
+	}
+	// Whatever else is there (not a segment) stays, and so does the directory then.
+	os.Remove(r.dir)
+	delete(s.rooms, room)
+
+	// The last ID may have been in that room.
+	return s.saveLastID()
+}
+
+// LastID is the ID of the last message appended, to keep the IDs growing after a restart.
+func (s *Store) LastID() uint64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.lastID
+}
+
+// Close syncs and closes the open segments.
+func (s *Store) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.rooms == nil {
+		return nil
+	}
+
+	var errs []error
+	for _, r := range s.rooms {
+		errs = append(errs, r.closeFile())
+	}
+	s.rooms = nil
+	errs = append(errs, s.saveLastID())
+
+	return errors.Join(errs...)
+}
+
+// saveLastID writes lastIDFile, replaced at once: a crash in the middle leaves the previous one.
+// s.mtx must be held.
+func (s *Store) saveLastID() error {
+	path := filepath.Join(s.dir, lastIDFile)
+	if err := os.WriteFile(path+".tmp", strconv.AppendUint(nil, s.lastID, 10), 0o644); err != nil {
+		return fmt.Errorf("failed to save the last ID: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to save the last ID: %w", err)
+	}
+
+	return nil
+}
+
+// applyRetention drops the oldest segments of the room, never the one being written.
+// s.mtx must be held.
+func (s *Store) applyRetention(r *roomLog) error {
+	total := 0
+	for _, seg := range r.segments {
+		total += seg.count
+	}
+
+	for len(r.segments) > 1 {
+		oldest := r.segments[0]
+		tooMany := s.opts.MaxMessages > 0 && total-oldest.count >= s.opts.MaxMessages
+		tooOld := s.opts.MaxAge > 0 && s.now().Sub(oldest.lastTime) > s.opts.MaxAge
+		if !tooMany && !tooOld {
+			break
+		}
+
+		if err := os.Remove(r.segmentPath(oldest.idx)); err != nil {
+			return fmt.Errorf("failed to remove history segment: %w", err)
+		}
+		r.segments = r.segments[1:]
+		total -= oldest.count
+	}
+
+	return nil
+}
+
+func (r *roomLog) current() *segment {
+	if len(r.segments) == 0 {
+		return nil
+	}
+	return r.segments[len(r.segments)-1]
+}
+
+// rotate closes the current segment and starts the next one. The first Append after Open starts a new segment too,
+// the last one may have been truncated.
+func (r *roomLog) rotate() error {
+	if err := r.closeFile(); err != nil {
+		return err
+	}
+
+	idx := 1
+	if seg := r.current(); seg != nil {
+		idx = seg.idx + 1
+	}
+	f, err := os.OpenFile(r.segmentPath(idx), os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open history segment: %w", err)
+	}
+	r.file = f
+	r.segments = append(r.segments, &segment{idx: idx})
+
+	return nil
+}
+
+func (r *roomLog) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+
+	if err := r.file.Sync(); err != nil {
+		r.file.Close()
+		r.file = nil
+		return fmt.Errorf("failed to sync history segment: %w", err)
+	}
+	err := r.file.Close()
+	r.file = nil
+
+	return err
+}
+
+func (r *roomLog) segmentPath(idx int) string {
+	return filepath.Join(r.dir, fmt.Sprintf("%08d", idx))
+}
+
+// checkRoom keeps the room names from going anywhere but in their own directory.
+func checkRoom(room string) error {
+	if room == "" || strings.HasPrefix(room, ".") || strings.ContainsAny(room, `/\`) {
+		return fmt.Errorf("invalid room name %q", room)
+	}
+
+	return nil
+}
+
+func appendRecord(b []byte, m Message) []byte {
+	payload := binary.BigEndian.AppendUint64(nil, m.ID)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(m.Time.UnixNano()))
+	payload = append(payload, m.Data...)
+
+	b = binary.BigEndian.AppendUint32(b, uint32(len(payload)))
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(payload, castagnoli))
+
+	return append(b, payload...)
+}
+
+// readSegment calls fn for every message of the file until it returns false.
+// It returns the size of the valid part of the file, which is where a corrupted file should be cut.
+func readSegment(path string, fn func(Message) bool) (int64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var offset int
+	for offset < len(b) {
+		rest := b[offset:]
+		if len(rest) < recordHeaderSize {
+			return int64(offset), fmt.Errorf("%w: truncated header", errCorruptRecord)
+		}
+		length := binary.BigEndian.Uint32(rest[0:4])
+		sum := binary.BigEndian.Uint32(rest[4:8])
+		if length < 16 || uint64(len(rest)-8) < uint64(length) {
+			return int64(offset), fmt.Errorf("%w: truncated payload", errCorruptRecord)
+		}
+		payload := rest[8 : 8+int(length)]
+		if crc32.Checksum(payload, castagnoli) != sum {
+			return int64(offset), fmt.Errorf("%w: checksum mismatch", errCorruptRecord)
+		}
+
+		m := Message{
+			ID:   binary.BigEndian.Uint64(payload[0:8]),
+			Time: time.Unix(0, int64(binary.BigEndian.Uint64(payload[8:16]))),
+			Data: payload[16:],
+		}
+		if !fn(m) {
+			break
+		}
+		offset += 8 + int(length)
+	}
+
+	return int64(offset), nil
+}
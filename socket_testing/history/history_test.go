@@ -0,0 +1,273 @@
+package history
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fill appends the messages from to to, one a minute.
+func fill(t *testing.T, s *Store, room string, from, to int) {
+	t.Helper()
+
+	for i := from; i <= to; i++ {
+		m := Message{ID: uint64(i), Time: start.Add(time.Duration(i) * time.Minute), Data: []byte(fmt.Sprintf("message %d", i))}
+		if err := s.Append(room, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// ids is the IDs of up to n messages before that one.
+func ids(t *testing.T, s *Store, room string, before uint64, n int) ([]uint64, bool) {
+	t.Helper()
+
+	msgs, more, err := s.Before(room, before, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []uint64
+	for _, m := range msgs {
+		if string(m.Data) != fmt.Sprintf("message %d", m.ID) {
+			t.Errorf("got %q for message %d", m.Data, m.ID)
+		}
+		got = append(got, m.ID)
+	}
+	return got, more
+}
+
+func TestBefore(t *testing.T) {
+	// About 4 messages per segment.
+	s, err := Open(t.TempDir(), Options{SegmentSize: 150})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	fill(t, s, "ops", 1, 10)
+	fill(t, s, "lobby", 11, 12)
+
+	testCases := []struct {
+		before   uint64
+		n        int
+		want     []uint64
+		wantMore bool
+	}{
+		{before: 0, n: 3, want: []uint64{8, 9, 10}, wantMore: true},
+		{before: 8, n: 3, want: []uint64{5, 6, 7}, wantMore: true},
+		{before: 5, n: 3, want: []uint64{2, 3, 4}, wantMore: true},
+		{before: 2, n: 3, want: []uint64{1}},
+		{before: 1, n: 3},
+		{before: 0, n: 20, want: []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		// Between the IDs of two rooms.
+		{before: 12, n: 2, want: []uint64{9, 10}, wantMore: true},
+	}
+	for _, tc := range testCases {
+		got, more := ids(t, s, "ops", tc.before, tc.n)
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) || more != tc.wantMore {
+			t.Errorf("before %d: got %v (more: %v), want %v (more: %v)", tc.before, got, more, tc.want, tc.wantMore)
+		}
+	}
+
+	if got, _ := ids(t, s, "nope", 0, 3); got != nil {
+		t.Errorf("got %v for a room without history", got)
+	}
+	if err := s.Append("ops", Message{ID: 12}); err == nil {
+		t.Error("appended an ID that doesn't grow")
+	}
+	if err := s.Append("../etc", Message{ID: 13}); err == nil {
+		t.Error("appended to a room outside the dir")
+	}
+}
+
+func TestSince(t *testing.T) {
+	s, err := Open(t.TempDir(), Options{SegmentSize: 150})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	fill(t, s, "ops", 1, 10)
+
+	testCases := []struct {
+		after    uint64
+		n        int
+		want     []uint64
+		wantMore bool
+	}{
+		{after: 7, n: 5, want: []uint64{8, 9, 10}},
+		{after: 3, n: 5, want: []uint64{6, 7, 8, 9, 10}, wantMore: true},
+		{after: 4, n: 6, want: []uint64{5, 6, 7, 8, 9, 10}},
+		{after: 10, n: 5},
+		{after: 0, n: 20, want: []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+	}
+	for _, tc := range testCases {
+		msgs, more, err := s.Since("ops", tc.after, tc.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []uint64
+		for _, m := range msgs {
+			got = append(got, m.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) || more != tc.wantMore {
+			t.Errorf("after %d: got %v (more: %v), want %v (more: %v)", tc.after, got, more, tc.want, tc.wantMore)
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, Options{SegmentSize: 150})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill(t, s, "ops", 1, 10)
+
+	// A crash in the middle of a write, without a Close: the last record is cut.
+	segments, _ := filepath.Glob(filepath.Join(dir, "ops", "*"))
+	last := segments[len(segments)-1]
+	info, _ := os.Stat(last)
+	if err := os.Truncate(last, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(dir, Options{SegmentSize: 150})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if got := s.LastID(); got != 9 {
+		t.Errorf("got last ID %d, want 9, the 10th was cut", got)
+	}
+	fill(t, s, "ops", 11, 11)
+	if got, _ := ids(t, s, "ops", 0, 3); fmt.Sprint(got) != "[8 9 11]" {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	testCases := []struct {
+		name  string
+		opts  Options
+		after time.Duration
+		// oldest is the oldest message left of 1 to 20, 0 for none.
+		oldest uint64
+	}{
+		{name: "no limit", opts: Options{}, oldest: 1},
+		// Whole segments of 4 messages are dropped, at least 10 are kept.
+		{name: "count", opts: Options{MaxMessages: 10}, oldest: 9},
+		// The messages are a minute apart, the last one at 20m.
+		{name: "age", opts: Options{MaxAge: 10 * time.Minute}, after: 20 * time.Minute, oldest: 9},
+		// The last segment stays while it's written to, but not once it's read back.
+		{name: "all too old", opts: Options{MaxAge: time.Minute}, after: time.Hour, oldest: 0},
+	}
+
+	for _, tc := range testCases {
+		tc.opts.SegmentSize = 150
+		s, err := Open(t.TempDir(), tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := start
+		s.now = func() time.Time { return now }
+		fill(t, s, "ops", 1, 16)
+		now = start.Add(tc.after)
+		fill(t, s, "ops", 17, 20)
+
+		if got, _ := ids(t, s, "ops", 0, 100); (tc.oldest == 0) != (len(got) == 0) || (len(got) > 0 && got[0] != tc.oldest) {
+			t.Errorf("%s: got %v, want from %d", tc.name, got, tc.oldest)
+		}
+		s.Close()
+	}
+}
+
+// TestRetentionIdle checks the messages of a room nobody writes to anymore still go.
+func TestRetentionIdle(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, Options{SegmentSize: 150, MaxAge: 10 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	now := start
+	s.now = func() time.Time { return now }
+	fill(t, s, "ops", 1, 12)
+	fill(t, s, "dev", 13, 20)
+
+	// Only the retention pass runs: nothing is appended to ops or read from it.
+	now = start.Add(27 * time.Minute)
+	if err := s.ApplyRetention(); err != nil {
+		t.Fatal(err)
+	}
+	segments, _ := os.ReadDir(filepath.Join(dir, "ops"))
+	if len(segments) != 0 {
+		t.Errorf("ops still has %d segments", len(segments))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ops")); !os.IsNotExist(err) {
+		t.Errorf("ops is still there: %v", err)
+	}
+	// The segment of dev from 13 to 16 is older than 10m, not the last one.
+	if got, _ := ids(t, s, "dev", 0, 100); fmt.Sprint(got) != "[17 18 19 20]" {
+		t.Errorf("got %v for dev", got)
+	}
+
+	// The room starts over, with the IDs still growing.
+	if s.LastID() != 20 {
+		t.Errorf("last ID is %d, want 20", s.LastID())
+	}
+	fill(t, s, "ops", 21, 21)
+	if got, _ := ids(t, s, "ops", 0, 100); fmt.Sprint(got) != "[21]" {
+		t.Errorf("got %v for ops", got)
+	}
+}
+
+// TestRetentionRestart checks the IDs keep growing after a restart when every room expired.
+func TestRetentionRestart(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, Options{MaxAge: 10 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := start
+	s.now = func() time.Time { return now }
+	fill(t, s, "ops", 1, 5)
+
+	now = start.Add(time.Hour)
+	if err := s.ApplyRetention(); err != nil {
+		t.Fatal(err)
+	}
+	// A crash: the last ID was saved when ops was dropped.
+	crashed, err := Open(dir, Options{MaxAge: 10 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := crashed.LastID(); got != 5 {
+		t.Errorf("got last ID %d after a crash, want 5", got)
+	}
+
+	fill(t, s, "dev", 6, 6)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	now = start.Add(2 * time.Hour)
+	s, err = Open(dir, Options{MaxAge: 10 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.now = func() time.Time { return now }
+	if err := s.ApplyRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.LastID(); got != 6 {
+		t.Errorf("got last ID %d after a restart, want 6", got)
+	}
+	if err := s.Append("ops", Message{ID: 6, Time: now}); err == nil {
+		t.Error("appended an ID already given")
+	}
+}
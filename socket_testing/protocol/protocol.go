@@ -0,0 +1,398 @@
+// Package protocol is what the chat server and its clients say to each other: one JSON envelope per websocket message.
+//
+//	{"v":1,"type":"chat","id":"3f2a...","room":"ops","payload":{"text":"hello"}}
+//
+// A client sends chat, join, leave, system (for the commands like listing the rooms) and ping messages,
+// each with an ID of its own. The server answers every one of them with an ack or an error referring to that ID,
+// and sends chat, join, leave and system messages with its own IDs, the sender and its timestamp.
+//
+// The server also pings every client now and then, a client answers with an ack of the ping: the heartbeat.
+//
+// Any message can carry the W3C trace context of its sender in trace, so a chat message can be followed
+// from the client saying it to the ones receiving it:
+//
+//	{"v":1,"type":"chat","id":"3f2a...","room":"ops","trace":{"traceparent":"00-4bf9...-00f0...-01"},"payload":{"text":"hello"}}
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// Version of the protocol, a message with another version is refused.
+const Version = 1
+
+// Type is the kind of a message, it tells what's in the payload.
+type Type string
+
+const (
+	// TypeChat is a message in a room, with a ChatPayload.
+	TypeChat Type = "chat"
+	// TypeJoin asks to join a room, with an optional JoinPayload. From the server, somebody joined the room.
+	TypeJoin Type = "join"
+	// TypeLeave asks to leave a room, no payload. From the server, somebody left the room.
+	TypeLeave Type = "leave"
+	// TypeSystem is a command for the server, or what the server has to say, with a SystemPayload.
+	TypeSystem Type = "system"
+	// TypeError is the server refusing a message, with an ErrorPayload.
+	TypeError Type = "error"
+	// TypeAck is the server confirming a message was handled, with an AckPayload.
+	// From a client, the answer to a ping of the server, with the ref only.
+	TypeAck Type = "ack"
+	// TypePing checks the other side is still there, no payload. It's answered with an ack.
+	TypePing Type = "ping"
+)
+
+// ResumeParam is the query parameter of the websocket URL with the ID of the last message a client saw,
+// when it reconnects: the server sends the messages of the lobby it missed, and takes over its old connection.
+const ResumeParam = "resume"
+
+// Lobby is the room everyone is in after connecting.
+const Lobby = "lobby"
+
+// Limits of a message from a client.
+const (
+	MaxIDLength   = 64
+	MaxTextLength = 4096
+	// MaxTraceLength is the max size of the values of trace together, the max size of a baggage header.
+	MaxTraceLength = 8192
+)
+
+// The keys of Envelope.Trace, the W3C headers of a trace context.
+var traceKeys = map[string]bool{"traceparent": true, "tracestate": true, "baggage": true}
+
+var (
+	idRE   = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	roomRE = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+)
+
+// Envelope is every message, both ways.
+type Envelope struct {
+	Version int    `json:"v"`
+	Type    Type   `json:"type"`
+	ID      string `json:"id"`
+	// Sender and Time are set by the server.
+	Sender string    `json:"sender,omitempty"`
+	Room   string    `json:"room,omitempty"`
+	Time   time.Time `json:"ts,omitzero"`
+	// Trace is the trace context of the message, the W3C traceparent, tracestate and baggage. Optional,
+	// it's a propagation.MapCarrier for OpenTelemetry.
+	Trace map[string]string `json:"trace,omitempty"`
+	// Payload depends on the type, see the *Payload types.
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type ChatPayload struct {
+	Text string `json:"text"`
+}
+
+type JoinPayload struct {
+	// Limit is the member limit of a room created by this join, 0 for the server's default.
+	Limit int `json:"limit,omitempty"`
+	// After is the ID of the last message a client resuming its session saw: the server sends
+	// the messages of the room since, instead of the last ones.
+	After string `json:"after,omitempty"`
+	// Members is set by the server: who's in the room now.
+	Members []string `json:"members,omitempty"`
+}
+
+// Commands of a system message from a client.
+const (
+	// CommandRooms lists the rooms.
+	CommandRooms = "rooms"
+	// CommandHistory pages backwards through the messages of the room of the envelope:
+	// up to Limit messages before the one with the ID Before, the latest ones without Before.
+	// The server sends the messages of a room to whoever joins it, with this command too.
+	CommandHistory = "history"
+)
+
+// MaxHistory is the max Limit of a history command.
+const MaxHistory = 100
+
+type SystemPayload struct {
+	// Command is set by a client, and by the server for the answer to a command.
+	Command string `json:"command,omitempty"`
+	// Before and Limit are the arguments of a history command.
+	Before string `json:"before,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+
+	// Text, Rooms, History and More are set by the server.
+	Text  string     `json:"text,omitempty"`
+	Rooms []RoomInfo `json:"rooms,omitempty"`
+	// History is chat messages, oldest first. More is whether there are older ones.
+	History []json.RawMessage `json:"history,omitempty"`
+	More    bool              `json:"more,omitempty"`
+}
+
+type RoomInfo struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+	// Limit is 0 for no limit.
+	Limit int `json:"limit,omitempty"`
+	// Joined is whether the client asking is in the room.
+	Joined bool `json:"joined,omitempty"`
+}
+
+type AckPayload struct {
+	// Ref is the ID of the client's message.
+	Ref string `json:"ref"`
+	// ID is the ID the server gave to the message, for a chat message.
+	ID string `json:"id,omitempty"`
+}
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Ref is the ID of the client's message, empty if it couldn't be read.
+	Ref string `json:"ref,omitempty"`
+}
+
+// Error codes.
+const (
+	CodeBadJSON            = "bad_json"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeInvalidMessage     = "invalid_message"
+	CodeNotInRoom          = "not_in_room"
+	CodeAlreadyInRoom      = "already_in_room"
+	CodeRoomFull           = "room_full"
+	// CodeRateLimited is a client talking too fast, the message is dropped. It's disconnected if it keeps going.
+	CodeRateLimited = "rate_limited"
+	// CodeMessageTooLarge is a websocket message over the server's limit, the client is disconnected.
+	CodeMessageTooLarge = "message_too_large"
+)
+
+// Error is why a message was refused, it becomes the payload of an error message.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func invalid(format string, args ...any) *Error {
+	return &Error{Code: CodeInvalidMessage, Message: fmt.Sprintf(format, args...)}
+}
+
+// New builds a message with a random ID. The payload is one of the *Payload types, or nil.
+func New(typ Type, room string, payload any) *Envelope {
+	e := &Envelope{Version: Version, Type: typ, ID: NewID(), Room: room}
+	if payload != nil {
+		var err error
+		if e.Payload, err = json.Marshal(payload); err != nil {
+			// The payload types are plain structs, they always marshal.
+			panic(fmt.Sprintf("protocol: failed to marshal %T: %v", payload, err))
+		}
+	}
+
+	return e
+}
+
+// NewID is 16 random hex characters, unique enough for the messages of a client.
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewError is the server's answer to a refused message, ref is the ID of that message if it's known.
+func NewError(err error, ref string) *Envelope {
+	var protoErr *Error
+	if !errors.As(err, &protoErr) {
+		protoErr = invalid("%v", err)
+	}
+
+	return New(TypeError, "", ErrorPayload{Code: protoErr.Code, Message: protoErr.Message, Ref: ref})
+}
+
+// Decode reads a message from a client, strictly: unknown fields, a missing ID, a server-only field,
+// an unknown type or a payload not matching the type are errors. The envelope is returned even when invalid,
+// if it could be read at all, so the error can refer to its ID.
+func Decode(data []byte) (*Envelope, error) {
+	var e Envelope
+	if err := strictUnmarshal(data, &e); err != nil {
+		return nil, &Error{Code: CodeBadJSON, Message: err.Error()}
+	}
+
+	return &e, e.Validate()
+}
+
+// Validate checks a message from a client.
+func (e *Envelope) Validate() error {
+	if e.Version != Version {
+		return &Error{Code: CodeUnsupportedVersion, Message: fmt.Sprintf("version %d, the server speaks %d", e.Version, Version)}
+	}
+	if e.ID == "" || len(e.ID) > MaxIDLength || !idRE.MatchString(e.ID) {
+		return invalid("id must be 1 to %d of A-Z, a-z, 0-9, _ and -", MaxIDLength)
+	}
+	if e.Sender != "" || !e.Time.IsZero() {
+		return invalid("sender and ts are set by the server")
+	}
+	size := 0
+	for k, v := range e.Trace {
+		if !traceKeys[k] {
+			return invalid("trace has traceparent, tracestate and baggage only, not %q", k)
+		}
+		size += len(v)
+	}
+	if size > MaxTraceLength {
+		return invalid("trace must be up to %d bytes", MaxTraceLength)
+	}
+
+	switch e.Type {
+	case TypeChat:
+		if err := ValidateRoom(e.Room); err != nil {
+			return err
+		}
+		var p ChatPayload
+		if err := e.DecodePayload(&p); err != nil {
+			return err
+		}
+		if p.Text == "" || len(p.Text) > MaxTextLength {
+			return invalid("text must be 1 to %d bytes", MaxTextLength)
+		}
+
+	case TypeJoin:
+		if err := ValidateRoom(e.Room); err != nil {
+			return err
+		}
+		var p JoinPayload
+		if err := e.DecodePayload(&p); err != nil {
+			return err
+		}
+		if p.Limit < 0 || p.Members != nil {
+			return invalid("a join has an optional positive limit and after only")
+		}
+		if p.After != "" && (len(p.After) > MaxIDLength || !idRE.MatchString(p.After)) {
+			return invalid("after must be the ID of a message")
+		}
+
+	case TypeLeave:
+		if err := ValidateRoom(e.Room); err != nil {
+			return err
+		}
+		if e.hasPayload() {
+			return invalid("a leave has no payload")
+		}
+
+	case TypeSystem:
+		var p SystemPayload
+		if err := e.DecodePayload(&p); err != nil {
+			return err
+		}
+		if p.Text != "" || p.Rooms != nil || p.History != nil || p.More {
+			return invalid("text, rooms, history and more are set by the server")
+		}
+		switch p.Command {
+		case CommandRooms:
+			if e.Room != "" || p.Before != "" || p.Limit != 0 {
+				return invalid("%s has no arguments", p.Command)
+			}
+		case CommandHistory:
+			if err := ValidateRoom(e.Room); err != nil {
+				return err
+			}
+			if p.Limit < 0 || p.Limit > MaxHistory {
+				return invalid("limit must be 0 to %d, 0 for the default", MaxHistory)
+			}
+			if p.Before != "" && (len(p.Before) > MaxIDLength || !idRE.MatchString(p.Before)) {
+				return invalid("before must be the ID of a message")
+			}
+		default:
+			return invalid("unknown command %q, try %q or %q", p.Command, CommandRooms, CommandHistory)
+		}
+
+	case TypePing:
+		if e.hasPayload() {
+			return invalid("a ping has no payload")
+		}
+
+	case TypeAck:
+		var p AckPayload
+		if err := e.DecodePayload(&p); err != nil {
+			return err
+		}
+		if e.Room != "" || p.ID != "" || p.Ref == "" || len(p.Ref) > MaxIDLength || !idRE.MatchString(p.Ref) {
+			return invalid("a client only acks the pings, with their ID as ref")
+		}
+
+	case TypeError:
+		return invalid("%s messages are sent by the server only", e.Type)
+
+	default:
+		return invalid("unknown type %q", e.Type)
+	}
+
+	return nil
+}
+
+// ValidateRoom checks the name of a room.
+func ValidateRoom(name string) error {
+	if !roomRE.MatchString(name) {
+		return invalid("invalid room name %q, use up to 32 of a-z, 0-9, _ and -", name)
+	}
+
+	return nil
+}
+
+func (e *Envelope) hasPayload() bool {
+	return len(e.Payload) != 0 && string(e.Payload) != "null"
+}
+
+// DecodePayload reads the payload into v, strictly. No payload leaves v as it is.
+func (e *Envelope) DecodePayload(v any) error {
+	if !e.hasPayload() {
+		return nil
+	}
+	if err := strictUnmarshal(e.Payload, v); err != nil {
+		return invalid("bad %s payload: %v", e.Type, err)
+	}
+
+	return nil
+}
+
+func strictUnmarshal(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("trailing data after the JSON value")
+	}
+
+	return nil
+}
+
+// Encode is the JSON of the message.
+func Encode(e *Envelope) []byte {
+	b, err := json.Marshal(e)
+	if err != nil {
+		// Same as in New, and the payload is already JSON.
+		panic(fmt.Sprintf("protocol: failed to marshal the envelope: %v", err))
+	}
+
+	return b
+}
+
+// Parse reads a message from the server. Unlike Decode it's lenient, a newer server may add fields,
+// only the version must match.
+func Parse(data []byte) (*Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	if e.Version != Version {
+		return nil, fmt.Errorf("version %d, the client speaks %d", e.Version, Version)
+	}
+
+	return &e, nil
+}
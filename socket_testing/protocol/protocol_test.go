@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	long := strings.Repeat("a", MaxTextLength+1)
+	longTrace := strings.Repeat("a", MaxTraceLength+1)
+
+	testCases := []struct {
+		msg string
+		// code is the code of the error, "" for a valid message.
+		code string
+		// ref is the ID the error refers to.
+		ref string
+	}{
+		{msg: `{"v":1,"type":"chat","id":"m1","room":"lobby","payload":{"text":"hello"}}`},
+		{msg: `{"v":1,"type":"join","id":"m1","room":"ops"}`},
+		{msg: `{"v":1,"type":"join","id":"m1","room":"ops","payload":{"limit":5}}`},
+		{msg: `{"v":1,"type":"join","id":"m1","room":"ops","payload":{"after":"1718000000000001"}}`},
+		{msg: `{"v":1,"type":"leave","id":"m1","room":"ops"}`},
+		{msg: `{"v":1,"type":"system","id":"m1","payload":{"command":"rooms"}}`},
+		{msg: `{"v":1,"type":"system","id":"m1","room":"ops","payload":{"command":"history"}}`},
+		{msg: `{"v":1,"type":"system","id":"m1","room":"ops","payload":{"command":"history","before":"1718000000000001","limit":50}}`},
+		{msg: `{"v":1,"type":"ping","id":"m1"}`},
+		{msg: `{"v":1,"type":"ack","id":"m1","payload":{"ref":"p1"}}`},
+		{msg: `{"v":1,"type":"chat","id":"m1","room":"lobby","trace":{"traceparent":"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01","baggage":"user=a"},"payload":{"text":"hello"}}`},
+
+		{msg: `hello`, code: CodeBadJSON},
+		{msg: `{"v":1,"type":"ping","id":"m1"} {}`, code: CodeBadJSON},
+		{msg: `{"v":1,"type":"ping","id":"m1","extra":true}`, code: CodeBadJSON},
+		{msg: `{"v":2,"type":"ping","id":"m1"}`, code: CodeUnsupportedVersion, ref: "m1"},
+		{msg: `{"type":"ping","id":"m1"}`, code: CodeUnsupportedVersion, ref: "m1"},
+		{msg: `{"v":1,"type":"ping"}`, code: CodeInvalidMessage},
+		{msg: `{"v":1,"type":"ping","id":"a b"}`, code: CodeInvalidMessage, ref: "a b"},
+		{msg: `{"v":1,"type":"ping","id":"m1","sender":"me"}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"ping","id":"m1","ts":"2024-01-01T00:00:00Z"}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"shout","id":"m1"}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"ping","id":"m1","trace":{"x-trace":"1"}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"ping","id":"m1","trace":{"baggage":"` + longTrace + `"}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"ack","id":"m1","payload":{"ref":"m0","id":"42"}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"ack","id":"m1"}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"error","id":"m1","payload":{"code":"bad_json","message":"no"}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"chat","id":"m1","payload":{"text":"hello"}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"chat","id":"m1","room":"Ops","payload":{"text":"hello"}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"chat","id":"m1","room":"ops"}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"chat","id":"m1","room":"ops","payload":{"text":"` + long + `"}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"chat","id":"m1","room":"ops","payload":{"txt":"hello"}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"join","id":"m1","room":"ops","payload":{"limit":-1}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"join","id":"m1","room":"ops","payload":{"members":["me"]}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"join","id":"m1","room":"ops","payload":{"after":"?"}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"leave","id":"m1","room":"ops","payload":{}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"system","id":"m1","payload":{"command":"kick"}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"system","id":"m1","payload":{"command":"rooms","limit":5}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"system","id":"m1","payload":{"command":"history"}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"system","id":"m1","room":"ops","payload":{"command":"history","limit":1000}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"system","id":"m1","room":"ops","payload":{"command":"history","before":"a b"}}`, code: CodeInvalidMessage, ref: "m1"},
+		{msg: `{"v":1,"type":"system","id":"m1","room":"ops","payload":{"command":"history","more":true}}`, code: CodeInvalidMessage, ref: "m1"},
+	}
+
+	for _, tc := range testCases {
+		env, err := Decode([]byte(tc.msg))
+		if tc.code == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.msg, err)
+			}
+			continue
+		}
+
+		var protoErr *Error
+		if !errors.As(err, &protoErr) || protoErr.Code != tc.code {
+			t.Errorf("%s: got %v, want a %s error", tc.msg, err, tc.code)
+			continue
+		}
+		ref := ""
+		if env != nil {
+			ref = env.ID
+		}
+		if ref != tc.ref {
+			t.Errorf("%s: got ref %q, want %q", tc.msg, ref, tc.ref)
+		}
+	}
+}
+
+// TestRoundTrip checks what a client builds is what the server accepts.
+func TestRoundTrip(t *testing.T) {
+	for _, env := range []*Envelope{
+		New(TypeChat, Lobby, ChatPayload{Text: "hello"}),
+		New(TypeJoin, "ops", JoinPayload{Limit: 3}),
+		New(TypeJoin, "ops", JoinPayload{}),
+		New(TypeLeave, "ops", nil),
+		New(TypeSystem, "", SystemPayload{Command: CommandRooms}),
+		New(TypeSystem, "ops", SystemPayload{Command: CommandHistory, Before: "42", Limit: 10}),
+		New(TypePing, "", nil),
+		New(TypeAck, "", AckPayload{Ref: NewID()}),
+	} {
+		data := Encode(env)
+		if _, err := Decode(data); err != nil {
+			t.Errorf("%s: %v", data, err)
+		}
+		// The fields set by the server aren't there at all.
+		if bytes.Contains(data, []byte(`"ts"`)) || bytes.Contains(data, []byte(`"sender"`)) {
+			t.Errorf("%s: server fields in a client message", data)
+		}
+	}
+
+	// What the server sends is read by the client.
+	e := NewError(&Error{Code: CodeRoomFull, Message: "#ops is full"}, "m1")
+	got, err := Parse(Encode(e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p ErrorPayload
+	if err := got.DecodePayload(&p); err != nil || p != (ErrorPayload{Code: CodeRoomFull, Message: "#ops is full", Ref: "m1"}) {
+		t.Errorf("got %+v (%v)", p, err)
+	}
+}
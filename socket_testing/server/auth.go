@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var nameRE = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("expired token")
+)
+
+// Auth issues and checks the tokens of the users: the name and the expiry, signed with HMAC-SHA256.
+// There's no account, a token is a name nobody else is using right now, proven for a while.
+type Auth struct {
+	secret []byte
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// claims is what a token says, its payload. ID makes every token unique, even 2 issued
+// for the same name in the same second: resuming a session takes the token it was opened with.
+type claims struct {
+	Name    string `json:"name"`
+	Expires int64  `json:"exp"`
+	ID      string `json:"jti"`
+}
+
+func NewAuth(secret []byte, ttl time.Duration) *Auth {
+	return &Auth{secret: secret, ttl: ttl, now: time.Now}
+}
+
+// CheckName checks a display name is usable.
+func CheckName(name string) error {
+	if !nameRE.MatchString(name) {
+		return fmt.Errorf("invalid name %q, use up to 32 of A-Z, a-z, 0-9, _, . and -", name)
+	}
+
+	return nil
+}
+
+// Issue signs a token for the name: base64url(payload).base64url(signature), like a JWT without its header.
+func (a *Auth) Issue(name string) (string, time.Time) {
+	expires := a.now().Add(a.ttl).Truncate(time.Second)
+	id := make([]byte, 8)
+	rand.Read(id)
+	payload, _ := json.Marshal(claims{Name: name, Expires: expires.Unix(), ID: base64.RawURLEncoding.EncodeToString(id)})
+
+	enc := base64.RawURLEncoding.EncodeToString(payload)
+	return enc + "." + base64.RawURLEncoding.EncodeToString(a.sign(enc)), expires
+}
+
+// Verify returns the name of a valid token.
+func (a *Auth) Verify(token string) (string, error) {
+	enc, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", errInvalidToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, a.sign(enc)) {
+		return "", errInvalidToken
+	}
+
+	// Signed by us, the payload can be trusted from here.
+	payload, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return "", errInvalidToken
+	}
+	var c claims
+	if err := json.Unmarshal(payload, &c); err != nil || CheckName(c.Name) != nil {
+		return "", errInvalidToken
+	}
+	if !a.now().Before(time.Unix(c.Expires, 0)) {
+		return "", errExpiredToken
+	}
+
+	return c.Name, nil
+}
+
+func (a *Auth) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// tokenFrom reads the token of a request: the Authorization header, or the token parameter
+// for the browsers, they can't set headers on a websocket.
+func tokenFrom(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+
+	return r.URL.Query().Get("token")
+}
+
+// LoginResponse is the answer to /login.
+type LoginResponse struct {
+	Name    string    `json:"name"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// HandleLogin issues a token for the name posted, unless somebody is connected with it.
+//
+//	curl -d name=alice localhost:3001/login
+func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST a name", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.PostFormValue("name")
+	if err := CheckName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.isOnline(name) {
+		http.Error(w, fmt.Sprintf("%s is already connected", name), http.StatusConflict)
+		return
+	}
+
+	token, expires := s.auth.Issue(name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginResponse{Name: name, Token: token, Expires: expires})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"learn-prometheus/socket_testing/protocol"
+)
+
+func TestAuth(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	auth := NewAuth([]byte("secret"), time.Hour)
+	auth.now = func() time.Time { return now }
+
+	token, expires := auth.Issue("alice")
+	if !expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("expires %s, want in an hour", expires)
+	}
+	if name, err := auth.Verify(token); err != nil || name != "alice" {
+		t.Errorf("got %q, %v, want alice", name, err)
+	}
+
+	// Another name with the same signature.
+	enc, sig, _ := strings.Cut(token, ".")
+	forged, _ := NewAuth([]byte("other"), time.Hour).Issue("alice")
+	other, _ := auth.Issue("bob")
+	otherEnc, _, _ := strings.Cut(other, ".")
+	for _, bad := range []string{"", "alice", enc, enc + ".", otherEnc + "." + sig, forged, token + "x"} {
+		if _, err := auth.Verify(bad); err != errInvalidToken {
+			t.Errorf("%q: got %v, want it invalid", bad, err)
+		}
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := auth.Verify(token); err != errExpiredToken {
+		t.Errorf("got %v, want it expired", err)
+	}
+}
+
+func TestServerLogin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub(HubOptions{})
+	go hub.Run(ctx)
+
+	srv, _ := newTestServer(hub)
+	defer srv.Close()
+
+	login := func(name string) (string, int) {
+		t.Helper()
+		resp, err := http.PostForm(srv.URL+"/login", url.Values{"name": {name}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var r LoginResponse
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&r); err != nil || r.Name != name {
+				t.Fatalf("got %+v, %v", r, err)
+			}
+		}
+		return r.Token, resp.StatusCode
+	}
+
+	if _, code := login("not a name"); code != http.StatusBadRequest {
+		t.Errorf("got %d for an invalid name", code)
+	}
+	if _, err := dial(srv, "nope"); err == nil {
+		t.Error("connected without a valid token")
+	}
+
+	token, code := login("alice")
+	if code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	ws, err := dial(srv, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lobby join is attributed to the name.
+	if env := receiveWS(t, ws); env.Sender != "alice" {
+		t.Errorf("got %+v, want alice joining", env)
+	}
+
+	// One session per name.
+	if _, code := login("alice"); code != http.StatusConflict {
+		t.Errorf("got %d for a name already connected", code)
+	}
+	if _, err := dial(srv, token); err == nil {
+		t.Error("connected twice with the same name")
+	}
+
+	// The name is free again once disconnected.
+	ws.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, code := login("alice"); code == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("alice still connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func receiveWS(t *testing.T, ws *websocket.Conn) *protocol.Envelope {
+	t.Helper()
+
+	var data []byte
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if err := websocket.Message.Receive(ws, &data); err != nil {
+		t.Fatal(err)
+	}
+	return parse(t, data)
+}
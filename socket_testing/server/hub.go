@@ -0,0 +1,667 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/net/websocket"
+
+	"learn-prometheus/socket_testing/history"
+	"learn-prometheus/socket_testing/protocol"
+	"learn-prometheus/socket_testing/tracing"
+)
+
+// Policy is what the hub does with a message for a client whose send queue is full,
+// a client reading slower than the others are talking.
+type Policy string
+
+const (
+	// PolicyDrop skips the message for the slow client only, it will miss it.
+	PolicyDrop Policy = "drop"
+	// PolicyDisconnect closes the slow client, it can reconnect and catch up.
+	PolicyDisconnect Policy = "disconnect"
+	// PolicyBlock waits for room in the queue: nobody misses anything. The messages wait in a backlog of the client,
+	// moved to its queue by a goroutine of its own, so the hub goes on with the others. After BlockTimeout
+	// without room for a message, the client is disconnected anyway: a dead client can't pile up messages forever.
+	PolicyBlock Policy = "block"
+)
+
+// ParsePolicy checks the name of a policy.
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case PolicyDrop, PolicyDisconnect, PolicyBlock:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("unknown slow consumer policy %q, must be drop, disconnect or block", name)
+}
+
+type HubOptions struct {
+	// QueueSize is the number of messages waiting to be written to a client, 64 by default.
+	QueueSize int
+	// Policy is for the clients whose queue is full, PolicyDrop by default.
+	Policy Policy
+	// BlockTimeout is how long PolicyBlock waits for a client, 5s by default.
+	BlockTimeout time.Duration
+	// WriteTimeout is how long writing a message to a client can take before it's considered gone, 10s by default.
+	WriteTimeout time.Duration
+	// PingInterval is how often a client is pinged, 30s by default. It answers with an ack.
+	PingInterval time.Duration
+	// PongTimeout is how long a client can stay silent, the acks of the pings included, before it's considered gone.
+	// 2 pings by default, it must be longer than PingInterval.
+	PongTimeout time.Duration
+	// IdleTimeout is how long a client can go without saying anything but acks and pings, 0 for no limit.
+	IdleTimeout time.Duration
+	// RoomLimit is the max number of members of a room, 0 for no limit. A room can be created with a lower limit.
+	RoomLimit int
+	// History keeps the chat messages of the rooms, nil for none.
+	History *history.Store
+	// HistoryOnJoin is the number of messages of the history sent to who joins a room, 20 by default.
+	HistoryOnJoin int
+	// ResumeLimit is the max number of messages sent to a client resuming its session, per room, 1000 by default.
+	// It missed them while reconnecting.
+	ResumeLimit int
+	// MetricsRooms is the number of rooms with their own label in chat_room_members, 20 by default.
+	// The clients name the rooms, the others are summed up.
+	MetricsRooms int
+	// TracerProvider traces the chat messages, from the trace context of the client saying them. No tracing by default.
+	TracerProvider trace.TracerProvider
+
+	// MaxMessageSize is the max size of a websocket message from a client, 64KiB by default: a chat message
+	// of MaxTextLength fits even with every character escaped. A bigger one gets the client disconnected.
+	MaxMessageSize int
+	// RateLimit is the number of messages per second a connection can send, RateBurst at once. 0 for no limit.
+	// UserRateLimit and UserRateBurst are the same for a user, whatever its connections: reconnecting doesn't
+	// refill it. The acks of the pings aren't counted.
+	RateLimit     float64
+	RateBurst     int
+	UserRateLimit float64
+	UserRateBurst int
+	// RateStrikes is the number of messages in a row a client can send over the limits before it's disconnected,
+	// 5 by default. It's warned for each one before.
+	RateStrikes int
+}
+
+func (o *HubOptions) setDefaults() {
+	if o.QueueSize <= 0 {
+		o.QueueSize = 64
+	}
+	if o.Policy == "" {
+		o.Policy = PolicyDrop
+	}
+	if o.BlockTimeout <= 0 {
+		o.BlockTimeout = 5 * time.Second
+	}
+	if o.WriteTimeout <= 0 {
+		o.WriteTimeout = 10 * time.Second
+	}
+	if o.PingInterval <= 0 {
+		o.PingInterval = 30 * time.Second
+	}
+	if o.PongTimeout <= o.PingInterval {
+		o.PongTimeout = 2 * o.PingInterval
+	}
+	if o.HistoryOnJoin <= 0 {
+		o.HistoryOnJoin = 20
+	}
+	if o.ResumeLimit <= 0 {
+		o.ResumeLimit = 1000
+	}
+	if o.MetricsRooms <= 0 {
+		o.MetricsRooms = 20
+	}
+	if o.MaxMessageSize <= 0 {
+		o.MaxMessageSize = 64 << 10
+	}
+	if o.RateBurst <= 0 {
+		o.RateBurst = max(1, int(o.RateLimit))
+	}
+	if o.UserRateBurst <= 0 {
+		o.UserRateBurst = max(1, int(o.UserRateLimit))
+	}
+	if o.RateStrikes <= 0 {
+		o.RateStrikes = 5
+	}
+	if o.TracerProvider == nil {
+		o.TracerProvider = noop.NewTracerProvider()
+	}
+}
+
+// Hub is the only one touching the list of clients: registering, unregistering and broadcasting
+// are events handled one by one by Run, so the connection goroutines never share anything but channels.
+type Hub struct {
+	opts HubOptions
+
+	register   chan *Client
+	unregister chan *Client
+	broadcast  chan broadcast
+	join       chan membership
+	leave      chan membership
+	list       chan request
+	history    chan historyRequest
+	reply      chan reply
+	// done is closed when Run returns, the events sent after that are dropped.
+	done chan struct{}
+
+	// clients and rooms are only used by Run.
+	clients map[*Client]bool
+	rooms   map[string]*room
+	// lastID is the last message ID, in microseconds since 1970 so the IDs keep growing across restarts.
+	// With a history, it starts from its last message: the clock of the server may have gone back.
+	lastID uint64
+	// labelled is the number of rooms with their own label in the metrics, the lobby aside. Only used by Run.
+	labelled int
+
+	metrics *metrics
+	tracer  trace.Tracer
+	now     func() time.Time
+}
+
+// request is what every event from a client has: who sent it, and the ID of its message for the ack.
+type request struct {
+	c   *Client
+	ref string
+}
+
+type broadcast struct {
+	request
+	// ctx has the span of the client saying it, if it traces its messages.
+	ctx  context.Context
+	room string
+	text string
+}
+
+// outgoing is a message queued for a client, already encoded.
+type outgoing struct {
+	data []byte
+	// said is when the chat message was received, for chat_broadcast_fanout_seconds. Zero for the other messages.
+	said time.Time
+	// route has the span of the hub routing the chat message, the parent of its delivery span,
+	// and sender links it to the span of the client saying it. nil for the other messages.
+	route  context.Context
+	sender trace.Link
+}
+
+type reply struct {
+	to  *Client
+	env *protocol.Envelope
+	// kick is the reason to disconnect the client once the message is written, "" to keep it.
+	kick string
+}
+
+func NewHub(opts HubOptions) *Hub {
+	opts.setDefaults()
+
+	h := &Hub{
+		opts:       opts,
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		broadcast:  make(chan broadcast),
+		join:       make(chan membership),
+		leave:      make(chan membership),
+		list:       make(chan request),
+		history:    make(chan historyRequest),
+		reply:      make(chan reply),
+		done:       make(chan struct{}),
+		clients:    make(map[*Client]bool),
+		rooms:      make(map[string]*room),
+		metrics:    newMetrics(opts.QueueSize),
+		tracer:     opts.TracerProvider.Tracer(tracing.Name),
+		now:        time.Now,
+	}
+	if opts.History != nil {
+		h.lastID = opts.History.LastID()
+	}
+
+	return h
+}
+
+// Run handles the events until ctx is done, then closes every client.
+func (h *Hub) Run(ctx context.Context) {
+	defer close(h.done)
+
+	for {
+		select {
+		case c := <-h.register:
+			h.clients[c] = true
+			h.metrics.connections.Inc()
+			fmt.Println("Active connection: ", len(h.clients))
+			h.joinRoom(membership{request: request{c: c}, room: Lobby, after: c.resume})
+
+		case c := <-h.unregister:
+			// Closed already, by its reader or its writer.
+			h.remove(c, "")
+
+		case b := <-h.broadcast:
+			h.say(b)
+
+		case m := <-h.join:
+			if h.clients[m.c] {
+				h.joinRoom(m)
+			}
+
+		case m := <-h.leave:
+			if h.clients[m.c] {
+				h.leaveRoom(m)
+			}
+
+		case r := <-h.list:
+			h.listRooms(r)
+
+		case r := <-h.history:
+			if h.clients[r.c] {
+				h.sendHistory(r)
+			}
+
+		case r := <-h.reply:
+			if r.env != nil {
+				h.send(r.to, r.env)
+			}
+			if r.kick != "" {
+				h.remove(r.to, r.kick)
+			}
+
+		case <-ctx.Done():
+			for c := range h.clients {
+				h.remove(c, reasonShutdown)
+			}
+			return
+		}
+	}
+}
+
+// say sends the message to the other members of the room, and acks it with its ID.
+// The message carries the trace context of its routing, the members' clients continue the trace.
+func (h *Hub) say(b broadcast) {
+	ctx, span := h.tracer.Start(b.ctx, "chat route", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("chat.room", b.room), attribute.String("chat.sender", b.c.name)))
+	defer span.End()
+	// After the route started: the deliveries start then, they're its children.
+	said := time.Now()
+
+	r, ok := h.rooms[b.room]
+	if !ok || !r.members[b.c] {
+		span.SetStatus(codes.Error, protocol.CodeNotInRoom)
+		h.fail(b.request, protocol.CodeNotInRoom, fmt.Sprintf("you're not in #%s, join it first", b.room))
+		return
+	}
+
+	env := h.stamp(protocol.New(protocol.TypeChat, b.room, protocol.ChatPayload{Text: b.text}))
+	env.Sender = b.c.name
+	env.Trace = tracing.Inject(ctx)
+	data := protocol.Encode(env)
+	span.SetAttributes(attribute.String("chat.message.id", env.ID), attribute.Int("chat.recipients", len(r.members)-1))
+	if h.opts.History != nil {
+		// Written in the hub, in order: appending is a write to the page cache, the segments are synced on rotation.
+		if err := h.opts.History.Append(b.room, history.Message{ID: h.lastID, Time: env.Time, Data: data}); err != nil {
+			fmt.Printf("Failed to save a message of #%s: %v\n", b.room, err)
+		}
+	}
+	h.metrics.broadcast.Inc()
+	var sender trace.Link
+	if sc := trace.SpanContextFromContext(b.ctx); sc.IsValid() {
+		sender = trace.Link{SpanContext: sc}
+	}
+	for c := range r.members {
+		if c != b.c {
+			h.deliver(c, outgoing{data: data, said: said, route: ctx, sender: sender})
+		}
+	}
+	h.ack(b.request, env.ID)
+}
+
+// stamp gives the message the next ID and the time of the server.
+func (h *Hub) stamp(env *protocol.Envelope) *protocol.Envelope {
+	env.Time = h.now().UTC()
+	h.lastID = max(h.lastID+1, uint64(env.Time.UnixMicro()))
+	env.ID = strconv.FormatUint(h.lastID, 10)
+
+	return env
+}
+
+// send stamps and queues a message for one client.
+func (h *Hub) send(c *Client, env *protocol.Envelope) {
+	h.deliver(c, outgoing{data: protocol.Encode(h.stamp(env))})
+}
+
+// ack confirms the request was handled, id is the ID of the message it created if any.
+// Events the server makes up (the lobby join on connection) have no ref, and no ack.
+func (h *Hub) ack(r request, id string) {
+	if r.ref != "" {
+		h.send(r.c, protocol.New(protocol.TypeAck, "", protocol.AckPayload{Ref: r.ref, ID: id}))
+	}
+}
+
+func (h *Hub) fail(r request, code, message string) {
+	h.send(r.c, protocol.NewError(&protocol.Error{Code: code, Message: message}, r.ref))
+}
+
+// remove takes the client out of its rooms and closes its send queue,
+// its writer stops and closes the connection for that reason.
+func (h *Hub) remove(c *Client, reason string) {
+	if !h.clients[c] {
+		// Already disconnected as a slow consumer.
+		return
+	}
+
+	// Deleted first: telling the rooms can disconnect other slow clients, and come back here.
+	delete(h.clients, c)
+	h.metrics.connections.Dec()
+	c.kicked = reason
+	c.backlogMtx.Lock()
+	if c.relaying {
+		// The relay closes the queue once the backlog is in it, in order.
+		c.closing = true
+	} else {
+		close(c.send)
+	}
+	c.backlogMtx.Unlock()
+	for name := range c.rooms {
+		h.leaveRoom(membership{request: request{c: c}, room: name})
+	}
+	fmt.Println("Active connection: ", len(h.clients))
+}
+
+// deliver queues the message for the client, or applies the slow consumer policy if its queue is full.
+func (h *Hub) deliver(c *Client, msg outgoing) {
+	if !h.clients[c] {
+		// Disconnected while the hub was busy with the event.
+		return
+	}
+
+	// Behind already with PolicyBlock: after the backlog, in order.
+	c.backlogMtx.Lock()
+	relaying := c.relaying
+	if relaying {
+		c.backlog = append(c.backlog, msg)
+	}
+	c.backlogMtx.Unlock()
+	if relaying {
+		return
+	}
+
+	select {
+	case c.send <- msg:
+		h.metrics.queueDepth.Observe(float64(len(c.send)))
+		return
+	default:
+	}
+
+	switch h.opts.Policy {
+	case PolicyDrop:
+		c.dropped++
+		h.metrics.dropped.Inc()
+		fmt.Printf("%s is too slow, dropped a message (%d so far)\n", c.name, c.dropped)
+
+	case PolicyDisconnect:
+		fmt.Printf("%s is too slow, disconnecting\n", c.name)
+		h.remove(c, reasonSlowConsumer)
+
+	case PolicyBlock:
+		c.backlogMtx.Lock()
+		c.backlog = append(c.backlog, msg)
+		if !c.relaying {
+			c.relaying = true
+			go h.relay(c)
+		}
+		c.backlogMtx.Unlock()
+	}
+}
+
+// relay moves the backlog of the client to its queue as it makes room, for PolicyBlock.
+// Until the backlog is empty, the hub adds to it instead of the queue: the messages stay in order.
+func (h *Hub) relay(c *Client) {
+	timer := time.NewTimer(h.opts.BlockTimeout)
+	defer timer.Stop()
+
+	for {
+		c.backlogMtx.Lock()
+		if len(c.backlog) == 0 {
+			c.stopRelay()
+			c.backlogMtx.Unlock()
+			return
+		}
+		msg := c.backlog[0]
+		c.backlogMtx.Unlock()
+
+		timer.Reset(h.opts.BlockTimeout)
+		select {
+		case c.send <- msg:
+			h.metrics.queueDepth.Observe(float64(len(c.send)))
+			c.backlogMtx.Lock()
+			c.backlog = c.backlog[1:]
+			c.backlogMtx.Unlock()
+			continue
+		case <-c.closed:
+			// Its writer failed, it's on its way out.
+		case <-timer.C:
+			fmt.Printf("%s is stuck for %s, disconnecting\n", c.name, h.opts.BlockTimeout)
+			// Still relaying meanwhile: what the hub adds to the backlog is dropped with it.
+			h.Kick(c, reasonSlowConsumer, nil)
+		}
+
+		c.backlogMtx.Lock()
+		c.backlog = nil
+		c.stopRelay()
+		c.backlogMtx.Unlock()
+		return
+	}
+}
+
+// Register adds the client and puts it in the lobby.
+func (h *Hub) Register(c *Client) {
+	select {
+	case h.register <- c:
+	case <-h.done:
+		close(c.send)
+	}
+}
+
+// Unregister removes the client, it's fine to call it more than once.
+func (h *Hub) Unregister(c *Client) {
+	select {
+	case h.unregister <- c:
+	case <-h.done:
+	}
+}
+
+// Broadcast sends the text to the other members of the room. ref is the ID of the client's message,
+// ctx has its trace context.
+func (h *Hub) Broadcast(ctx context.Context, from *Client, ref, room, text string) {
+	select {
+	case h.broadcast <- broadcast{request: request{c: from, ref: ref}, ctx: ctx, room: room, text: text}:
+	case <-h.done:
+	}
+}
+
+// Reply sends the message to that client only.
+func (h *Hub) Reply(to *Client, env *protocol.Envelope) {
+	select {
+	case h.reply <- reply{to: to, env: env}:
+	case <-h.done:
+	}
+}
+
+// Kick sends the message to the client, an error saying why, then disconnects it for that reason.
+// Its queue is written before, in order. A nil message only disconnects it.
+func (h *Hub) Kick(c *Client, reason string, env *protocol.Envelope) {
+	select {
+	case h.reply <- reply{to: c, env: env, kick: reason}:
+	case <-h.done:
+	}
+}
+
+// Why a client was disconnected, in the logs and chat_disconnects_total.
+const (
+	// reasonClean is the client closing the connection.
+	reasonClean = "clean"
+	// reasonTimeout is a client silent for PongTimeout, pings unanswered, or a write taking longer than WriteTimeout.
+	reasonTimeout = "timeout"
+	// reasonIdle is a client saying nothing for IdleTimeout, even if it answers the pings.
+	reasonIdle = "idle"
+	// reasonProtocolError is a client sending something that isn't a websocket message.
+	reasonProtocolError = "protocol_error"
+	// reasonWriteError is a write failing before its timeout, the connection is broken.
+	reasonWriteError   = "write_error"
+	reasonSlowConsumer = "slow_consumer"
+	reasonShutdown     = "shutdown"
+	// reasonReplaced is a client reconnecting before the server noticed its old connection was gone.
+	reasonReplaced = "replaced"
+	// reasonTooLarge is a message over MaxMessageSize, reasonRateLimited a client going over the rate limits
+	// RateStrikes times in a row.
+	reasonTooLarge    = "too_large"
+	reasonRateLimited = "rate_limited"
+)
+
+// closeCodes are the close codes of the disconnections with a reason the client should know, RFC 6455 section 7.4.1.
+// For the clients that can read them, like a browser, the x/net ones can't: the kicked ones get an error before.
+var closeCodes = map[string]int{
+	reasonShutdown: 1001, // Going away.
+	// Policy violation.
+	reasonRateLimited: 1008,
+	// Message too big.
+	reasonTooLarge: 1009,
+}
+
+// Client is one connection. Its messages are read by the goroutine of HandleWS and written by its own goroutine,
+// so a client slow to read only fills its own queue.
+type Client struct {
+	ws *websocket.Conn
+	// conn is the connection under ws, nil in the tests of the hub.
+	conn net.Conn
+	name string
+
+	// send is the queue of messages to write. Only the hub sends to it and closes it, or the relay while it runs.
+	send chan outgoing
+	// backlog is for PolicyBlock, the messages waiting for room in send. relaying is set while the relay
+	// moves them, and closing once the hub removed the client: the relay closes send when it's done then.
+	backlogMtx sync.Mutex
+	backlog    []outgoing
+	relaying   bool
+	closing    bool
+	// dropped is the number of messages dropped by PolicyDrop, and rooms the rooms the client is in.
+	// Only used by the hub.
+	dropped int
+	rooms   map[string]bool
+	// kicked is why the hub removed the client, set before closing send so the writer can read it.
+	kicked string
+	// resume is the ID of the last message the client saw before reconnecting, "" for a new session.
+	resume string
+
+	// closed is closed once the connection is closing, reading from it can only fail from then on.
+	closed    chan struct{}
+	closeOnce sync.Once
+	// reason is why the connection was closed, the first one wins. Read it once closed is.
+	reason string
+}
+
+func newClient(ws *websocket.Conn, name string, queueSize int) *Client {
+	return &Client{
+		ws:     ws,
+		name:   name,
+		send:   make(chan outgoing, queueSize),
+		rooms:  make(map[string]bool),
+		closed: make(chan struct{}),
+	}
+}
+
+// writeLoop writes the queued messages until the hub closes the queue, or a write fails,
+// and pings the client in between. Either way the connection is closed, so the reader stops too.
+func (c *Client) writeLoop(h *Hub) {
+	ticker := time.NewTicker(h.opts.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		var msg outgoing
+		select {
+		case m, ok := <-c.send:
+			if !ok {
+				c.close(c.kicked)
+				return
+			}
+			msg = m
+		case <-ticker.C:
+			// The pings aren't messages of the chat, they get a random ID instead of one from the hub.
+			msg.data = protocol.Encode(protocol.New(protocol.TypePing, "", nil))
+		}
+
+		span := h.startDelivery(c, msg)
+		c.ws.SetWriteDeadline(time.Now().Add(h.opts.WriteTimeout))
+		// Text frames, JSON is text.
+		if err := websocket.Message.Send(c.ws, string(msg.data)); err != nil {
+			fmt.Printf("Failed to send to %s: %v\n", c.name, err)
+			reason := reasonWriteError
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				reason = reasonTimeout
+			}
+			span.RecordError(err)
+			span.SetStatus(codes.Error, reason)
+			span.End()
+			// Closed first: the hub may be blocked on this client, waiting for room in its queue.
+			c.close(reason)
+			h.Unregister(c)
+			return
+		}
+		span.End()
+		h.metrics.bytesOut.Add(float64(len(msg.data)))
+		if !msg.said.IsZero() {
+			h.metrics.fanout.Observe(time.Since(msg.said).Seconds())
+		}
+	}
+}
+
+// startDelivery starts the span of a chat message written to the client, from the moment it was queued:
+// a slow client shows as a long delivery. The other messages aren't traced.
+func (h *Hub) startDelivery(c *Client, msg outgoing) trace.Span {
+	if msg.route == nil {
+		return trace.SpanFromContext(context.Background())
+	}
+
+	_, span := h.tracer.Start(msg.route, "chat deliver", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithTimestamp(msg.said), trace.WithLinks(msg.sender), trace.WithAttributes(attribute.String("chat.recipient", c.name)))
+	return span
+}
+
+// close closes the connection, reason is ignored if it's closed already. A reason with a close code
+// is only given by the writer, nothing else writes then.
+func (c *Client) close(reason string) {
+	c.closeOnce.Do(func() {
+		c.reason = reason
+		close(c.closed)
+		// A single close frame: ws.Close writes a normal one, so with another code only the connection under it is closed.
+		if code := closeCodes[reason]; code != 0 && c.conn != nil {
+			// Promoted from the frame handler of the connection.
+			c.ws.WriteClose(code)
+			c.conn.Close()
+			return
+		}
+		c.ws.Close()
+	})
+}
+
+// stopRelay is the end of the relay, c.backlogMtx must be held.
+func (c *Client) stopRelay() {
+	c.relaying = false
+	if c.closing {
+		close(c.send)
+	}
+}
+
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
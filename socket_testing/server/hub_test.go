@@ -0,0 +1,571 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/websocket"
+
+	"learn-prometheus/socket_testing/history"
+	"learn-prometheus/socket_testing/protocol"
+)
+
+// wait returns once the hub is done with the events sent before: it handles them one by one.
+func wait(h *Hub) {
+	h.Unregister(newClient(nil, "nobody", 1))
+}
+
+func receive(t *testing.T, c *Client) (*protocol.Envelope, bool) {
+	t.Helper()
+
+	select {
+	case msg, ok := <-c.send:
+		if !ok {
+			return nil, false
+		}
+		return parse(t, msg.data), true
+	case <-time.After(time.Second):
+		t.Fatalf("nothing for %s", c.name)
+		return nil, false
+	}
+}
+
+// drain reads what's queued for the client, like the lobby join.
+func drain(t *testing.T, c *Client) []*protocol.Envelope {
+	t.Helper()
+
+	var envs []*protocol.Envelope
+	for {
+		select {
+		case msg := <-c.send:
+			envs = append(envs, parse(t, msg.data))
+		default:
+			return envs
+		}
+	}
+}
+
+func parse(t *testing.T, data []byte) *protocol.Envelope {
+	t.Helper()
+
+	env, err := protocol.Parse(data)
+	if err != nil {
+		t.Fatalf("%s: %v", data, err)
+	}
+	if env.ID == "" || env.Time.IsZero() {
+		t.Errorf("%s: the server must set the ID and the time", data)
+	}
+	return env
+}
+
+// text is the text of a chat message, "" for the other types.
+func text(env *protocol.Envelope) string {
+	var p protocol.ChatPayload
+	if env == nil || env.Type != protocol.TypeChat {
+		return ""
+	}
+	env.DecodePayload(&p)
+	return p.Text
+}
+
+func TestHubSlowConsumer(t *testing.T) {
+	testCases := []struct {
+		policy Policy
+		// read is read by the slow client after two messages, with a queue of 1.
+		read []string
+		// open is whether it's still connected.
+		open bool
+	}{
+		{policy: PolicyDrop, read: []string{"1"}, open: true},
+		{policy: PolicyDisconnect, read: []string{"1"}, open: false},
+		{policy: PolicyBlock, read: []string{"1", "2"}, open: true},
+	}
+
+	for _, tc := range testCases {
+		ctx, cancel := context.WithCancel(context.Background())
+		h := NewHub(HubOptions{QueueSize: 1, Policy: tc.policy})
+		go h.Run(ctx)
+
+		from, slow := newClient(nil, "from", 10), newClient(nil, "slow", 1)
+		h.Register(from)
+		h.Register(slow)
+		wait(h)
+		drain(t, slow)
+
+		h.Broadcast(ctx, from, "m1", Lobby, "1")
+		// With PolicyBlock, the hub waits for the slow client to read.
+		go h.Broadcast(ctx, from, "m2", Lobby, "2")
+		time.Sleep(50 * time.Millisecond)
+
+		for _, want := range tc.read {
+			if got, _ := receive(t, slow); text(got) != want || got.Sender != "from" || got.Room != Lobby {
+				t.Errorf("%s: got %+v, want %q from from in the lobby", tc.policy, got, want)
+			}
+		}
+
+		drain(t, from)
+		h.Broadcast(ctx, from, "m3", Lobby, "3")
+		wait(h)
+		if got, ok := receive(t, slow); ok != tc.open || (ok && text(got) != "3") {
+			t.Errorf("%s: got %+v (open: %v) after catching up, want open: %v", tc.policy, got, ok, tc.open)
+		}
+		if got, want := testutil.ToFloat64(h.metrics.dropped), map[Policy]float64{PolicyDrop: 1}[tc.policy]; got != want {
+			t.Errorf("%s: got %v dropped messages, want %v", tc.policy, got, want)
+		}
+		// Nobody gets their own messages, only the ack.
+		envs := drain(t, from)
+		for _, env := range envs {
+			if env.Type == protocol.TypeChat {
+				t.Errorf("%s: the sender got its own message %+v", tc.policy, env)
+			}
+		}
+		var ack protocol.AckPayload
+		if last := envs[len(envs)-1]; last.Type != protocol.TypeAck || last.DecodePayload(&ack) != nil || ack.Ref != "m3" || ack.ID == "" {
+			t.Errorf("%s: got %+v, want the ack of m3 with the ID of the message", tc.policy, last)
+		}
+
+		cancel()
+		<-h.done
+	}
+}
+
+// TestHubBlockTimeout checks a stuck client doesn't hold the others up with PolicyBlock, and is disconnected in the end.
+func TestHubBlockTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewHub(HubOptions{QueueSize: 1, Policy: PolicyBlock, BlockTimeout: 200 * time.Millisecond})
+	go h.Run(ctx)
+
+	from, stuck, other := newClient(nil, "from", 10), newClient(nil, "stuck", 1), newClient(nil, "other", 10)
+	h.Register(from)
+	h.Register(other)
+	// Last, its queue of 1 only has its own join.
+	h.Register(stuck)
+	wait(h)
+	drain(t, stuck)
+	drain(t, other)
+
+	start := time.Now()
+	for i := range 3 {
+		h.Broadcast(ctx, from, fmt.Sprint("m", i), Lobby, fmt.Sprint(i))
+	}
+	// Everyone else goes on meanwhile.
+	h.Join(other, "j", "dev", 0, "")
+	wait(h)
+	for _, want := range []string{"0", "1", "2"} {
+		if got, _ := receive(t, other); text(got) != want {
+			t.Errorf("got %+v, want %q", got, want)
+		}
+	}
+	if env, _ := receive(t, other); env.Type != protocol.TypeJoin || env.Room != "dev" {
+		t.Errorf("got %+v, want the join of dev", env)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("the hub waited %s for the stuck client", elapsed)
+	}
+
+	// Never reading anything past the first message, it's disconnected once the block timeout is over.
+	time.Sleep(400 * time.Millisecond)
+	if got, _ := receive(t, stuck); text(got) != "0" {
+		t.Errorf("got %+v, want the first message, queued before it got stuck", got)
+	}
+	if got, ok := receive(t, stuck); ok {
+		t.Errorf("got %+v, the stuck client must be disconnected", got)
+	}
+}
+
+func TestHubIDs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewHub(HubOptions{})
+	// The clock goes back, the IDs keep growing.
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	h.now = func() time.Time {
+		now = now.Add(-time.Second)
+		return now
+	}
+	go h.Run(ctx)
+
+	a, b := newClient(nil, "a", 10), newClient(nil, "b", 10)
+	h.Register(a)
+	h.Register(b)
+	for i := range 3 {
+		h.Broadcast(ctx, a, fmt.Sprint("m", i), Lobby, "hello")
+	}
+	wait(h)
+
+	var last uint64
+	for _, env := range drain(t, b) {
+		id, err := strconv.ParseUint(env.ID, 10, 64)
+		if err != nil || id <= last {
+			t.Errorf("got ID %q after %d, want a growing number", env.ID, last)
+		}
+		last = id
+	}
+}
+
+func TestHubRooms(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewHub(HubOptions{})
+	go h.Run(ctx)
+
+	a, b, c := newClient(nil, "a", 10), newClient(nil, "b", 10), newClient(nil, "c", 10)
+	for _, client := range []*Client{a, b, c} {
+		h.Register(client)
+	}
+
+	// queued is what's queued for the client, once the hub is done with the events sent before.
+	queued := func(client *Client) []*protocol.Envelope {
+		wait(h)
+		return drain(t, client)
+	}
+	// failed checks the client got an error with that code, and nothing else.
+	failed := func(client *Client, ref, code string) {
+		t.Helper()
+		envs := queued(client)
+		var p protocol.ErrorPayload
+		if len(envs) != 1 || envs[0].Type != protocol.TypeError || envs[0].DecodePayload(&p) != nil || p.Code != code || p.Ref != ref {
+			t.Errorf("got %+v, want a %s error for %s", envs, code, ref)
+		}
+	}
+	queued(a)
+	queued(b)
+	queued(c)
+
+	h.Broadcast(ctx, a, "m1", "ops", "hello?")
+	failed(a, "m1", protocol.CodeNotInRoom)
+
+	h.Join(b, "j1", "ops", 2, "")
+	queued(b)
+	h.Join(a, "j2", "ops", 0, "")
+	envs := queued(a)
+	var join protocol.JoinPayload
+	if len(envs) != 2 || envs[0].Type != protocol.TypeJoin || envs[0].Sender != "a" || envs[0].Room != "ops" ||
+		envs[0].DecodePayload(&join) != nil || strings.Join(join.Members, ",") != "a,b" || envs[1].Type != protocol.TypeAck {
+		t.Errorf("got %+v, want the join with the members and the ack", envs)
+	}
+	if envs := queued(b); len(envs) != 1 || envs[0].Type != protocol.TypeJoin || envs[0].Sender != "a" {
+		t.Errorf("got %+v, want a joined", envs)
+	}
+
+	h.Join(c, "j3", "ops", 0, "")
+	// The limit set by the first member.
+	failed(c, "j3", protocol.CodeRoomFull)
+	h.Join(a, "j4", "ops", 0, "")
+	failed(a, "j4", protocol.CodeAlreadyInRoom)
+
+	h.Broadcast(ctx, a, "m2", "ops", "incident in #ops")
+	if envs := queued(b); len(envs) != 1 || text(envs[0]) != "incident in #ops" || envs[0].Room != "ops" {
+		t.Errorf("got %+v", envs)
+	}
+	if envs := queued(c); len(envs) != 0 {
+		t.Errorf("c got %+v, it's not in #ops", envs)
+	}
+	queued(a)
+
+	// rooms lists the rooms sent to c.
+	rooms := func() []protocol.RoomInfo {
+		t.Helper()
+		h.List(c, "l1")
+		envs := queued(c)
+		var p protocol.SystemPayload
+		if len(envs) != 2 || envs[0].Type != protocol.TypeSystem || envs[0].DecodePayload(&p) != nil {
+			t.Fatalf("got %+v, want the rooms", envs)
+		}
+		return p.Rooms
+	}
+	want := []protocol.RoomInfo{{Name: "lobby", Members: 3, Joined: true}, {Name: "ops", Members: 2, Limit: 2}}
+	if got := rooms(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// The room goes with its last member, a disconnection counts.
+	h.Leave(b, "l2", "ops")
+	if envs := queued(b); len(envs) != 2 || envs[0].Type != protocol.TypeLeave || envs[1].Type != protocol.TypeAck {
+		t.Errorf("got %+v, want b left and the ack", envs)
+	}
+	h.Leave(b, "l3", "ops")
+	failed(b, "l3", protocol.CodeNotInRoom)
+	h.Unregister(a)
+	if envs := queued(c); len(envs) != 1 || envs[0].Type != protocol.TypeLeave || envs[0].Sender != "a" || envs[0].Room != Lobby {
+		t.Errorf("got %+v, want a left the lobby", envs)
+	}
+	want = []protocol.RoomInfo{{Name: "lobby", Members: 2, Joined: true}}
+	if got := rooms(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v, #ops must be gone", got, want)
+	}
+}
+
+// newTestServer serves the chat server like main does.
+func newTestServer(hub *Hub) (*httptest.Server, *Server) {
+	server := NewServer(hub, NewAuth([]byte("secret"), time.Hour))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", server.HandleLogin)
+	mux.HandleFunc("/ws", server.ServeWS)
+
+	return httptest.NewServer(mux), server
+}
+
+func dial(srv *httptest.Server, token string) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+	config.Header.Set("Authorization", "Bearer "+token)
+	return websocket.DialConfig(config)
+}
+
+// say sends a chat message to the lobby.
+func say(ws *websocket.Conn, text string) error {
+	return websocket.Message.Send(ws, string(protocol.Encode(protocol.New(protocol.TypeChat, Lobby, protocol.ChatPayload{Text: text}))))
+}
+
+// TestServerLoad has every client talking at once, run it with -race.
+func TestServerLoad(t *testing.T) {
+	const clients, messages = 20, 50
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub(HubOptions{QueueSize: 16, Policy: PolicyBlock})
+	go hub.Run(ctx)
+
+	srv, server := newTestServer(hub)
+	defer srv.Close()
+
+	conns := make([]*websocket.Conn, clients)
+	for i := range conns {
+		token, _ := server.auth.Issue(fmt.Sprintf("client-%d", i))
+		ws, err := dial(srv, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		conns[i] = ws
+	}
+
+	// A client is registered once it gets a message from the others, the first one is registered
+	// once it sends anything. Until everyone is, the first one keeps asking.
+	var registered, done sync.WaitGroup
+	registered.Add(clients - 1)
+	done.Add(clients)
+	counts := make([]int, clients)
+	for i, ws := range conns {
+		go func() {
+			defer done.Done()
+
+			seen := false
+			for counts[i] < (clients-1)*messages {
+				var data []byte
+				ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+				if err := websocket.Message.Receive(ws, &data); err != nil {
+					t.Errorf("client %d: %v after %d messages", i, err, counts[i])
+					return
+				}
+				env, err := protocol.Parse(data)
+				if err != nil {
+					t.Errorf("client %d: %v", i, err)
+					return
+				}
+				if env.Type != protocol.TypeChat {
+					// Somebody joined the lobby, or the ack of a message.
+					continue
+				}
+				if text(env) == "probe" {
+					if !seen {
+						seen = true
+						registered.Done()
+					}
+					continue
+				}
+				counts[i]++
+			}
+		}()
+	}
+
+	probed := make(chan struct{})
+	go func() {
+		registered.Wait()
+		close(probed)
+	}()
+	for waiting := true; waiting; {
+		if err := say(conns[0], "probe"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-probed:
+			waiting = false
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	var senders sync.WaitGroup
+	for i, ws := range conns {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			for j := 0; j < messages; j++ {
+				if err := say(ws, fmt.Sprintf("message %d from %d", j, i)); err != nil {
+					t.Errorf("client %d: %v", i, err)
+					return
+				}
+			}
+		}()
+	}
+	senders.Wait()
+	done.Wait()
+
+	// Every message written to every other client is in the fan-out latency, the probes too.
+	var m dto.Metric
+	if err := server.metrics.fanout.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.GetHistogram().GetSampleCount(), uint64(clients*(clients-1)*messages); got < want {
+		t.Errorf("got %d fan-out latencies, want at least %d", got, want)
+	}
+	if got, want := testutil.ToFloat64(server.metrics.received.WithLabelValues(string(protocol.TypeChat))), float64(clients*messages); got < want {
+		t.Errorf("got %v chat messages received, want at least %v", got, want)
+	}
+}
+
+func TestHubHistory(t *testing.T) {
+	dir := t.TempDir()
+	store, err := history.Open(dir, history.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := NewHub(HubOptions{History: store, HistoryOnJoin: 2})
+	go h.Run(ctx)
+
+	a := newClient(nil, "a", 10)
+	h.Register(a)
+	for i := range 3 {
+		h.Broadcast(ctx, a, fmt.Sprint("m", i), Lobby, fmt.Sprint("message ", i))
+	}
+	wait(h)
+	drain(t, a)
+
+	// replayed checks the client got the history, and returns the IDs of its messages.
+	replayed := func(envs []*protocol.Envelope, want ...string) []string {
+		t.Helper()
+		for _, env := range envs {
+			var p protocol.SystemPayload
+			if env.Type != protocol.TypeSystem || env.DecodePayload(&p) != nil || p.Command != protocol.CommandHistory {
+				continue
+			}
+			var texts, ids []string
+			for _, data := range p.History {
+				msg := parse(t, data)
+				texts, ids = append(texts, text(msg)), append(ids, msg.ID)
+			}
+			if fmt.Sprint(texts) != fmt.Sprint(want) {
+				t.Errorf("got %q, want %q", texts, want)
+			}
+			return ids
+		}
+		t.Errorf("got %+v, want the history", envs)
+		return nil
+	}
+
+	// The last messages on join.
+	b := newClient(nil, "b", 10)
+	h.Register(b)
+	wait(h)
+	ids := replayed(drain(t, b), "message 1", "message 2")
+
+	// Then the older ones, by ID.
+	h.History(b, "h1", Lobby, ids[0], 0)
+	wait(h)
+	replayed(drain(t, b), "message 0")
+
+	// The members only.
+	h.History(b, "h2", "ops", "", 0)
+	wait(h)
+	if envs := drain(t, b); len(envs) != 1 || envs[0].Type != protocol.TypeError {
+		t.Errorf("got %+v, want an error", envs)
+	}
+
+	cancel()
+	<-h.done
+	store.Close()
+
+	// After a restart, the history is still there and the IDs keep growing, whatever the clock says.
+	if store, err = history.Open(dir, history.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	h = NewHub(HubOptions{History: store})
+	h.now = func() time.Time { return time.Unix(0, 0) }
+	go h.Run(ctx)
+
+	c := newClient(nil, "c", 10)
+	h.Register(c)
+	wait(h)
+	envs := drain(t, c)
+	replayed(envs, "message 0", "message 1", "message 2")
+	last, _ := strconv.ParseUint(ids[1], 10, 64)
+	if id, _ := strconv.ParseUint(envs[0].ID, 10, 64); id <= last {
+		t.Errorf("got ID %d after a restart, want more than %d", id, last)
+	}
+}
+
+func TestHubMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewHub(HubOptions{MetricsRooms: 2})
+	go h.Run(ctx)
+
+	a, b := newClient(nil, "a", 10), newClient(nil, "b", 10)
+	h.Register(a)
+	h.Register(b)
+	for _, room := range []string{"one", "two", "three", "four"} {
+		h.Join(a, "", room, 0, "")
+	}
+	h.Join(b, "", "four", 0, "")
+	wait(h)
+
+	// members checks chat_room_members, room by room.
+	members := func(want map[string]float64) {
+		t.Helper()
+		if n := testutil.CollectAndCount(h.metrics.members); n != len(want) {
+			t.Errorf("got %d rooms in the metrics, want %d", n, len(want))
+		}
+		for room, n := range want {
+			if got := testutil.ToFloat64(h.metrics.members.WithLabelValues(room)); got != n {
+				t.Errorf("got %v members in %s, want %v", got, room, n)
+			}
+		}
+	}
+	// The lobby, and only the first 2 other rooms get their name.
+	members(map[string]float64{Lobby: 2, "one": 1, "two": 1, otherRooms: 3})
+	if got := testutil.ToFloat64(h.metrics.connections); got != 2 {
+		t.Errorf("got %v connections, want 2", got)
+	}
+
+	// A room gone frees its label for the next one.
+	h.Leave(a, "", "one")
+	h.Join(b, "", "five", 0, "")
+	wait(h)
+	members(map[string]float64{Lobby: 2, "two": 1, "five": 1, otherRooms: 3})
+
+	h.Unregister(a)
+	wait(h)
+	members(map[string]float64{Lobby: 1, "five": 1, otherRooms: 1})
+	if got := testutil.ToFloat64(h.metrics.connections); got != 1 {
+		t.Errorf("got %v connections, want 1", got)
+	}
+}
@@ -1,84 +1,409 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"time"
 
 	"golang.org/x/net/websocket"
+
+	"learn-prometheus/socket_testing/history"
+	"learn-prometheus/socket_testing/protocol"
+	"learn-prometheus/socket_testing/tracing"
 )
 
 type Server struct {
-	conns map[*websocket.Conn]bool
+	hub     *Hub
+	auth    *Auth
+	metrics *metrics
+
+	// online are the names connected, a name has one session at a time.
+	// buckets are the rate limits of the users, kept across their connections until they're full again.
+	mu      sync.Mutex
+	online  map[string]*session
+	buckets map[string]*tokenBucket
 }
 
-func NewServer() *Server {
+// session is a name connected, from the check of its token until its connection is done.
+type session struct {
+	// c is set once the connection is upgraded.
+	c *Client
+	// done is closed once the name is free again.
+	done chan struct{}
+	// token is the one the session was opened with, the proof needed to take it over.
+	token string
+}
+
+func NewServer(hub *Hub, auth *Auth) *Server {
 	return &Server{
-		conns: make(map[*websocket.Conn]bool),
+		hub:     hub,
+		auth:    auth,
+		metrics: hub.metrics,
+		online:  make(map[string]*session),
+		buckets: make(map[string]*tokenBucket),
 	}
 }
 
-func (s *Server) HandleWS(ws *websocket.Conn) {
-	fmt.Printf("Receive new connection from client: %s\n", ws.RemoteAddr())
+// ServeWS checks the token of the user before upgrading the connection to a websocket,
+// the users without a valid token or already connected get an HTTP error instead.
+//
+// A client resuming its session (with the resume parameter) takes over the connection of its name instead:
+// after a short outage, the server may not have noticed the old one is dead yet. Only with the token
+// that connection was opened with: another token for the name doesn't prove it's the same user.
+func (s *Server) ServeWS(w http.ResponseWriter, r *http.Request) {
+	token := tokenFrom(r)
+	name, err := s.auth.Verify(token)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		s.metrics.connects.WithLabelValues("unauthorized").Inc()
+		http.Error(w, err.Error()+", get one from /login", http.StatusUnauthorized)
+		return
+	}
+	sess := s.claim(name, token, r.URL.Query().Has(protocol.ResumeParam))
+	if sess == nil {
+		s.metrics.connects.WithLabelValues("name_in_use").Inc()
+		http.Error(w, fmt.Sprintf("%s is already connected", name), http.StatusConflict)
+		return
+	}
+	defer s.release(name, sess)
 
-	s.conns[ws] = true
-	fmt.Println("Active connection: ", len(s.conns))
+	// The Origin isn't checked: the token is what identifies the user, not the page it comes from.
+	hijacked := &hijackRecorder{ResponseWriter: w}
+	websocket.Server{Handler: func(ws *websocket.Conn) { s.HandleWS(ws, hijacked.conn, sess, name) }}.ServeHTTP(hijacked, r)
+}
 
-	buf := make([]byte, 1024)
+// hijackRecorder keeps the connection the websocket takes over: closing it is closing the websocket
+// without the normal close frame of ws.Close, after one with another code.
+type hijackRecorder struct {
+	http.ResponseWriter
+	conn net.Conn
+}
 
-	// After the connection is established, the server will wait for the client's message via the socket.
-	// The server will reply with "Thank you for the message!!!" upon receiving a message.
-	for {
-		n, err := ws.Read(buf)
-		// This will occur when the connection is close from the other side.
-		if err == io.EOF {
-			fmt.Printf("Connection %s close...\n", ws.RemoteAddr().String())
-			delete(s.conns, ws)
-			break
-		} else if err != nil {
-			fmt.Println("read error: ", err)
-			continue
+func (h *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(h.ResponseWriter).Hijack()
+	h.conn = conn
+	return conn, rw, err
+}
+
+// claim returns the session of the name opened with the token, nil if somebody is using it. With takeover
+// and the token of the session, the connection using it is closed and its session waited for, as long as
+// it takes to write to a client.
+func (s *Server) claim(name, token string, takeover bool) *session {
+	s.mu.Lock()
+	old := s.online[name]
+	if old == nil {
+		sess := &session{done: make(chan struct{}), token: token}
+		s.online[name] = sess
+		s.mu.Unlock()
+		return sess
+	}
+	c := old.c
+	s.mu.Unlock()
+
+	if !takeover || !hmac.Equal([]byte(old.token), []byte(token)) {
+		return nil
+	}
+	if c != nil {
+		fmt.Printf("%s is back, closing its old connection\n", name)
+		c.close(reasonReplaced)
+	}
+	select {
+	case <-old.done:
+		// Somebody else may have taken it in between, no waiting twice.
+		return s.claim(name, token, false)
+	case <-time.After(s.hub.opts.WriteTimeout):
+		return nil
+	}
+}
+
+func (s *Server) release(name string, sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.online, name)
+	close(sess.done)
+	// The users gone long enough to be forgotten by their bucket don't need one anymore.
+	now := time.Now()
+	for name, b := range s.buckets {
+		if s.online[name] == nil && b.full(now) {
+			delete(s.buckets, name)
+		}
+	}
+}
+
+// limiter is the rate limit of a new connection of the user.
+func (s *Server) limiter(name string) *limiter {
+	opts, now := s.hub.opts, time.Now()
+	l := &limiter{}
+	if opts.RateLimit > 0 {
+		l.conn = newTokenBucket(opts.RateLimit, opts.RateBurst, now)
+	}
+	if opts.UserRateLimit > 0 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.buckets[name] == nil {
+			s.buckets[name] = newTokenBucket(opts.UserRateLimit, opts.UserRateBurst, now)
 		}
+		l.user = s.buckets[name]
+	}
 
-		msg := fmt.Sprintf("[%s] %s", ws.RemoteAddr().String(), buf[:n])
-		fmt.Println("Incoming message: ", msg)
+	return l
+}
 
-		// Broadcast to all the active user in the group.
-		for userInGroup, active := range s.conns {
-			if !active {
-				continue
+func (s *Server) isOnline(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.online[name] != nil
+}
+
+// HandleWS is the connection of an authenticated user, conn the connection under ws.
+func (s *Server) HandleWS(ws *websocket.Conn, conn net.Conn, sess *session, name string) {
+	fmt.Printf("Receive new connection from %s: %s\n", name, ws.Request().RemoteAddr)
+
+	opts := s.hub.opts
+	c := newClient(ws, name, opts.QueueSize)
+	c.conn = conn
+	// The lobby sends what was said since the last message the client saw, if it's resuming.
+	c.resume = ws.Request().URL.Query().Get(protocol.ResumeParam)
+	if c.resume != "" {
+		s.metrics.connects.WithLabelValues("resumed").Inc()
+	} else {
+		s.metrics.connects.WithLabelValues("new").Inc()
+	}
+	s.mu.Lock()
+	sess.c = c
+	s.mu.Unlock()
+	s.hub.Register(c)
+	go c.writeLoop(s.hub)
+
+	// The connection is closed by the websocket package once HandleWS returns, the writer must be done by then.
+	defer func() {
+		s.hub.Unregister(c)
+		<-c.closed
+		fmt.Printf("Connection %s closed: %s\n", c.name, c.reason)
+		s.metrics.disconnects.WithLabelValues(c.reason).Inc()
+	}()
+
+	// active is the last time the client said something, not counting the heartbeat.
+	active := time.Now()
+	limiter := s.limiter(name)
+	// Bigger messages aren't read, see below.
+	ws.MaxPayloadBytes = opts.MaxMessageSize
+
+	// After the connection is established, the server will wait for the client's messages via the socket:
+	// JSON envelopes, see the protocol package.
+	for {
+		// A client answers the pings, it has something to say at least every PingInterval.
+		// Nothing for PongTimeout means it's gone without closing, like a laptop closed or a cable pulled.
+		deadline := time.Now().Add(opts.PongTimeout)
+		if idle := active.Add(opts.IdleTimeout); opts.IdleTimeout > 0 && idle.Before(deadline) {
+			deadline = idle
+		}
+		ws.SetReadDeadline(deadline)
+
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			if errors.Is(err, websocket.ErrFrameTooLarge) {
+				fmt.Printf("%s sent a message over %d bytes, disconnecting\n", c.name, opts.MaxMessageSize)
+				s.hub.Kick(c, reasonTooLarge, protocol.NewError(&protocol.Error{Code: protocol.CodeMessageTooLarge,
+					Message: fmt.Sprintf("messages are up to %d bytes", opts.MaxMessageSize)}, ""))
+				return
 			}
+			// Ignored if the hub or the writer closed the connection first, they know why.
+			c.close(readReason(err, active, opts.IdleTimeout))
+			return
+		}
+		s.metrics.bytesIn.Add(float64(len(data)))
 
-			if userInGroup.RemoteAddr().String() == ws.RemoteAddr().String() {
+		env, err := protocol.Decode(data)
+		// Invalid messages too, answering them is work. Not the answers to the pings: a client can't help those.
+		if env == nil || env.Type != protocol.TypeAck {
+			if limit := limiter.allow(time.Now()); limit != "" {
+				s.metrics.throttled.WithLabelValues(limit).Inc()
+				ref := ""
+				if env != nil {
+					ref = env.ID
+				}
+				if limiter.strikes >= opts.RateStrikes {
+					fmt.Printf("%s keeps going over its rate limit, disconnecting\n", c.name)
+					s.hub.Kick(c, reasonRateLimited, protocol.NewError(&protocol.Error{Code: protocol.CodeRateLimited,
+						Message: fmt.Sprintf("too many messages over the %s rate limit, disconnected", limit)}, ref))
+					return
+				}
+				s.hub.Reply(c, protocol.NewError(&protocol.Error{Code: protocol.CodeRateLimited,
+					Message: fmt.Sprintf("slow down, message dropped: over the %s rate limit (%d of %d before disconnecting)", limit, limiter.strikes, opts.RateStrikes)}, ref))
 				continue
 			}
+		}
+		if err != nil {
+			fmt.Printf("Invalid message from %s: %v\n", c.name, err)
+			s.metrics.received.WithLabelValues("invalid").Inc()
+			ref := ""
+			if env != nil {
+				ref = env.ID
+			}
+			s.hub.Reply(c, protocol.NewError(err, ref))
+			continue
+		}
+		s.metrics.received.WithLabelValues(string(env.Type)).Inc()
+		if env.Type == protocol.TypeAck || env.Type == protocol.TypePing {
+			// The heartbeat, reading it was the point.
+			if env.Type == protocol.TypePing {
+				s.hub.Reply(c, protocol.New(protocol.TypeAck, "", protocol.AckPayload{Ref: env.ID}))
+			}
+			continue
+		}
 
-			err = websocket.Message.Send(userInGroup, msg)
-			if err != nil {
-				fmt.Println("Failed to send via socket: ", err)
+		fmt.Printf("Incoming message from %s: %s\n", c.name, data)
+		active = time.Now()
+		// The client's span, if it traces its messages.
+		s.handle(tracing.Extract(context.Background(), env.Trace), c, env)
+	}
+}
 
-				return
-			}
+// readReason is why reading from a client failed.
+func readReason(err error, active time.Time, idleTimeout time.Duration) string {
+	switch {
+	case err == io.EOF:
+		// A close frame, or the connection closed between two messages.
+		return reasonClean
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		if idleTimeout > 0 && time.Since(active) >= idleTimeout {
+			return reasonIdle
+		}
+		return reasonTimeout
+	}
+
+	// A broken frame, or a connection cut in the middle of a message.
+	return reasonProtocolError
+}
+
+// handle passes a message to the hub, which acks it. Decode checked the payloads already,
+// the heartbeat is handled by HandleWS.
+func (s *Server) handle(ctx context.Context, c *Client, env *protocol.Envelope) {
+	switch env.Type {
+	case protocol.TypeChat:
+		var p protocol.ChatPayload
+		env.DecodePayload(&p)
+		// Broadcast to the rest of the users in the room.
+		s.hub.Broadcast(ctx, c, env.ID, env.Room, p.Text)
+
+	case protocol.TypeJoin:
+		var p protocol.JoinPayload
+		env.DecodePayload(&p)
+		s.hub.Join(c, env.ID, env.Room, p.Limit, p.After)
+
+	case protocol.TypeLeave:
+		s.hub.Leave(c, env.ID, env.Room)
+
+	case protocol.TypeSystem:
+		var p protocol.SystemPayload
+		env.DecodePayload(&p)
+		switch p.Command {
+		case protocol.CommandRooms:
+			s.hub.List(c, env.ID)
+		case protocol.CommandHistory:
+			s.hub.History(c, env.ID, env.Room, p.Before, p.Limit)
 		}
 	}
 }
 
 func main() {
+	var (
+		listenAddr   = flag.String("listen", ":3001", "address to listen on")
+		queueSize    = flag.Int("queue-size", 64, "number of messages waiting to be written to a client")
+		slowConsumer = flag.String("slow-consumer", "drop", "what to do with a message for a client whose queue is full: drop, disconnect or block")
+		blockTimeout = flag.Duration("block-timeout", 5*time.Second, "with -slow-consumer block, how long a message can wait for room in the queue of a client before disconnecting it")
+		writeTimeout = flag.Duration("write-timeout", 10*time.Second, "how long writing a message to a client can take")
+		pingInterval = flag.Duration("ping-interval", 30*time.Second, "how often the clients are pinged")
+		pongTimeout  = flag.Duration("pong-timeout", time.Minute, "how long a client can go without answering the pings, or saying anything, before it's disconnected. Must be longer than -ping-interval")
+		idleTimeout  = flag.Duration("idle-timeout", 0, "how long a client can go without saying anything but answering the pings before it's disconnected, 0 for no limit")
+		secret       = flag.String("secret", os.Getenv("CHAT_SECRET"), "key signing the tokens of /login, $CHAT_SECRET by default. Without one, a random key is used and the tokens die with the server")
+		tokenTTL     = flag.Duration("token-ttl", 24*time.Hour, "how long a token of /login is valid")
+		roomLimit    = flag.Int("room-limit", 0, "max number of members of a room, 0 for no limit. a join can create a room with a lower one")
+
+		maxMessageSize = flag.Int("max-message-size", 64<<10, "max size of a message from a client in bytes, a client sending a bigger one is disconnected with the close code 1009")
+		rateLimit      = flag.Float64("rate-limit", 5, "number of messages per second a connection can send on average, 0 for no limit")
+		rateBurst      = flag.Int("rate-burst", 10, "number of messages a connection can send at once")
+		userRateLimit  = flag.Float64("user-rate-limit", 2, "number of messages per second a user can send on average, whatever its connections, 0 for no limit")
+		userRateBurst  = flag.Int("user-rate-burst", 30, "number of messages a user can send at once")
+		rateStrikes    = flag.Int("rate-strikes", 5, "number of messages in a row over a rate limit before a client is disconnected with the close code 1008, it's warned for each one")
+
+		historyPath        = flag.String("history.path", "chat-history/", "directory of the messages of the rooms, empty for no history")
+		historyMaxAge      = flag.Duration("history.max-age", 7*24*time.Hour, "how long the messages are kept, 0 keeps them forever")
+		historyMaxMessages = flag.Int("history.max-messages", 10000, "number of messages kept per room, 0 for no limit")
+		historyOnJoin      = flag.Int("history.on-join", 20, "number of messages sent to who joins a room")
+
+		otlpEndpoint = flag.String("otlp.endpoint", "", "OTLP HTTP endpoint the traces of the chat messages are sent to, like localhost:4318. Empty for no tracing")
+		metricsRooms = flag.Int("metrics.rooms", 20, "number of rooms with their own label in chat_room_members, the lobby aside. The others are summed up")
+	)
+	flag.Parse()
+
+	policy, err := ParsePolicy(*slowConsumer)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	key := []byte(*secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+		fmt.Println("No -secret, the tokens will be invalid after a restart")
+	}
+
+	var store *history.Store
+	if *historyPath != "" {
+		store, err = history.Open(*historyPath, history.Options{MaxAge: *historyMaxAge, MaxMessages: *historyMaxMessages})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer store.Close()
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
+	if store != nil {
+		go store.Run(ctx)
+	}
+
+	tracerProvider, shutdownTracing, err := tracing.NewProvider(context.Background(), *otlpEndpoint, "chat-server")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// The last spans are sent on the way out.
+	defer shutdownTracing(context.Background())
 
 	fmt.Println("Starting websocket server...")
-	server := NewServer()
+	hub := NewHub(HubOptions{QueueSize: *queueSize, Policy: policy, BlockTimeout: *blockTimeout, WriteTimeout: *writeTimeout,
+		PingInterval: *pingInterval, PongTimeout: *pongTimeout, IdleTimeout: *idleTimeout, RoomLimit: *roomLimit,
+		History: store, HistoryOnJoin: *historyOnJoin, MetricsRooms: *metricsRooms,
+		TracerProvider: tracerProvider, MaxMessageSize: *maxMessageSize, RateLimit: *rateLimit, RateBurst: *rateBurst,
+		UserRateLimit: *userRateLimit, UserRateBurst: *userRateBurst, RateStrikes: *rateStrikes})
+	go hub.Run(ctx)
+	server := NewServer(hub, NewAuth(key, *tokenTTL))
 
-	http.Handle("/ws", websocket.Handler(server.HandleWS))
+	http.HandleFunc("/login", server.HandleLogin)
+	http.HandleFunc("/ws", server.ServeWS)
+	http.Handle("/metrics", server.metrics.handler())
 
 	srvErr := make(chan error, 1)
 	go func() {
-		srvErr <- http.ListenAndServe(":3001", nil)
+		srvErr <- http.ListenAndServe(*listenAddr, nil)
 	}()
 
 	select {
@@ -90,7 +415,9 @@ func main() {
 		// Wait for the first Ctrl+C.
 		// Stop receiving signal notifications as soon as possible.
 		fmt.Println("Gracefully shutdown...")
-		time.Sleep(1 * time.Second)
 		stop()
+		// The hub closes every client on its way out.
+		<-hub.done
+		time.Sleep(1 * time.Second)
 	}
 }
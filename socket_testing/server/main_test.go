@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/attribute"
+	sdkTrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/websocket"
+
+	"learn-prometheus/socket_testing/history"
+	"learn-prometheus/socket_testing/protocol"
+	"learn-prometheus/socket_testing/tracing"
+)
+
+// heartbeat answers the pings of the server until the connection is closed.
+func heartbeat(ws *websocket.Conn) {
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			return
+		}
+		if env, err := protocol.Parse(data); err == nil && env.Type == protocol.TypePing {
+			websocket.Message.Send(ws, string(protocol.Encode(protocol.New(protocol.TypeAck, "", protocol.AckPayload{Ref: env.ID}))))
+		}
+	}
+}
+
+func TestServerHeartbeat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub(HubOptions{PingInterval: 20 * time.Millisecond, PongTimeout: 100 * time.Millisecond, IdleTimeout: 300 * time.Millisecond})
+	go hub.Run(ctx)
+
+	srv, server := newTestServer(hub)
+	defer srv.Close()
+
+	connect := func(name string) *websocket.Conn {
+		t.Helper()
+		token, _ := server.auth.Issue(name)
+		ws, err := dial(srv, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		return ws
+	}
+	// disconnected waits for the number of disconnections for that reason.
+	disconnected := func(reason string, want float64, within time.Duration) {
+		t.Helper()
+		deadline := time.Now().Add(within)
+		for {
+			got := testutil.ToFloat64(server.metrics.disconnects.WithLabelValues(reason))
+			if got == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got %v %s disconnections, want %v", got, reason, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// Never answers: gone after PongTimeout, even with the pings written fine.
+	connect("mute")
+	// Answers the pings but never says anything: gone after IdleTimeout.
+	alive := connect("alive")
+	go heartbeat(alive)
+	// Answers the pings and talks.
+	chatty := connect("chatty")
+	go heartbeat(chatty)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(50 * time.Millisecond):
+				websocket.Message.Send(chatty, string(protocol.Encode(protocol.New(protocol.TypeChat, Lobby, protocol.ChatPayload{Text: "still here"}))))
+			}
+		}
+	}()
+
+	disconnected(reasonTimeout, 1, time.Second)
+	disconnected(reasonIdle, 1, time.Second)
+	// The chatty one stays.
+	time.Sleep(200 * time.Millisecond)
+	if got := testutil.ToFloat64(server.metrics.disconnects.WithLabelValues(reasonIdle)); got != 1 {
+		t.Errorf("got %v idle disconnections, want only alive", got)
+	}
+	close(stop)
+
+	chatty.Close()
+	disconnected(reasonClean, 1, time.Second)
+}
+
+func TestServerResume(t *testing.T) {
+	store, err := history.Open(t.TempDir(), history.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub(HubOptions{History: store, HistoryOnJoin: 1})
+	go hub.Run(ctx)
+
+	srv, server := newTestServer(hub)
+	defer srv.Close()
+
+	connect := func(token, resume string) (*websocket.Conn, error) {
+		u := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+		if resume != "" {
+			u += "?" + url.Values{protocol.ResumeParam: {resume}}.Encode()
+		}
+		config, err := websocket.NewConfig(u, "http://localhost/")
+		if err != nil {
+			return nil, err
+		}
+		config.Header.Set("Authorization", "Bearer "+token)
+		return websocket.DialConfig(config)
+	}
+	// until reads the messages of ws up to the one with that text, and returns its ID.
+	until := func(ws *websocket.Conn, want string) string {
+		t.Helper()
+		for {
+			if env := receiveWS(t, ws); text(env) == want {
+				return env.ID
+			}
+		}
+	}
+
+	aliceToken, _ := server.auth.Issue("alice")
+	alice, err := connect(aliceToken, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bobToken, _ := server.auth.Issue("bob")
+	bob, err := connect(bobToken, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	say(bob, "one")
+	seen := until(alice, "one")
+
+	// Without resuming, the name is still taken.
+	if _, err := connect(aliceToken, ""); err == nil {
+		t.Error("connected twice with the same name")
+	}
+	// Another token for the name isn't alice's session: no taking it over.
+	otherToken, _ := server.auth.Issue("alice")
+	if _, err := connect(otherToken, seen); err == nil {
+		t.Error("resumed the session of alice with another token")
+	}
+	if got := testutil.ToFloat64(server.metrics.disconnects.WithLabelValues(reasonReplaced)); got != 0 {
+		t.Errorf("got %v replaced connections, want alice still connected", got)
+	}
+
+	// alice's connection is dead but the server doesn't know it yet, meanwhile bob keeps talking.
+	// What's written to it is lost, alice saw up to one.
+	say(bob, "two")
+	say(bob, "three")
+	until(alice, "three")
+
+	back, err := connect(aliceToken, seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer back.Close()
+
+	// Back in the lobby, with exactly what was missed.
+	if env := receiveWS(t, back); env.Type != protocol.TypeJoin || env.Sender != "alice" {
+		t.Errorf("got %+v, want alice joining", env)
+	}
+	var p protocol.SystemPayload
+	if err := receiveWS(t, back).DecodePayload(&p); err != nil || p.Command != protocol.CommandHistory {
+		t.Fatalf("got %+v, %v, want the history", p, err)
+	}
+	var texts []string
+	for _, data := range p.History {
+		texts = append(texts, text(parse(t, data)))
+	}
+	if fmt.Sprint(texts) != "[two three]" {
+		t.Errorf("got %q, want what was said since one", texts)
+	}
+
+	// The old connection is closed by the server.
+	alice.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(alice, &data); err != nil {
+			break
+		}
+	}
+	if got := testutil.ToFloat64(server.metrics.disconnects.WithLabelValues(reasonReplaced)); got != 1 {
+		t.Errorf("got %v replaced connections, want 1", got)
+	}
+}
+
+func TestServerTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub(HubOptions{TracerProvider: sdkTrace.NewTracerProvider(sdkTrace.WithSpanProcessor(recorder))})
+	go hub.Run(ctx)
+
+	srv, server := newTestServer(hub)
+	defer srv.Close()
+
+	var conns []*websocket.Conn
+	for _, name := range []string{"alice", "bob"} {
+		token, _ := server.auth.Issue(name)
+		ws, err := dial(srv, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		conns = append(conns, ws)
+	}
+	alice, bob := conns[0], conns[1]
+	// alice's join of the lobby, then bob's.
+	receiveWS(t, alice)
+	receiveWS(t, bob)
+
+	// alice traces what she says, the client's producer span.
+	sendCtx, send := sdkTrace.NewTracerProvider().Tracer("client").Start(context.Background(), "chat send")
+	send.End()
+	env := protocol.New(protocol.TypeChat, Lobby, protocol.ChatPayload{Text: "traced"})
+	env.Trace = tracing.Inject(sendCtx)
+	if err := websocket.Message.Send(alice, string(protocol.Encode(env))); err != nil {
+		t.Fatal(err)
+	}
+
+	// bob gets the trace context of the routing, for its own span.
+	var got *protocol.Envelope
+	for got == nil || got.Type != protocol.TypeChat {
+		got = receiveWS(t, bob)
+	}
+	routed := trace.SpanContextFromContext(tracing.Extract(context.Background(), got.Trace))
+
+	// The delivery span ends once the message is written, right after bob got it.
+	var route, deliver sdkTrace.ReadOnlySpan
+	deadline := time.Now().Add(time.Second)
+	for deliver == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d spans, want the route and the delivery", len(recorder.Ended()))
+		}
+		time.Sleep(5 * time.Millisecond)
+		for _, span := range recorder.Ended() {
+			switch span.Name() {
+			case "chat route":
+				route = span
+			case "chat deliver":
+				deliver = span
+			}
+		}
+	}
+
+	traceID := send.SpanContext().TraceID()
+	if route == nil || route.SpanContext().TraceID() != traceID || route.Parent().SpanID() != send.SpanContext().SpanID() {
+		t.Fatalf("got route %+v, want a child of the client's span", route)
+	}
+	if routed.SpanID() != route.SpanContext().SpanID() {
+		t.Errorf("bob got the span %v, want the route %v", routed.SpanID(), route.SpanContext().SpanID())
+	}
+	if deliver.Parent().SpanID() != route.SpanContext().SpanID() || deliver.SpanKind() != trace.SpanKindConsumer {
+		t.Errorf("got delivery %+v, want a consumer child of the route", deliver)
+	}
+	if deliver.StartTime().Before(route.StartTime()) {
+		t.Errorf("the delivery starts at %v, before the route at %v", deliver.StartTime(), route.StartTime())
+	}
+	if links := deliver.Links(); len(links) != 1 || links[0].SpanContext.SpanID() != send.SpanContext().SpanID() {
+		t.Errorf("got links %+v, want the client's span", links)
+	}
+	if !slices.Contains(deliver.Attributes(), attribute.String("chat.recipient", "bob")) {
+		t.Errorf("got delivery attributes %v, want to bob", deliver.Attributes())
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The buckets barely refill during the test.
+	hub := NewHub(HubOptions{MaxMessageSize: 512, RateLimit: 0.001, RateBurst: 3, UserRateLimit: 0.001, UserRateBurst: 4, RateStrikes: 2})
+	go hub.Run(ctx)
+
+	srv, server := newTestServer(hub)
+	defer srv.Close()
+
+	connect := func(name string) *websocket.Conn {
+		t.Helper()
+		token, _ := server.auth.Issue(name)
+		ws, err := dial(srv, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		// The lobby join.
+		receiveWS(t, ws)
+		return ws
+	}
+	// answers reads until the connection is closed, or n messages, and returns the acks and the error codes.
+	answers := func(ws *websocket.Conn, n int) (acks int, errs []string) {
+		t.Helper()
+		for range n {
+			var data []byte
+			ws.SetReadDeadline(time.Now().Add(time.Second))
+			if err := websocket.Message.Receive(ws, &data); err != nil {
+				break
+			}
+			env := parse(t, data)
+			switch env.Type {
+			case protocol.TypeAck:
+				acks++
+			case protocol.TypeError:
+				var p protocol.ErrorPayload
+				env.DecodePayload(&p)
+				errs = append(errs, p.Code)
+			}
+		}
+		return acks, errs
+	}
+	disconnected := func(reason string) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for testutil.ToFloat64(server.metrics.disconnects.WithLabelValues(reason)) != 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("not disconnected for %s", reason)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// Too big to be read: disconnected, with a reason.
+	big := connect("big")
+	if err := say(big, strings.Repeat("a", 600)); err != nil {
+		t.Fatal(err)
+	}
+	if _, errs := answers(big, 10); fmt.Sprint(errs) != "[message_too_large]" {
+		t.Errorf("got errors %v, want message_too_large", errs)
+	}
+	disconnected(reasonTooLarge)
+
+	// The burst of the connection goes through, then a warning, then the door.
+	flood := connect("flood")
+	for i := range 5 {
+		// The server may be gone already.
+		say(flood, fmt.Sprint("flood ", i))
+	}
+	acks, errs := answers(flood, 10)
+	if acks != 3 || len(errs) == 0 || errs[len(errs)-1] != protocol.CodeRateLimited {
+		t.Errorf("got %d acks and errors %v, want 3 and rate_limited", acks, errs)
+	}
+	disconnected(reasonRateLimited)
+	if got := testutil.ToFloat64(server.metrics.throttled.WithLabelValues(limitConnection)); got != 2 {
+		t.Errorf("got %v throttled messages, want 2: a warning and the last straw", got)
+	}
+
+	// The bucket of the user outlives its connection: reconnecting doesn't refill it.
+	user := connect("user")
+	for range 3 {
+		say(user, "hi")
+	}
+	if acks, errs := answers(user, 3); acks != 3 || errs != nil {
+		t.Fatalf("got %d acks and errors %v, want 3 acks", acks, errs)
+	}
+	user.Close()
+	deadline := time.Now().Add(time.Second)
+	for server.isOnline("user") {
+		if time.Now().After(deadline) {
+			t.Fatal("user still connected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	user = connect("user")
+	say(user, "hi again")
+	say(user, "still there?")
+	if acks, errs := answers(user, 2); acks != 1 || fmt.Sprint(errs) != "[rate_limited]" {
+		t.Errorf("got %d acks and errors %v after reconnecting, want the last token and a warning", acks, errs)
+	}
+	if got := testutil.ToFloat64(server.metrics.throttled.WithLabelValues(limitUser)); got != 1 {
+		t.Errorf("got %v messages throttled for the user, want 1", got)
+	}
+}
+
+// recordedConn keeps what's read from the connection: the close frames, the x/net client doesn't return them.
+type recordedConn struct {
+	net.Conn
+
+	mu   sync.Mutex
+	read []byte
+}
+
+func (c *recordedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.read = append(c.read, b[:n]...)
+	c.mu.Unlock()
+	return n, err
+}
+
+// closeCodesIn returns the codes of the close frames written by the server, after the handshake.
+func closeCodesIn(t *testing.T, data []byte) []int {
+	t.Helper()
+
+	_, frames, ok := bytes.Cut(data, []byte("\r\n\r\n"))
+	if !ok {
+		t.Fatal("no handshake")
+	}
+	var closes []int
+	// The frames of a server aren't masked.
+	for len(frames) > 0 {
+		if len(frames) < 2 {
+			t.Fatalf("truncated frame header")
+		}
+		opcode, n := frames[0]&0x0f, int(frames[1]&0x7f)
+		frames = frames[2:]
+		switch n {
+		case 126:
+			n, frames = int(binary.BigEndian.Uint16(frames)), frames[2:]
+		case 127:
+			n, frames = int(binary.BigEndian.Uint64(frames)), frames[8:]
+		}
+		if len(frames) < n {
+			t.Fatalf("truncated frame")
+		}
+		if opcode == 0x8 {
+			closes = append(closes, int(binary.BigEndian.Uint16(frames[:n])))
+		}
+		frames = frames[n:]
+	}
+
+	return closes
+}
+
+// TestServerCloseCode checks a client kicked gets a single close frame, with the code of the reason.
+func TestServerCloseCode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub(HubOptions{MaxMessageSize: 512})
+	go hub.Run(ctx)
+
+	srv, server := newTestServer(hub)
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	config, err := websocket.NewConfig("ws://"+u.Host+"/ws", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := server.auth.Issue("big")
+	config.Header.Set("Authorization", "Bearer "+token)
+	raw, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &recordedConn{Conn: raw}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	if err := say(ws, strings.Repeat("a", 600)); err != nil {
+		t.Fatal(err)
+	}
+	// Until the server closes the connection.
+	for {
+		var data []byte
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			break
+		}
+	}
+	raw.SetReadDeadline(time.Now().Add(time.Second))
+	io.Copy(io.Discard, conn)
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if got := closeCodesIn(t, conn.read); fmt.Sprint(got) != "[1009]" {
+		t.Errorf("got close frames %v, want one 1009", got)
+	}
+}
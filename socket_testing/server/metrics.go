@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// otherRooms is the room label of the rooms beyond MetricsRooms. "~" can't be in a room name.
+const otherRooms = "~other"
+
+// metrics of the chat server, on a registry of its own like the ping server, so the tests can run several servers.
+// Every label has a handful of values whatever the clients do: the rooms are named by the clients, so only the
+// first MetricsRooms rooms get their own label.
+type metrics struct {
+	registry *prometheus.Registry
+
+	// connections is updated by the hub, members by room too.
+	connections prometheus.Gauge
+	members     *prometheus.GaugeVec
+	// connects is by result: new, resumed, unauthorized or name_in_use.
+	connects *prometheus.CounterVec
+	// disconnects is by reason, see the reason* constants.
+	disconnects *prometheus.CounterVec
+
+	// received is by type of message, invalid for the ones that don't decode.
+	received  *prometheus.CounterVec
+	broadcast prometheus.Counter
+	bytesIn   prometheus.Counter
+	bytesOut  prometheus.Counter
+
+	// fanout is from a message said to the moment it's written to one of the members of the room, so one observation
+	// per recipient: the slow ones show in the tail.
+	fanout prometheus.Histogram
+	// queueDepth is the length of the queue of a client when a message is queued for it.
+	queueDepth prometheus.Histogram
+	dropped    prometheus.Counter
+	// throttled is by limit: connection or user.
+	throttled *prometheus.CounterVec
+}
+
+// newMetrics makes the metrics of a hub, queueSize is the max depth of the queues.
+func newMetrics(queueSize int) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "chat_connections",
+			Help: "Number of clients connected.",
+		}),
+		members: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "chat_room_members",
+			Help: "Number of clients in a room. The rooms beyond -metrics.rooms are summed in room=\"" + otherRooms + "\".",
+		}, []string{"room"}),
+		connects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_connects_total",
+			Help: "Number of websocket connections, by result: new, resumed (a client reconnecting), unauthorized or name_in_use.",
+		}, []string{"result"}),
+		disconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_disconnects_total",
+			Help: "Number of clients disconnected, by reason: clean, timeout, idle, protocol_error, write_error, slow_consumer, shutdown, replaced, too_large or rate_limited.",
+		}, []string{"reason"}),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_messages_received_total",
+			Help: "Number of messages received from the clients, by type, invalid for the ones rejected.",
+		}, []string{"type"}),
+		broadcast: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "chat_messages_broadcast_total",
+			Help: "Number of chat messages sent to the members of a room.",
+		}),
+		bytesIn: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "chat_received_bytes_total",
+			Help: "Size of the messages received from the clients.",
+		}),
+		bytesOut: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "chat_sent_bytes_total",
+			Help: "Size of the messages written to the clients, pings included.",
+		}),
+		fanout: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "chat_broadcast_fanout_seconds",
+			Help: "Time from a chat message received to its delivery to one member of the room, one observation per recipient.",
+			// From a fast local write to a slow consumer nearing -write-timeout.
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+		queueDepth: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "chat_send_queue_depth",
+			Help:    "Number of messages waiting in the queue of a client, when one more is queued.",
+			Buckets: queueBuckets(queueSize),
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "chat_dropped_messages_total",
+			Help: "Number of messages not sent to a client too slow to read them, with -slow-consumer drop.",
+		}),
+		throttled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_throttled_messages_total",
+			Help: "Number of messages from the clients dropped for going over a rate limit, by limit: connection or user.",
+		}, []string{"limit"}),
+	}
+	m.registry.MustRegister(m.connections, m.members, m.connects, m.disconnects, m.received, m.broadcast,
+		m.bytesIn, m.bytesOut, m.fanout, m.queueDepth, m.dropped, m.throttled)
+
+	return m
+}
+
+// queueBuckets are powers of 2 up to the size of the queue, a full queue is in the last one.
+func queueBuckets(queueSize int) []float64 {
+	var buckets []float64
+	for b := 1; b < queueSize; b *= 2 {
+		buckets = append(buckets, float64(b))
+	}
+	return append(buckets, float64(queueSize))
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
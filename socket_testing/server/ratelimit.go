@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket lets through rate messages per second on average, and up to burst at once.
+// It's shared by the connections of a user, one after the other, so it's locked.
+type tokenBucket struct {
+	rate, burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket starts full: a client connecting can say a few things at once.
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// ok is whether there's a token, without taking it.
+func (b *tokenBucket) ok(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= 1
+}
+
+// take takes the token ok found. Never below 0: a connection being replaced may have taken it meanwhile.
+func (b *tokenBucket) take() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = max(0, b.tokens-1)
+}
+
+// full is whether the bucket forgot everything, it can be dropped.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// The limits of chat_throttled_messages_total.
+const (
+	limitConnection = "connection"
+	limitUser       = "user"
+)
+
+// limiter is the rate limit of one connection, only used by its reader. A message must get through
+// the bucket of the connection and the one of the user, either is nil without limit.
+type limiter struct {
+	conn, user *tokenBucket
+	// strikes is the number of messages throttled in a row.
+	strikes int
+}
+
+// allow returns "" if the message can be handled, or the limit it hit. A token is only taken
+// when both buckets have one: a message refused by one doesn't cost anything in the other.
+func (l *limiter) allow(now time.Time) string {
+	limit := ""
+	switch {
+	case l.conn != nil && !l.conn.ok(now):
+		limit = limitConnection
+	case l.user != nil && !l.user.ok(now):
+		limit = limitUser
+	}
+
+	if limit != "" {
+		l.strikes++
+		return limit
+	}
+	if l.conn != nil {
+		l.conn.take()
+	}
+	if l.user != nil {
+		l.user.take()
+	}
+	l.strikes = 0
+
+	return ""
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Unix(0, 0)
+	b := newTokenBucket(2, 3, start)
+
+	// at is the time of the message, in ms since start.
+	for i, tc := range []struct {
+		at   int
+		want bool
+	}{
+		// The burst at once.
+		{at: 0, want: true},
+		{at: 0, want: true},
+		{at: 0, want: true},
+		{at: 0},
+		// A token every 500ms.
+		{at: 400},
+		{at: 500, want: true},
+		{at: 600},
+		// Never more than the burst, however long the wait.
+		{at: 60000, want: true},
+		{at: 60000, want: true},
+		{at: 60000, want: true},
+		{at: 60000},
+	} {
+		got := b.ok(start.Add(time.Duration(tc.at) * time.Millisecond))
+		if got {
+			b.take()
+		}
+		if got != tc.want {
+			t.Errorf("message %d at %dms: got %v, want %v", i, tc.at, got, tc.want)
+		}
+	}
+
+	if b.full(start.Add(61 * time.Second)) {
+		t.Error("full after 1s, want 1.5s")
+	}
+	if !b.full(start.Add(61500 * time.Millisecond)) {
+		t.Error("not full after 1.5s")
+	}
+}
+
+// TestLimiter checks a message refused by the user's bucket doesn't take a token from the connection's.
+func TestLimiter(t *testing.T) {
+	start := time.Unix(0, 0)
+	l := &limiter{conn: newTokenBucket(1, 5, start), user: newTokenBucket(1, 2, start)}
+
+	for i, want := range []string{"", "", limitUser, limitUser, limitUser} {
+		if got := l.allow(start); got != want {
+			t.Errorf("message %d: got %q, want %q", i, got, want)
+		}
+	}
+	if l.strikes != 3 {
+		t.Errorf("got %d strikes, want 3", l.strikes)
+	}
+	// Only the 2 messages let through took a token of the connection.
+	if got := l.conn.tokens; got != 3 {
+		t.Errorf("the connection has %v tokens left, want 3", got)
+	}
+
+	// The user's bucket refills first: the connection still has room, it's not the limit hit.
+	if got := l.allow(start.Add(time.Second)); got != "" {
+		t.Errorf("after 1s: got %q, want the message through", got)
+	}
+	if l.strikes != 0 {
+		t.Errorf("got %d strikes after a message through, want 0", l.strikes)
+	}
+	if got := l.allow(start.Add(time.Second)); got != limitUser {
+		t.Errorf("got %q, want the user limit again", got)
+	}
+}
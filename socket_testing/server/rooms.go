@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"learn-prometheus/socket_testing/history"
+	"learn-prometheus/socket_testing/protocol"
+)
+
+// Lobby is the room everyone joins when connecting.
+const Lobby = protocol.Lobby
+
+// room is only used by the hub. It exists as long as somebody is in it.
+type room struct {
+	name string
+	// limit is the max number of members, 0 for no limit.
+	limit   int
+	members map[*Client]bool
+	// label is the room label of its members in the metrics: its name, or otherRooms.
+	label string
+}
+
+// membership is a client joining or leaving a room.
+type membership struct {
+	request
+	room string
+	// limit is only used to create the room, an existing room keeps its limit.
+	limit int
+	// after is the last message a client resuming its session saw, see sendHistory.
+	after string
+}
+
+// Join adds the client to the room, creating it if it doesn't exist. ref is the ID of the client's message,
+// after the last message it saw if it's resuming its session.
+func (h *Hub) Join(c *Client, ref, room string, limit int, after string) {
+	select {
+	case h.join <- membership{request: request{c: c, ref: ref}, room: room, limit: limit, after: after}:
+	case <-h.done:
+	}
+}
+
+// Leave removes the client from the room, the room goes away with its last member.
+func (h *Hub) Leave(c *Client, ref, room string) {
+	select {
+	case h.leave <- membership{request: request{c: c, ref: ref}, room: room}:
+	case <-h.done:
+	}
+}
+
+// History sends up to limit messages of the room before the one with the ID before, to a member of the room.
+// before is "" for the latest messages, limit is 0 for HistoryOnJoin.
+func (h *Hub) History(c *Client, ref, room, before string, limit int) {
+	select {
+	case h.history <- historyRequest{request: request{c: c, ref: ref}, room: room, before: before, limit: limit}:
+	case <-h.done:
+	}
+}
+
+// List sends the list of rooms to the client.
+func (h *Hub) List(c *Client, ref string) {
+	select {
+	case h.list <- request{c: c, ref: ref}:
+	case <-h.done:
+	}
+}
+
+func (h *Hub) joinRoom(m membership) {
+	c := m.c
+	if c.rooms[m.room] {
+		h.fail(m.request, protocol.CodeAlreadyInRoom, fmt.Sprintf("you're already in #%s", m.room))
+		return
+	}
+
+	r, ok := h.rooms[m.room]
+	if !ok {
+		r = &room{name: m.room, limit: h.opts.RoomLimit, members: make(map[*Client]bool), label: h.roomLabel(m.room)}
+		if m.limit > 0 && (r.limit == 0 || m.limit < r.limit) {
+			r.limit = m.limit
+		}
+		h.rooms[m.room] = r
+	}
+	if r.limit > 0 && len(r.members) >= r.limit {
+		h.fail(m.request, protocol.CodeRoomFull, fmt.Sprintf("#%s is full (%d members)", r.name, r.limit))
+		h.collect(r)
+		return
+	}
+
+	r.members[c] = true
+	c.rooms[r.name] = true
+	h.metrics.members.WithLabelValues(r.label).Inc()
+	// Everyone in the room gets the same message, the new member included: it's how it learns who's there.
+	env := h.stamp(protocol.New(protocol.TypeJoin, r.name, protocol.JoinPayload{Members: memberNames(r)}))
+	env.Sender = c.name
+	data := protocol.Encode(env)
+	for member := range r.members {
+		h.deliver(member, outgoing{data: data})
+	}
+	// Telling the members may have disconnected them all, and collected the room.
+	if len(r.members) > 0 {
+		h.rooms[r.name] = r
+	}
+	// What was said before, or what was missed since the last message seen,
+	// the same way as an answer to a history command.
+	h.sendHistory(historyRequest{request: request{c: c}, room: r.name, limit: h.opts.HistoryOnJoin, after: m.after})
+	h.ack(m.request, env.ID)
+}
+
+// leaveRoom removes the client from the room. A membership without ref is the client disconnecting,
+// there's nobody to tell it went wrong.
+func (h *Hub) leaveRoom(m membership) {
+	c := m.c
+	r, ok := h.rooms[m.room]
+	if !ok || !r.members[c] {
+		if m.ref != "" {
+			h.fail(m.request, protocol.CodeNotInRoom, fmt.Sprintf("you're not in #%s", m.room))
+		}
+		return
+	}
+
+	// The one leaving gets the message too, unless it's already gone.
+	env := h.stamp(protocol.New(protocol.TypeLeave, r.name, nil))
+	env.Sender = c.name
+	data := protocol.Encode(env)
+	for member := range r.members {
+		h.deliver(member, outgoing{data: data})
+	}
+	delete(r.members, c)
+	delete(c.rooms, r.name)
+	h.metrics.members.WithLabelValues(r.label).Dec()
+	h.collect(r)
+	h.ack(m.request, env.ID)
+}
+
+// collect deletes the room once it's empty.
+func (h *Hub) collect(r *room) {
+	if len(r.members) > 0 || h.rooms[r.name] != r {
+		return
+	}
+
+	delete(h.rooms, r.name)
+	if r.label != otherRooms {
+		h.metrics.members.DeleteLabelValues(r.label)
+		if r.name != Lobby {
+			h.labelled--
+		}
+	}
+}
+
+// roomLabel is the label of a new room in the metrics: its name while there are less than MetricsRooms rooms
+// with one, the lobby aside.
+func (h *Hub) roomLabel(name string) string {
+	if name == Lobby {
+		return name
+	}
+	if h.labelled >= h.opts.MetricsRooms {
+		return otherRooms
+	}
+	h.labelled++
+
+	return name
+}
+
+func (h *Hub) listRooms(req request) {
+	if !h.clients[req.c] {
+		return
+	}
+
+	p := protocol.SystemPayload{Command: protocol.CommandRooms}
+	if len(h.rooms) == 0 {
+		p.Text = "no rooms, join one"
+	}
+	for name, r := range h.rooms {
+		p.Rooms = append(p.Rooms, protocol.RoomInfo{Name: name, Members: len(r.members), Limit: r.limit, Joined: req.c.rooms[name]})
+	}
+	sort.Slice(p.Rooms, func(i, j int) bool { return p.Rooms[i].Name < p.Rooms[j].Name })
+
+	h.send(req.c, protocol.New(protocol.TypeSystem, "", p))
+	h.ack(req, "")
+}
+
+// historyRequest is a page of the history of a room. Without a ref, it's the one sent on join.
+// With after, it's the messages since that one instead, up to ResumeLimit.
+type historyRequest struct {
+	request
+	room   string
+	before string
+	after  string
+	limit  int
+}
+
+func (h *Hub) sendHistory(r historyRequest) {
+	if r.ref != "" && !r.c.rooms[r.room] {
+		// The history is for the members only.
+		h.fail(r.request, protocol.CodeNotInRoom, fmt.Sprintf("you're not in #%s, join it first", r.room))
+		return
+	}
+	if h.opts.History == nil {
+		if r.ref != "" {
+			h.send(r.c, protocol.New(protocol.TypeSystem, r.room, protocol.SystemPayload{Command: protocol.CommandHistory, Text: "no history on this server"}))
+			h.ack(r.request, "")
+		}
+		return
+	}
+
+	if r.limit <= 0 {
+		r.limit = h.opts.HistoryOnJoin
+	}
+
+	var (
+		msgs []history.Message
+		more bool
+		err  error
+	)
+	if r.after != "" {
+		// An ID that isn't a number (from another server?) is like no ID, the last messages are better than nothing.
+		after, _ := strconv.ParseUint(r.after, 10, 64)
+		msgs, more, err = h.opts.History.Since(r.room, after, h.opts.ResumeLimit)
+	} else {
+		// The IDs are numbers, an ID that isn't has nothing before it.
+		var before uint64
+		if r.before != "" {
+			if before, err = strconv.ParseUint(r.before, 10, 64); err != nil || before == 0 {
+				before = 1
+			}
+		}
+		msgs, more, err = h.opts.History.Before(r.room, before, r.limit)
+	}
+	if err != nil {
+		fmt.Printf("Failed to read the history of #%s: %v\n", r.room, err)
+	}
+	// Nothing to say on join in a room without history, an answer to a command is always sent.
+	if len(msgs) > 0 || r.ref != "" {
+		p := protocol.SystemPayload{Command: protocol.CommandHistory, More: more}
+		for _, m := range msgs {
+			p.History = append(p.History, m.Data)
+		}
+		h.send(r.c, protocol.New(protocol.TypeSystem, r.room, p))
+	}
+	h.ack(r.request, "")
+}
+
+func memberNames(r *room) []string {
+	names := make([]string, 0, len(r.members))
+	for member := range r.members {
+		names = append(names, member.name)
+	}
+	sort.Strings(names)
+
+	return names
+}
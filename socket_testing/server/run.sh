@@ -1,3 +1,3 @@
 #!/bin/bash
 
-go run ./socket_testing/server/main.go
+go run ./socket_testing/server "$@"
@@ -0,0 +1,69 @@
+// Package tracing is the OpenTelemetry tracing of the chat: the trace context of a message travels in its envelope,
+// in protocol.Envelope.Trace, like the MapCarrier of otel/step3 sent over its websocket.
+//
+// A chat message makes one trace:
+//
+//	chat send (producer, the client saying it)
+//	└── chat route (server, the hub sending it to the room)
+//	    ├── chat deliver (consumer, written to one member, linked to chat send)
+//	    │   └── chat receive (consumer, the member's client printing it)
+//	    └── ...
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdkTrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Name is the name of the tracers of the chat.
+const Name = "learn-prometheus/socket_testing"
+
+// Propagator reads and writes the W3C trace context and baggage.
+var Propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Inject returns the trace context of ctx for Envelope.Trace, nil if there's none.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	Propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+
+	return carrier
+}
+
+// Extract returns ctx with the trace context of Envelope.Trace, the span in it is the one of the sender.
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	return Propagator.Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// NewProvider exports the spans to an OTLP HTTP endpoint, like the collector of the otel steps on localhost:4318.
+// Without endpoint, there's no tracing. Shut the provider down before exiting, the spans are sent by batch.
+func NewProvider(ctx context.Context, endpoint, service string) (trace.TracerProvider, func(context.Context) error, error) {
+	if endpoint == "" {
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	}
+
+	exp, err := otlptracehttp.New(ctx,
+		// Change from HTTPS -> HTTP.
+		otlptracehttp.WithInsecure(),
+		otlptracehttp.WithEndpoint(endpoint),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service)))
+	if err != nil {
+		return nil, nil, err
+	}
+	provider := sdkTrace.NewTracerProvider(sdkTrace.WithBatcher(exp), sdkTrace.WithResource(res))
+
+	return provider, provider.Shutdown, nil
+}
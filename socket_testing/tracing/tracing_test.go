@@ -0,0 +1,36 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/baggage"
+	sdkTrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInjectExtract(t *testing.T) {
+	if got := Inject(context.Background()); got != nil {
+		t.Errorf("got %v without a span, want nil: no trace in the envelope", got)
+	}
+
+	ctx, span := sdkTrace.NewTracerProvider().Tracer(Name).Start(context.Background(), "chat send")
+	defer span.End()
+	member, _ := baggage.NewMember("room", "ops")
+	bag, _ := baggage.New(member)
+	ctx = baggage.ContextWithBaggage(ctx, bag)
+
+	carrier := Inject(ctx)
+	if carrier["traceparent"] == "" || carrier["baggage"] != "room=ops" {
+		t.Fatalf("got %v", carrier)
+	}
+
+	got := Extract(context.Background(), carrier)
+	// The span of the sender, remote for the receiver.
+	if sc := trace.SpanContextFromContext(got); sc.TraceID() != span.SpanContext().TraceID() || sc.SpanID() != span.SpanContext().SpanID() || !sc.IsRemote() {
+		t.Errorf("got span %v, want %v", sc, span.SpanContext())
+	}
+	if v := baggage.FromContext(got).Member("room").Value(); v != "ops" {
+		t.Errorf("got room %q in the baggage", v)
+	}
+}
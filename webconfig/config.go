@@ -0,0 +1,166 @@
+// Package webconfig protects every endpoint of an HTTP server with a web.yml file,
+// the same format as the exporter-toolkit one used by Prometheus and the exporters:
+//
+//	tls_server_config:
+//	  cert_file: server.crt
+//	  key_file: server.key
+//	  # NoClientCert, RequestClientCert, RequireAnyClientCert, VerifyClientCertIfGiven or RequireAndVerifyClientCert.
+//	  client_auth_type: RequireAndVerifyClientCert
+//	  client_ca_file: ca.crt
+//	  client_allowed_sans: ["prometheus.example.com"]
+//	  min_version: TLS12
+//	basic_auth_users:
+//	  # htpasswd -nBC 10 "" | tr -d ':\n'
+//	  prometheus: $2y$10$...
+//	bearer_tokens:
+//	  # echo -n <token> | sha256sum
+//	  grafana: 5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8
+//
+// bearer_tokens isn't in exporter-toolkit. The tokens are random, long and not chosen by a human,
+// so a SHA-256 is enough to keep them out of the file, unlike passwords which need bcrypt.
+//
+// With basic_auth_users or bearer_tokens, every request needs one of them. A client certificate is checked
+// on top of that, during the TLS handshake. The files are relative to the directory of web.yml.
+package webconfig
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	TLSServerConfig *TLSConfig        `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"`
+	// BearerTokens maps a name, only used to tell the tokens apart, to the hex SHA-256 of the token.
+	BearerTokens map[string]string `yaml:"bearer_tokens"`
+}
+
+type TLSConfig struct {
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ClientAuthType string `yaml:"client_auth_type"`
+	ClientCAFile   string `yaml:"client_ca_file"`
+	// ClientAllowedSANs, if set, is the list of the client certificates accepted,
+	// by DNS name, email address, IP address or URI.
+	ClientAllowedSANs []string `yaml:"client_allowed_sans"`
+	MinVersion        string   `yaml:"min_version"`
+}
+
+// clientAuth is what the handshake does with the client certificate.
+type clientAuth struct {
+	request bool // ask for one.
+	require bool // refuse the connection without one.
+	verify  bool // check it was signed by client_ca_file.
+}
+
+var clientAuthTypes = map[string]clientAuth{
+	"":                           {},
+	"NoClientCert":               {},
+	"RequestClientCert":          {request: true},
+	"RequireAnyClientCert":       {request: true, require: true},
+	"VerifyClientCertIfGiven":    {request: true, verify: true},
+	"RequireAndVerifyClientCert": {request: true, require: true, verify: true},
+}
+
+var tlsVersions = map[string]uint16{
+	"":      tls.VersionTLS12,
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// Load reads and checks a web.yml, the files in it are made relative to its directory.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if tc := cfg.TLSServerConfig; tc != nil {
+		dir := filepath.Dir(path)
+		for _, file := range []*string{&tc.CertFile, &tc.KeyFile, &tc.ClientCAFile} {
+			if *file != "" && !filepath.IsAbs(*file) {
+				*file = filepath.Join(dir, *file)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// ParseConfig reads a web.yml, unknown fields are an error: a typo must not turn the auth off.
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) Validate() error {
+	if tc := c.TLSServerConfig; tc != nil {
+		if tc.CertFile == "" || tc.KeyFile == "" {
+			return errors.New("tls_server_config needs both cert_file and key_file")
+		}
+
+		auth, ok := clientAuthTypes[tc.ClientAuthType]
+		if !ok {
+			return fmt.Errorf("unknown client_auth_type %q", tc.ClientAuthType)
+		}
+		if auth.verify && tc.ClientCAFile == "" {
+			return fmt.Errorf("client_auth_type %s needs client_ca_file", tc.ClientAuthType)
+		}
+		if !auth.verify && tc.ClientCAFile != "" {
+			return fmt.Errorf("client_ca_file is set but client_auth_type %q doesn't verify the client certificates", tc.ClientAuthType)
+		}
+		if len(tc.ClientAllowedSANs) > 0 && !auth.verify {
+			return fmt.Errorf("client_allowed_sans needs a client_auth_type verifying the certificates")
+		}
+
+		if _, ok := tlsVersions[tc.MinVersion]; !ok {
+			return fmt.Errorf("unknown min_version %q, expected TLS10, TLS11, TLS12 or TLS13", tc.MinVersion)
+		}
+	}
+
+	for user, hash := range c.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("basic_auth_users: the password of %s is not a bcrypt hash: %w", user, err)
+		}
+	}
+
+	for name, hash := range c.BearerTokens {
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != 32 {
+			return fmt.Errorf("bearer_tokens: %s is not a hex SHA-256", name)
+		}
+	}
+
+	return nil
+}
+
+// authRequired tells if a request needs a password or a token.
+func (c *Config) authRequired() bool {
+	return len(c.BasicAuthUsers) > 0 || len(c.BearerTokens) > 0
+}
@@ -0,0 +1,431 @@
+package webconfig
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Values of the reason label of web_auth_failures_total.
+const (
+	reasonMissing     = "missing_credentials"
+	reasonBasicAuth   = "basic_auth"
+	reasonBearerToken = "bearer_token"
+	reasonClientCert  = "client_cert"
+)
+
+// maxCachedLogins bounds the cache of the checked passwords, it's emptied when it's full.
+const maxCachedLogins = 100
+
+// statInterval is how often the certificate files are checked for a change, at most.
+const statInterval = time.Second
+
+// Server applies a web.yml to an http.Server. The zero config, from New(""), is plain HTTP without auth.
+//
+// Reload rereads web.yml. The certificates are also reloaded on their own as soon as their files change,
+// so a renewed certificate is used without a reload: every handshake gets the TLS config of the moment.
+type Server struct {
+	path string
+
+	mtx sync.RWMutex
+	cfg *Config
+	// loaded is set once web.yml was read, from then on TLS can't be turned on or off.
+	loaded bool
+
+	certs certFiles
+
+	// logins caches the passwords bcrypt accepted: checking one takes 50ms+ on purpose,
+	// and Prometheus sends the same one every scrape.
+	loginsMtx sync.Mutex
+	logins    map[[sha256.Size]byte]bool
+
+	failures *prometheus.CounterVec
+	reloaded prometheus.Gauge
+}
+
+var _ prometheus.Collector = (*Server)(nil)
+
+func New(path string) (*Server, error) {
+	s := &Server{
+		path:   path,
+		cfg:    &Config{},
+		logins: make(map[[sha256.Size]byte]bool),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "web_auth_failures_total",
+			Help: "Number of requests and TLS handshakes refused by the web config, by reason.",
+		}, []string{"reason"}),
+		reloaded: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "web_config_last_reload_successful",
+			Help: "Whether the last reload of the web config, or of its certificates, succeeded.",
+		}),
+	}
+	for _, reason := range []string{reasonMissing, reasonBasicAuth, reasonBearerToken, reasonClientCert} {
+		s.failures.WithLabelValues(reason)
+	}
+
+	if path == "" {
+		s.reloaded.Set(1)
+		return s, nil
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload rereads web.yml. On error the current config stays.
+// TLS can't be turned on or off by a reload, the listener was started with or without it.
+func (s *Server) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+
+	err := s.reload()
+	if err != nil {
+		s.reloaded.Set(0)
+		return err
+	}
+	s.reloaded.Set(1)
+
+	return nil
+}
+
+func (s *Server) reload() error {
+	cfg, err := Load(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.RLock()
+	current, loaded := s.cfg, s.loaded
+	s.mtx.RUnlock()
+	if loaded && (current.TLSServerConfig != nil) != (cfg.TLSServerConfig != nil) {
+		return errors.New("tls_server_config can't be added or removed by a reload, restart instead")
+	}
+
+	if tc := cfg.TLSServerConfig; tc != nil {
+		// Checked now, so a broken file is reported by the reload, not by the next handshake.
+		if err := s.certs.load(tc); err != nil {
+			return err
+		}
+	}
+
+	s.mtx.Lock()
+	s.cfg, s.loaded = cfg, true
+	s.mtx.Unlock()
+
+	return nil
+}
+
+func (s *Server) config() *Config {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.cfg
+}
+
+// ListenAndServe is srv.ListenAndServe with the web config: TLS if configured, and the auth in front of srv.Handler
+// (http.DefaultServeMux if nil). It returns http.ErrServerClosed after a Shutdown, like srv.ListenAndServe.
+func (s *Server) ListenAndServe(srv *http.Server) error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(srv, l)
+}
+
+// Serve is ListenAndServe on an existing listener.
+func (s *Server) Serve(srv *http.Server, l net.Listener) error {
+	handler := srv.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	srv.Handler = s.Handler(handler)
+
+	if s.config().TLSServerConfig == nil {
+		return srv.Serve(l)
+	}
+
+	srv.TLSConfig = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) { return s.tlsConfig() },
+	}
+
+	return srv.ServeTLS(l, "", "")
+}
+
+// tlsConfig is the TLS config of one handshake.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	tc := s.config().TLSServerConfig
+	if tc == nil {
+		return nil, errors.New("TLS is off")
+	}
+
+	if err := s.certs.refresh(tc); err != nil {
+		// The previous certificates are still good to use, until they expire.
+		log.Printf("webconfig: failed to reload the certificates: %v\n", err)
+		s.reloaded.Set(0)
+	}
+	cert, clientCAs := s.certs.get()
+
+	cfg := &tls.Config{
+		MinVersion:   tlsVersions[tc.MinVersion],
+		Certificates: []tls.Certificate{*cert},
+	}
+
+	auth := clientAuthTypes[tc.ClientAuthType]
+	if auth.request {
+		// The certificate is checked by verifyClient instead of crypto/tls, so every refusal is counted.
+		cfg.ClientAuth = tls.RequestClientCert
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if err := verifyClient(cs, auth, clientCAs, tc.ClientAllowedSANs); err != nil {
+				s.failures.WithLabelValues(reasonClientCert).Inc()
+				return err
+			}
+			return nil
+		}
+	}
+
+	return cfg, nil
+}
+
+func verifyClient(cs tls.ConnectionState, auth clientAuth, roots *x509.CertPool, allowedSANs []string) error {
+	if len(cs.PeerCertificates) == 0 {
+		if auth.require {
+			return errors.New("client certificate required")
+		}
+		return nil
+	}
+	if !auth.verify {
+		return nil
+	}
+
+	leaf := cs.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("invalid client certificate: %w", err)
+	}
+
+	if len(allowedSANs) == 0 {
+		return nil
+	}
+
+	var sans []string
+	sans = append(sans, leaf.DNSNames...)
+	sans = append(sans, leaf.EmailAddresses...)
+	for _, ip := range leaf.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range leaf.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, san := range sans {
+		for _, allowed := range allowedSANs {
+			if san == allowed {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("client certificate for %v is not in client_allowed_sans", sans)
+}
+
+// Handler asks for a password or a token before handing the request to h, when web.yml has some.
+func (s *Server) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.config()
+		if !cfg.authRequired() {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if reason := s.authenticate(cfg, r); reason != "" {
+			s.failures.WithLabelValues(reason).Inc()
+
+			if len(cfg.BasicAuthUsers) > 0 {
+				w.Header().Add("WWW-Authenticate", `Basic realm="Prometheus", charset="UTF-8"`)
+			}
+			if len(cfg.BearerTokens) > 0 {
+				w.Header().Add("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// authenticate returns why the request is refused, empty if it's not.
+func (s *Server) authenticate(cfg *Config, r *http.Request) string {
+	header := r.Header.Get("Authorization")
+
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+		sum := sha256.Sum256([]byte(token))
+		for _, hash := range cfg.BearerTokens {
+			// Validate checked it's hex already.
+			want, _ := hex.DecodeString(hash)
+			if subtle.ConstantTimeCompare(sum[:], want) == 1 {
+				return ""
+			}
+		}
+		return reasonBearerToken
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return reasonMissing
+	}
+
+	hash, ok := cfg.BasicAuthUsers[user]
+	if !ok {
+		// Unknown users take as long as known ones, not to tell which ones exist.
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return reasonBasicAuth
+	}
+
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+	s.loginsMtx.Lock()
+	cached := s.logins[key]
+	s.loginsMtx.Unlock()
+	if cached {
+		return ""
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return reasonBasicAuth
+	}
+
+	s.loginsMtx.Lock()
+	if len(s.logins) >= maxCachedLogins {
+		clear(s.logins)
+	}
+	s.logins[key] = true
+	s.loginsMtx.Unlock()
+
+	return ""
+}
+
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	return hash
+})
+
+func (s *Server) Describe(ch chan<- *prometheus.Desc) {
+	s.failures.Describe(ch)
+	s.reloaded.Describe(ch)
+}
+
+func (s *Server) Collect(ch chan<- prometheus.Metric) {
+	s.failures.Collect(ch)
+	s.reloaded.Collect(ch)
+}
+
+// certFiles holds the certificate, its key and the client CAs, reloaded when their files change.
+type certFiles struct {
+	mtx       sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	// stamp tells if a file changed: its path, size and modification time.
+	stamp    string
+	lastStat time.Time
+}
+
+func (c *certFiles) get() (*tls.Certificate, *x509.CertPool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.cert, c.clientCAs
+}
+
+// refresh reloads the files if they changed since the last time, checking at most every statInterval.
+func (c *certFiles) refresh(tc *TLSConfig) error {
+	c.mtx.Lock()
+	if time.Since(c.lastStat) < statInterval {
+		c.mtx.Unlock()
+		return nil
+	}
+	c.lastStat = time.Now()
+	stamp := c.stamp
+	c.mtx.Unlock()
+
+	if current, err := fileStamp(tc); err != nil || current == stamp {
+		return err
+	}
+
+	return c.load(tc)
+}
+
+func (c *certFiles) load(tc *TLSConfig) error {
+	stamp, err := fileStamp(tc)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load the certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if tc.ClientCAFile != "" {
+		pem, err := os.ReadFile(tc.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", tc.ClientCAFile)
+		}
+	}
+
+	c.mtx.Lock()
+	c.cert, c.clientCAs, c.stamp, c.lastStat = &cert, clientCAs, stamp, time.Now()
+	c.mtx.Unlock()
+
+	return nil
+}
+
+func fileStamp(tc *TLSConfig) (string, error) {
+	var b strings.Builder
+	for _, path := range []string{tc.CertFile, tc.KeyFile, tc.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", path, fi.Size(), fi.ModTime().UnixNano())
+	}
+
+	return b.String(), nil
+}
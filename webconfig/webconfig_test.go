@@ -0,0 +1,258 @@
+package webconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseConfig(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	testCases := []struct {
+		name string
+		yml  string
+		ok   bool
+	}{
+		{name: "empty", yml: "", ok: true},
+		{name: "users", yml: "basic_auth_users:\n  alice: " + string(hash), ok: true},
+		{name: "plain password", yml: "basic_auth_users:\n  alice: secret"},
+		{name: "token not hashed", yml: "bearer_tokens:\n  grafana: secret"},
+		{name: "typo", yml: "basic_auth_user:\n  alice: " + string(hash)},
+		{name: "no key", yml: "tls_server_config:\n  cert_file: a.crt"},
+		{name: "verify without CA", yml: "tls_server_config:\n  cert_file: a.crt\n  key_file: a.key\n  client_auth_type: RequireAndVerifyClientCert"},
+		{name: "unknown client auth", yml: "tls_server_config:\n  cert_file: a.crt\n  key_file: a.key\n  client_auth_type: Yes"},
+		{name: "SANs without verify", yml: "tls_server_config:\n  cert_file: a.crt\n  key_file: a.key\n  client_allowed_sans: [a]"},
+		{name: "min version", yml: "tls_server_config:\n  cert_file: a.crt\n  key_file: a.key\n  min_version: TLS13", ok: true},
+	}
+
+	for _, tc := range testCases {
+		_, err := ParseConfig([]byte(tc.yml))
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got error %v, want ok=%t", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	token := sha256.Sum256([]byte("my-token"))
+
+	path := filepath.Join(t.TempDir(), "web.yml")
+	writeFile(t, path, fmt.Sprintf("basic_auth_users:\n  alice: %s\nbearer_tokens:\n  grafana: %s\n", hash, hex.EncodeToString(token[:])))
+
+	s, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }))
+
+	testCases := []struct {
+		name  string
+		setup func(r *http.Request)
+		code  int
+	}{
+		{name: "nothing", setup: func(r *http.Request) {}, code: http.StatusUnauthorized},
+		{name: "good password", setup: func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, code: http.StatusOK},
+		{name: "cached password", setup: func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, code: http.StatusOK},
+		{name: "bad password", setup: func(r *http.Request) { r.SetBasicAuth("alice", "nope") }, code: http.StatusUnauthorized},
+		{name: "unknown user", setup: func(r *http.Request) { r.SetBasicAuth("bob", "secret") }, code: http.StatusUnauthorized},
+		{name: "good token", setup: func(r *http.Request) { r.Header.Set("Authorization", "Bearer my-token") }, code: http.StatusOK},
+		{name: "bad token", setup: func(r *http.Request) { r.Header.Set("Authorization", "Bearer other") }, code: http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		tc.setup(req)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != tc.code {
+			t.Errorf("%s: got %d, want %d", tc.name, rec.Code, tc.code)
+		}
+	}
+
+	want := `# HELP web_auth_failures_total Number of requests and TLS handshakes refused by the web config, by reason.
+# TYPE web_auth_failures_total counter
+web_auth_failures_total{reason="basic_auth"} 2
+web_auth_failures_total{reason="bearer_token"} 1
+web_auth_failures_total{reason="client_cert"} 0
+web_auth_failures_total{reason="missing_credentials"} 1
+`
+	if err := testutil.CollectAndCompare(s, strings.NewReader(want), "web_auth_failures_total"); err != nil {
+		t.Error(err)
+	}
+
+	// A broken web.yml is refused, the users stay.
+	writeFile(t, path, "basic_auth_users:\n  alice: secret\n")
+	if err := s.Reload(); err == nil {
+		t.Error("a reload with a plain password must fail")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got %d after a failed reload, want the auth to stay", rec.Code)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCert(t, nil, nil, "ca")
+	serverCert, serverKey := newCert(t, ca, caKey, "localhost")
+	clientCert, clientKey := newCert(t, ca, caKey, "prometheus")
+	otherCert, otherKey := newCert(t, ca, caKey, "someone-else")
+
+	writePEM(t, filepath.Join(dir, "ca.crt"), ca, nil)
+	writePEM(t, filepath.Join(dir, "server.crt"), serverCert, nil)
+	writePEM(t, filepath.Join(dir, "server.key"), nil, serverKey)
+	writeFile(t, filepath.Join(dir, "web.yml"), `tls_server_config:
+  cert_file: server.crt
+  key_file: server.key
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: ca.crt
+  client_allowed_sans: [prometheus]
+`)
+
+	s, err := New(filepath.Join(dir, "web.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })}
+	go s.Serve(srv, l)
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	get := func(certs ...tls.Certificate) (*x509.Certificate, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		resp, err := client.Get("https://localhost:" + fmt.Sprint(l.Addr().(*net.TCPAddr).Port))
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0], nil
+	}
+
+	if _, err := get(); err == nil {
+		t.Error("no client certificate must be refused")
+	}
+	if _, err := get(keyPair(otherCert, otherKey)); err == nil {
+		t.Error("a client certificate not in client_allowed_sans must be refused")
+	}
+	got, err := get(keyPair(clientCert, clientKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(serverCert) {
+		t.Error("got the wrong server certificate")
+	}
+
+	// A renewed certificate is used without a reload.
+	renewed, renewedKey := newCert(t, ca, caKey, "localhost")
+	writePEM(t, filepath.Join(dir, "server.crt"), renewed, nil)
+	writePEM(t, filepath.Join(dir, "server.key"), nil, renewedKey)
+	s.certs.mtx.Lock()
+	s.certs.lastStat = time.Time{}
+	s.certs.mtx.Unlock()
+
+	if got, err = get(keyPair(clientCert, clientKey)); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(renewed) {
+		t.Error("the renewed certificate wasn't picked up")
+	}
+
+	if n := testutil.ToFloat64(s.failures.WithLabelValues(reasonClientCert)); n != 2 {
+		t.Errorf("got %v client certificate failures, want 2", n)
+	}
+}
+
+func newCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func keyPair(cert *x509.Certificate, key *ecdsa.PrivateKey) tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+}
+
+func writePEM(t *testing.T, path string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	t.Helper()
+
+	var block *pem.Block
+	if cert != nil {
+		block = &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}
+	} else {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	}
+
+	writeFile(t, path, string(pem.EncodeToMemory(block)))
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,326 @@
+// Package window answers "how is it right now?" from a histogram, without Prometheus.
+//
+// A cumulative histogram only says what happened since the process started. A Ring snapshots it
+// every slice (10s by default) and keeps enough snapshots for the longest window. The stats over a window
+// are the difference between now and the snapshot at the start of the window,
+// like increase(ping_process_bucket[5m]) and histogram_quantile over it in PromQL.
+package window
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"learn-prometheus/quantile"
+)
+
+type Options struct {
+	// Slice is the time between two snapshots, the resolution of the windows. 10s by default.
+	Slice time.Duration
+	// Windows are the windows of the stats, 1m, 5m and 15m by default.
+	Windows []time.Duration
+	// Quantiles are estimated for every window, p50, p90 and p99 by default.
+	Quantiles []float64
+	// Exclude leaves out the series with one of these values for the label, e.g. the requests shed
+	// in no time that would bring the quantiles down just when the latency goes up.
+	Exclude map[string][]string
+}
+
+func (o *Options) setDefaults() {
+	if o.Slice <= 0 {
+		o.Slice = 10 * time.Second
+	}
+	if len(o.Windows) == 0 {
+		o.Windows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+	}
+	if len(o.Quantiles) == 0 {
+		o.Quantiles = []float64{0.5, 0.9, 0.99}
+	}
+}
+
+// Ring keeps the snapshots of the histograms of a collector, summed by the groupBy labels:
+// grouped by endpoint and handler, the ok and error requests of ping_process add up.
+type Ring struct {
+	collector prometheus.Collector
+	groupBy   []string
+	opts      Options
+
+	mtx       sync.Mutex
+	snapshots []snapshot // oldest first, at most size.
+	size      int
+
+	now func() time.Time
+}
+
+type snapshot struct {
+	time   time.Time
+	series map[string]*histogram
+}
+
+// histogram is one group, cumulative. The last bucket is +Inf.
+type histogram struct {
+	labels  map[string]string
+	count   float64
+	sum     float64
+	buckets quantile.Buckets
+}
+
+// New takes the first snapshot right away, the windows can't go back further than that.
+func New(collector prometheus.Collector, groupBy []string, opts Options) *Ring {
+	opts.setDefaults()
+
+	longest := opts.Windows[0]
+	for _, w := range opts.Windows {
+		longest = max(longest, w)
+	}
+
+	r := &Ring{
+		collector: collector,
+		groupBy:   groupBy,
+		opts:      opts,
+		// One more to have a snapshot at the start of the longest window.
+		size: int(longest/opts.Slice) + 1,
+		now:  time.Now,
+	}
+	r.Snapshot()
+
+	return r
+}
+
+// Run takes a snapshot every slice until ctx is done.
+func (r *Ring) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.opts.Slice)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.Snapshot()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Snapshot adds a snapshot to the ring, dropping the oldest one if it's full.
+func (r *Ring) Snapshot() {
+	s := r.take()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.snapshots = append(r.snapshots, s)
+	if len(r.snapshots) > r.size {
+		r.snapshots = r.snapshots[len(r.snapshots)-r.size:]
+	}
+}
+
+func (r *Ring) take() snapshot {
+	s := snapshot{time: r.now(), series: make(map[string]*histogram)}
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		r.collector.Collect(ch)
+		close(ch)
+	}()
+
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil || pb.Histogram == nil {
+			continue
+		}
+
+		labels := make(map[string]string, len(r.groupBy))
+		for _, lp := range pb.GetLabel() {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		if r.excluded(labels) {
+			continue
+		}
+		values := make([]string, len(r.groupBy))
+		group := make(map[string]string, len(r.groupBy))
+		for i, name := range r.groupBy {
+			values[i] = labels[name]
+			group[name] = labels[name]
+		}
+		key := strings.Join(values, "\xff")
+
+		h, ok := s.series[key]
+		if !ok {
+			h = &histogram{labels: group}
+			for _, b := range pb.Histogram.GetBucket() {
+				h.buckets = append(h.buckets, quantile.Bucket{UpperBound: b.GetUpperBound()})
+			}
+			h.buckets = append(h.buckets, quantile.Bucket{UpperBound: math.Inf(+1)})
+			s.series[key] = h
+		}
+
+		// Every series of a vec has the same buckets.
+		h.count += float64(pb.Histogram.GetSampleCount())
+		h.sum += pb.Histogram.GetSampleSum()
+		for i, b := range pb.Histogram.GetBucket() {
+			if i < len(h.buckets)-1 {
+				h.buckets[i].Count += float64(b.GetCumulativeCount())
+			}
+		}
+		h.buckets[len(h.buckets)-1].Count = h.count
+	}
+
+	return s
+}
+
+func (r *Ring) excluded(labels map[string]string) bool {
+	for name, values := range r.opts.Exclude {
+		if v, ok := labels[name]; ok && slices.Contains(values, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Series is the stats of one group.
+type Series struct {
+	Labels  map[string]string `json:"labels"`
+	Windows []Stats           `json:"windows"`
+}
+
+// Stats is what happened in one window. Mean and the quantiles are null when nothing was observed.
+type Stats struct {
+	Window string `json:"window"`
+	// Seconds is the time actually covered, shorter than the window while the ring is filling up.
+	Seconds   float64             `json:"seconds"`
+	Count     float64             `json:"count"`
+	Rate      float64             `json:"rate"`
+	Mean      *float64            `json:"mean"`
+	Quantiles map[string]*float64 `json:"quantiles"`
+}
+
+// Stats compares a snapshot taken now with the one at the start of every window, sorted by labels.
+func (r *Ring) Stats() []Series {
+	current := r.take()
+
+	r.mtx.Lock()
+	snapshots := r.snapshots
+	r.mtx.Unlock()
+
+	keys := make([]string, 0, len(current.series))
+	for key := range current.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	series := make([]Series, 0, len(keys))
+	for _, key := range keys {
+		h := current.series[key]
+		s := Series{Labels: h.labels}
+
+		for _, w := range r.opts.Windows {
+			start := startOf(snapshots, current.time.Add(-w))
+			s.Windows = append(s.Windows, r.stats(w, current.time.Sub(start.time), h, start.series[key]))
+		}
+
+		series = append(series, s)
+	}
+
+	return series
+}
+
+// startOf is the newest snapshot at or before t, the oldest one if the ring doesn't go back that far.
+func startOf(snapshots []snapshot, t time.Time) snapshot {
+	i := sort.Search(len(snapshots), func(i int) bool { return snapshots[i].time.After(t) })
+	if i == 0 {
+		return snapshots[0]
+	}
+
+	return snapshots[i-1]
+}
+
+// stats of the observations between before and after. A group missing from before is new, it started at 0.
+func (r *Ring) stats(w, covered time.Duration, after, before *histogram) Stats {
+	st := Stats{
+		Window:    formatWindow(w),
+		Seconds:   covered.Seconds(),
+		Quantiles: make(map[string]*float64, len(r.opts.Quantiles)),
+	}
+
+	delta := make(quantile.Buckets, len(after.buckets))
+	copy(delta, after.buckets)
+	sum := after.sum
+	st.Count = after.count
+	if before != nil && len(before.buckets) == len(delta) {
+		for i := range delta {
+			delta[i].Count -= before.buckets[i].Count
+		}
+		sum -= before.sum
+		st.Count -= before.count
+	}
+
+	if st.Seconds > 0 {
+		st.Rate = st.Count / st.Seconds
+	}
+	for _, q := range r.opts.Quantiles {
+		st.Quantiles[quantileName(q)] = nil
+	}
+	if st.Count <= 0 {
+		return st
+	}
+
+	mean := sum / st.Count
+	st.Mean = &mean
+	for _, q := range r.opts.Quantiles {
+		v := quantile.BucketQuantile(q, append(quantile.Buckets(nil), delta...))
+		if !math.IsNaN(v) {
+			st.Quantiles[quantileName(q)] = &v
+		}
+	}
+
+	return st
+}
+
+// quantileName is p50 for 0.5, p99.9 for 0.999.
+func quantileName(q float64) string {
+	return "p" + strconv.FormatFloat(q*100, 'f', -1, 64)
+}
+
+// formatWindow is 1m instead of 1m0s and 1h instead of 1h0m0s: the zero seconds, then the zero minutes,
+// are trimmed. Only after a unit, 10s and 10m stay as they are.
+func formatWindow(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+
+	return s
+}
+
+// Handler serves the stats as JSON.
+func (r *Ring) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(struct {
+			Slice  string   `json:"slice"`
+			Series []Series `json:"series"`
+		}{Slice: r.opts.Slice.String(), Series: r.Stats()})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to encode the stats: %v", err), http.StatusInternalServerError)
+		}
+	})
+}
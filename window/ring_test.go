@@ -0,0 +1,124 @@
+package window
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRing(t *testing.T) {
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ping_process",
+		Help:    "h",
+		Buckets: []float64{0.01, 0.1, 1},
+	}, []string{"endpoint", "status"})
+
+	now := time.Unix(1700000000, 0)
+	r := New(vec, []string{"endpoint"}, Options{Slice: 10 * time.Second, Windows: []time.Duration{time.Minute, 5 * time.Minute}})
+	r.now = func() time.Time { return now }
+	// The first snapshot was taken with time.Now, start over at now.
+	r.snapshots = nil
+	r.Snapshot()
+
+	// 4 minutes of fast pings, then 1 minute of slow ones. ok and error add up.
+	for i := 0; i < 30; i++ {
+		now = now.Add(10 * time.Second)
+		for j := 0; j < 10; j++ {
+			status := "ok"
+			if j == 0 {
+				status = "error"
+			}
+			if i < 24 {
+				vec.WithLabelValues("/ping", status).Observe(0.005)
+			} else {
+				vec.WithLabelValues("/ping", status).Observe(0.5)
+			}
+		}
+		r.Snapshot()
+	}
+
+	stats := r.Stats()
+	if len(stats) != 1 || stats[0].Labels["endpoint"] != "/ping" || len(stats[0].Labels) != 1 {
+		t.Fatalf("got %+v, want /ping only", stats)
+	}
+
+	oneMinute, fiveMinutes := stats[0].Windows[0], stats[0].Windows[1]
+
+	if oneMinute.Window != "1m" || oneMinute.Count != 60 || oneMinute.Rate != 1 {
+		t.Errorf("1m: got %+v, want 60 slow pings at 1/s", oneMinute)
+	}
+	if p50 := *oneMinute.Quantiles["p50"]; p50 < 0.1 || p50 > 1 {
+		t.Errorf("1m: got p50 %v, want it in the slow bucket", p50)
+	}
+	if mean := *oneMinute.Mean; math.Abs(mean-0.5) > 1e-9 {
+		t.Errorf("1m: got mean %v, want 0.5", mean)
+	}
+
+	if fiveMinutes.Count != 300 || fiveMinutes.Seconds != 300 {
+		t.Errorf("5m: got %+v, want 300 pings over 300s", fiveMinutes)
+	}
+	if p50 := *fiveMinutes.Quantiles["p50"]; p50 > 0.01 {
+		t.Errorf("5m: got p50 %v, want it in the fast bucket", p50)
+	}
+	if p90 := *fiveMinutes.Quantiles["p90"]; p90 < 0.1 {
+		t.Errorf("5m: got p90 %v, want it in the slow bucket", p90)
+	}
+
+	// The ring only keeps 5m, older snapshots are gone.
+	if len(r.snapshots) != 31 {
+		t.Errorf("got %d snapshots, want 31", len(r.snapshots))
+	}
+
+	// Nothing in the last minute: no mean, no quantiles.
+	for i := 0; i < 6; i++ {
+		now = now.Add(10 * time.Second)
+		r.Snapshot()
+	}
+	idle := r.Stats()[0].Windows[0]
+	if idle.Count != 0 || idle.Mean != nil || idle.Quantiles["p99"] != nil {
+		t.Errorf("got %+v, want an empty window", idle)
+	}
+}
+
+func TestFormatWindow(t *testing.T) {
+	for _, tt := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{d: time.Minute, want: "1m"},
+		{d: 5 * time.Minute, want: "5m"},
+		{d: 10 * time.Minute, want: "10m"},
+		{d: 90 * time.Second, want: "1m30s"},
+		{d: 10 * time.Second, want: "10s"},
+		{d: time.Hour, want: "1h"},
+		{d: 10 * time.Hour, want: "10h"},
+		{d: 90 * time.Minute, want: "1h30m"},
+		{d: time.Hour + time.Second, want: "1h0m1s"},
+	} {
+		if got := formatWindow(tt.d); got != tt.want {
+			t.Errorf("formatWindow(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestRingExclude(t *testing.T) {
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ping_process",
+		Help:    "h",
+		Buckets: []float64{0.01, 0.1, 1},
+	}, []string{"endpoint", "status"})
+
+	r := New(vec, []string{"endpoint"}, Options{Exclude: map[string][]string{"status": {"shed", "canceled"}}})
+	for range 10 {
+		vec.WithLabelValues("/ping", "ok").Observe(0.5)
+		vec.WithLabelValues("/ping", "shed").Observe(0)
+		vec.WithLabelValues("/ping", "canceled").Observe(0)
+	}
+
+	stats := r.Stats()[0].Windows[0]
+	if stats.Count != 10 || *stats.Mean != 0.5 || *stats.Quantiles["p50"] < 0.1 {
+		t.Errorf("got %+v, want the 10 ok pings only", stats)
+	}
+}